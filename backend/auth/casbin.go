@@ -124,6 +124,36 @@ func loadDefaultPolicies() error {
 	Enforcer.AddPolicy("admin", "/api/smpp-users/:id", "PUT")
 	Enforcer.AddPolicy("admin", "/api/smpp-users/:id", "DELETE")
 	Enforcer.AddPolicy("admin", "/api/smpp-users/:id/connection-status", "PUT")
+	Enforcer.AddPolicy("admin", "/api/smpp-users/:id/bind-audits", "GET")
+
+	// Admin SMPP billing policies
+	Enforcer.AddPolicy("admin", "/api/smpp-users/:id/balance", "GET")
+	Enforcer.AddPolicy("admin", "/api/smpp-users/:id/balance/top-up", "POST")
+	Enforcer.AddPolicy("admin", "/api/smpp-users/:id/balance-transactions", "GET")
+	Enforcer.AddPolicy("admin", "/api/smpp-rates", "GET")
+	Enforcer.AddPolicy("admin", "/api/smpp-rates", "POST")
+	Enforcer.AddPolicy("admin", "/api/smpp-rates/:id", "PUT")
+	Enforcer.AddPolicy("admin", "/api/smpp-rates/:id", "DELETE")
+
+	// Admin SMPP DLR profile policies
+	Enforcer.AddPolicy("admin", "/api/smpp-dlr-profiles", "GET")
+	Enforcer.AddPolicy("admin", "/api/smpp-dlr-profiles", "POST")
+	Enforcer.AddPolicy("admin", "/api/smpp-dlr-profiles/:id", "GET")
+	Enforcer.AddPolicy("admin", "/api/smpp-dlr-profiles/:id", "PUT")
+	Enforcer.AddPolicy("admin", "/api/smpp-dlr-profiles/:id", "DELETE")
+
+	// Admin SMPP error code policies
+	Enforcer.AddPolicy("admin", "/api/smpp-error-codes", "GET")
+	Enforcer.AddPolicy("admin", "/api/smpp-error-codes", "POST")
+	Enforcer.AddPolicy("admin", "/api/smpp-error-codes/:id", "PUT")
+	Enforcer.AddPolicy("admin", "/api/smpp-error-codes/:id", "DELETE")
+
+	// Admin dead-letter policies
+	Enforcer.AddPolicy("admin", "/api/dead-letters", "GET")
+	Enforcer.AddPolicy("admin", "/api/dead-letters/:queue/messages", "GET")
+	Enforcer.AddPolicy("admin", "/api/dead-letters/:queue/messages/:id", "GET")
+	Enforcer.AddPolicy("admin", "/api/dead-letters/:queue/messages/:id/replay", "POST")
+	Enforcer.AddPolicy("admin", "/api/dead-letters/:queue", "DELETE")
 
 	// Admin SMPP user anti-detection policies
 	Enforcer.AddPolicy("admin", "/api/smpp-users/:id/anti-detection-config", "GET")
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+
+	"tsimsocketserver/config"
+	"tsimsocketserver/rabbitmq"
+)
+
+func main() {
+	// Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	if err := rabbitmq.MigrateQueues(cfg.RabbitMQ.URL); err != nil {
+		log.Fatalf("Failed to migrate RabbitMQ queues: %v", err)
+	}
+
+	log.Println("RabbitMQ queue migration completed successfully")
+}
@@ -42,6 +42,12 @@ func runMigrations() error {
 		&models.SmsLog{},
 		&models.AlarmLog{},
 		&models.SmppUser{},
+		&models.SmppMessage{},
+		&models.SmppBindAudit{},
+		&models.SmppRate{},
+		&models.SmppBalanceTransaction{},
+		&models.SmppDlrProfile{},
+		&models.SmppErrorCode{},
 		&models.BlacklistNumber{},
 		&models.Filter{},
 		&models.ScheduleTask{},
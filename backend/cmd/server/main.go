@@ -11,6 +11,7 @@ import (
 	"tsimsocketserver/redis"
 	"tsimsocketserver/routes"
 	"tsimsocketserver/services"
+	"tsimsocketserver/utils"
 	"tsimsocketserver/websocket"
 	"tsimsocketserver/websocket_handlers"
 
@@ -26,6 +27,11 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Initialize message ID generator
+	if err := utils.InitMessageIDGenerator(cfg.Server.NodeID); err != nil {
+		log.Fatalf("Failed to initialize message ID generator: %v", err)
+	}
+
 	// Initialize database
 	if err := database.InitializeDatabase(cfg); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
@@ -41,10 +47,10 @@ func main() {
 
 	// Initialize RabbitMQ
 	rabbitMQHandler := rabbitmq.NewRabbitMQHandler()
+	rabbitMQHandler.SetConsumerLimits(cfg.RabbitMQ.Prefetch, cfg.RabbitMQ.Workers)
 	if err := rabbitMQHandler.Connect(cfg.RabbitMQ.URL); err != nil {
-		log.Printf("Warning: Failed to connect to RabbitMQ: %v", err)
-	} else {
-		log.Println("Successfully connected to RabbitMQ")
+		// Consumers registered meanwhile start once the handler has reconnected
+		log.Printf("Warning: Failed to connect to RabbitMQ, reconnecting in the background: %v", err)
 	}
 
 	// Initialize Redis service
@@ -65,6 +71,11 @@ func main() {
 	deliveryReportService := services.NewDeliveryReportService(deliveryReportPublisher.PublishDeliveryReport)
 	websocket_handlers.SetDeliveryReportService(deliveryReportService)
 
+	// Initialize inbound SMS service
+	inboundSmsPublisher := rabbitmq.NewInboundSmsPublisher(rabbitMQHandler)
+	inboundSmsService := services.NewInboundSmsService(inboundSmsPublisher.PublishInboundSms)
+	websocket_handlers.SetInboundSmsService(inboundSmsService)
+
 	// Initialize SMS monitoring service
 	smsMonitoringService := services.NewSmsMonitoringService()
 	// Configure with values from config (use defaults if not set)
@@ -113,6 +124,10 @@ func main() {
 	}
 	go startSmsMonitoringCron(smsMonitoringService, checkInterval)
 
+	// Start SMS expiry cron job
+	smsExpiryService := services.NewSmsExpiryService(deliveryReportService)
+	go startSmsExpiryCron(smsExpiryService)
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
@@ -135,7 +150,7 @@ func main() {
 	}))
 
 	// Setup routes
-	routes.SetupRoutes(app, cfg, wsServer, redisService)
+	routes.SetupRoutes(app, cfg, wsServer, redisService, rabbitMQHandler)
 
 	// Start server
 	log.Printf("Server starting on port %s", cfg.Server.Port)
@@ -182,3 +197,20 @@ func startSmsMonitoringCron(smsMonitoringService *services.SmsMonitoringService,
 		}
 	}
 }
+
+// startSmsExpiryCron starts the cron job expiring SMPP messages whose validity period ended without a delivery report
+func startSmsExpiryCron(smsExpiryService *services.SmsExpiryService) {
+	ticker := time.NewTicker(1 * time.Minute) // Check every minute
+	defer ticker.Stop()
+
+	log.Println("SMS expiry cron job started")
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := smsExpiryService.ExpireOverdueMessages(); err != nil {
+				log.Printf("Error in SMS expiry cron job: %v", err)
+			}
+		}
+	}
+}
@@ -29,7 +29,8 @@ type JWTConfig struct {
 }
 
 type ServerConfig struct {
-	Port string `mapstructure:"port"`
+	Port   string `mapstructure:"port"`
+	NodeID int    `mapstructure:"node_id"`
 }
 
 type RabbitMQConfig struct {
@@ -38,6 +39,8 @@ type RabbitMQConfig struct {
 	Password string `mapstructure:"password"`
 	Host     string `mapstructure:"host"`
 	Port     int    `mapstructure:"port"`
+	Prefetch int    `mapstructure:"prefetch"` // Unacknowledged messages each queue consumer holds, defaults to 50
+	Workers  int    `mapstructure:"workers"`  // Messages each queue consumer handles in parallel, defaults to 10
 }
 
 type RedisConfig struct {
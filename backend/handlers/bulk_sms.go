@@ -52,6 +52,16 @@ func (h *BulkSmsHandler) SendBulkSms(c *fiber.Ctx) error {
 		})
 	}
 
+	// The priority orders the messages in the outbox of each device
+	if req.Priority == "" {
+		req.Priority = "normal"
+	} else if !models.IsValidSmsPriority(req.Priority) {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Priority must be one of low, normal, high and urgent",
+		})
+	}
+
 	// Get authenticated user from context
 	user := c.Locals("user").(*auth.Claims)
 	username := user.Username
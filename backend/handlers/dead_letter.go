@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"tsimsocketserver/rabbitmq"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Dead-lettered messages listed when no limit is given, and the most listed at once
+const (
+	defaultDeadLetterLimit = 50
+	maxDeadLetterLimit     = 500
+)
+
+type DeadLetterHandler struct {
+	rabbitMQ *rabbitmq.RabbitMQHandler
+}
+
+func NewDeadLetterHandler(rabbitMQHandler *rabbitmq.RabbitMQHandler) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		rabbitMQ: rabbitMQHandler,
+	}
+}
+
+// GetDeadLetterQueues returns the number of dead-lettered messages of every queue
+func (h *DeadLetterHandler) GetDeadLetterQueues(c *fiber.Ctx) error {
+	counts, err := h.rabbitMQ.DeadLetterCounts()
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   "RabbitMQ error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": counts,
+	})
+}
+
+// GetDeadLetters returns dead-lettered messages of a queue without removing them
+func (h *DeadLetterHandler) GetDeadLetters(c *fiber.Ctx) error {
+	queue := c.Params("queue")
+	if response := h.validateQueue(c, queue); response != nil {
+		return response
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultDeadLetterLimit)))
+	if err != nil || limit < 1 || limit > maxDeadLetterLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": "limit must be between 1 and " + strconv.Itoa(maxDeadLetterLimit),
+		})
+	}
+
+	deadLetters, err := h.rabbitMQ.ListDeadLetters(queue, limit)
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   "RabbitMQ error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": deadLetters,
+	})
+}
+
+// GetDeadLetter returns a dead-lettered message of a queue
+func (h *DeadLetterHandler) GetDeadLetter(c *fiber.Ctx) error {
+	queue := c.Params("queue")
+	if response := h.validateQueue(c, queue); response != nil {
+		return response
+	}
+
+	deadLetter, err := h.rabbitMQ.GetDeadLetter(queue, c.Params("id"))
+	if err != nil {
+		return h.deadLetterError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"data": deadLetter,
+	})
+}
+
+// ReplayDeadLetter publishes a dead-lettered message to its queue again. The optional body holds top-level fields
+// that replace those of the message, for example {"destination_addr": "905551112233"}.
+func (h *DeadLetterHandler) ReplayDeadLetter(c *fiber.Ctx) error {
+	queue := c.Params("queue")
+	if response := h.validateQueue(c, queue); response != nil {
+		return response
+	}
+
+	var edits map[string]json.RawMessage
+	if len(c.Body()) > 0 {
+		if err := json.Unmarshal(c.Body(), &edits); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Invalid request body",
+				"message": err.Error(),
+			})
+		}
+	}
+
+	deadLetter, err := h.rabbitMQ.ReplayDeadLetter(queue, c.Params("id"), edits)
+	if err != nil {
+		return h.deadLetterError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Dead-lettered message replayed successfully",
+		"data":    deadLetter,
+	})
+}
+
+// PurgeDeadLetters removes all dead-lettered messages of a queue
+func (h *DeadLetterHandler) PurgeDeadLetters(c *fiber.Ctx) error {
+	queue := c.Params("queue")
+	if response := h.validateQueue(c, queue); response != nil {
+		return response
+	}
+
+	purged, err := h.rabbitMQ.PurgeDeadLetters(queue)
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   "RabbitMQ error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Dead-letter queue purged successfully",
+		"purged":  purged,
+	})
+}
+
+// validateQueue rejects queues without a dead-letter queue
+func (h *DeadLetterHandler) validateQueue(c *fiber.Ctx, queue string) error {
+	if !rabbitmq.IsDeadLetterSource(queue) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "Queue not found",
+			"message": "No dead-letter queue for queue " + queue,
+		})
+	}
+	return nil
+}
+
+// deadLetterError answers a failed lookup or replay of a dead-lettered message
+func (h *DeadLetterHandler) deadLetterError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, rabbitmq.ErrDeadLetterNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "Message not found",
+			"message": err.Error(),
+		})
+	case errors.Is(err, rabbitmq.ErrDeadLetterNotEditable):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+		"error":   "RabbitMQ error",
+		"message": err.Error(),
+	})
+}
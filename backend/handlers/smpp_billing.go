@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+	"tsimsocketserver/services"
+	"tsimsocketserver/utils"
+
+	"tsimcloud/shared/billing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type SmppBillingHandler struct {
+	db              *gorm.DB
+	billingService  *services.BillingService
+	smppUserHandler *SmppUserHandler
+	balanceThrottle *requestThrottle
+}
+
+func NewSmppBillingHandler(smppUserHandler *SmppUserHandler) *SmppBillingHandler {
+	return &SmppBillingHandler{
+		db:              database.GetDB(),
+		billingService:  services.NewBillingService(),
+		smppUserHandler: smppUserHandler,
+		balanceThrottle: newRequestThrottle(balanceRequestLimit, balanceRequestWindow, balanceMaxFailures, balanceLockout),
+	}
+}
+
+// GetSmppUserBalance returns the prepaid balance and SMS count of an SMPP user
+func (h *SmppBillingHandler) GetSmppUserBalance(c *fiber.Ctx) error {
+	smppUser, found := h.findSmppUser(c)
+	if !found {
+		return nil
+	}
+
+	return c.JSON(fiber.Map{
+		"data": balanceData(smppUser),
+	})
+}
+
+// TopUpSmppUserBalance credits the balance and SMS count of an SMPP user
+func (h *SmppBillingHandler) TopUpSmppUserBalance(c *fiber.Ctx) error {
+	smppUser, found := h.findSmppUser(c)
+	if !found {
+		return nil
+	}
+
+	var request struct {
+		Amount      string `json:"amount"`
+		SmsCount    int    `json:"sms_count"`
+		Description string `json:"description"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+
+	var amount int64
+	if request.Amount != "" {
+		var err error
+		amount, err = billing.ParseAmount(request.Amount)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "amount must be a decimal number with at most 4 decimals",
+			})
+		}
+	}
+	if amount == 0 && request.SmsCount == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": "amount or sms_count is required",
+		})
+	}
+
+	if request.Description == "" {
+		request.Description = "Top-up"
+	}
+
+	entry, err := h.billingService.TopUp(smppUser, amount, request.SmsCount, request.Description)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	h.db.First(smppUser, smppUser.ID)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Balance topped up successfully",
+		"data": fiber.Map{
+			"transaction": entry,
+			"balance":     balanceData(smppUser),
+		},
+	})
+}
+
+// GetSmppUserBalanceTransactions retrieves the balance ledger of an SMPP user with pagination
+func (h *SmppBillingHandler) GetSmppUserBalanceTransactions(c *fiber.Ctx) error {
+	smppUser, found := h.findSmppUser(c)
+	if !found {
+		return nil
+	}
+
+	var transactions []models.SmppBalanceTransaction
+	var total int64
+
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	limit, _ := strconv.Atoi(c.Query("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	query := h.db.Model(&models.SmppBalanceTransaction{}).Where("smpp_user_id = ?", smppUser.ID)
+	if entryType := c.Query("type"); entryType != "" {
+		query = query.Where("type = ?", entryType)
+	}
+	if messageID := c.Query("message_id"); messageID != "" {
+		query = query.Where("message_id = ?", messageID)
+	}
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	if err := query.Offset(offset).Limit(limit).Order("id DESC").Find(&transactions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	lastPage := int((total + int64(limit) - 1) / int64(limit))
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	return c.JSON(fiber.Map{
+		"data": transactions,
+		"meta": fiber.Map{
+			"current_page": page,
+			"last_page":    lastPage,
+			"per_page":     limit,
+			"total":        total,
+		},
+	})
+}
+
+// GetSmppRates retrieves the message rates, optionally of a single SMPP user
+func (h *SmppBillingHandler) GetSmppRates(c *fiber.Ctx) error {
+	var rates []models.SmppRate
+
+	query := h.db.Model(&models.SmppRate{})
+	if smppUserID := c.Query("smpp_user_id"); smppUserID != "" {
+		query = query.Where("smpp_user_id = ?", smppUserID)
+	}
+	if prefix := c.Query("prefix"); prefix != "" {
+		query = query.Where("prefix LIKE ? ESCAPE '!'", utils.LikePrefix(prefix))
+	}
+
+	if err := query.Order("prefix ASC").Find(&rates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": rates,
+	})
+}
+
+// CreateSmppRate creates a message rate for a destination prefix
+func (h *SmppBillingHandler) CreateSmppRate(c *fiber.Ctx) error {
+	var rate models.SmppRate
+	if err := c.BodyParser(&rate); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+
+	if message := h.validateRate(&rate); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if err := h.db.Create(&rate).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Rate created successfully",
+		"data":    rate,
+	})
+}
+
+// UpdateSmppRate updates a message rate
+func (h *SmppBillingHandler) UpdateSmppRate(c *fiber.Ctx) error {
+	var rate models.SmppRate
+	if err := h.db.First(&rate, c.Params("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "Not found",
+				"message": "Rate not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	if err := c.BodyParser(&rate); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+
+	if message := h.validateRate(&rate); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if err := h.db.Save(&rate).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Rate updated successfully",
+		"data":    rate,
+	})
+}
+
+// DeleteSmppRate deletes a message rate
+func (h *SmppBillingHandler) DeleteSmppRate(c *fiber.Ctx) error {
+	result := h.db.Delete(&models.SmppRate{}, c.Params("id"))
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": result.Error.Error(),
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "Not found",
+			"message": "Rate not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Rate deleted successfully",
+	})
+}
+
+// GetOwnBalance returns the balance of the SMPP user authenticating with HTTP basic auth (system_id and password).
+// Users without the mt_http_balance permission may not query their balance. The route is public, so requests are
+// limited per client IP and per system_id, and both are locked out for a while after repeated failed logins.
+func (h *SmppBillingHandler) GetOwnBalance(c *fiber.Ctx) error {
+	systemID, password, ok := parseBasicAuth(c.Get("Authorization"))
+	if !ok {
+		c.Set("WWW-Authenticate", `Basic realm="smpp"`)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Authentication required",
+		})
+	}
+
+	ipKey, systemKey := "ip:"+c.IP(), "system_id:"+systemID
+	if retryAfter, allowed := h.balanceThrottle.allow(ipKey, systemKey); !allowed {
+		c.Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many requests",
+		})
+	}
+
+	smppUser, err := h.smppUserHandler.AuthenticateSmppUser(systemID, password)
+	if err != nil {
+		h.balanceThrottle.fail(ipKey, systemKey)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid credentials",
+		})
+	}
+	h.balanceThrottle.succeed(systemKey)
+
+	if !smppUser.MtHttpBalance {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Balance query not allowed for this user",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": balanceData(smppUser),
+	})
+}
+
+// findSmppUser loads the SMPP user of the request.
+// When it cannot, the error response is already written and found is false.
+func (h *SmppBillingHandler) findSmppUser(c *fiber.Ctx) (smppUser *models.SmppUser, found bool) {
+	smppUser = &models.SmppUser{}
+	if err := h.db.First(smppUser, c.Params("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "Not found",
+				"message": "SMPP user not found",
+			})
+			return nil, false
+		}
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+		return nil, false
+	}
+	return smppUser, true
+}
+
+// validateRate checks a rate before it is stored and returns the validation message of an invalid one
+func (h *SmppBillingHandler) validateRate(rate *models.SmppRate) string {
+	rate.Prefix = strings.TrimPrefix(strings.TrimSpace(rate.Prefix), "+")
+	if rate.Prefix == "" || !billing.IsDigits(rate.Prefix) {
+		return "prefix is required and must only contain digits"
+	}
+
+	amount, err := billing.ParseAmount(rate.Rate)
+	if err != nil || amount < 0 {
+		return "rate must be a positive decimal number with at most 4 decimals"
+	}
+	rate.Rate = billing.FormatAmount(amount)
+
+	if rate.SmppUserID != nil {
+		var count int64
+		h.db.Model(&models.SmppUser{}).Where("id = ?", *rate.SmppUserID).Count(&count)
+		if count == 0 {
+			return "SMPP user not found"
+		}
+	}
+	return ""
+}
+
+// balanceData is the balance of an SMPP user as returned by the balance endpoints, unset values are unlimited
+func balanceData(smppUser *models.SmppUser) fiber.Map {
+	return fiber.Map{
+		"system_id": smppUser.SystemID,
+		"balance":   smppUser.MtBalance,
+		"sms_count": smppUser.MtSmsCount,
+	}
+}
+
+// parseBasicAuth extracts the credentials of an HTTP basic Authorization header
+func parseBasicAuth(header string) (string, string, bool) {
+	encoded, found := strings.CutPrefix(header, "Basic ")
+	if !found {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
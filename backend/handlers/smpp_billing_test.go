@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tsimsocketserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSmppBillingUnknownUser(t *testing.T) {
+	db := newTestDB(t, &models.SmppUser{}, &models.SmppBalanceTransaction{})
+	h := &SmppBillingHandler{db: db}
+
+	app := fiber.New()
+	app.Get("/smpp-users/:id/balance", h.GetSmppUserBalance)
+	app.Get("/smpp-users/:id/balance/transactions", h.GetSmppUserBalanceTransactions)
+
+	for _, path := range []string{"/smpp-users/42/balance", "/smpp-users/42/balance/transactions"} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("GET %s status = %d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestGetSmppRatesPrefix(t *testing.T) {
+	db := newTestDB(t, &models.SmppRate{})
+	for _, prefix := range []string{"90", "905", "4", "1"} {
+		if err := db.Create(&models.SmppRate{Prefix: prefix, Rate: "0.1000"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &SmppBillingHandler{db: db}
+
+	app := fiber.New()
+	app.Get("/smpp-rates", h.GetSmppRates)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?prefix=90", 2},
+		{"?prefix=9", 2},
+		// Wildcards in the prefix only match themselves
+		{"?prefix=%25", 0},
+		{"?prefix=_", 0},
+		{"", 4},
+	}
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", "/smpp-rates"+tt.query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data []models.SmppRate `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Data) != tt.want {
+			t.Errorf("GET /smpp-rates%s returned %d rates, want %d", tt.query, len(body.Data), tt.want)
+		}
+	}
+}
+
+func TestGetOwnBalanceLocksOutRepeatedFailures(t *testing.T) {
+	db := newTestDB(t, &models.SmppUser{})
+	if err := db.Create(&models.SmppUser{SystemID: "esme", Password: "secret", IsActive: true, MtHttpBalance: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	h := &SmppBillingHandler{
+		db:              db,
+		smppUserHandler: &SmppUserHandler{db: db},
+		balanceThrottle: newRequestThrottle(balanceRequestLimit, balanceRequestWindow, balanceMaxFailures, balanceLockout),
+	}
+
+	app := fiber.New()
+	app.Get("/smpp/balance", h.GetOwnBalance)
+	get := func(secret string) *http.Response {
+		t.Helper()
+		request := httptest.NewRequest("GET", "/smpp/balance", nil)
+		request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("esme:"+secret)))
+		resp, err := app.Test(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := get("secret"); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d with the right password, want 200", resp.StatusCode)
+	}
+	for i := 0; i < balanceMaxFailures; i++ {
+		if resp := get("wrong"); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want 401", i+1, resp.StatusCode)
+		}
+	}
+
+	// Once locked out, even the right password is refused without checking it
+	resp := get("secret")
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("status = %d after %d failures, want 429", resp.StatusCode, balanceMaxFailures)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("lockout without Retry-After")
+	}
+}
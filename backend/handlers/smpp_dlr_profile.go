@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type SmppDlrProfileHandler struct {
+	db *gorm.DB
+}
+
+func NewSmppDlrProfileHandler() *SmppDlrProfileHandler {
+	return &SmppDlrProfileHandler{
+		db: database.GetDB(),
+	}
+}
+
+// GetSmppDlrProfiles returns all DLR profiles
+func (h *SmppDlrProfileHandler) GetSmppDlrProfiles(c *fiber.Ctx) error {
+	var profiles []models.SmppDlrProfile
+	if err := h.db.Order("name ASC").Find(&profiles).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": profiles,
+	})
+}
+
+// GetSmppDlrProfile returns a DLR profile
+func (h *SmppDlrProfileHandler) GetSmppDlrProfile(c *fiber.Ctx) error {
+	profile, found := h.findProfile(c)
+	if !found {
+		return nil
+	}
+
+	return c.JSON(fiber.Map{
+		"data": profile,
+	})
+}
+
+// CreateSmppDlrProfile creates a DLR profile, omitted fields keep the values of the built-in layout
+func (h *SmppDlrProfileHandler) CreateSmppDlrProfile(c *fiber.Ctx) error {
+	profile := models.NewSmppDlrProfile()
+	if err := c.BodyParser(&profile); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+	profile.ID = 0
+
+	if message := h.validateProfile(&profile); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if err := h.db.Create(&profile).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "DLR profile created successfully",
+		"data":    profile,
+	})
+}
+
+// UpdateSmppDlrProfile updates a DLR profile
+func (h *SmppDlrProfileHandler) UpdateSmppDlrProfile(c *fiber.Ctx) error {
+	profile, found := h.findProfile(c)
+	if !found {
+		return nil
+	}
+	id := profile.ID
+
+	if err := c.BodyParser(profile); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+	profile.ID = id
+
+	if message := h.validateProfile(profile); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if err := h.db.Save(profile).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "DLR profile updated successfully",
+		"data":    profile,
+	})
+}
+
+// DeleteSmppDlrProfile deletes a DLR profile that no SMPP user is attached to
+func (h *SmppDlrProfileHandler) DeleteSmppDlrProfile(c *fiber.Ctx) error {
+	profile, found := h.findProfile(c)
+	if !found {
+		return nil
+	}
+
+	var users int64
+	h.db.Model(&models.SmppUser{}).Where("dlr_profile_id = ?", profile.ID).Count(&users)
+	if users > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": "DLR profile is attached to " + strconv.FormatInt(users, 10) + " SMPP users",
+		})
+	}
+
+	if err := h.db.Delete(profile).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "DLR profile deleted successfully",
+	})
+}
+
+// findProfile loads the DLR profile of the request.
+// When it cannot, the error response is already written and found is false.
+func (h *SmppDlrProfileHandler) findProfile(c *fiber.Ctx) (profile *models.SmppDlrProfile, found bool) {
+	profile = &models.SmppDlrProfile{}
+	if err := h.db.First(profile, c.Params("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "Not found",
+				"message": "DLR profile not found",
+			})
+			return nil, false
+		}
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+		return nil, false
+	}
+	return profile, true
+}
+
+// validateProfile checks a DLR profile before it is stored and returns the validation message of an invalid one
+func (h *SmppDlrProfileHandler) validateProfile(profile *models.SmppDlrProfile) string {
+	profile.Name = strings.TrimSpace(profile.Name)
+	if profile.Name == "" {
+		return "name is required"
+	}
+
+	var count int64
+	h.db.Model(&models.SmppDlrProfile{}).Where("name = ? AND id != ?", profile.Name, profile.ID).Count(&count)
+	if count > 0 {
+		return "name already exists"
+	}
+
+	if strings.TrimSpace(profile.TextTemplate) == "" {
+		return "text_template is required"
+	}
+
+	if !models.IsValidDlrIDFormat(profile.IDFormat) {
+		return "id_format must be as_issued, hex, hex_upper or decimal"
+	}
+
+	// A layout without any date element would print itself
+	if profile.DateFormat == "" || time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(profile.DateFormat) == profile.DateFormat {
+		return "date_format must be a Go time layout such as 0601021504"
+	}
+
+	if profile.ErrorCodeMap != nil {
+		errorCodeMap, ok := models.NormalizeDlrErrorCodeMap(*profile.ErrorCodeMap)
+		if !ok {
+			return "error_code_map must be a comma separated list of code=value or stat=value pairs"
+		}
+		profile.ErrorCodeMap = errorCodeMap
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tsimsocketserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSmppDlrProfileUnknownProfile(t *testing.T) {
+	db := newTestDB(t, &models.SmppDlrProfile{}, &models.SmppUser{})
+	h := &SmppDlrProfileHandler{db: db}
+
+	app := fiber.New()
+	app.Get("/smpp-dlr-profiles/:id", h.GetSmppDlrProfile)
+	app.Put("/smpp-dlr-profiles/:id", h.UpdateSmppDlrProfile)
+	app.Delete("/smpp-dlr-profiles/:id", h.DeleteSmppDlrProfile)
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		request := httptest.NewRequest(method, "/smpp-dlr-profiles/42", strings.NewReader(`{"name": "profile"}`))
+		request.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(request)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("%s of an unknown profile status = %d, want 404", method, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+	"tsimsocketserver/services"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+type SmppErrorCodeHandler struct {
+	db *gorm.DB
+}
+
+func NewSmppErrorCodeHandler() *SmppErrorCodeHandler {
+	return &SmppErrorCodeHandler{
+		db: database.GetDB(),
+	}
+}
+
+// GetSmppErrorCodes returns the error code mappings and the built-in defaults they override
+func (h *SmppErrorCodeHandler) GetSmppErrorCodes(c *fiber.Ctx) error {
+	var mappings []models.SmppErrorCode
+
+	query := h.db.Model(&models.SmppErrorCode{})
+	if source := c.Query("source"); source != "" {
+		query = query.Where("source = ?", source)
+	}
+
+	if err := query.Order("source ASC, reason ASC").Find(&mappings).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":     mappings,
+		"defaults": services.DefaultErrorCodes(),
+	})
+}
+
+// CreateSmppErrorCode maps a failure reason to an SMPP error code
+func (h *SmppErrorCodeHandler) CreateSmppErrorCode(c *fiber.Ctx) error {
+	var mapping models.SmppErrorCode
+	if err := c.BodyParser(&mapping); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+	mapping.ID = 0
+
+	if message := h.validateMapping(&mapping); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if err := h.db.Create(&mapping).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Error code mapping created successfully",
+		"data":    mapping,
+	})
+}
+
+// UpdateSmppErrorCode updates an error code mapping
+func (h *SmppErrorCodeHandler) UpdateSmppErrorCode(c *fiber.Ctx) error {
+	var mapping models.SmppErrorCode
+	if err := h.db.First(&mapping, c.Params("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "Not found",
+				"message": "Error code mapping not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+	id := mapping.ID
+
+	if err := c.BodyParser(&mapping); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+	mapping.ID = id
+
+	if message := h.validateMapping(&mapping); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if err := h.db.Save(&mapping).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Error code mapping updated successfully",
+		"data":    mapping,
+	})
+}
+
+// DeleteSmppErrorCode deletes an error code mapping, the failure reason falls back to its built-in default
+func (h *SmppErrorCodeHandler) DeleteSmppErrorCode(c *fiber.Ctx) error {
+	result := h.db.Delete(&models.SmppErrorCode{}, c.Params("id"))
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": result.Error.Error(),
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "Not found",
+			"message": "Error code mapping not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Error code mapping deleted successfully",
+	})
+}
+
+// validateMapping checks a mapping before it is stored and returns the validation message of an invalid one
+func (h *SmppErrorCodeHandler) validateMapping(mapping *models.SmppErrorCode) string {
+	mapping.Source = strings.TrimSpace(mapping.Source)
+	mapping.Reason = strings.ToLower(strings.TrimSpace(mapping.Reason))
+
+	switch mapping.Source {
+	case models.ErrorSourceDeviceResult, models.ErrorSourceDeviceStatus, models.ErrorSourceRouter:
+	default:
+		return "source must be device_result, device_status or router"
+	}
+
+	if mapping.Source == models.ErrorSourceDeviceResult {
+		if code, err := strconv.Atoi(mapping.Reason); err == nil {
+			mapping.Reason = strconv.Itoa(code)
+		}
+	}
+
+	if !models.IsValidErrorReason(mapping.Source, mapping.Reason) {
+		switch mapping.Source {
+		case models.ErrorSourceDeviceResult:
+			return "reason of device_result must be an Android result code"
+		case models.ErrorSourceDeviceStatus:
+			return "reason of device_status must be failed, undelivered, rejected or expired"
+		default:
+			return "reason of router must be no_route, no_device, limit_exceeded, blacklisted, device_failed, expired or internal"
+		}
+	}
+
+	if mapping.ErrorCode == 0 {
+		return "error_code must be between 1 and 255"
+	}
+
+	var count int64
+	h.db.Model(&models.SmppErrorCode{}).Where("source = ? AND reason = ? AND id != ?", mapping.Source, mapping.Reason, mapping.ID).Count(&count)
+	if count > 0 {
+		return "a mapping for this source and reason already exists"
+	}
+	return ""
+}
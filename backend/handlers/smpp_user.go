@@ -1,14 +1,24 @@
 package handlers
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"slices"
 	"strconv"
+	"strings"
 	"tsimsocketserver/database"
 	"tsimsocketserver/models"
 	"tsimsocketserver/redis"
 
 	"time"
 
+	"tsimcloud/shared/billing"
+	"tsimcloud/shared/idgen"
+	"tsimcloud/shared/password"
+
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -36,6 +46,18 @@ func (h *SmppUserHandler) CreateSmppUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// The password is not part of the serialized model
+	var credentials struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&credentials); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request body",
+			"message": err.Error(),
+		})
+	}
+	smppUser.Password = credentials.Password
+
 	// Validate required fields
 	if smppUser.SystemID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -51,6 +73,82 @@ func (h *SmppUserHandler) CreateSmppUser(c *fiber.Ctx) error {
 		})
 	}
 
+	if smppUser.DataSmDlrPdu != "" && !models.IsValidDlrPdu(smppUser.DataSmDlrPdu) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": "data_sm_dlr_pdu must be deliver_sm or data_sm",
+		})
+	}
+
+	if message := validateMessageIDFormat(smppUser.MessageIDFormat, smppUser.MessageIDMaxLength); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": message,
+		})
+	}
+
+	if smppUser.TLSCertFingerprint != nil {
+		fingerprint, ok := normalizeCertFingerprint(*smppUser.TLSCertFingerprint)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "tls_cert_fingerprint must be a SHA-256 fingerprint in hex",
+			})
+		}
+		smppUser.TLSCertFingerprint = fingerprint
+	}
+
+	if smppUser.AllowedIPs != nil {
+		allowedIPs, ok := normalizeAllowedIPs(*smppUser.AllowedIPs)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "allowed_ips must be a comma separated list of CIDR ranges or IP addresses",
+			})
+		}
+		smppUser.AllowedIPs = allowedIPs
+	}
+
+	if smppUser.AllowedBindModes != nil {
+		bindModes, ok := normalizeBindModes(*smppUser.AllowedBindModes)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "allowed_bind_modes must be a comma separated list of tx, rx and trx",
+			})
+		}
+		smppUser.AllowedBindModes = bindModes
+	}
+
+	if smppUser.MtBalance != nil {
+		balance, ok := normalizeBalance(*smppUser.MtBalance)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "mt_balance must be a positive decimal number with at most 4 decimals",
+			})
+		}
+		smppUser.MtBalance = balance
+	}
+
+	if smppUser.MtSmsCount != nil {
+		smsCount, ok := normalizeSmsCount(*smppUser.MtSmsCount)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "mt_sms_count must be a positive whole number",
+			})
+		}
+		smppUser.MtSmsCount = smsCount
+	}
+
+	if smppUser.DlrProfileID != nil && !h.dlrProfileExists(*smppUser.DlrProfileID) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": "DLR profile not found",
+		})
+	}
+
 	// Check if system_id already exists
 	var existingUser models.SmppUser
 	if err := h.db.Where("system_id = ?", smppUser.SystemID).First(&existingUser).Error; err == nil {
@@ -60,6 +158,16 @@ func (h *SmppUserHandler) CreateSmppUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// Only the password hash is stored
+	passwordHash, err := password.Hash(smppUser.Password)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Failed to hash password",
+			"message": err.Error(),
+		})
+	}
+	smppUser.Password = passwordHash
+
 	// Create the SMPP user
 	if err := h.db.Create(&smppUser).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -76,7 +184,6 @@ func (h *SmppUserHandler) CreateSmppUser(c *fiber.Ctx) error {
 			Source:    "backend",
 			Data: map[string]interface{}{
 				"system_id":            smppUser.SystemID,
-				"password":             smppUser.Password,
 				"max_connection_speed": smppUser.MaxConnectionSpeed,
 				"is_active":            smppUser.IsActive,
 			},
@@ -231,6 +338,138 @@ func (h *SmppUserHandler) UpdateSmppUser(c *fiber.Ctx) error {
 		}
 	}
 
+	if dlrPdu, exists := updateData["data_sm_dlr_pdu"]; exists {
+		if value, ok := dlrPdu.(string); !ok || !models.IsValidDlrPdu(value) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "data_sm_dlr_pdu must be deliver_sm or data_sm",
+			})
+		}
+	}
+
+	// The format and the max length are checked together, each falling back to the stored value
+	_, formatUpdated := updateData["message_id_format"]
+	_, maxLengthUpdated := updateData["message_id_max_length"]
+	if formatUpdated || maxLengthUpdated {
+		format, maxLength := smppUser.MessageIDFormat, smppUser.MessageIDMaxLength
+		message := ""
+		if formatUpdated {
+			value, ok := updateData["message_id_format"].(string)
+			if !ok {
+				message = "message_id_format must be decimal, hex or uuid"
+			}
+			format = value
+		}
+		if maxLengthUpdated {
+			// JSON numbers are decoded as float64
+			value, ok := updateData["message_id_max_length"].(float64)
+			if !ok || value != float64(int(value)) {
+				message = "message_id_max_length must be a whole number"
+			}
+			maxLength = int(value)
+		}
+		if message == "" {
+			message = validateMessageIDFormat(format, maxLength)
+		}
+		if message != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": message,
+			})
+		}
+	}
+
+	if newPassword, exists := updateData["password"]; exists {
+		value, ok := newPassword.(string)
+		if !ok || value == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "Password cannot be empty",
+			})
+		}
+
+		// Only the password hash is stored
+		passwordHash, err := password.Hash(value)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":   "Failed to hash password",
+				"message": err.Error(),
+			})
+		}
+		updateData["password"] = passwordHash
+	}
+
+	if value, exists := updateData["tls_cert_fingerprint"]; exists && value != nil {
+		text, ok := value.(string)
+		fingerprint, valid := normalizeCertFingerprint(text)
+		if !ok || !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "tls_cert_fingerprint must be a SHA-256 fingerprint in hex",
+			})
+		}
+		updateData["tls_cert_fingerprint"] = fingerprint
+	}
+
+	if value, exists := updateData["allowed_ips"]; exists && value != nil {
+		text, ok := value.(string)
+		allowedIPs, valid := normalizeAllowedIPs(text)
+		if !ok || !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "allowed_ips must be a comma separated list of CIDR ranges or IP addresses",
+			})
+		}
+		updateData["allowed_ips"] = allowedIPs
+	}
+
+	if value, exists := updateData["allowed_bind_modes"]; exists && value != nil {
+		text, ok := value.(string)
+		bindModes, valid := normalizeBindModes(text)
+		if !ok || !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "allowed_bind_modes must be a comma separated list of tx, rx and trx",
+			})
+		}
+		updateData["allowed_bind_modes"] = bindModes
+	}
+
+	if value, exists := updateData["mt_balance"]; exists && value != nil {
+		text, ok := value.(string)
+		balance, valid := normalizeBalance(text)
+		if !ok || !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "mt_balance must be a positive decimal number with at most 4 decimals",
+			})
+		}
+		updateData["mt_balance"] = balance
+	}
+
+	if value, exists := updateData["mt_sms_count"]; exists && value != nil {
+		text, ok := value.(string)
+		smsCount, valid := normalizeSmsCount(text)
+		if !ok || !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "mt_sms_count must be a positive whole number",
+			})
+		}
+		updateData["mt_sms_count"] = smsCount
+	}
+
+	if value, exists := updateData["dlr_profile_id"]; exists && value != nil {
+		// JSON numbers are decoded as float64
+		profileID, ok := value.(float64)
+		if !ok || profileID != float64(uint(profileID)) || !h.dlrProfileExists(uint(profileID)) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "DLR profile not found",
+			})
+		}
+	}
+
 	// Update the SMPP user
 	if err := h.db.Model(&smppUser).Updates(updateData).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -248,6 +487,63 @@ func (h *SmppUserHandler) UpdateSmppUser(c *fiber.Ctx) error {
 	})
 }
 
+// GetSmppUserBindAudits retrieves the binds of an SMPP user refused by its address or bind mode restrictions
+func (h *SmppUserHandler) GetSmppUserBindAudits(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var smppUser models.SmppUser
+	if err := h.db.First(&smppUser, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error":   "Not found",
+				"message": "SMPP user not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	var audits []models.SmppBindAudit
+	var total int64
+
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	limit, _ := strconv.Atoi(c.Query("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	query := h.db.Model(&models.SmppBindAudit{}).Where("system_id = ?", smppUser.SystemID)
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&audits).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Database error",
+			"message": err.Error(),
+		})
+	}
+
+	lastPage := int((total + int64(limit) - 1) / int64(limit))
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	return c.JSON(fiber.Map{
+		"data": audits,
+		"meta": fiber.Map{
+			"current_page": page,
+			"last_page":    lastPage,
+			"per_page":     limit,
+			"total":        total,
+		},
+	})
+}
+
 // DeleteSmppUser deletes an SMPP user
 func (h *SmppUserHandler) DeleteSmppUser(c *fiber.Ctx) error {
 	id := c.Params("id")
@@ -282,7 +578,6 @@ func (h *SmppUserHandler) DeleteSmppUser(c *fiber.Ctx) error {
 			Source:    "backend",
 			Data: map[string]interface{}{
 				"system_id":            smppUser.SystemID,
-				"password":             smppUser.Password,
 				"max_connection_speed": smppUser.MaxConnectionSpeed,
 				"is_active":            smppUser.IsActive,
 				"is_online":            smppUser.IsOnline,
@@ -373,6 +668,7 @@ func (h *SmppUserHandler) GetSmppUserStats(c *fiber.Ctx) error {
 		InactiveUsers    int64 `json:"inactive_users"`
 		OfflineUsers     int64 `json:"offline_users"`
 		TotalMessages    int64 `json:"total_messages"`
+		TotalRejected    int64 `json:"total_rejected"`
 		TotalConnections int64 `json:"total_connections"`
 	}
 
@@ -385,6 +681,7 @@ func (h *SmppUserHandler) GetSmppUserStats(c *fiber.Ctx) error {
 
 	// Get message and connection totals
 	h.db.Model(&models.SmppUser{}).Select("COALESCE(SUM(total_messages_sent + total_messages_received), 0)").Scan(&stats.TotalMessages)
+	h.db.Model(&models.SmppUser{}).Select("COALESCE(SUM(total_messages_rejected), 0)").Scan(&stats.TotalRejected)
 	h.db.Model(&models.SmppUser{}).Select("COALESCE(SUM(connection_count), 0)").Scan(&stats.TotalConnections)
 
 	return c.JSON(fiber.Map{
@@ -392,16 +689,141 @@ func (h *SmppUserHandler) GetSmppUserStats(c *fiber.Ctx) error {
 	})
 }
 
-// AuthenticateSmppUser authenticates an SMPP user for connection
-func (h *SmppUserHandler) AuthenticateSmppUser(systemID, password string) (*models.SmppUser, error) {
+// AuthenticateSmppUser authenticates an SMPP user with the password it binds with.
+// Passwords not yet migrated to a hash by the SMPP server are accepted in clear text, as on bind.
+func (h *SmppUserHandler) AuthenticateSmppUser(systemID, secret string) (*models.SmppUser, error) {
 	var smppUser models.SmppUser
 
-	err := h.db.Where("system_id = ? AND password = ? AND is_active = ?",
-		systemID, password, true).First(&smppUser).Error
-
+	err := h.db.Where("system_id = ? AND is_active = ?", systemID, true).First(&smppUser).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			password.CheckUnknownUser(secret)
+		}
 		return nil, err
 	}
 
+	if !password.Check(smppUser.Password, secret) {
+		return nil, errors.New("invalid credentials")
+	}
+
 	return &smppUser, nil
 }
+
+// dlrProfileExists reports whether a DLR profile can be attached to an SMPP user
+func (h *SmppUserHandler) dlrProfileExists(profileID uint) bool {
+	var count int64
+	h.db.Model(&models.SmppDlrProfile{}).Where("id = ?", profileID).Count(&count)
+	return count > 0
+}
+
+// validateMessageIDFormat checks the message ID format of a user against its max length and returns the
+// validation message, empty when valid. IDs are never shortened, so the max length must fit every ID of the format.
+func validateMessageIDFormat(format string, maxLength int) string {
+	if format != "" && !idgen.IsValidFormat(format) {
+		return "message_id_format must be decimal, hex or uuid"
+	}
+	if maxLength < 0 || !idgen.FitsLength(format, maxLength) {
+		return fmt.Sprintf("message_id_max_length must be 0 or at least %d for the %s format", idgen.MaxLength(format), formatName(format))
+	}
+	return ""
+}
+
+// formatName returns the message ID format used for an empty format
+func formatName(format string) string {
+	if format == "" {
+		return idgen.FormatDecimal
+	}
+	return format
+}
+
+// normalizeCertFingerprint lowercases a SHA-256 certificate fingerprint and strips its separators.
+// An empty fingerprint clears the mapping and is returned as nil.
+func normalizeCertFingerprint(fingerprint string) (*string, bool) {
+	fingerprint = strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+	if fingerprint == "" {
+		return nil, true
+	}
+	if len(fingerprint) != 64 {
+		return nil, false
+	}
+	if _, err := hex.DecodeString(fingerprint); err != nil {
+		return nil, false
+	}
+	return &fingerprint, true
+}
+
+// normalizeAllowedIPs validates a comma separated list of CIDR ranges and IP addresses and joins it without blanks.
+// An empty list removes the restriction and is returned as nil.
+func normalizeAllowedIPs(allowedIPs string) (*string, bool) {
+	var entries []string
+	for _, entry := range strings.Split(allowedIPs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return nil, false
+			}
+		} else if net.ParseIP(entry) == nil {
+			return nil, false
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, true
+	}
+	normalized := strings.Join(entries, ",")
+	return &normalized, true
+}
+
+// normalizeBindModes validates a comma separated list of bind modes and joins it lowercased without blanks or duplicates.
+// An empty list removes the restriction and is returned as nil.
+func normalizeBindModes(bindModes string) (*string, bool) {
+	var modes []string
+	for _, mode := range strings.Split(bindModes, ",") {
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if mode == "" {
+			continue
+		}
+		if !models.IsValidBindMode(mode) {
+			return nil, false
+		}
+		if slices.Contains(modes, mode) {
+			continue
+		}
+		modes = append(modes, mode)
+	}
+	if len(modes) == 0 {
+		return nil, true
+	}
+	normalized := strings.Join(modes, ",")
+	return &normalized, true
+}
+
+// normalizeBalance validates a prepaid balance and formats it with 4 decimals.
+// An empty balance is not limited and is returned as nil.
+func normalizeBalance(balance string) (*string, bool) {
+	if strings.TrimSpace(balance) == "" {
+		return nil, true
+	}
+	amount, err := billing.ParseAmount(balance)
+	if err != nil || amount < 0 {
+		return nil, false
+	}
+	normalized := billing.FormatAmount(amount)
+	return &normalized, true
+}
+
+// normalizeSmsCount validates a prepaid SMS count.
+// An empty SMS count is not limited and is returned as nil.
+func normalizeSmsCount(smsCount string) (*string, bool) {
+	text := strings.TrimSpace(smsCount)
+	if text == "" {
+		return nil, true
+	}
+	if count, err := strconv.Atoi(text); err != nil || count < 0 {
+		return nil, false
+	}
+	return &text, true
+}
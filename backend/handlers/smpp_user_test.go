@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"testing"
+	"tsimsocketserver/models"
+
+	"tsimcloud/shared/password"
+)
+
+func TestValidateMessageIDFormat(t *testing.T) {
+	tests := []struct {
+		format    string
+		maxLength int
+		valid     bool
+	}{
+		{"", 0, true},
+		{"decimal", 0, true},
+		{"decimal", 19, true},
+		{"decimal", 10, false},
+		{"", 10, false},
+		{"hex", 16, true},
+		{"hex", 12, false},
+		{"uuid", 36, true},
+		{"uuid", 20, false},
+		{"base64", 0, false},
+		{"decimal", -1, false},
+	}
+
+	for _, tt := range tests {
+		message := validateMessageIDFormat(tt.format, tt.maxLength)
+		if (message == "") != tt.valid {
+			t.Errorf("validateMessageIDFormat(%q, %d) = %q, want valid %v", tt.format, tt.maxLength, message, tt.valid)
+		}
+	}
+}
+
+func TestAuthenticateSmppUser(t *testing.T) {
+	db := newTestDB(t, &models.SmppUser{})
+
+	hash, err := password.Hash("hashed-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*models.SmppUser{
+		{SystemID: "hashed", Password: hash, IsActive: true},
+		{SystemID: "legacy", Password: "clear-secret", IsActive: true},
+		{SystemID: "inactive", Password: "clear-secret"},
+	} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// IsActive defaults to true on create
+	db.Model(&models.SmppUser{}).Where("system_id = ?", "inactive").Update("is_active", false)
+
+	h := &SmppUserHandler{db: db}
+	tests := []struct {
+		systemID string
+		secret   string
+		valid    bool
+	}{
+		{"hashed", "hashed-secret", true},
+		{"hashed", "wrong", false},
+		{"legacy", "clear-secret", true},
+		{"legacy", "wrong", false},
+		{"inactive", "clear-secret", false},
+		{"unknown", "clear-secret", false},
+	}
+
+	for _, tt := range tests {
+		user, err := h.AuthenticateSmppUser(tt.systemID, tt.secret)
+		if (err == nil) != tt.valid {
+			t.Errorf("AuthenticateSmppUser(%s, %s) error = %v, want valid %v", tt.systemID, tt.secret, err, tt.valid)
+		}
+		if err == nil && user.SystemID != tt.systemID {
+			t.Errorf("AuthenticateSmppUser(%s) returned user %s", tt.systemID, user.SystemID)
+		}
+	}
+}
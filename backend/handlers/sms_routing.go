@@ -102,6 +102,8 @@ func (h *SmsRoutingHandler) GetAllSmsRoutings(c *fiber.Ctx) error {
 			"direction":                 routing.Direction,
 			"system_id":                 routing.SystemID,
 			"destination_address":       routing.DestinationAddress,
+			"sim_number":                routing.SimNumber,
+			"keyword":                   routing.Keyword,
 			"target_type":               routing.TargetType,
 			"device_group_ids":          routing.DeviceGroupIDs,
 			"user_id":                   routing.UserID,
@@ -176,6 +178,8 @@ func (h *SmsRoutingHandler) GetSmsRoutingByID(c *fiber.Ctx) error {
 		"direction":                 routing.Direction,
 		"system_id":                 routing.SystemID,
 		"destination_address":       routing.DestinationAddress,
+		"sim_number":                routing.SimNumber,
+		"keyword":                   routing.Keyword,
 		"target_type":               routing.TargetType,
 		"device_group_ids":          routing.DeviceGroupIDs,
 		"user_id":                   routing.UserID,
@@ -246,6 +250,16 @@ func (h *SmsRoutingHandler) CreateSmsRouting(c *fiber.Ctx) error {
 		})
 	}
 
+	// Inbound routings deliver to an SMPP client
+	if requestData["direction"] == "inbound" {
+		if systemID, ok := requestData["system_id"].(string); !ok || systemID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":   "Validation failed",
+				"message": "System ID is required for inbound routings",
+			})
+		}
+	}
+
 	// Validate target-specific fields
 	if requestData["target_type"] == "device_group" {
 		deviceGroupIDs, ok := requestData["device_group_ids"].([]interface{})
@@ -352,6 +366,25 @@ func (h *SmsRoutingHandler) UpdateSmsRouting(c *fiber.Ctx) error {
 		})
 	}
 
+	// Inbound routings deliver to an SMPP client
+	direction := routing.Direction
+	if value, ok := updateData["direction"].(string); ok {
+		direction = value
+	}
+	systemID := ""
+	if routing.SystemID != nil {
+		systemID = *routing.SystemID
+	}
+	if value, exists := updateData["system_id"]; exists {
+		systemID, _ = value.(string)
+	}
+	if direction == "inbound" && systemID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Validation failed",
+			"message": "System ID is required for inbound routings",
+		})
+	}
+
 	// Convert device_group_ids array to JSON string if present
 	if deviceGroupIDs, ok := updateData["device_group_ids"].([]interface{}); ok {
 		deviceGroupIDsJSON, err := json.Marshal(deviceGroupIDs)
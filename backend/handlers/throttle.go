@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits of the public SMPP balance query, which checks a password hash on every request
+const (
+	balanceRequestLimit  = 10               // Requests per client IP and per system_id within balanceRequestWindow
+	balanceRequestWindow = time.Minute      // Window the request limit applies to
+	balanceMaxFailures   = 5                // Failed logins in a row before the IP or system_id is locked out
+	balanceLockout       = 15 * time.Minute // How long a locked out IP or system_id is refused
+)
+
+// requestThrottle limits the requests made under a key, such as a client IP or a system_id, and locks a key
+// out after too many failed logins in a row. It keeps its counters in memory.
+type requestThrottle struct {
+	mutex       sync.Mutex
+	limit       int
+	window      time.Duration
+	maxFailures int
+	lockout     time.Duration
+	entries     map[string]*throttleEntry
+	lastPrune   time.Time
+	now         func() time.Time
+}
+
+// throttleEntry holds the counters of one key
+type throttleEntry struct {
+	windowStart time.Time
+	requests    int
+	failures    int
+	lockedUntil time.Time
+}
+
+// newRequestThrottle returns a throttle allowing limit requests per window and key,
+// locking a key out for lockout after maxFailures failed logins in a row
+func newRequestThrottle(limit int, window time.Duration, maxFailures int, lockout time.Duration) *requestThrottle {
+	return &requestThrottle{
+		limit:       limit,
+		window:      window,
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		entries:     make(map[string]*throttleEntry),
+		now:         time.Now,
+	}
+}
+
+// allow counts a request under every key and reports whether it may go ahead.
+// A refused request is not counted, retryAfter tells when the keys that refused it allow requests again.
+func (t *requestThrottle) allow(keys ...string) (retryAfter time.Duration, allowed bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	t.prune(now)
+
+	for _, key := range keys {
+		entry := t.entry(key, now)
+		if now.Before(entry.lockedUntil) {
+			retryAfter = max(retryAfter, entry.lockedUntil.Sub(now))
+		} else if entry.requests >= t.limit {
+			retryAfter = max(retryAfter, entry.windowStart.Add(t.window).Sub(now))
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+
+	for _, key := range keys {
+		t.entries[key].requests++
+	}
+	return 0, true
+}
+
+// fail records a failed login under every key, locking out the keys that failed too often in a row
+func (t *requestThrottle) fail(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	for _, key := range keys {
+		entry := t.entry(key, now)
+		entry.failures++
+		if entry.failures >= t.maxFailures {
+			entry.failures = 0
+			entry.lockedUntil = now.Add(t.lockout)
+		}
+	}
+}
+
+// succeed clears the failed logins of a key
+func (t *requestThrottle) succeed(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if entry, exists := t.entries[key]; exists {
+		entry.failures = 0
+	}
+}
+
+// entry returns the counters of a key, starting a new window once the current one is over
+func (t *requestThrottle) entry(key string, now time.Time) *throttleEntry {
+	entry, exists := t.entries[key]
+	if !exists {
+		entry = &throttleEntry{windowStart: now}
+		t.entries[key] = entry
+	}
+	if now.Sub(entry.windowStart) >= t.window {
+		entry.windowStart = now
+		entry.requests = 0
+	}
+	return entry
+}
+
+// prune drops the keys that are neither counting requests nor locked out, at most once per window.
+// Failed logins are forgotten once a key stayed idle for as long as a lockout lasts.
+func (t *requestThrottle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.window {
+		return
+	}
+	t.lastPrune = now
+
+	for key, entry := range t.entries {
+		idle := now.Sub(entry.windowStart)
+		if now.Before(entry.lockedUntil) || idle < t.window || (entry.failures > 0 && idle < t.lockout) {
+			continue
+		}
+		delete(t.entries, key)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestThrottleLimitsRequestsPerKey(t *testing.T) {
+	now := time.Now()
+	throttle := newRequestThrottle(2, time.Minute, 3, 15*time.Minute)
+	throttle.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, allowed := throttle.allow("ip:1", "system_id:esme"); !allowed {
+			t.Fatalf("request %d refused within the limit", i+1)
+		}
+	}
+	retryAfter, allowed := throttle.allow("ip:1", "system_id:esme")
+	if allowed || retryAfter != time.Minute {
+		t.Fatalf("request beyond the limit: allowed %v, retry after %v; want refused for a minute", allowed, retryAfter)
+	}
+	// The system_id is limited from every IP, and the IP for every system_id
+	if _, allowed := throttle.allow("ip:2", "system_id:esme"); allowed {
+		t.Error("system_id over its limit allowed from another IP")
+	}
+	if _, allowed := throttle.allow("ip:1", "system_id:other"); allowed {
+		t.Error("IP over its limit allowed for another system_id")
+	}
+	if _, allowed := throttle.allow("ip:2", "system_id:other"); !allowed {
+		t.Error("request of other keys refused")
+	}
+
+	now = now.Add(time.Minute)
+	if _, allowed := throttle.allow("ip:1", "system_id:esme"); !allowed {
+		t.Error("request refused in the next window")
+	}
+}
+
+func TestRequestThrottleLocksOutAfterFailures(t *testing.T) {
+	now := time.Now()
+	throttle := newRequestThrottle(100, time.Minute, 3, 15*time.Minute)
+	throttle.now = func() time.Time { return now }
+
+	// A success clears the failures of the system_id
+	throttle.fail("ip:1", "system_id:esme")
+	throttle.fail("ip:1", "system_id:esme")
+	throttle.succeed("system_id:esme")
+	throttle.fail("ip:2", "system_id:esme")
+	if _, allowed := throttle.allow("ip:2", "system_id:esme"); !allowed {
+		t.Fatal("locked out before the failures in a row")
+	}
+
+	throttle.fail("ip:1", "system_id:esme")
+	if _, allowed := throttle.allow("ip:1", "system_id:other"); allowed {
+		t.Error("IP not locked out after three failures")
+	}
+	if _, allowed := throttle.allow("ip:3", "system_id:other"); !allowed {
+		t.Error("other keys locked out")
+	}
+	throttle.fail("ip:2", "system_id:esme")
+	retryAfter, allowed := throttle.allow("ip:3", "system_id:esme")
+	if allowed || retryAfter != 15*time.Minute {
+		t.Errorf("locked out system_id: allowed %v, retry after %v; want refused for the lockout", allowed, retryAfter)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if _, allowed := throttle.allow("ip:1", "system_id:esme"); !allowed {
+		t.Error("request refused after the lockout")
+	}
+}
+
+func TestRequestThrottlePrunesIdleKeys(t *testing.T) {
+	now := time.Now()
+	throttle := newRequestThrottle(10, time.Minute, 3, 15*time.Minute)
+	throttle.now = func() time.Time { return now }
+
+	throttle.allow("ip:idle")
+	throttle.fail("ip:failed")
+
+	now = now.Add(2 * time.Minute)
+	throttle.allow("ip:new")
+	if _, exists := throttle.entries["ip:idle"]; exists {
+		t.Error("idle key kept")
+	}
+	if _, exists := throttle.entries["ip:failed"]; !exists {
+		t.Error("failed logins forgotten before the lockout period")
+	}
+
+	now = now.Add(15 * time.Minute)
+	throttle.allow("ip:new")
+	if _, exists := throttle.entries["ip:failed"]; exists {
+		t.Error("failed logins of an idle key kept after the lockout period")
+	}
+}
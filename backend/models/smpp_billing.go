@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"tsimcloud/shared/billing"
+)
+
+// Types of balance ledger entries
+const (
+	LedgerTopUp  = billing.LedgerTopUp
+	LedgerCharge = billing.LedgerCharge
+	LedgerRefund = billing.LedgerRefund
+)
+
+// SmppRate is the price of one message segment to destinations starting with a prefix.
+// Rates without a user apply to every user that has no rate of its own for the prefix.
+type SmppRate struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	SmppUserID *uint     `json:"smpp_user_id" gorm:"index"`
+	Prefix     string    `json:"prefix" gorm:"not null;size:20;index"`
+	Rate       string    `json:"rate" gorm:"type:decimal(20,4);not null;default:0"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SmppRate
+func (SmppRate) TableName() string {
+	return "smpp_rates"
+}
+
+// SmppBalanceTransaction is an entry of the balance ledger of an SMPP user, shared with the SMPP server
+type SmppBalanceTransaction = billing.Transaction
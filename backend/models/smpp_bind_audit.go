@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// SmppBindAudit records a bind the SMPP server refused because of the source address or bind mode restrictions of a user
+type SmppBindAudit struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	SystemID   string    `json:"system_id" gorm:"not null;size:50;index"`
+	RemoteAddr string    `json:"remote_addr" gorm:"not null;size:64"`
+	BindType   string    `json:"bind_type" gorm:"not null;size:20"`
+	Reason     string    `json:"reason" gorm:"not null;size:255"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+// TableName specifies the table name for SmppBindAudit
+func (SmppBindAudit) TableName() string {
+	return "smpp_bind_audits"
+}
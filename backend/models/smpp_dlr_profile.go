@@ -0,0 +1,116 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the message ID in the text of a delivery report
+const (
+	DlrIDFormatAsIssued = "as_issued" // The message ID as returned in submit_sm_resp
+	DlrIDFormatHex      = "hex"       // Decimal message IDs converted to lowercase hexadecimal
+	DlrIDFormatHexUpper = "hex_upper" // Decimal message IDs converted to uppercase hexadecimal
+	DlrIDFormatDecimal  = "decimal"   // Hexadecimal message IDs converted to decimal
+)
+
+// Stat values of the delivery report text, usable as keys of an error code map
+var dlrStatValues = []string{"SCHEDULED", "ENROUTE", "DELIVRD", "EXPIRED", "DELETED", "UNDELIV", "ACCEPTD", "UNKNOWN", "REJECTD"}
+
+// SmppDlrProfile is a named layout of the delivery reports sent to the SMPP users it is attached to.
+// The SMPP server applies it; users without a profile receive the built-in layout.
+type SmppDlrProfile struct {
+	ID   uint   `json:"id" gorm:"primaryKey"`
+	Name string `json:"name" gorm:"uniqueIndex;not null;size:50"`
+
+	// Text of the receipt with the placeholders {id}, {sub}, {dlvrd}, {submit_date}, {done_date}, {stat}, {err} and {text}
+	TextTemplate string `json:"text_template" gorm:"type:text;not null"`
+	IDFormat     string `json:"id_format" gorm:"size:20;not null;default:'as_issued'"`
+	DateFormat   string `json:"date_format" gorm:"size:20;not null;default:'0601021504'"` // Go time layout of the submit and done dates
+
+	// Addressing of the deliver_sm carrying the receipt. Numbers and flags have no column default so that zeros are stored as given.
+	SourceAddrTON uint8 `json:"source_addr_ton" gorm:"not null"`
+	SourceAddrNPI uint8 `json:"source_addr_npi" gorm:"not null"`
+	DestAddrTON   uint8 `json:"dest_addr_ton" gorm:"not null"`
+	DestAddrNPI   uint8 `json:"dest_addr_npi" gorm:"not null"`
+
+	// TLVs added to the receipt
+	IncludeReceiptedMessageID bool  `json:"include_receipted_message_id" gorm:"not null"`
+	IncludeMessageState       bool  `json:"include_message_state" gorm:"not null"`
+	IncludeNetworkErrorCode   bool  `json:"include_network_error_code" gorm:"not null"`
+	NetworkType               uint8 `json:"network_type" gorm:"not null"` // Network type of network_error_code, 3 is GSM
+
+	// Comma separated "key=value" pairs replacing the err field, keys are error codes or stat values such as UNDELIV
+	ErrorCodeMap *string `json:"error_code_map" gorm:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SmppDlrProfile
+func (SmppDlrProfile) TableName() string {
+	return "smpp_dlr_profiles"
+}
+
+// NewSmppDlrProfile returns a profile laid out like the built-in receipts with SMPP 3.4 dates (YYMMDDhhmm),
+// for requests to fill in
+func NewSmppDlrProfile() SmppDlrProfile {
+	return SmppDlrProfile{
+		TextTemplate:              "id:{id} sub:{sub} dlvrd:{dlvrd} submit date:{submit_date} done date:{done_date} stat:{stat} err:{err} text:{text}",
+		IDFormat:                  DlrIDFormatAsIssued,
+		DateFormat:                "0601021504",
+		SourceAddrTON:             1, // International
+		SourceAddrNPI:             1, // ISDN
+		DestAddrTON:               5, // Alphanumeric
+		DestAddrNPI:               0, // Unknown
+		IncludeReceiptedMessageID: true,
+		IncludeMessageState:       true,
+		IncludeNetworkErrorCode:   true,
+		NetworkType:               3, // GSM
+	}
+}
+
+// IsValidDlrIDFormat reports whether format is a message ID format of delivery report texts
+func IsValidDlrIDFormat(format string) bool {
+	switch format {
+	case DlrIDFormatAsIssued, DlrIDFormatHex, DlrIDFormatHexUpper, DlrIDFormatDecimal:
+		return true
+	}
+	return false
+}
+
+// NormalizeDlrErrorCodeMap validates an error code map and returns it with blanks removed.
+// Keys are error codes from 0 to 255 or stat values, values are printed as given and may not contain spaces.
+func NormalizeDlrErrorCodeMap(errorCodeMap string) (*string, bool) {
+	var pairs []string
+	for _, pair := range strings.Split(errorCodeMap, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if !ok || key == "" || value == "" || strings.ContainsAny(value, " \t") {
+			return nil, false
+		}
+
+		if code, err := strconv.Atoi(key); err == nil {
+			if code < 0 || code > 255 {
+				return nil, false
+			}
+			key = strconv.Itoa(code)
+		} else if !containsString(dlrStatValues, key) {
+			return nil, false
+		}
+
+		pairs = append(pairs, key+"="+value)
+	}
+
+	if len(pairs) == 0 {
+		return nil, true
+	}
+	normalized := strings.Join(pairs, ",")
+	return &normalized, true
+}
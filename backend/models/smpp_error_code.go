@@ -0,0 +1,75 @@
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+// Sources of the failure reasons mapped to SMPP error codes
+const (
+	ErrorSourceDeviceResult = "device_result" // Android SmsManager result code reported by a device, such as 2 for radio off
+	ErrorSourceDeviceStatus = "device_status" // Failure status reported by a device, such as undelivered
+	ErrorSourceRouter       = "router"        // Failure of the SMS router, such as no_device
+)
+
+// Failures of the SMS router
+const (
+	RouterFailureNoRoute       = "no_route"       // No routing rule matches the message
+	RouterFailureNoDevice      = "no_device"      // No connected device can send the message
+	RouterFailureLimitExceeded = "limit_exceeded" // The SMS limits of the devices are exhausted
+	RouterFailureBlacklisted   = "blacklisted"    // The destination is blacklisted
+	RouterFailureDeviceFailed  = "device_failed"  // No device accepted the message
+	RouterFailureExpired       = "expired"        // The validity period ended before delivery
+	RouterFailureInternal      = "internal"       // The router could not process the message
+)
+
+// Failure statuses reported by devices
+var deviceFailureStatuses = []string{"failed", "undelivered", "rejected", "expired"}
+
+// Failures of the SMS router
+var routerFailures = []string{
+	RouterFailureNoRoute, RouterFailureNoDevice, RouterFailureLimitExceeded, RouterFailureBlacklisted,
+	RouterFailureDeviceFailed, RouterFailureExpired, RouterFailureInternal,
+}
+
+// SmppErrorCode maps a failure reason to the error code reported in SMPP delivery reports (err field and
+// network_error_code). Mappings override the built-in defaults of the same source and reason.
+type SmppErrorCode struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Source      string    `json:"source" gorm:"not null;size:20;uniqueIndex:idx_smpp_error_code_reason"`
+	Reason      string    `json:"reason" gorm:"not null;size:50;uniqueIndex:idx_smpp_error_code_reason"`
+	ErrorCode   uint8     `json:"error_code" gorm:"not null"`
+	Description *string   `json:"description" gorm:"size:255"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SmppErrorCode
+func (SmppErrorCode) TableName() string {
+	return "smpp_error_codes"
+}
+
+// IsValidErrorReason reports whether reason is a failure reason of source
+func IsValidErrorReason(source, reason string) bool {
+	switch source {
+	case ErrorSourceDeviceResult:
+		// Result codes are looked up in their decimal form without leading zeros
+		code, err := strconv.Atoi(reason)
+		return err == nil && code >= 0 && strconv.Itoa(code) == reason
+	case ErrorSourceDeviceStatus:
+		return containsString(deviceFailureStatuses, reason)
+	case ErrorSourceRouter:
+		return containsString(routerFailures, reason)
+	}
+	return false
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
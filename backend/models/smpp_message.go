@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"tsimcloud/shared/dlr"
+)
+
+// Message states of SMPP messages, as reported by query_sm and delivery receipts
+const (
+	SmppMessageStateScheduled     = dlr.StateScheduled
+	SmppMessageStateEnroute       = dlr.StateEnroute
+	SmppMessageStateDelivered     = dlr.StateDelivered
+	SmppMessageStateExpired       = dlr.StateExpired
+	SmppMessageStateDeleted       = dlr.StateDeleted
+	SmppMessageStateUndeliverable = dlr.StateUndeliverable
+	SmppMessageStateAccepted      = dlr.StateAccepted
+	SmppMessageStateUnknown       = dlr.StateUnknown
+	SmppMessageStateRejected      = dlr.StateRejected
+)
+
+// SmppMessage represents the state of a message submitted over SMPP.
+// Rows are created by the SMPP server; the router claims them before handing them to a device.
+type SmppMessage struct {
+	ID                   uint       `json:"id" gorm:"primaryKey"`
+	MessageID            string     `json:"message_id" gorm:"uniqueIndex;not null;size:64"`
+	ParentMessageID      string     `json:"parent_message_id" gorm:"index;size:64"` // Message the segment was published as, set for segments of concatenated messages
+	SegmentNumber        uint8      `json:"segment_number" gorm:"not null;default:0"`
+	SystemID             string     `json:"system_id" gorm:"index;not null;size:50"`
+	ServiceType          string     `json:"service_type" gorm:"size:6"`
+	SourceAddr           string     `json:"source_addr" gorm:"size:21"`
+	DestinationAddr      string     `json:"destination_addr" gorm:"size:21"`
+	RegisteredDelivery   uint8      `json:"registered_delivery" gorm:"not null;default:0"`
+	DataCoding           uint8      `json:"data_coding" gorm:"not null;default:0"`
+	ShortMessage         string     `json:"short_message" gorm:"type:text"`
+	ScheduleDeliveryTime string     `json:"schedule_delivery_time" gorm:"size:17"`
+	ValidityPeriod       string     `json:"validity_period" gorm:"size:17"`
+	DlrPdu               string     `json:"dlr_pdu" gorm:"size:20;not null;default:'deliver_sm'"`
+	MessageState         uint8      `json:"message_state" gorm:"not null;default:1"`
+	ErrorCode            uint8      `json:"error_code" gorm:"not null;default:0"`
+	SubmitDate           time.Time  `json:"submit_date" gorm:"not null"`
+	FinalDate            *time.Time `json:"final_date"`
+	DispatchedAt         *time.Time `json:"dispatched_at"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at" gorm:"index"`
+}
+
+// TableName specifies the table name for SmppMessage
+func (SmppMessage) TableName() string {
+	return "smpp_messages"
+}
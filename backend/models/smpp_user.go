@@ -3,13 +3,15 @@ package models
 import (
 	"time"
 
+	"tsimcloud/shared/idgen"
+
 	"gorm.io/gorm"
 )
 
 type SmppUser struct {
 	ID                    uint       `json:"id" gorm:"primaryKey"`
 	SystemID              string     `json:"system_id" gorm:"uniqueIndex;not null;size:50"`
-	Password              string     `json:"password" gorm:"not null;size:100"`
+	Password              string     `json:"-" gorm:"not null;size:100"` // bcrypt hash, never serialized
 	MaxConnectionSpeed    int        `json:"max_connection_speed" gorm:"not null;default:100"`
 	IsActive              bool       `json:"is_active" gorm:"not null;default:true"`
 	IsOnline              bool       `json:"is_online" gorm:"not null;default:false"`
@@ -19,6 +21,7 @@ type SmppUser struct {
 	ConnectionCount       int        `json:"connection_count" gorm:"not null;default:0"`
 	TotalMessagesSent     int        `json:"total_messages_sent" gorm:"not null;default:0"`
 	TotalMessagesReceived int        `json:"total_messages_received" gorm:"not null;default:0"`
+	TotalMessagesRejected int        `json:"total_messages_rejected" gorm:"not null;default:0"`
 
 	// MT Messaging Credentials
 	MtSrcAddr              *string `json:"mt_src_addr" gorm:"size:50"`
@@ -45,10 +48,50 @@ type SmppUser struct {
 	MtHttpBulk             bool    `json:"mt_http_bulk" gorm:"default:false"`
 	MtHexContent           bool    `json:"mt_hex_content" gorm:"default:true"`
 
+	// DataSmDlrPdu selects the PDU used for delivery reports of messages submitted with data_sm
+	DataSmDlrPdu string `json:"data_sm_dlr_pdu" gorm:"size:20;not null;default:'deliver_sm'"`
+
+	// Message ID format returned in submit_sm_resp and delivery reports
+	MessageIDFormat    string `json:"message_id_format" gorm:"size:20;not null;default:'decimal'"`
+	MessageIDMaxLength int    `json:"message_id_max_length" gorm:"not null;default:0"`
+
+	// SHA-256 fingerprint (hex) of the TLS client certificate that authenticates this user
+	TLSCertFingerprint *string `json:"tls_cert_fingerprint" gorm:"size:64;index"`
+
+	// Comma separated CIDR ranges or IPs the user may bind from, and bind modes (tx, rx, trx) it may use; empty allows all
+	AllowedIPs       *string `json:"allowed_ips" gorm:"type:text"`
+	AllowedBindModes *string `json:"allowed_bind_modes" gorm:"size:20"`
+
+	// DLR profile laying out the delivery reports of this user, the built-in layout when unset
+	DlrProfileID *uint `json:"dlr_profile_id" gorm:"index"`
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// PDUs that can carry delivery reports back to an SMPP client
+const (
+	DlrPduDeliverSM = "deliver_sm"
+	DlrPduDataSM    = "data_sm"
+)
+
+// IsValidDlrPdu reports whether pdu can be used to deliver delivery reports
+func IsValidDlrPdu(pdu string) bool {
+	return pdu == DlrPduDeliverSM || pdu == DlrPduDataSM
+}
+
+// Bind modes accepted in AllowedBindModes
+const (
+	BindModeTX  = "tx"
+	BindModeRX  = "rx"
+	BindModeTRX = "trx"
+)
+
+// IsValidBindMode reports whether mode restricts an SMPP bind type
+func IsValidBindMode(mode string) bool {
+	return mode == BindModeTX || mode == BindModeRX || mode == BindModeTRX
+}
+
 // TableName specifies the table name for SmppUser
 func (SmppUser) TableName() string {
 	return "smpp_users"
@@ -59,6 +102,12 @@ func (u *SmppUser) BeforeCreate(tx *gorm.DB) error {
 	if u.MaxConnectionSpeed <= 0 {
 		u.MaxConnectionSpeed = 100
 	}
+	if u.DataSmDlrPdu == "" {
+		u.DataSmDlrPdu = DlrPduDeliverSM
+	}
+	if u.MessageIDFormat == "" {
+		u.MessageIDFormat = idgen.FormatDecimal
+	}
 	return nil
 }
 
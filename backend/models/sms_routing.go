@@ -16,7 +16,9 @@ type SmsRouting struct {
 	Direction          string  `json:"direction" gorm:"size:50;not null"`   // inbound, outbound
 	SystemID           *string `json:"system_id" gorm:"size:255"`           // SMPP system ID
 	DestinationAddress *string `json:"destination_address" gorm:"size:255"` // Destination address pattern
-	TargetType         string  `json:"target_type" gorm:"size:50;not null"` // device_group
+	SimNumber          *string `json:"sim_number" gorm:"size:50"`           // Receiving SIM number (inbound)
+	Keyword            *string `json:"keyword" gorm:"size:100"`             // First word of the message (inbound)
+	TargetType         string  `json:"target_type" gorm:"size:50;not null"` // device_group, smpp
 	DeviceGroupIDs     *string `json:"device_group_ids" gorm:"type:text"`   // JSON array of device group IDs
 	UserID             *uint   `json:"user_id"`                             // User ID for HTTP source
 	IsActive           bool    `json:"is_active" gorm:"default:true"`
@@ -68,6 +70,11 @@ func (r *SmsRouting) GetDisplayName() string {
 			return "Multiple Device Groups"
 		}
 		return "Device Group"
+	case "smpp":
+		if r.SystemID != nil {
+			return *r.SystemID
+		}
+		return "SMPP Client"
 	default:
 		return "Unknown Target"
 	}
@@ -136,6 +143,8 @@ func (r *SmsRouting) GetTargetTypeBadgeVariant() string {
 	switch r.TargetType {
 	case "device_group":
 		return "secondary"
+	case "smpp":
+		return "default"
 	default:
 		return "outline"
 	}
@@ -67,6 +67,7 @@ type SmsLogData struct {
 	PhoneNumber string `json:"phone_number"`
 	Message     string `json:"message"`
 	Status      string `json:"status"`
+	ResultCode  *int   `json:"result_code,omitempty"` // Android SmsManager result code of a failed send
 	DeviceGroup string `json:"device_group"`
 	CountrySite string `json:"country_site"`
 }
@@ -88,6 +89,7 @@ type SmsDeliveryReportData struct {
 	PhoneNumber string `json:"phone_number"`
 	MessageID   string `json:"message_id"`
 	Status      string `json:"status"`
+	ResultCode  *int   `json:"result_code,omitempty"` // Android SmsManager result code of a failed delivery
 	SimSlot     int    `json:"sim_slot"`
 	Timestamp   int64  `json:"timestamp"`
 	DeviceGroup string `json:"device_group"`
@@ -243,6 +245,29 @@ type SendSmsData struct {
 	MessageID   string `json:"message_id"`
 }
 
+// SMS priorities, from lowest to highest
+var smsPriorities = []string{"low", "normal", "high", "urgent"}
+
+// IsValidSmsPriority reports whether a priority is one of low, normal, high and urgent
+func IsValidSmsPriority(priority string) bool {
+	for _, known := range smsPriorities {
+		if known == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// SmsPriorityLevel ranks a priority for ordering, higher levels first. Unknown priorities rank as normal.
+func SmsPriorityLevel(priority string) int {
+	for level, known := range smsPriorities {
+		if known == priority {
+			return level
+		}
+	}
+	return 1 // normal
+}
+
 // SendUssdData represents send USSD command data
 type SendUssdData struct {
 	SimSlot   int    `json:"sim_slot"`
@@ -278,6 +303,9 @@ type DeviceConnection struct {
 	ConnectionType string      `json:"connection_type"` // android, frontend, usbmodem
 	Conn           interface{} `json:"-"`
 	IsHandicap     bool        `json:"is_handicap"`
+	// Seconds the device waits between two SMS on a SIM, from its device group
+	Sim1GuardInterval int `json:"sim1_guard_interval"`
+	Sim2GuardInterval int `json:"sim2_guard_interval"`
 }
 
 // QRConfigData represents QR code configuration data
@@ -0,0 +1,49 @@
+package rabbitmq
+
+import (
+	"fmt"
+
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// queueConsumer is a queue consumer started on every new channel
+type queueConsumer struct {
+	queueName   string
+	orderingKey func(message []byte) string
+	handler     MessageHandler
+}
+
+// openChannel opens the channel of a new connection and sets up the SMPP exchange and queues
+func openChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %v", err)
+	}
+
+	// Copies of failed messages are only acknowledged once the broker confirms them
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	// Set up exchange and queues for SMPP integration
+	if err := setupSmppQueues(ch); err != nil {
+		if topology.IsArgumentsMismatch(err) {
+			return nil, fmt.Errorf("failed to setup SMPP queues, a queue exists with other arguments; stop the backend and the SMPP server and run cmd/migrate-queues: %v", err)
+		}
+		return nil, fmt.Errorf("failed to setup SMPP queues: %v", err)
+	}
+	return ch, nil
+}
+
+// currentChannel returns the channel of the current connection, nil before the first connection
+func (r *RabbitMQHandler) currentChannel() *amqp.Channel {
+	return r.connection.Channel()
+}
+
+// State returns the state of the RabbitMQ connection
+func (r *RabbitMQHandler) State() amqpconn.State {
+	return r.connection.State()
+}
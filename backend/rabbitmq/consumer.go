@@ -0,0 +1,194 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Consumer limits used when none are configured
+const (
+	defaultPrefetch = 50
+	defaultWorkers  = 10
+)
+
+// maxRetries is how many times a failed message is queued again before it is dead-lettered
+const maxRetries = topology.MaxRetries
+
+// publishConfirmTimeout is how long a copy of a failed or dead-lettered message waits for the broker confirm
+const publishConfirmTimeout = 5 * time.Second
+
+// publisher publishes a message and returns once the broker has confirmed it
+type publisher func(exchange, key string, msg amqp.Publishing) error
+
+// ErrUnprocessable marks a message that fails on every attempt, such as malformed JSON.
+// It is dead-lettered at once instead of being requeued.
+var ErrUnprocessable = errors.New("unprocessable message")
+
+// MessageHandler handles a message consumed from a queue. redelivered is set when the message may have been handled
+// before: the broker delivered it before without an acknowledgement, it is a retry of a failed message,
+// or it was replayed from a dead-letter queue.
+type MessageHandler func(message []byte, redelivered bool) error
+
+// consume starts consuming messages from a queue on a channel with manual acknowledgements.
+// Messages are spread over the workers by their ordering key, so that messages with the same key stay in order.
+// A retried message comes back after its delay behind the later messages of its key, so the order only holds
+// for messages that were handled on their first attempt.
+func (r *RabbitMQHandler) consume(ch *amqp.Channel, c queueConsumer) error {
+	prefetch := r.prefetch
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
+	}
+	workers := r.workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	// The prefetch applies to the consumer started next on the channel
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		log.Printf("Failed to set prefetch of queue %s: %v", c.queueName, err)
+		return err
+	}
+
+	msgs, err := ch.Consume(
+		c.queueName, // queue
+		"",          // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
+	)
+
+	if err != nil {
+		log.Printf("Failed to start consuming from queue %s: %v", c.queueName, err)
+		return err
+	}
+
+	// A lane holds up to the prefetch, so that a busy worker never holds back the others
+	publish := func(exchange, key string, msg amqp.Publishing) error {
+		return amqpconn.PublishConfirmed(ch, exchange, key, msg, publishConfirmTimeout)
+	}
+	lanes := make([]chan amqp.Delivery, workers)
+	for i := range lanes {
+		lanes[i] = make(chan amqp.Delivery, prefetch)
+		go func(lane <-chan amqp.Delivery) {
+			for msg := range lane {
+				handleDelivery(publish, c.queueName, msg, c.handler)
+			}
+		}(lanes[i])
+	}
+
+	go func() {
+		next := 0
+		for msg := range msgs {
+			lane := next
+			if key := orderingKeyOf(c.orderingKey, msg.Body); key != "" {
+				hash := fnv.New32a()
+				hash.Write([]byte(key))
+				lane = int(hash.Sum32() % uint32(workers))
+			} else {
+				next = (next + 1) % workers
+			}
+			lanes[lane] <- msg
+		}
+
+		// The channel closed, unacknowledged messages are redelivered on the next one
+		for _, lane := range lanes {
+			close(lane)
+		}
+	}()
+
+	log.Printf("Started consuming from queue: %s (prefetch %d, %d workers)", c.queueName, prefetch, workers)
+	return nil
+}
+
+// orderingKeyOf returns the ordering key of a message, empty when messages need no order
+func orderingKeyOf(orderingKey func(message []byte) string, message []byte) string {
+	if orderingKey == nil {
+		return ""
+	}
+	return orderingKey(message)
+}
+
+// handleDelivery handles a message and acknowledges it. A failed message waits in a retry queue and comes back
+// with its retry count raised until it has been retried maxRetries times; when it still fails, or cannot be processed
+// at all, it is moved to the dead-letter queue of its queue. The original is acknowledged once its copy is confirmed.
+func handleDelivery(publish publisher, queueName string, msg amqp.Delivery, handler MessageHandler) {
+	log.Printf("Received message from queue %s: %s", queueName, string(msg.Body))
+
+	err := runHandler(handler, msg)
+	if err == nil {
+		if err := msg.Ack(false); err != nil {
+			log.Printf("Failed to acknowledge message from queue %s: %v", queueName, err)
+		}
+		return
+	}
+
+	if retries := retryCountOf(msg); retries < maxRetries && !errors.Is(err, ErrUnprocessable) {
+		log.Printf("Error processing message from queue %s, retrying it (%d of %d): %v", queueName, retries+1, maxRetries, err)
+		settle(msg, queueName, retry(publish, queueName, msg))
+		return
+	}
+
+	reason := DeadLetterFailed
+	if errors.Is(err, ErrUnprocessable) {
+		reason = DeadLetterUnprocessable
+	}
+	log.Printf("Error processing message from queue %s, dead-lettering it: %v", queueName, err)
+	settle(msg, queueName, deadLetter(publish, queueName, msg, reason, err))
+}
+
+// retry publishes a copy of a failed message with its retry count raised to the retry queue of the attempt,
+// which hands it back to its queue once the delay of the attempt has passed
+func retry(publish publisher, queueName string, msg amqp.Delivery) error {
+	retryQueue, copied := topology.RetryMessage(msg, queueName)
+	return publish("", retryQueue, copied)
+}
+
+// declareRetryQueues declares the retry queues of the queues with a dead-letter queue
+func declareRetryQueues(ch *amqp.Channel) error {
+	for _, source := range deadLetterSources {
+		if err := topology.DeclareRetryQueues(ch, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle acknowledges a message once its copy was published. When the copy was not confirmed,
+// the message is requeued as it is rather than lost.
+func settle(msg amqp.Delivery, queueName string, publishErr error) {
+	if publishErr != nil {
+		log.Printf("Failed to publish copy of message from queue %s, requeueing it: %v", queueName, publishErr)
+		if err := msg.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue message from queue %s: %v", queueName, err)
+		}
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		log.Printf("Failed to acknowledge message from queue %s: %v", queueName, err)
+	}
+}
+
+// retryCountOf returns how many times a failed message was queued again
+func retryCountOf(msg amqp.Delivery) int64 {
+	return topology.CountHeader(msg.Headers, topology.HeaderRetryCount)
+}
+
+// runHandler calls a message handler and turns a panic into an error
+func runHandler(handler MessageHandler, msg amqp.Delivery) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return handler(msg.Body, msg.Redelivered || retryCountOf(msg) > 0 || isReplay(msg))
+}
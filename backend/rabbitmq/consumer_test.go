@@ -0,0 +1,179 @@
+package rabbitmq
+
+import (
+	"errors"
+	"testing"
+
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// settlement records how a delivery was acknowledged
+type settlement struct {
+	acked    bool
+	requeued bool
+	rejected bool
+}
+
+func (s *settlement) Ack(tag uint64, multiple bool) error {
+	s.acked = true
+	return nil
+}
+
+func (s *settlement) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		s.requeued = true
+	} else {
+		s.rejected = true
+	}
+	return nil
+}
+
+func (s *settlement) Reject(tag uint64, requeue bool) error {
+	return s.Nack(tag, false, requeue)
+}
+
+// publication is a message published by handleDelivery
+type publication struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// recordPublisher records published messages and fails them with err
+func recordPublisher(published *[]publication, err error) publisher {
+	return func(exchange, key string, msg amqp.Publishing) error {
+		*published = append(*published, publication{exchange: exchange, key: key, msg: msg})
+		return err
+	}
+}
+
+func newDelivery(s *settlement, headers amqp.Table, redelivered bool) amqp.Delivery {
+	return amqp.Delivery{Acknowledger: s, Headers: headers, Redelivered: redelivered, MessageId: "m1", Body: []byte(`{}`)}
+}
+
+func TestHandleDeliveryAcksHandledMessage(t *testing.T) {
+	s := &settlement{}
+	var published []publication
+
+	handleDelivery(recordPublisher(&published, nil), "sms_queue", newDelivery(s, nil, false), func([]byte, bool) error { return nil })
+
+	if !s.acked || len(published) != 0 {
+		t.Errorf("settlement = %+v, published %d, want acked without copies", s, len(published))
+	}
+}
+
+func TestHandleDeliveryRetriesWithCount(t *testing.T) {
+	failure := errors.New("database down")
+
+	// A redelivery after a reconnect is not a retry and keeps all its retries
+	s := &settlement{}
+	var published []publication
+	var redelivered bool
+	handleDelivery(recordPublisher(&published, nil), "sms_queue", newDelivery(s, nil, true), func(_ []byte, r bool) error {
+		redelivered = r
+		return failure
+	})
+
+	if !redelivered {
+		t.Error("handler of a redelivered message was not told")
+	}
+	// The retry waits in the retry queue of its first attempt instead of going straight back to the queue
+	if len(published) != 1 || published[0].exchange != "" || published[0].key != topology.RetryQueue("sms_queue", 1) {
+		t.Fatalf("published %+v, want a retry to the first retry queue", published)
+	}
+	if count := topology.CountHeader(published[0].msg.Headers, topology.HeaderRetryCount); count != 1 {
+		t.Errorf("retry count = %d, want 1", count)
+	}
+	if !s.acked {
+		t.Errorf("settlement = %+v, want the original acked once its retry is published", s)
+	}
+
+	// Later attempts wait longer
+	s = &settlement{}
+	published = nil
+	handleDelivery(recordPublisher(&published, nil), "sms_queue", newDelivery(s, amqp.Table{topology.HeaderRetryCount: int32(1)}, false), func([]byte, bool) error {
+		return failure
+	})
+	if len(published) != 1 || published[0].key != topology.RetryQueue("sms_queue", 2) {
+		t.Fatalf("published %+v, want the second retry in the second retry queue", published)
+	}
+
+	// The last retry is dead-lettered
+	s = &settlement{}
+	published = nil
+	handleDelivery(recordPublisher(&published, nil), "sms_queue", newDelivery(s, amqp.Table{topology.HeaderRetryCount: int32(maxRetries)}, false), func([]byte, bool) error {
+		return failure
+	})
+
+	if len(published) != 1 || published[0].exchange != deadLetterExchange || published[0].key != "sms_queue" {
+		t.Fatalf("published %+v, want the message dead-lettered", published)
+	}
+	if reason := published[0].msg.Headers[topology.HeaderDeadLetterReason]; reason != DeadLetterFailed {
+		t.Errorf("dead-letter reason = %v, want %s", reason, DeadLetterFailed)
+	}
+	if id := published[0].msg.MessageId; id == "" || id == "m1" {
+		t.Errorf("dead-lettered message ID = %q, want an ID of its own", id)
+	}
+	if !s.acked {
+		t.Errorf("settlement = %+v, want the original acked once it is dead-lettered", s)
+	}
+}
+
+func TestHandleDeliveryDeadLettersUnprocessableMessage(t *testing.T) {
+	s := &settlement{}
+	var published []publication
+
+	handleDelivery(recordPublisher(&published, nil), "tsimcloudrouter", newDelivery(s, nil, false), func([]byte, bool) error {
+		return ErrUnprocessable
+	})
+
+	if len(published) != 1 || published[0].exchange != deadLetterExchange {
+		t.Fatalf("published %+v, want the message dead-lettered without retries", published)
+	}
+	if reason := published[0].msg.Headers[topology.HeaderDeadLetterReason]; reason != DeadLetterUnprocessable {
+		t.Errorf("dead-letter reason = %v, want %s", reason, DeadLetterUnprocessable)
+	}
+}
+
+func TestHandleDeliveryRequeuesUnconfirmedCopy(t *testing.T) {
+	s := &settlement{}
+	var published []publication
+
+	handleDelivery(recordPublisher(&published, amqpconn.ErrNacked), "sms_queue", newDelivery(s, nil, false), func([]byte, bool) error {
+		return ErrUnprocessable
+	})
+
+	if s.acked || s.rejected || !s.requeued {
+		t.Errorf("settlement = %+v, want the original requeued when its copy is not confirmed", s)
+	}
+}
+
+func TestHandleDeliveryRecoversPanic(t *testing.T) {
+	s := &settlement{}
+	var published []publication
+
+	handleDelivery(recordPublisher(&published, nil), "sms_queue", newDelivery(s, nil, false), func([]byte, bool) error {
+		panic("nil map")
+	})
+
+	if len(published) != 1 || !s.acked {
+		t.Errorf("settlement = %+v, published %d, want the message retried", s, len(published))
+	}
+}
+
+func TestConsumeQueueRequiresDeadLetterQueue(t *testing.T) {
+	r := NewRabbitMQHandler()
+	if err := r.ConsumeQueue("unknown_queue", nil, func([]byte, bool) error { return nil }); err == nil {
+		t.Error("consuming a queue without a dead-letter queue succeeded")
+	}
+}
+
+func TestProcessSmsMessageRejectsMalformedJSON(t *testing.T) {
+	sc := &SmsConsumer{}
+	if err := sc.processSmsMessage([]byte(`not json`)); !errors.Is(err, ErrUnprocessable) {
+		t.Errorf("processSmsMessage error = %v, want ErrUnprocessable", err)
+	}
+}
@@ -0,0 +1,309 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// routerExchange is the exchange of the SMPP queues
+const routerExchange = "tsimcloudrouter"
+
+// deadLetterExchange receives the messages that could not be handled, with their queue as routing key
+var deadLetterExchange = topology.DeadLetterExchange(routerExchange)
+
+// Reasons a message was dead-lettered
+const (
+	DeadLetterUnprocessable = topology.ReasonUnprocessable
+	DeadLetterFailed        = topology.ReasonFailed
+)
+
+// maxDeadLetterScan limits how many dead-lettered messages are read to find one by ID
+const maxDeadLetterScan = 1000
+
+// deadLetterSources are the queues whose failed messages are kept in a dead-letter queue
+var deadLetterSources = []string{"tsimcloudrouter", "sms_queue", "tsimcloud_delivery_report", "tsimcloud_deliver_sm"}
+
+var (
+	ErrDeadLetterNotFound    = errors.New("dead-lettered message not found")
+	ErrDeadLetterNotEditable = errors.New("dead-lettered message is not a JSON object and cannot be edited")
+)
+
+// DeadLetter is a message held in a dead-letter queue
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	Queue       string    `json:"queue"` // Queue the message failed in
+	Reason      string    `json:"reason"`
+	Error       string    `json:"error"`
+	FailedAt    time.Time `json:"failed_at"`
+	ReplayCount int64     `json:"replay_count"`
+	ContentType string    `json:"content_type"`
+	Body        any       `json:"body"` // The JSON body, or the raw body when it is not JSON
+}
+
+// DeadLetterQueueInfo is the number of messages in the dead-letter queue of a queue
+type DeadLetterQueueInfo struct {
+	Queue           string `json:"queue"`
+	DeadLetterQueue string `json:"dead_letter_queue"`
+	Messages        int    `json:"messages"`
+}
+
+// DeadLetterQueue returns the queue holding the dead-lettered messages of a queue
+func DeadLetterQueue(queueName string) string {
+	return topology.DeadLetterQueue(queueName)
+}
+
+// IsDeadLetterSource reports whether failed messages of a queue are dead-lettered
+func IsDeadLetterSource(queueName string) bool {
+	for _, source := range deadLetterSources {
+		if source == queueName {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceQueueArguments returns the arguments a queue with a dead-letter queue is declared with.
+// They must match the declaration of the queue by the SMPP server.
+func sourceQueueArguments(queueName string) amqp.Table {
+	if queueName == "tsimcloudrouter" {
+		// Higher priorities are delivered first
+		return topology.PriorityQueueArguments(routerExchange, queueName)
+	}
+	return topology.QueueArguments(routerExchange, queueName)
+}
+
+// declareDeadLetterQueues declares the dead-letter exchange and the dead-letter queues
+func declareDeadLetterQueues(ch *amqp.Channel) error {
+	for _, source := range deadLetterSources {
+		if err := topology.DeclareDeadLetterQueue(ch, routerExchange, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deadLetter publishes a message that could not be handled to the dead-letter queue of its queue,
+// with the reason in its headers
+func deadLetter(publish publisher, queueName string, msg amqp.Delivery, reason string, cause error) error {
+	return publish(deadLetterExchange, queueName, topology.DeadLetterMessage(msg, queueName, reason, cause))
+}
+
+// isReplay reports whether a message was replayed from a dead-letter queue
+func isReplay(msg amqp.Delivery) bool {
+	_, ok := msg.Headers[topology.HeaderReplayCount]
+	return ok
+}
+
+// DeadLetterCounts returns the number of messages in every dead-letter queue
+func (r *RabbitMQHandler) DeadLetterCounts() ([]DeadLetterQueueInfo, error) {
+	ch := r.currentChannel()
+	if ch == nil {
+		return nil, amqp.ErrClosed
+	}
+
+	infos := make([]DeadLetterQueueInfo, 0, len(deadLetterSources))
+	for _, source := range deadLetterSources {
+		queue, err := ch.QueueInspect(DeadLetterQueue(source))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, DeadLetterQueueInfo{Queue: source, DeadLetterQueue: queue.Name, Messages: queue.Messages})
+	}
+	return infos, nil
+}
+
+// ListDeadLetters returns up to limit messages from the head of the dead-letter queue of a queue.
+// The messages stay in the dead-letter queue.
+func (r *RabbitMQHandler) ListDeadLetters(queueName string, limit int) ([]DeadLetter, error) {
+	deadLetters := []DeadLetter{}
+	err := r.browseDeadLetters(queueName, func(_ *amqp.Channel, msg amqp.Delivery) (bool, error) {
+		deadLetters = append(deadLetters, newDeadLetter(queueName, msg))
+		return len(deadLetters) < limit, nil
+	})
+	return deadLetters, err
+}
+
+// GetDeadLetter returns a message of the dead-letter queue of a queue by its ID
+func (r *RabbitMQHandler) GetDeadLetter(queueName, id string) (*DeadLetter, error) {
+	var found *DeadLetter
+	err := r.browseDeadLetters(queueName, func(_ *amqp.Channel, msg amqp.Delivery) (bool, error) {
+		if msg.MessageId != id {
+			return true, nil
+		}
+		deadLetter := newDeadLetter(queueName, msg)
+		found = &deadLetter
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrDeadLetterNotFound
+	}
+	return found, nil
+}
+
+// ReplayDeadLetter publishes a message of the dead-letter queue of a queue to the queue again and removes it
+// from the dead-letter queue. edits replace top-level fields of a JSON message before it is replayed.
+func (r *RabbitMQHandler) ReplayDeadLetter(queueName, id string, edits map[string]json.RawMessage) (*DeadLetter, error) {
+	var replayed *DeadLetter
+	err := r.browseDeadLetters(queueName, func(ch *amqp.Channel, msg amqp.Delivery) (bool, error) {
+		if msg.MessageId != id {
+			return true, nil
+		}
+
+		body := msg.Body
+		if len(edits) > 0 {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+				return false, ErrDeadLetterNotEditable
+			}
+			for field, value := range edits {
+				fields[field] = value
+			}
+			edited, err := json.Marshal(fields)
+			if err != nil {
+				return false, err
+			}
+			body = edited
+		}
+
+		// The dead-letter headers and the retry count are dropped, the replay count tells the consumer the message may have been handled before
+		headers := amqp.Table{}
+		for key, value := range msg.Headers {
+			switch key {
+			case topology.HeaderDeadLetterReason, topology.HeaderDeadLetterError, topology.HeaderOriginalQueue, topology.HeaderFailedAt, topology.HeaderRetryCount:
+				continue
+			}
+			headers[key] = value
+		}
+		headers[topology.HeaderReplayCount] = replayCountOf(msg) + 1
+
+		// The message is only removed from the dead-letter queue once the broker has the replayed copy
+		err := amqpconn.PublishConfirmed(
+			ch,
+			"",        // exchange
+			queueName, // routing key
+			amqp.Publishing{
+				Headers:      headers,
+				ContentType:  msg.ContentType,
+				Timestamp:    time.Now(),
+				DeliveryMode: amqp.Persistent,
+				Priority:     msg.Priority,
+				Body:         body,
+			},
+			publishConfirmTimeout,
+		)
+		if err != nil {
+			return false, err
+		}
+		if err := msg.Ack(false); err != nil {
+			return false, err
+		}
+
+		deadLetter := newDeadLetter(queueName, msg)
+		deadLetter.Body = messageBody(body)
+		replayed = &deadLetter
+		log.Printf("Replayed dead-lettered message %s to queue %s", id, queueName)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if replayed == nil {
+		return nil, ErrDeadLetterNotFound
+	}
+	return replayed, nil
+}
+
+// PurgeDeadLetters removes all messages from the dead-letter queue of a queue and returns how many were removed
+func (r *RabbitMQHandler) PurgeDeadLetters(queueName string) (int, error) {
+	ch := r.currentChannel()
+	if ch == nil {
+		return 0, amqp.ErrClosed
+	}
+
+	purged, err := ch.QueuePurge(DeadLetterQueue(queueName), false)
+	if err != nil {
+		log.Printf("Failed to purge dead-letter queue of %s: %v", queueName, err)
+		return 0, err
+	}
+
+	log.Printf("Purged %d messages from dead-letter queue of %s", purged, queueName)
+	return purged, nil
+}
+
+// browseDeadLetters reads the messages of the dead-letter queue of a queue on a channel of its own until visit
+// returns false. Messages visit does not acknowledge return to the queue when the channel is closed.
+func (r *RabbitMQHandler) browseDeadLetters(queueName string, visit func(ch *amqp.Channel, msg amqp.Delivery) (bool, error)) error {
+	conn := r.connection.Conn()
+	if conn == nil || conn.IsClosed() {
+		return amqp.ErrClosed
+	}
+
+	// One browse at a time, so that messages held by one are not missing from another
+	r.browseMutex.Lock()
+	defer r.browseMutex.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %v", err)
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	for i := 0; i < maxDeadLetterScan; i++ {
+		msg, ok, err := ch.Get(DeadLetterQueue(queueName), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		next, err := visit(ch, msg)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+// newDeadLetter describes a message read from the dead-letter queue of a queue
+func newDeadLetter(queueName string, msg amqp.Delivery) DeadLetter {
+	deadLetter := DeadLetter{
+		ID:          msg.MessageId,
+		Queue:       queueName,
+		ReplayCount: replayCountOf(msg),
+		ContentType: msg.ContentType,
+		Body:        messageBody(msg.Body),
+	}
+	deadLetter.Reason, _ = msg.Headers[topology.HeaderDeadLetterReason].(string)
+	deadLetter.Error, _ = msg.Headers[topology.HeaderDeadLetterError].(string)
+	if failedAt, ok := msg.Headers[topology.HeaderFailedAt].(string); ok {
+		deadLetter.FailedAt, _ = time.Parse(time.RFC3339, failedAt)
+	}
+	return deadLetter
+}
+
+// replayCountOf returns how many times a message was replayed from a dead-letter queue
+func replayCountOf(msg amqp.Delivery) int64 {
+	return topology.CountHeader(msg.Headers, topology.HeaderReplayCount)
+}
+
+// messageBody returns a message body as JSON when it is valid JSON, otherwise as a string
+func messageBody(body []byte) any {
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
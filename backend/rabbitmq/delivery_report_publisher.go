@@ -29,8 +29,13 @@ func (drp *DeliveryReportPublisher) PublishDeliveryReport(report *types.Delivery
 		return err
 	}
 
+	ch := drp.rabbitMQ.currentChannel()
+	if ch == nil {
+		return amqp.ErrClosed
+	}
+
 	// Publish to delivery report queue
-	err = drp.rabbitMQ.channel.Publish(
+	err = ch.Publish(
 		"tsimcloudrouter", // exchange
 		"delivery_report", // routing key
 		false,             // mandatory
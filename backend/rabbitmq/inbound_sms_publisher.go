@@ -0,0 +1,56 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"log"
+
+	"tsimsocketserver/types"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// InboundSmsPublisher handles publishing inbound SMS to the SMPP server
+type InboundSmsPublisher struct {
+	rabbitMQ *RabbitMQHandler
+}
+
+// NewInboundSmsPublisher creates a new inbound SMS publisher
+func NewInboundSmsPublisher(rabbitMQ *RabbitMQHandler) *InboundSmsPublisher {
+	return &InboundSmsPublisher{
+		rabbitMQ: rabbitMQ,
+	}
+}
+
+// PublishInboundSms publishes an inbound SMS to the SMPP server
+func (isp *InboundSmsPublisher) PublishInboundSms(message *types.InboundSmsMessage) error {
+	ch := isp.rabbitMQ.currentChannel()
+	if ch == nil {
+		return amqp.ErrClosed
+	}
+
+	// Convert message to JSON
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// Publish to inbound SMS queue
+	err = ch.Publish(
+		"tsimcloudrouter", // exchange
+		"deliver_sm",      // routing key
+		false,             // mandatory
+		false,             // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+		},
+	)
+	if err != nil {
+		log.Printf("Failed to publish inbound SMS: %v", err)
+		return err
+	}
+
+	log.Printf("Published inbound SMS %s for system: %s", message.MessageID, message.SystemID)
+	return nil
+}
@@ -0,0 +1,39 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"log"
+
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MigrateQueues declares the queues whose arguments changed since they were first declared again, keeping their
+// messages, and sets up the exchange and queues with their bindings. RabbitMQ refuses to change the arguments of an
+// existing queue, so the backend and the SMPP server fail to start until this has run.
+// Both must be stopped while it runs.
+func MigrateQueues(url string) error {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	for _, queueName := range deadLetterSources {
+		migrated, err := topology.MigrateQueue(conn, queueName, sourceQueueArguments(queueName))
+		if err != nil {
+			return fmt.Errorf("failed to migrate queue %s: %v", queueName, err)
+		}
+		if migrated {
+			log.Printf("Declared queue %s with its new arguments", queueName)
+		}
+	}
+
+	// Deleted queues lost their bindings
+	ch, err := openChannel(conn)
+	if err != nil {
+		return err
+	}
+	return ch.Close()
+}
@@ -1,22 +1,49 @@
 package rabbitmq
 
 import (
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"tsimsocketserver/redis"
 
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// smppDelayQueues hold scheduled SMPP messages back; every queue dead-letters its messages to the SMPP router
+// once they have waited for its delay. Longer waits pass through the queues several times.
+var smppDelayQueues = []struct {
+	name  string
+	delay time.Duration
+}{
+	{"tsimcloudrouter_delay_1h", time.Hour},
+	{"tsimcloudrouter_delay_10m", 10 * time.Minute},
+	{"tsimcloudrouter_delay_1m", time.Minute},
+	{"tsimcloudrouter_delay_10s", 10 * time.Second},
+	{"tsimcloudrouter_delay_1s", time.Second},
+}
+
 type RabbitMQHandler struct {
-	conn         *amqp.Connection
-	channel      *amqp.Channel
+	connection   *amqpconn.Connection
+	browseMutex  sync.Mutex // Serializes reads of the dead-letter queues
+	prefetch     int        // Unacknowledged messages each consumer holds at once
+	workers      int        // Messages each consumer handles in parallel
 	redisService *redis.RedisService
 }
 
 func NewRabbitMQHandler() *RabbitMQHandler {
-	return &RabbitMQHandler{}
+	return &RabbitMQHandler{connection: amqpconn.New(openChannel)}
+}
+
+// SetConsumerLimits sets how many unacknowledged messages each consumer holds and how many it handles in parallel.
+// Zero keeps the default.
+func (r *RabbitMQHandler) SetConsumerLimits(prefetch, workers int) {
+	r.prefetch = prefetch
+	r.workers = workers
 }
 
 // SetRedisService sets the Redis service for the RabbitMQ handler
@@ -24,42 +51,16 @@ func (r *RabbitMQHandler) SetRedisService(redisService *redis.RedisService) {
 	r.redisService = redisService
 }
 
-// Connect establishes connection to RabbitMQ
+// Connect establishes connection to RabbitMQ and keeps it up in the background.
+// When the broker is not reachable the error of the first attempt is returned and the handler connects later.
 func (r *RabbitMQHandler) Connect(url string) error {
-	var err error
-
-	// Try to connect with retry mechanism
-	for i := 0; i < 5; i++ {
-		r.conn, err = amqp.Dial(url)
-		if err == nil {
-			break
-		}
-		log.Printf("Failed to connect to RabbitMQ, retrying in 5 seconds... (attempt %d/5)", i+1)
-		time.Sleep(5 * time.Second)
-	}
-
-	if err != nil {
-		return err
-	}
-
-	r.channel, err = r.conn.Channel()
-	if err != nil {
-		return err
-	}
-
-	// Set up exchange and queues for SMPP integration
-	if err := r.setupSmppQueues(); err != nil {
-		log.Printf("Warning: Failed to setup SMPP queues: %v", err)
-	}
-
-	log.Println("Successfully connected to RabbitMQ")
-	return nil
+	return r.connection.Connect(url)
 }
 
 // setupSmppQueues sets up the exchange and queues for SMPP integration
-func (r *RabbitMQHandler) setupSmppQueues() error {
+func setupSmppQueues(ch *amqp.Channel) error {
 	// Declare exchange
-	err := r.channel.ExchangeDeclare(
+	err := ch.ExchangeDeclare(
 		"tsimcloudrouter", // name
 		"direct",          // type
 		true,              // durable
@@ -72,21 +73,31 @@ func (r *RabbitMQHandler) setupSmppQueues() error {
 		return err
 	}
 
-	// Declare tsimcloudrouter queue for SMPP messages
-	_, err = r.channel.QueueDeclare(
-		"tsimcloudrouter", // name
-		true,              // durable
-		false,             // delete when unused
-		false,             // exclusive
-		false,             // no-wait
-		nil,               // arguments
+	// Declare dead-letter queues for messages that could not be handled
+	if err := declareDeadLetterQueues(ch); err != nil {
+		return err
+	}
+
+	// Declare retry queues holding failed messages back before they are handled again
+	if err := declareRetryQueues(ch); err != nil {
+		return err
+	}
+
+	// Declare tsimcloudrouter queue for SMPP messages, higher priorities are delivered first
+	_, err = ch.QueueDeclare(
+		"tsimcloudrouter",                       // name
+		true,                                    // durable
+		false,                                   // delete when unused
+		false,                                   // exclusive
+		false,                                   // no-wait
+		sourceQueueArguments("tsimcloudrouter"), // arguments
 	)
 	if err != nil {
 		return err
 	}
 
 	// Bind tsimcloudrouter queue to exchange
-	err = r.channel.QueueBind(
+	err = ch.QueueBind(
 		"tsimcloudrouter", // queue name
 		"submit_sm",       // routing key
 		"tsimcloudrouter", // exchange
@@ -98,33 +109,33 @@ func (r *RabbitMQHandler) setupSmppQueues() error {
 	}
 
 	// Declare delivery report queue
-	_, err = r.channel.QueueDeclare(
+	_, err = ch.QueueDeclare(
 		"tsimcloud_delivery_report", // name
 		true,                        // durable
 		false,                       // delete when unused
 		false,                       // exclusive
 		false,                       // no-wait
-		nil,                         // arguments
+		sourceQueueArguments("tsimcloud_delivery_report"), // arguments
 	)
 	if err != nil {
 		return err
 	}
 
 	// Declare sms_queue for regular SMS messages
-	_, err = r.channel.QueueDeclare(
-		"sms_queue", // name
-		true,        // durable
-		false,       // delete when unused
-		false,       // exclusive
-		false,       // no-wait
-		nil,         // arguments
+	_, err = ch.QueueDeclare(
+		"sms_queue",                       // name
+		true,                              // durable
+		false,                             // delete when unused
+		false,                             // exclusive
+		false,                             // no-wait
+		sourceQueueArguments("sms_queue"), // arguments
 	)
 	if err != nil {
 		return err
 	}
 
 	// Bind delivery report queue to exchange
-	err = r.channel.QueueBind(
+	err = ch.QueueBind(
 		"tsimcloud_delivery_report", // queue name
 		"delivery_report",           // routing key
 		"tsimcloudrouter",           // exchange
@@ -135,18 +146,63 @@ func (r *RabbitMQHandler) setupSmppQueues() error {
 		return err
 	}
 
+	// Declare inbound SMS queue consumed by the SMPP server
+	_, err = ch.QueueDeclare(
+		"tsimcloud_deliver_sm", // name
+		true,                   // durable
+		false,                  // delete when unused
+		false,                  // exclusive
+		false,                  // no-wait
+		sourceQueueArguments("tsimcloud_deliver_sm"), // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	// Bind inbound SMS queue to exchange
+	err = ch.QueueBind(
+		"tsimcloud_deliver_sm", // queue name
+		"deliver_sm",           // routing key
+		"tsimcloudrouter",      // exchange
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Declare delay queues for scheduled SMPP messages
+	for _, delayQueue := range smppDelayQueues {
+		_, err = ch.QueueDeclare(
+			delayQueue.name, // name
+			true,            // durable
+			false,           // delete when unused
+			false,           // exclusive
+			false,           // no-wait
+			amqp.Table{
+				"x-message-ttl":             delayQueue.delay.Milliseconds(),
+				"x-dead-letter-exchange":    "tsimcloudrouter",
+				"x-dead-letter-routing-key": "submit_sm",
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Println("Successfully set up SMPP queues and exchange")
 	return nil
 }
 
 // CreateQueue creates a new queue in RabbitMQ
 func (r *RabbitMQHandler) CreateQueue(queueName string) error {
-	if r.channel == nil {
+	ch := r.currentChannel()
+	if ch == nil {
 		return amqp.ErrClosed
 	}
 
 	// Declare queue
-	_, err := r.channel.QueueDeclare(
+	_, err := ch.QueueDeclare(
 		queueName, // name
 		true,      // durable (survives server restart)
 		false,     // delete when unused
@@ -166,12 +222,13 @@ func (r *RabbitMQHandler) CreateQueue(queueName string) error {
 
 // DeleteQueue deletes a queue from RabbitMQ
 func (r *RabbitMQHandler) DeleteQueue(queueName string) error {
-	if r.channel == nil {
+	ch := r.currentChannel()
+	if ch == nil {
 		return amqp.ErrClosed
 	}
 
 	// Delete queue
-	_, err := r.channel.QueueDelete(
+	_, err := ch.QueueDelete(
 		queueName, // name
 		false,     // ifUnused
 		false,     // ifEmpty
@@ -189,11 +246,12 @@ func (r *RabbitMQHandler) DeleteQueue(queueName string) error {
 
 // PublishMessage publishes a message to a queue
 func (r *RabbitMQHandler) PublishMessage(queueName string, message []byte) error {
-	if r.channel == nil {
+	ch := r.currentChannel()
+	if ch == nil {
 		return amqp.ErrClosed
 	}
 
-	err := r.channel.Publish(
+	err := ch.Publish(
 		"",        // exchange
 		queueName, // routing key
 		false,     // mandatory
@@ -214,57 +272,70 @@ func (r *RabbitMQHandler) PublishMessage(queueName string, message []byte) error
 	return nil
 }
 
-// ConsumeQueue starts consuming messages from a queue
-func (r *RabbitMQHandler) ConsumeQueue(queueName string, handler func([]byte) error) error {
-	if r.channel == nil {
+// PublishDelayed publishes an SMPP message to the longest delay queue that does not exceed delay.
+// The message comes back to the SMPP router with its SMPP priority when the queue delay has passed.
+func (r *RabbitMQHandler) PublishDelayed(message []byte, delay time.Duration, priorityFlag uint8) error {
+	ch := r.currentChannel()
+	if ch == nil {
 		return amqp.ErrClosed
 	}
 
-	msgs, err := r.channel.Consume(
-		queueName, // queue
-		"",        // consumer
-		true,      // auto-ack
-		false,     // exclusive
-		false,     // no-local
-		false,     // no-wait
-		nil,       // args
-	)
+	delayQueue := smppDelayQueues[len(smppDelayQueues)-1]
+	for _, candidate := range smppDelayQueues {
+		if candidate.delay <= delay {
+			delayQueue = candidate
+			break
+		}
+	}
 
+	err := ch.Publish(
+		"",              // exchange
+		delayQueue.name, // routing key
+		false,           // mandatory
+		false,           // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         message,
+			DeliveryMode: amqp.Persistent,
+			Priority:     min(priorityFlag, topology.MaxPriority),
+			Timestamp:    time.Now(),
+		},
+	)
 	if err != nil {
-		log.Printf("Failed to start consuming from queue %s: %v", queueName, err)
+		log.Printf("Failed to publish message to delay queue %s: %v", delayQueue.name, err)
 		return err
 	}
 
-	go func() {
-		for msg := range msgs {
-			log.Printf("Received message from queue %s: %s", queueName, string(msg.Body))
-
-			if err := handler(msg.Body); err != nil {
-				log.Printf("Error processing message from queue %s: %v", queueName, err)
-			}
-		}
-	}()
-
-	log.Printf("Started consuming from queue: %s", queueName)
 	return nil
 }
 
+// ConsumeQueue starts consuming messages from a queue, again after every reconnection.
+// Messages are handled by a pool of workers; messages with the same ordering key are handled one after another
+// in the order they arrived. orderingKey may be nil when the order does not matter. A failed message is retried
+// after a delay, behind the messages of its key that arrived meanwhile, so the order only holds for messages
+// that do not fail. Only queues with a dead-letter queue can be consumed.
+func (r *RabbitMQHandler) ConsumeQueue(queueName string, orderingKey func(message []byte) string, handler MessageHandler) error {
+	// Without a dead-letter queue a message failing for good could only be dropped
+	if !IsDeadLetterSource(queueName) {
+		return fmt.Errorf("queue %s has no dead-letter queue", queueName)
+	}
+	c := queueConsumer{queueName: queueName, orderingKey: orderingKey, handler: handler}
+	return r.connection.AddConsumer("consumer of queue "+queueName, func(ch *amqp.Channel) error {
+		return r.consume(ch, c)
+	})
+}
+
 // GetQueueInfo returns information about a queue
 func (r *RabbitMQHandler) GetQueueInfo(queueName string) (amqp.Queue, error) {
-	if r.channel == nil {
+	ch := r.currentChannel()
+	if ch == nil {
 		return amqp.Queue{}, amqp.ErrClosed
 	}
 
-	return r.channel.QueueInspect(queueName)
+	return ch.QueueInspect(queueName)
 }
 
-// Close closes the RabbitMQ connection
+// Close stops reconnecting and closes the RabbitMQ connection
 func (r *RabbitMQHandler) Close() error {
-	if r.channel != nil {
-		r.channel.Close()
-	}
-	if r.conn != nil {
-		return r.conn.Close()
-	}
-	return nil
+	return r.connection.Close()
 }
@@ -2,6 +2,7 @@ package rabbitmq
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"time"
 
@@ -70,11 +71,26 @@ func NewSmsConsumer(rabbitMQ *RabbitMQHandler, wsServer *websocket.WebSocketServ
 func (sc *SmsConsumer) StartConsuming(queueName string) error {
 	log.Printf("Starting SMS consumer for queue: %s", queueName)
 
-	return sc.rabbitMQ.ConsumeQueue(queueName, func(message []byte) error {
+	return sc.rabbitMQ.ConsumeQueue(queueName, smsRecipient, func(message []byte, _ bool) error {
 		return sc.processSmsMessage(message)
 	})
 }
 
+// smsRecipient returns the phone number an SMS message is sent to, the ordering key of the consumer
+func smsRecipient(message []byte) string {
+	var smsMsg struct {
+		PhoneNumber string `json:"phone_number"`
+		DestAddr    string `json:"dest_addr"`
+	}
+	if err := json.Unmarshal(message, &smsMsg); err != nil {
+		return ""
+	}
+	if smsMsg.PhoneNumber != "" {
+		return smsMsg.PhoneNumber
+	}
+	return smsMsg.DestAddr
+}
+
 // processSmsMessage processes a single SMS message
 func (sc *SmsConsumer) processSmsMessage(message []byte) error {
 	// Try to parse as regular SMS message first
@@ -85,12 +101,11 @@ func (sc *SmsConsumer) processSmsMessage(message []byte) error {
 
 	// Try to parse as SMPP SMS message
 	var smppMsg SmppSmsMessage
-	if err := json.Unmarshal(message, &smppMsg); err == nil {
-		return sc.processSmppSmsMessage(smppMsg)
+	if err := json.Unmarshal(message, &smppMsg); err != nil {
+		log.Printf("Error: Could not parse SMS message as either regular or SMPP format: %v", err)
+		return fmt.Errorf("%w: %v", ErrUnprocessable, err)
 	}
-
-	log.Printf("Error: Could not parse SMS message as either regular or SMPP format")
-	return nil
+	return sc.processSmppSmsMessage(smppMsg)
 }
 
 // processRegularSmsMessage processes regular SMS messages (from frontend)
@@ -215,7 +230,7 @@ func (sc *SmsConsumer) processSmppSmsMessage(smppMsg SmppSmsMessage) error {
 		Message:                 &smppMsg.Message,
 		MessageLength:           len(smppMsg.Message),
 		Direction:               "outbound",
-		Priority:                "normal",
+		Priority:                smppPriority(smppMsg.Priority),
 		Status:                  "pending",
 		DeliveryReportRequested: true,
 		QueuedAt:                &time.Time{},
@@ -2,6 +2,7 @@ package rabbitmq
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -15,7 +16,11 @@ import (
 	"tsimsocketserver/websocket"
 	"tsimsocketserver/websocket_handlers"
 
+	"tsimcloud/shared/dlr"
+	"tsimcloud/shared/smpptime"
+
 	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/gorm"
 )
 
 // SmppSubmitSMMessage represents the SMPP submit_sm message structure from RabbitMQ
@@ -37,6 +42,7 @@ type SmppSubmitSMMessage struct {
 	SMDefaultMsgID       uint8                  `json:"sm_default_msg_id"`
 	OptionalParameters   map[string]interface{} `json:"optional_parameters"`
 	Concatenation        *ConcatenationInfo     `json:"concatenation,omitempty"`
+	SegmentMessageIDs    []string               `json:"segment_message_ids,omitempty"` // Message IDs returned for each segment of a reassembled message
 }
 
 // ConcatenationInfo represents concatenation information
@@ -48,37 +54,92 @@ type ConcatenationInfo struct {
 
 // SmsRouter handles routing SMS messages from SMPP to active Android devices
 type SmsRouter struct {
-	rabbitMQ *RabbitMQHandler
-	wsServer *websocket.WebSocketServer
+	rabbitMQ   *RabbitMQHandler
+	wsServer   *websocket.WebSocketServer
+	errorCodes *services.ErrorCodeService
 }
 
 // NewSmsRouter creates a new SMS router
 func NewSmsRouter(rabbitMQ *RabbitMQHandler, wsServer *websocket.WebSocketServer) *SmsRouter {
 	return &SmsRouter{
-		rabbitMQ: rabbitMQ,
-		wsServer: wsServer,
+		rabbitMQ:   rabbitMQ,
+		wsServer:   wsServer,
+		errorCodes: services.NewErrorCodeService(),
 	}
 }
 
-// StartRouting starts consuming SMPP messages and routing them to devices
+// StartRouting starts consuming SMPP messages and routing them to devices.
+// Messages to the same destination are routed in the order they were submitted.
 func (sr *SmsRouter) StartRouting(queueName string) error {
 	log.Printf("Starting SMS router for queue: %s", queueName)
 
-	return sr.rabbitMQ.ConsumeQueue(queueName, func(message []byte) error {
-		return sr.processSmppMessage(message)
-	})
+	return sr.rabbitMQ.ConsumeQueue(queueName, smppDestination, sr.processSmppMessage)
 }
 
-// processSmppMessage processes SMPP messages from RabbitMQ
-func (sr *SmsRouter) processSmppMessage(message []byte) error {
+// smppDestination returns the destination address of an SMPP message, the ordering key of the router
+func smppDestination(message []byte) string {
+	var smppMsg struct {
+		DestinationAddr string `json:"destination_addr"`
+	}
+	if err := json.Unmarshal(message, &smppMsg); err != nil {
+		return ""
+	}
+	return smppMsg.DestinationAddr
+}
+
+// processSmppMessage processes SMPP messages from RabbitMQ, redelivered is set for messages whose routing was interrupted
+func (sr *SmsRouter) processSmppMessage(message []byte, redelivered bool) error {
 	var smppMsg SmppSubmitSMMessage
 	if err := json.Unmarshal(message, &smppMsg); err != nil {
 		log.Printf("Error unmarshaling SMPP message: %v", err)
-		return err
+		return fmt.Errorf("%w: %v", ErrUnprocessable, err)
 	}
 
 	log.Printf("Processing SMPP message: %s from %s to %s (SystemID: %s)", smppMsg.MessageID, smppMsg.SourceAddr, smppMsg.DestinationAddr, smppMsg.SystemID)
 
+	// Scheduled messages wait in the delay queues until their delivery time, expired messages are not sent
+	schedule, expiry := sr.deliveryWindow(&smppMsg)
+	now := time.Now()
+	if !expiry.IsZero() && !now.Before(expiry) {
+		log.Printf("SMPP message %s expired before it could be sent (validity: %s)", smppMsg.MessageID, smppMsg.ValidityPeriod)
+		sr.logSmppMessageProcessing(smppMsg, "Validity period expired before delivery")
+		return sr.sendExpiredReport(smppMsg, "Validity period expired before delivery")
+	}
+	if schedule.After(now) {
+		return sr.holdUntilScheduled(smppMsg, schedule.Sub(now))
+	}
+
+	// Claim the message so that cancel_sm/replace_sm can no longer change it, and pick up any replacement
+	smppMessage, err := services.NewSmppMessageService().ClaimForDispatch(smppMsg.MessageID)
+	if errors.Is(err, services.ErrSmppMessageWithdrawn) && redelivered && sr.isInterruptedDispatch(smppMessage) {
+		// An earlier attempt claimed the message and stopped before a device took it
+		log.Printf("Resuming interrupted routing of redelivered SMPP message %s", smppMsg.MessageID)
+		err = nil
+	}
+	if err == nil {
+		if smppMessage.ShortMessage != "" {
+			smppMsg.ShortMessage = smppMessage.ShortMessage
+		}
+		smppMsg.ScheduleDeliveryTime = smppMessage.ScheduleDeliveryTime
+		smppMsg.ValidityPeriod = smppMessage.ValidityPeriod
+		smppMsg.RegisteredDelivery = smppMessage.RegisteredDelivery
+	} else if errors.Is(err, services.ErrSmppMessageWithdrawn) {
+		log.Printf("SMPP message %s is no longer pending (state: %d), dropping it", smppMsg.MessageID, smppMessage.MessageState)
+		sr.logSmppMessageProcessing(smppMsg, "Message no longer pending (cancelled or already dispatched)")
+
+		// A message cancelled before it was dispatched is never sent
+		if smppMessage.MessageState == models.SmppMessageStateDeleted {
+			if err := services.NewBillingService().RefundMessage(smppMsg.MessageID, "Message cancelled"); err != nil {
+				log.Printf("Failed to refund cancelled message %s: %v", smppMsg.MessageID, err)
+			}
+		}
+		return nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		// Without a claim a message cancelled meanwhile could still be sent, it is retried instead
+		log.Printf("Failed to claim SMPP message %s: %v", smppMsg.MessageID, err)
+		return fmt.Errorf("failed to claim SMPP message %s: %w", smppMsg.MessageID, err)
+	}
+
 	// Log SMPP message processing to alarm log with routing info
 	sr.logSmppMessageProcessing(smppMsg, "Processing SMPP message")
 
@@ -90,13 +151,13 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 		Find(&routings).Error; err != nil {
 		log.Printf("Error fetching SMS routing rules: %v", err)
 		sr.createSmsRoutingFailureAlarm(smppMsg, "Error fetching routing rules")
-		return sr.sendUndeliveredReport(smppMsg, "Error fetching routing rules")
+		return sr.sendUndeliveredReport(smppMsg, models.RouterFailureInternal, "Error fetching routing rules")
 	}
 
 	if len(routings) == 0 {
 		log.Printf("No active SMS routing found for SMPP outbound messages")
 		sr.createSmsRoutingFailureAlarm(smppMsg, "No active routing rule found")
-		return sr.sendUndeliveredReport(smppMsg, "No active routing rule found")
+		return sr.sendUndeliveredReport(smppMsg, models.RouterFailureNoRoute, "No active routing rule found")
 	}
 
 	// Find the best matching routing rule
@@ -149,7 +210,7 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 		sr.logSmppMessageProcessing(smppMsg, failureReason)
 
 		sr.createSmsRoutingFailureAlarm(smppMsg, failureReason)
-		return sr.sendUndeliveredReport(smppMsg, failureReason)
+		return sr.sendUndeliveredReport(smppMsg, models.RouterFailureNoRoute, failureReason)
 	}
 
 	// Get connected devices
@@ -161,7 +222,7 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 		sr.logSmppMessageProcessing(smppMsg, "No connected devices available")
 
 		sr.createSmsRoutingFailureAlarm(smppMsg, "No connected devices available")
-		return sr.sendUndeliveredReport(smppMsg, "No connected devices available")
+		return sr.sendUndeliveredReport(smppMsg, models.RouterFailureNoDevice, "No connected devices available")
 	}
 
 	log.Printf("Found %d connected devices total", len(connectedDevices))
@@ -176,13 +237,14 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 		sr.logSmppMessageProcessing(smppMsg, fmt.Sprintf("No suitable devices found for routing rule '%s' (Device Groups: %s)", routing.Name, deviceGroups))
 
 		sr.createSmsRoutingFailureAlarm(smppMsg, fmt.Sprintf("No suitable devices found for routing rule '%s' (Device Groups: %s)", routing.Name, deviceGroups))
-		return sr.sendUndeliveredReport(smppMsg, "No suitable devices found")
+		return sr.sendUndeliveredReport(smppMsg, models.RouterFailureNoDevice, "No suitable devices found")
 	}
 
 	log.Printf("Found %d available devices for routing", len(availableDevices))
 
 	// Try to send SMS to devices until one succeeds
 	var lastError error
+	lastFailure := models.RouterFailureDeviceFailed
 	for i, device := range availableDevices {
 		simSlot := sr.selectSimSlot(device, *routing)
 
@@ -192,23 +254,23 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 		if err != nil {
 			log.Printf("Failed to check SMS limits for device %s: %v", device.DeviceID, err)
 			lastError = err
+			lastFailure = models.RouterFailureInternal
 			continue
 		}
 
 		if !canSend {
 			log.Printf("SMS limit exceeded for device %s (SIM slot %d): %s", device.DeviceID, simSlot, reason)
 			lastError = fmt.Errorf("SMS limit exceeded: %s", reason)
+			lastFailure = models.RouterFailureLimitExceeded
 
 			// Create SMS log entry for limit exceeded
-			if err := sr.createSmsLogForSmpp(smppMsg, "failed", fmt.Sprintf("SMS limit exceeded: %s", reason), device.DeviceID); err != nil {
+			if err := sr.createSmsLogForSmpp(smppMsg, "failed", models.RouterFailureLimitExceeded, fmt.Sprintf("SMS limit exceeded: %s", reason), device.DeviceID); err != nil {
 				log.Printf("Failed to create SMS log for limit exceeded: %v", err)
 			}
 
-			// Send delivery report for limit exceeded if delivery report was requested
-			if smppMsg.RegisteredDelivery == 1 {
-				if err := sr.sendDeliveryReportForFailedAttempt(smppMsg, fmt.Sprintf("SMS limit exceeded: %s", reason)); err != nil {
-					log.Printf("Failed to send delivery report for limit exceeded: %v", err)
-				}
+			// The message stays en route while other devices are tried
+			if err := sr.sendIntermediateNotification(smppMsg, dlr.StateEnroute, fmt.Sprintf("SMS limit exceeded: %s", reason)); err != nil {
+				log.Printf("Failed to send intermediate notification for limit exceeded: %v", err)
 			}
 
 			// Create SMS failure alarm for limit exceeded
@@ -223,7 +285,7 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 			PhoneNumber: smppMsg.DestinationAddr,
 			Message:     smppMsg.ShortMessage,
 			SimSlot:     simSlot,
-			Priority:    sr.convertPriority(smppMsg.PriorityFlag),
+			Priority:    smppPriority(smppMsg.PriorityFlag),
 			MessageID:   smppMsg.MessageID, // SMPP message ID for delivery report tracking
 		}
 
@@ -233,18 +295,17 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 		// Send SMS via WebSocket
 		if err := sr.wsServer.SendSms(device.DeviceID, smsData); err != nil {
 			lastError = err
+			lastFailure = models.RouterFailureDeviceFailed
 			log.Printf("Failed to send SMS to device %s: %v", device.DeviceID, err)
 
 			// Create SMS log entry for failed attempt
-			if err := sr.createSmsLogForSmpp(smppMsg, "failed", fmt.Sprintf("Device %s failed: %v", device.DeviceID, err), device.DeviceID); err != nil {
+			if err := sr.createSmsLogForSmpp(smppMsg, "failed", models.RouterFailureDeviceFailed, fmt.Sprintf("Device %s failed: %v", device.DeviceID, err), device.DeviceID); err != nil {
 				log.Printf("Failed to create SMS log for failed attempt: %v", err)
 			}
 
-			// Send delivery report for failed attempt if delivery report was requested
-			if smppMsg.RegisteredDelivery == 1 {
-				if err := sr.sendDeliveryReportForFailedAttempt(smppMsg, fmt.Sprintf("Device %s failed: %v", device.DeviceID, err)); err != nil {
-					log.Printf("Failed to send delivery report for failed attempt: %v", err)
-				}
+			// The message stays en route while other devices are tried
+			if err := sr.sendIntermediateNotification(smppMsg, dlr.StateEnroute, fmt.Sprintf("Device %s failed: %v", device.DeviceID, err)); err != nil {
+				log.Printf("Failed to send intermediate notification for failed attempt: %v", err)
 			}
 
 			// Create SMS failure alarm
@@ -261,10 +322,14 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 
 		// Success! Create SMS log entry for successful delivery
 		// Note: Status is "sent" initially, will be updated to "delivered" when delivery report comes
-		if err := sr.createSmsLogForSmpp(smppMsg, "sent", "", device.DeviceID); err != nil {
+		if err := sr.createSmsLogForSmpp(smppMsg, "sent", "", "", device.DeviceID); err != nil {
 			log.Printf("Failed to create SMS log for successful delivery: %v", err)
 		}
 
+		if err := sr.sendIntermediateNotification(smppMsg, dlr.StateEnroute, fmt.Sprintf("Sent to device %s", device.DeviceID)); err != nil {
+			log.Printf("Failed to send intermediate notification for message %s: %v", smppMsg.MessageID, err)
+		}
+
 		// Log successful SMS delivery to alarm log
 		sr.logSmppMessageProcessing(smppMsg, fmt.Sprintf("SMS delivered successfully to device %s (SIM slot %d, attempt %d)", device.DeviceID, simSlot, i+1))
 
@@ -276,7 +341,77 @@ func (sr *SmsRouter) processSmppMessage(message []byte) error {
 	// All devices failed
 	log.Printf("Failed to send SMS to any device after trying %d devices", len(availableDevices))
 	sr.createSmsRoutingFailureAlarm(smppMsg, fmt.Sprintf("All devices failed after trying %d devices. Last error: %v", len(availableDevices), lastError))
-	return sr.sendUndeliveredReport(smppMsg, fmt.Sprintf("All devices failed. Last error: %v", lastError))
+	return sr.sendUndeliveredReport(smppMsg, lastFailure, fmt.Sprintf("All devices failed. Last error: %v", lastError))
+}
+
+// isInterruptedDispatch reports whether a claimed message never reached a device, so that routing it again sends it once
+func (sr *SmsRouter) isInterruptedDispatch(smppMessage *models.SmppMessage) bool {
+	if smppMessage == nil || smppMessage.MessageState != models.SmppMessageStateEnroute {
+		return false
+	}
+
+	var sent int64
+	if err := database.GetDB().Model(&models.SmsLog{}).
+		Where("message_id = ? AND status NOT IN ?", smppMessage.MessageID, []string{"failed", "pending", "queued"}).
+		Count(&sent).Error; err != nil {
+		log.Printf("Failed to check the SMS log of message %s: %v", smppMessage.MessageID, err)
+		return false
+	}
+	return sent == 0
+}
+
+// deliveryWindow returns the scheduled delivery time and the expiry of a message, zero when unset.
+// The stored message carries the times changed by replace_sm; relative times are rewritten as absolute times
+// counting from the submission so that they survive the delay queues.
+func (sr *SmsRouter) deliveryWindow(smppMsg *SmppSubmitSMMessage) (time.Time, time.Time) {
+	reference := time.Now()
+	if smppMessage, err := services.NewSmppMessageService().GetMessage(smppMsg.MessageID); err == nil {
+		// Cancelled and dispatched messages are dropped when they are claimed
+		pending := smppMessage.MessageState == models.SmppMessageStateScheduled || smppMessage.MessageState == models.SmppMessageStateEnroute
+		if smppMessage.DispatchedAt != nil || !pending {
+			return time.Time{}, time.Time{}
+		}
+		smppMsg.ScheduleDeliveryTime = smppMessage.ScheduleDeliveryTime
+		smppMsg.ValidityPeriod = smppMessage.ValidityPeriod
+		reference = smppMessage.SubmitDate
+	}
+
+	schedule, err := smpptime.Parse(smppMsg.ScheduleDeliveryTime, reference)
+	if err != nil {
+		log.Printf("Ignoring invalid schedule delivery time of SMPP message %s: %v", smppMsg.MessageID, err)
+		schedule = time.Time{}
+	}
+	expiry, err := smpptime.Parse(smppMsg.ValidityPeriod, reference)
+	if err != nil {
+		log.Printf("Ignoring invalid validity period of SMPP message %s: %v", smppMsg.MessageID, err)
+		expiry = time.Time{}
+	}
+
+	smppMsg.ScheduleDeliveryTime = ""
+	if !schedule.IsZero() {
+		smppMsg.ScheduleDeliveryTime = smpptime.FormatAbsolute(schedule)
+	}
+	smppMsg.ValidityPeriod = ""
+	if !expiry.IsZero() {
+		smppMsg.ValidityPeriod = smpptime.FormatAbsolute(expiry)
+	}
+	return schedule, expiry
+}
+
+// holdUntilScheduled puts a scheduled message back into the delay queues until its delivery time.
+// A message that cannot be held back is reported as undelivered rather than lost.
+func (sr *SmsRouter) holdUntilScheduled(smppMsg SmppSubmitSMMessage, delay time.Duration) error {
+	body, err := json.Marshal(smppMsg)
+	if err == nil {
+		err = sr.rabbitMQ.PublishDelayed(body, delay, smppMsg.PriorityFlag)
+	}
+	if err != nil {
+		log.Printf("Failed to hold back scheduled SMPP message %s: %v", smppMsg.MessageID, err)
+		return sr.sendUndeliveredReport(smppMsg, models.RouterFailureInternal, "Failed to schedule message")
+	}
+
+	log.Printf("SMPP message %s scheduled for %s, held back for %s", smppMsg.MessageID, smppMsg.ScheduleDeliveryTime, delay.Round(time.Second))
+	return nil
 }
 
 // getAllAvailableDevicesForRouting gets all available devices for routing, ordered by priority and strategy
@@ -488,49 +623,58 @@ func (sr *SmsRouter) selectSimSlot(device *models.DeviceConnection, routing mode
 	return 1
 }
 
-// sendDeliveryReportForFailedAttempt sends delivery report for failed SMS attempts
-func (sr *SmsRouter) sendDeliveryReportForFailedAttempt(smppMsg SmppSubmitSMMessage, reason string) error {
+// sendIntermediateNotification sends an ENROUTE or ACCEPTED notification if the SMPP client asked for
+// intermediate notifications
+func (sr *SmsRouter) sendIntermediateNotification(smppMsg SmppSubmitSMMessage, messageState uint8, reason string) error {
+	if !dlr.Wanted(smppMsg.RegisteredDelivery, messageState) {
+		return nil
+	}
+
 	deliveryReport := &types.DeliveryReportMessage{
 		MessageID:       smppMsg.MessageID,
 		SystemID:        smppMsg.SystemID,
 		SourceAddr:      smppMsg.DestinationAddr,
 		DestinationAddr: smppMsg.SourceAddr,
-		MessageState:    4, // UNDELIVERABLE
+		MessageState:    messageState,
 		ErrorCode:       0,
 		FinalDate:       time.Now().Format("20060102150405"),
 		SubmitDate:      time.Now().Format("20060102150405"),
 		DoneDate:        time.Now().Format("20060102150405"),
 		Delivered:       false,
-		Failed:          true,
+		Failed:          false,
 		FailureReason:   reason,
 	}
 
 	// Publish delivery report to RabbitMQ
 	if err := sr.publishDeliveryReport(deliveryReport); err != nil {
-		log.Printf("Error publishing failed attempt delivery report: %v", err)
+		log.Printf("Error publishing intermediate notification: %v", err)
 		return err
 	}
 
-	log.Printf("Sent failed attempt delivery report for message %s: %s", smppMsg.MessageID, reason)
+	log.Printf("Sent intermediate notification with state %d for message %s: %s", messageState, smppMsg.MessageID, reason)
 	return nil
 }
 
-// Helper function to send undelivered report
-func (sr *SmsRouter) sendUndeliveredReport(smppMsg SmppSubmitSMMessage, reason string) error {
+// Helper function to send undelivered report, failure is the router failure reason mapped to the error code
+func (sr *SmsRouter) sendUndeliveredReport(smppMsg SmppSubmitSMMessage, failure, reason string) error {
 	// Create SMS log entry for failed delivery
-	if err := sr.createSmsLogForSmpp(smppMsg, "failed", reason, ""); err != nil {
+	if err := sr.createSmsLogForSmpp(smppMsg, "failed", failure, reason, ""); err != nil {
 		log.Printf("Error creating SMS log for undelivered message: %v", err)
 	}
 
+	if err := services.NewBillingService().RefundMessage(smppMsg.MessageID, reason); err != nil {
+		log.Printf("Failed to refund undelivered message %s: %v", smppMsg.MessageID, err)
+	}
+
 	// Only send delivery report if it was requested
-	if smppMsg.RegisteredDelivery == 1 {
+	if dlr.Wanted(smppMsg.RegisteredDelivery, dlr.StateUndeliverable) {
 		deliveryReport := &types.DeliveryReportMessage{
 			MessageID:       smppMsg.MessageID,
 			SystemID:        smppMsg.SystemID,
 			SourceAddr:      smppMsg.DestinationAddr, // Orijinal hedef numara (mesajın gönderildiği yer)
 			DestinationAddr: smppMsg.SourceAddr,      // SMPP client adresi (mesajın geldiği yer)
-			MessageState:    5,                       // UNDELIVERABLE (System standard)
-			ErrorCode:       0,
+			MessageState:    dlr.StateUndeliverable,
+			ErrorCode:       sr.errorCodes.Resolve(models.ErrorSourceRouter, failure),
 			FinalDate:       time.Now().Format("20060102150405"),
 			SubmitDate:      time.Now().Format("20060102150405"),
 			DoneDate:        time.Now().Format("20060102150405"),
@@ -551,6 +695,48 @@ func (sr *SmsRouter) sendUndeliveredReport(smppMsg SmppSubmitSMMessage, reason s
 	return nil
 }
 
+// sendExpiredReport reports a message whose validity period ended before it could be sent
+func (sr *SmsRouter) sendExpiredReport(smppMsg SmppSubmitSMMessage, reason string) error {
+	if err := sr.createSmsLogForSmpp(smppMsg, "expired", models.RouterFailureExpired, reason, ""); err != nil {
+		log.Printf("Error creating SMS log for expired message: %v", err)
+	}
+
+	if err := services.NewSmppMessageService().ExpireMessage(smppMsg.MessageID); err != nil {
+		log.Printf("Failed to expire SMPP message %s: %v", smppMsg.MessageID, err)
+	}
+
+	if err := services.NewBillingService().RefundMessage(smppMsg.MessageID, reason); err != nil {
+		log.Printf("Failed to refund expired message %s: %v", smppMsg.MessageID, err)
+	}
+
+	// Only send delivery report if it was requested
+	if dlr.Wanted(smppMsg.RegisteredDelivery, dlr.StateExpired) {
+		deliveryReport := &types.DeliveryReportMessage{
+			MessageID:       smppMsg.MessageID,
+			SystemID:        smppMsg.SystemID,
+			SourceAddr:      smppMsg.DestinationAddr,
+			DestinationAddr: smppMsg.SourceAddr,
+			MessageState:    dlr.StateExpired,
+			ErrorCode:       sr.errorCodes.Resolve(models.ErrorSourceRouter, models.RouterFailureExpired),
+			FinalDate:       time.Now().Format("20060102150405"),
+			SubmitDate:      time.Now().Format("20060102150405"),
+			DoneDate:        time.Now().Format("20060102150405"),
+			Delivered:       false,
+			Failed:          true,
+			FailureReason:   reason,
+		}
+
+		if err := sr.publishDeliveryReport(deliveryReport); err != nil {
+			log.Printf("Error publishing expired delivery report: %v", err)
+			return err
+		}
+
+		log.Printf("Sent expired delivery report for message %s: %s", smppMsg.MessageID, reason)
+	}
+
+	return nil
+}
+
 // publishDeliveryReport publishes delivery report to RabbitMQ
 func (sr *SmsRouter) publishDeliveryReport(report *types.DeliveryReportMessage) error {
 	// Convert message to JSON
@@ -559,8 +745,13 @@ func (sr *SmsRouter) publishDeliveryReport(report *types.DeliveryReportMessage)
 		return err
 	}
 
+	ch := sr.rabbitMQ.currentChannel()
+	if ch == nil {
+		return amqp.ErrClosed
+	}
+
 	// Publish to delivery report queue
-	err = sr.rabbitMQ.channel.Publish(
+	err = ch.Publish(
 		"tsimcloudrouter", // exchange
 		"delivery_report", // routing key
 		false,             // mandatory
@@ -579,8 +770,8 @@ func (sr *SmsRouter) publishDeliveryReport(report *types.DeliveryReportMessage)
 	return nil
 }
 
-// createSmsLogForSmpp creates an SMS log entry for SMPP messages
-func (sr *SmsRouter) createSmsLogForSmpp(smppMsg SmppSubmitSMMessage, status, errorMsg string, deviceID string) error {
+// createSmsLogForSmpp creates an SMS log entry for SMPP messages, failure is the router failure reason of failed messages
+func (sr *SmsRouter) createSmsLogForSmpp(smppMsg SmppSubmitSMMessage, status, failure, errorMsg string, deviceID string) error {
 	// Get device information from the successful device (if available)
 	var deviceInfo *models.Device
 	var simCardInfo *models.SimCardRecord
@@ -621,13 +812,28 @@ func (sr *SmsRouter) createSmsLogForSmpp(smppMsg SmppSubmitSMMessage, status, er
 		Message:                 &smppMsg.ShortMessage,
 		MessageLength:           len(smppMsg.ShortMessage),
 		Direction:               "outbound",
-		Priority:                sr.convertPriority(smppMsg.PriorityFlag),
+		Priority:                smppPriority(smppMsg.PriorityFlag),
 		Status:                  status,
-		DeliveryReportRequested: smppMsg.RegisteredDelivery == 1,
+		DeliveryReportRequested: dlr.Requested(smppMsg.RegisteredDelivery),
 		QueuedAt:                func() *time.Time { now := time.Now(); return &now }(),
 		Metadata:                sr.createMetadata(smppMsg),
 	}
 
+	// Messages still waiting for a delivery report when their validity ends are expired by the SMS expiry service
+	if expiry, err := smpptime.Parse(smppMsg.ValidityPeriod, time.Now()); err == nil && !expiry.IsZero() {
+		smsLog.ExpiresAt = &expiry
+	}
+
+	// Price the message as charged by the SMPP server
+	if charge, err := services.NewBillingService().MessageCharge(smppMsg.MessageID); err != nil {
+		log.Printf("Failed to load charge of message %s: %v", smppMsg.MessageID, err)
+	} else if charge != nil {
+		smsLog.Rate = charge.Rate
+		smsLog.Charge = charge.TotalCost
+		smsLog.TotalCost = charge.TotalCost
+		smsLog.PduCount = charge.Segments
+	}
+
 	// Add device information if available
 	if deviceInfo != nil {
 		smsLog.DeviceID = &deviceInfo.IMEI
@@ -661,6 +867,9 @@ func (sr *SmsRouter) createSmsLogForSmpp(smppMsg SmppSubmitSMMessage, status, er
 	if errorMsg != "" {
 		smsLog.ErrorMessage = &errorMsg
 	}
+	if failure != "" {
+		smsLog.ErrorCode = services.FormatErrorCode(sr.errorCodes.Resolve(models.ErrorSourceRouter, failure))
+	}
 
 	return database.GetDB().Create(&smsLog).Error
 }
@@ -700,14 +909,14 @@ func (sr *SmsRouter) matchesDestinationPattern(pattern, address string) bool {
 	return pattern == address
 }
 
-// convertPriority converts SMPP priority flag to string priority
-func (sr *SmsRouter) convertPriority(priorityFlag uint8) string {
+// smppPriority converts SMPP priority flag to string priority
+func smppPriority(priorityFlag uint8) string {
 	switch priorityFlag {
 	case 0:
 		return "normal"
 	case 1:
 		return "high"
-	case 2:
+	case 2, 3:
 		return "urgent"
 	default:
 		return "normal"
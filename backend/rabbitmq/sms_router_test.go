@@ -0,0 +1,66 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// useTestDB points the database package at an in-memory SQLite database with the given tables migrated
+func useTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens its own database
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		sqlDB.Close()
+	})
+	return db
+}
+
+func TestProcessSmppMessageRetriesWhenTheClaimFails(t *testing.T) {
+	db := useTestDB(t, &models.SmppMessage{})
+	if err := db.Create(&models.SmppMessage{MessageID: "m1", SystemID: "esme", MessageState: models.SmppMessageStateEnroute, SubmitDate: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The message can be read but not claimed
+	claimErr := errors.New("database unavailable")
+	if err := db.Callback().Update().Before("gorm:update").Register("fail_updates", func(tx *gorm.DB) {
+		tx.AddError(claimErr)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(SmppSubmitSMMessage{MessageID: "m1", SystemID: "esme", DestinationAddr: "905551112233"})
+	err := (&SmsRouter{}).processSmppMessage(body, false)
+	if err == nil {
+		t.Fatal("message was routed without a claim")
+	}
+	if errors.Is(err, ErrUnprocessable) {
+		t.Errorf("error = %v, want a retryable error", err)
+	}
+}
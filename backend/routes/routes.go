@@ -4,13 +4,14 @@ import (
 	"tsimsocketserver/config"
 	"tsimsocketserver/handlers"
 	"tsimsocketserver/middleware"
+	"tsimsocketserver/rabbitmq"
 	"tsimsocketserver/redis"
 	"tsimsocketserver/websocket"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func SetupRoutes(app *fiber.App, cfg *config.Config, wsServer *websocket.WebSocketServer, redisService *redis.RedisService) {
+func SetupRoutes(app *fiber.App, cfg *config.Config, wsServer *websocket.WebSocketServer, redisService *redis.RedisService, rabbitMQHandler *rabbitmq.RabbitMQHandler) {
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(cfg)
 	userHandler := handlers.NewUserHandler()
@@ -22,12 +23,16 @@ func SetupRoutes(app *fiber.App, cfg *config.Config, wsServer *websocket.WebSock
 	websocketHandler := handlers.NewWebSocketHandler(cfg)
 	alarmLogHandler := handlers.NewAlarmLogHandler(cfg)
 	smppUserHandler := handlers.NewSmppUserHandler(redisService)
+	smppBillingHandler := handlers.NewSmppBillingHandler(smppUserHandler)
+	smppDlrProfileHandler := handlers.NewSmppDlrProfileHandler()
+	smppErrorCodeHandler := handlers.NewSmppErrorCodeHandler()
 	blacklistNumberHandler := handlers.NewBlacklistNumberHandler()
 	bulkSmsHandler := handlers.NewBulkSmsHandler(wsServer)
 	scheduleTaskHandler := handlers.NewScheduleTaskHandler(wsServer)
 	mccMncHandler := handlers.NewMccMncHandler()
 	smsRoutingHandler := handlers.NewSmsRoutingHandler()
 	configHandler := handlers.NewConfigHandler()
+	deadLetterHandler := handlers.NewDeadLetterHandler(rabbitMQHandler)
 
 	// API routes
 	api := app.Group("/api")
@@ -37,6 +42,9 @@ func SetupRoutes(app *fiber.App, cfg *config.Config, wsServer *websocket.WebSock
 	auth.Post("/login", authHandler.Login)
 	auth.Post("/forgot-password", authHandler.ForgotPassword)
 
+	// SMPP user balance query, authenticated with the SMPP credentials
+	api.Get("/smpp/balance", smppBillingHandler.GetOwnBalance)
+
 	// Protected routes
 	protected := api.Group("", middleware.AuthMiddleware(cfg), middleware.PermissionMiddleware())
 
@@ -136,6 +144,42 @@ func SetupRoutes(app *fiber.App, cfg *config.Config, wsServer *websocket.WebSock
 	smppUsers.Put("/:id", smppUserHandler.UpdateSmppUser)
 	smppUsers.Delete("/:id", smppUserHandler.DeleteSmppUser)
 	smppUsers.Put("/:id/connection-status", smppUserHandler.UpdateConnectionStatus)
+	smppUsers.Get("/:id/bind-audits", smppUserHandler.GetSmppUserBindAudits)
+
+	// SMPP User Billing routes
+	smppUsers.Get("/:id/balance", smppBillingHandler.GetSmppUserBalance)
+	smppUsers.Post("/:id/balance/top-up", smppBillingHandler.TopUpSmppUserBalance)
+	smppUsers.Get("/:id/balance-transactions", smppBillingHandler.GetSmppUserBalanceTransactions)
+
+	// SMPP Rate routes
+	smppRates := protected.Group("/smpp-rates")
+	smppRates.Get("/", smppBillingHandler.GetSmppRates)
+	smppRates.Post("/", smppBillingHandler.CreateSmppRate)
+	smppRates.Put("/:id", smppBillingHandler.UpdateSmppRate)
+	smppRates.Delete("/:id", smppBillingHandler.DeleteSmppRate)
+
+	// SMPP DLR Profile routes
+	smppDlrProfiles := protected.Group("/smpp-dlr-profiles")
+	smppDlrProfiles.Get("/", smppDlrProfileHandler.GetSmppDlrProfiles)
+	smppDlrProfiles.Post("/", smppDlrProfileHandler.CreateSmppDlrProfile)
+	smppDlrProfiles.Get("/:id", smppDlrProfileHandler.GetSmppDlrProfile)
+	smppDlrProfiles.Put("/:id", smppDlrProfileHandler.UpdateSmppDlrProfile)
+	smppDlrProfiles.Delete("/:id", smppDlrProfileHandler.DeleteSmppDlrProfile)
+
+	// SMPP Error Code routes
+	smppErrorCodes := protected.Group("/smpp-error-codes")
+	smppErrorCodes.Get("/", smppErrorCodeHandler.GetSmppErrorCodes)
+	smppErrorCodes.Post("/", smppErrorCodeHandler.CreateSmppErrorCode)
+	smppErrorCodes.Put("/:id", smppErrorCodeHandler.UpdateSmppErrorCode)
+	smppErrorCodes.Delete("/:id", smppErrorCodeHandler.DeleteSmppErrorCode)
+
+	// Dead-letter routes
+	deadLetters := protected.Group("/dead-letters")
+	deadLetters.Get("/", deadLetterHandler.GetDeadLetterQueues)
+	deadLetters.Get("/:queue/messages", deadLetterHandler.GetDeadLetters)
+	deadLetters.Get("/:queue/messages/:id", deadLetterHandler.GetDeadLetter)
+	deadLetters.Post("/:queue/messages/:id/replay", deadLetterHandler.ReplayDeadLetter)
+	deadLetters.Delete("/:queue", deadLetterHandler.PurgeDeadLetters)
 
 	// SMPP User Anti-Detection routes
 	smppUsers.Get("/:id/anti-detection-config", handlers.GetSmppUserAntiDetectionConfig)
@@ -242,11 +286,20 @@ func SetupRoutes(app *fiber.App, cfg *config.Config, wsServer *websocket.WebSock
 	// WebSocket routes
 	app.Get("/ws", wsServer.HandleWebSocket) // Unified WebSocket endpoint (type=android|frontend)
 
-	// Health check
+	// Health check, degraded while RabbitMQ is not connected
 	app.Get("/health", func(c *fiber.Ctx) error {
+		rabbitMQState := rabbitMQHandler.State()
+		if !rabbitMQState.Connected {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"status":   "degraded",
+				"message":  "RabbitMQ is not connected",
+				"rabbitmq": rabbitMQState,
+			})
+		}
 		return c.JSON(fiber.Map{
-			"status":  "ok",
-			"message": "Server is running",
+			"status":   "ok",
+			"message":  "Server is running",
+			"rabbitmq": rabbitMQState,
 		})
 	})
 
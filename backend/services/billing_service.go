@@ -0,0 +1,132 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+
+	"tsimcloud/shared/billing"
+
+	"gorm.io/gorm"
+)
+
+// BillingService manages the prepaid balance ledger of SMPP users
+type BillingService struct{}
+
+func NewBillingService() *BillingService {
+	return &BillingService{}
+}
+
+// MessageCharge sums up what was charged for a message and its segments
+type MessageCharge struct {
+	Rate      string
+	Segments  int
+	TotalCost string
+}
+
+// TopUp credits the balance and SMS count of an SMPP user and records it in the ledger.
+// A balance or SMS count that is not limited yet starts from zero.
+func (s *BillingService) TopUp(smppUser *models.SmppUser, amount int64, smsCount int, description string) (*models.SmppBalanceTransaction, error) {
+	entry := &models.SmppBalanceTransaction{
+		SmppUserID:  smppUser.ID,
+		SystemID:    smppUser.SystemID,
+		Type:        models.LedgerTopUp,
+		Amount:      billing.FormatAmount(amount),
+		SmsCount:    smsCount,
+		Description: description,
+		CreatedAt:   time.Now(),
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{}
+		if amount != 0 {
+			updates["mt_balance"] = gorm.Expr("CAST(CAST(COALESCE(NULLIF(mt_balance, ''), '0') AS DECIMAL(20,4)) + CAST(? AS DECIMAL(20,4)) AS CHAR)", billing.FormatAmount(amount))
+		}
+		if smsCount != 0 {
+			updates["mt_sms_count"] = gorm.Expr("CAST(CAST(COALESCE(NULLIF(mt_sms_count, ''), '0') AS SIGNED) + ? AS CHAR)", smsCount)
+		}
+		if err := tx.Model(&models.SmppUser{}).Where("id = ?", smppUser.ID).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to credit balance: %v", err)
+		}
+		if err := tx.Create(entry).Error; err != nil {
+			return fmt.Errorf("failed to record top-up: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// RefundMessage gives back what was reserved for a message that could not be delivered.
+// Concatenated messages are charged per segment, so the charges of their segments are refunded too.
+// A message is refunded at most once.
+func (s *BillingService) RefundMessage(messageID, reason string) error {
+	messageIDs, err := s.chargedMessageIDs(messageID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range messageIDs {
+		if err := s.refundCharge(id, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refundCharge refunds the charge of a single message or segment
+func (s *BillingService) refundCharge(messageID, reason string) error {
+	refund, err := billing.RefundMessage(database.GetDB(), messageID, reason)
+	if err != nil {
+		return err
+	}
+	if refund != nil {
+		log.Printf("Refunded %s and %d SMS of message %s to %s", refund.Amount, refund.SmsCount, messageID, refund.SystemID)
+	}
+	return nil
+}
+
+// MessageCharge returns the rate, segment count and total price of a message and its segments.
+// Messages the SMPP server did not charge return nil.
+func (s *BillingService) MessageCharge(messageID string) (*MessageCharge, error) {
+	messageIDs, err := s.chargedMessageIDs(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var charges []models.SmppBalanceTransaction
+	if err := database.GetDB().Where("message_id IN ? AND type = ?", messageIDs, models.LedgerCharge).Find(&charges).Error; err != nil {
+		return nil, fmt.Errorf("failed to load charges of message %s: %v", messageID, err)
+	}
+	if len(charges) == 0 {
+		return nil, nil
+	}
+
+	charge := &MessageCharge{Rate: charges[0].Rate}
+	var total int64
+	for _, entry := range charges {
+		rate, err := billing.ParseAmount(entry.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate of message %s: %v", messageID, err)
+		}
+		charge.Segments += entry.Segments
+		total += rate * int64(entry.Segments)
+	}
+	charge.TotalCost = billing.FormatAmount(total)
+	return charge, nil
+}
+
+// chargedMessageIDs returns the message ID with the IDs of the segments it was assembled from
+func (s *BillingService) chargedMessageIDs(messageID string) ([]string, error) {
+	var segmentIDs []string
+	if err := database.GetDB().Model(&models.SmppMessage{}).
+		Where("parent_message_id = ? AND message_id <> ?", messageID, messageID).
+		Pluck("message_id", &segmentIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load segments of message %s: %v", messageID, err)
+	}
+	return append([]string{messageID}, segmentIDs...), nil
+}
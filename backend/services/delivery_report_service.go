@@ -7,6 +7,8 @@ import (
 
 	"tsimsocketserver/models"
 	"tsimsocketserver/types"
+
+	"tsimcloud/shared/dlr"
 )
 
 // DeliveryReportService handles delivery report operations
@@ -55,6 +57,14 @@ func (drs *DeliveryReportService) PublishDeliveryReport(smsLog models.SmsLog, st
 		return nil
 	}
 
+	// Only publish the reports the SMPP client asked for
+	registeredDelivery := registeredDeliveryOf(smsLog, metadata)
+	if !dlr.Wanted(registeredDelivery, report.MessageState) {
+		log.Printf("Delivery report with state %d not requested for message %s (registered_delivery: 0x%02X)",
+			report.MessageState, smsLog.MessageID, registeredDelivery)
+		return nil
+	}
+
 	// Publish to RabbitMQ
 	if err := drs.publishDeliveryReport(report); err != nil {
 		log.Printf("Failed to publish delivery report for message %s: %v", smsLog.MessageID, err)
@@ -100,37 +110,39 @@ func (drs *DeliveryReportService) createDeliveryReport(smsLog models.SmsLog, sys
 	// 0 = SCHEDULED, 1 = ENROUTE, 2 = DELIVERED, 3 = EXPIRED, 4 = DELETED, 5 = UNDELIVERABLE, 6 = ACCEPTED, 7 = UNKNOWN, 8 = REJECTED
 	switch status {
 	case "sent":
-		// Don't send delivery report for "sent" status from Android devices
-		// This is an intermediate status, not a final delivery status
-		log.Printf("Skipping delivery report for intermediate status: %s", status)
-		return nil
+		// The device handed the message to the network, an intermediate notification
+		report.MessageState = dlr.StateAccepted
+		report.Delivered = false
+		report.Failed = false
+		report.FailureReason = ""
 	case "delivered":
-		report.MessageState = 2 // DELIVERED (System standard)
+		report.MessageState = dlr.StateDelivered
 		report.Delivered = true
 		report.Failed = false
 		report.FailureReason = ""
 	case "failed", "undelivered":
-		report.MessageState = 5 // UNDELIVERABLE (System standard)
+		report.MessageState = dlr.StateUndeliverable
 		report.Delivered = false
 		report.Failed = true
 		report.FailureReason = "Message undelivered"
 	case "expired":
-		report.MessageState = 3 // EXPIRED (System standard)
+		report.MessageState = dlr.StateExpired
 		report.Delivered = false
 		report.Failed = true
 		report.FailureReason = "Message expired"
 	case "rejected":
-		report.MessageState = 8 // REJECTED (System standard)
+		report.MessageState = dlr.StateRejected
 		report.Delivered = false
 		report.Failed = true
 		report.FailureReason = "Message rejected"
 	case "timeout":
-		report.MessageState = 6 // ACCEPTED (System standard)
+		// The device never reported the outcome, the message is given up as undeliverable
+		report.MessageState = dlr.StateUndeliverable
 		report.Delivered = false
 		report.Failed = true
 		report.FailureReason = "Message timeout"
 	case "cancelled":
-		report.MessageState = 4 // DELETED (System standard)
+		report.MessageState = dlr.StateDeleted
 		report.Delivered = false
 		report.Failed = true
 		report.FailureReason = "Message cancelled"
@@ -140,8 +152,25 @@ func (drs *DeliveryReportService) createDeliveryReport(smsLog models.SmsLog, sys
 		return nil
 	}
 
-	log.Printf("Created delivery report for message %s: status=%s, message_state=%d, delivered=%t, failed=%t",
-		smsLog.MessageID, status, report.MessageState, report.Delivered, report.Failed)
+	// Failures carry the error code mapped from the device or router failure reason
+	if report.Failed {
+		report.ErrorCode = ParseErrorCode(smsLog.ErrorCode)
+	}
+
+	log.Printf("Created delivery report for message %s: status=%s, message_state=%d, delivered=%t, failed=%t, error_code=%d",
+		smsLog.MessageID, status, report.MessageState, report.Delivered, report.Failed, report.ErrorCode)
 
 	return report
 }
+
+// registeredDeliveryOf returns the registered_delivery of an SMPP message as recorded in the metadata of its SMS log.
+// Logs written before it was recorded fall back to whether a delivery report was requested.
+func registeredDeliveryOf(smsLog models.SmsLog, metadata map[string]interface{}) uint8 {
+	if value, ok := metadata["registered_delivery"].(float64); ok {
+		return uint8(value)
+	}
+	if smsLog.DeliveryReportRequested {
+		return dlr.RegisteredDeliverySmscReceipt
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"testing"
+	"tsimsocketserver/models"
+	"tsimsocketserver/types"
+
+	"tsimcloud/shared/dlr"
+)
+
+func TestPublishDeliveryReport(t *testing.T) {
+	smppLog := func(registeredDelivery string) models.SmsLog {
+		connector := "smpp"
+		metadata := `{"system_id": "esme", "registered_delivery": ` + registeredDelivery + `}`
+		errorCode := "11"
+		return models.SmsLog{MessageID: "msg-1", SourceConnector: &connector, Metadata: &metadata, ErrorCode: &errorCode}
+	}
+
+	tests := []struct {
+		name               string
+		registeredDelivery string
+		status             string
+		wantState          uint8 // 0 when no report is published
+		wantFailed         bool
+	}{
+		{"delivered", "1", "delivered", dlr.StateDelivered, false},
+		{"delivered on failure receipt", "2", "delivered", 0, false},
+		{"undelivered", "2", "undelivered", dlr.StateUndeliverable, true},
+		{"timeout is a failure", "2", "timeout", dlr.StateUndeliverable, true},
+		{"timeout without receipt", "0", "timeout", 0, false},
+		{"sent as intermediate notification", "16", "sent", dlr.StateAccepted, false},
+		{"sent without intermediate notifications", "1", "sent", 0, false},
+		{"cancelled", "1", "cancelled", dlr.StateDeleted, true},
+		{"intermediate status", "1", "enroute", 0, false},
+	}
+
+	for _, tt := range tests {
+		var published *types.DeliveryReportMessage
+		service := NewDeliveryReportService(func(report *types.DeliveryReportMessage) error {
+			published = report
+			return nil
+		})
+
+		if err := service.PublishDeliveryReport(smppLog(tt.registeredDelivery), tt.status); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.wantState == 0 {
+			if published != nil {
+				t.Errorf("%s: published a report with state %d, want none", tt.name, published.MessageState)
+			}
+			continue
+		}
+		if published == nil {
+			t.Errorf("%s: no report published, want state %d", tt.name, tt.wantState)
+			continue
+		}
+		if published.MessageState != tt.wantState || published.Failed != tt.wantFailed {
+			t.Errorf("%s: report state %d failed %v, want state %d failed %v", tt.name, published.MessageState, published.Failed, tt.wantState, tt.wantFailed)
+		}
+		if tt.wantFailed && published.ErrorCode != 11 {
+			t.Errorf("%s: error code = %d, want 11", tt.name, published.ErrorCode)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"log"
+	"strconv"
+
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+
+	"gorm.io/gorm"
+)
+
+// defaultErrorCodes are the error codes of failure reasons without a mapping in smpp_error_codes
+var defaultErrorCodes = []models.SmppErrorCode{
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureNoRoute, ErrorCode: 11, Description: stringPtr("No routing rule for the message")},
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureNoDevice, ErrorCode: 12, Description: stringPtr("No device available")},
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureLimitExceeded, ErrorCode: 13, Description: stringPtr("SMS limits of the devices exceeded")},
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureBlacklisted, ErrorCode: 14, Description: stringPtr("Destination blacklisted")},
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureDeviceFailed, ErrorCode: 15, Description: stringPtr("No device accepted the message")},
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureInternal, ErrorCode: 16, Description: stringPtr("Internal routing error")},
+	{Source: models.ErrorSourceRouter, Reason: models.RouterFailureExpired, ErrorCode: 17, Description: stringPtr("Validity period expired")},
+	{Source: models.ErrorSourceDeviceResult, Reason: "1", ErrorCode: 21, Description: stringPtr("Generic failure")},
+	{Source: models.ErrorSourceDeviceResult, Reason: "2", ErrorCode: 22, Description: stringPtr("Radio off")},
+	{Source: models.ErrorSourceDeviceResult, Reason: "3", ErrorCode: 23, Description: stringPtr("Null PDU")},
+	{Source: models.ErrorSourceDeviceResult, Reason: "4", ErrorCode: 24, Description: stringPtr("No service")},
+	{Source: models.ErrorSourceDeviceResult, Reason: "5", ErrorCode: 25, Description: stringPtr("Sending limit of the device exceeded")},
+	{Source: models.ErrorSourceDeviceStatus, Reason: "failed", ErrorCode: 31, Description: stringPtr("Sending failed")},
+	{Source: models.ErrorSourceDeviceStatus, Reason: "undelivered", ErrorCode: 32, Description: stringPtr("Not delivered by the network")},
+	{Source: models.ErrorSourceDeviceStatus, Reason: "rejected", ErrorCode: 33, Description: stringPtr("Rejected by the network")},
+	{Source: models.ErrorSourceDeviceStatus, Reason: "expired", ErrorCode: 34, Description: stringPtr("Expired in the network")},
+}
+
+// ErrorCodeService maps failure reasons of devices and of the SMS router to SMPP error codes
+type ErrorCodeService struct {
+	db *gorm.DB
+}
+
+// NewErrorCodeService creates a new error code service
+func NewErrorCodeService() *ErrorCodeService {
+	return &ErrorCodeService{
+		db: database.GetDB(),
+	}
+}
+
+// DefaultErrorCodes returns the built-in error codes, used for failure reasons without a mapping
+func DefaultErrorCodes() []models.SmppErrorCode {
+	return append([]models.SmppErrorCode(nil), defaultErrorCodes...)
+}
+
+// Resolve returns the error code of a failure reason, 0 when it has none
+func (s *ErrorCodeService) Resolve(source, reason string) uint8 {
+	var mapping models.SmppErrorCode
+	err := s.db.Where("source = ? AND reason = ?", source, reason).First(&mapping).Error
+	if err == nil {
+		return mapping.ErrorCode
+	}
+	if err != gorm.ErrRecordNotFound {
+		log.Printf("Failed to load error code of %s %s: %v", source, reason, err)
+	}
+
+	for _, mapping := range defaultErrorCodes {
+		if mapping.Source == source && mapping.Reason == reason {
+			return mapping.ErrorCode
+		}
+	}
+	return 0
+}
+
+// ResolveDeviceFailure returns the error code of a failure reported by a device. The Android result code is
+// more specific than the status and is looked up first.
+func (s *ErrorCodeService) ResolveDeviceFailure(status string, resultCode *int) uint8 {
+	if resultCode != nil {
+		if errorCode := s.Resolve(models.ErrorSourceDeviceResult, strconv.Itoa(*resultCode)); errorCode != 0 {
+			return errorCode
+		}
+	}
+	return s.Resolve(models.ErrorSourceDeviceStatus, status)
+}
+
+// FormatErrorCode formats an error code as stored in SmsLog.ErrorCode, nil when there is none
+func FormatErrorCode(errorCode uint8) *string {
+	if errorCode == 0 {
+		return nil
+	}
+	value := strconv.Itoa(int(errorCode))
+	return &value
+}
+
+// ParseErrorCode returns the error code stored in SmsLog.ErrorCode, 0 when there is none
+func ParseErrorCode(errorCode *string) uint8 {
+	if errorCode == nil {
+		return 0
+	}
+	value, err := strconv.ParseUint(*errorCode, 10, 8)
+	if err != nil {
+		return 0
+	}
+	return uint8(value)
+}
+
+// stringPtr returns a pointer to s
+func stringPtr(s string) *string {
+	return &s
+}
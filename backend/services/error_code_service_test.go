@@ -0,0 +1,39 @@
+package services
+
+import (
+	"testing"
+
+	"tsimsocketserver/models"
+)
+
+func TestResolveErrorCode(t *testing.T) {
+	db := useTestDB(t, &models.SmppErrorCode{})
+	if err := db.Create(&models.SmppErrorCode{Source: models.ErrorSourceRouter, Reason: models.RouterFailureNoDevice, ErrorCode: 99}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service := NewErrorCodeService()
+
+	tests := []struct {
+		source, reason string
+		want           uint8
+	}{
+		{models.ErrorSourceRouter, models.RouterFailureNoDevice, 99}, // Mapping overrides the default
+		{models.ErrorSourceRouter, models.RouterFailureNoRoute, 11},
+		{models.ErrorSourceRouter, models.RouterFailureBlacklisted, 14},
+		{models.ErrorSourceDeviceStatus, "undelivered", 32},
+		{models.ErrorSourceDeviceStatus, "unknown", 0},
+	}
+	for _, tt := range tests {
+		if got := service.Resolve(tt.source, tt.reason); got != tt.want {
+			t.Errorf("Resolve(%s, %s) = %d, want %d", tt.source, tt.reason, got, tt.want)
+		}
+	}
+
+	radioOff, unmapped := 2, 42
+	if got := service.ResolveDeviceFailure("failed", &radioOff); got != 22 {
+		t.Errorf("ResolveDeviceFailure with result code 2 = %d, want 22", got)
+	}
+	if got := service.ResolveDeviceFailure("failed", &unmapped); got != 31 {
+		t.Errorf("ResolveDeviceFailure with an unmapped result code = %d, want the status code 31", got)
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+	"tsimsocketserver/types"
+)
+
+// InboundSmsService routes SMS received by devices to SMPP clients
+type InboundSmsService struct {
+	publishInboundSms func(*types.InboundSmsMessage) error
+}
+
+// NewInboundSmsService creates a new inbound SMS service
+func NewInboundSmsService(publishFunc func(*types.InboundSmsMessage) error) *InboundSmsService {
+	return &InboundSmsService{
+		publishInboundSms: publishFunc,
+	}
+}
+
+// RouteInboundSms finds the inbound routing for a received SMS and publishes it to the SMPP server.
+// Messages without a matching routing are only kept in the SMS logs.
+func (s *InboundSmsService) RouteInboundSms(smsLog models.SmsLog, device models.Device) error {
+	simNumber := ""
+	if smsLog.SimcardNumber != nil {
+		simNumber = *smsLog.SimcardNumber
+	}
+	text := ""
+	if smsLog.Message != nil {
+		text = *smsLog.Message
+	}
+
+	routing, err := s.findRouting(device, simNumber, text)
+	if err != nil {
+		return err
+	}
+	if routing == nil {
+		log.Printf("No inbound routing matched SMS %s from device %s", smsLog.MessageID, device.IMEI)
+		return nil
+	}
+
+	message := &types.InboundSmsMessage{
+		MessageID:       smsLog.MessageID,
+		SystemID:        *routing.SystemID,
+		DestinationAddr: simNumber,
+		Message:         text,
+		DeviceIMEI:      device.IMEI,
+		RoutingID:       routing.ID,
+		ReceivedAt:      time.Now().Format("20060102150405"),
+	}
+	if smsLog.SourceAddr != nil {
+		message.SourceAddr = *smsLog.SourceAddr
+	}
+	if smsLog.SimSlot != nil {
+		message.SimSlot = *smsLog.SimSlot
+	}
+	if smsLog.ReceivedAt != nil {
+		message.ReceivedAt = smsLog.ReceivedAt.Format("20060102150405")
+	}
+
+	if err := s.publishInboundSms(message); err != nil {
+		return fmt.Errorf("failed to publish inbound SMS: %v", err)
+	}
+
+	// Link the log entry to the SMPP user the message was routed to
+	updates := map[string]interface{}{
+		"smpp_sent": true,
+	}
+	var smppUser models.SmppUser
+	if err := database.GetDB().Where("system_id = ?", message.SystemID).First(&smppUser).Error; err == nil {
+		updates["smpp_user_id"] = smppUser.ID
+	}
+	if err := database.GetDB().Model(&models.SmsLog{}).Where("message_id = ?", smsLog.MessageID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update SMS log for inbound message %s: %v", smsLog.MessageID, err)
+	}
+
+	log.Printf("Inbound SMS %s routed to SMPP system %s by routing %d", smsLog.MessageID, message.SystemID, routing.ID)
+	return nil
+}
+
+// findRouting returns the highest priority active inbound routing matching the message.
+// Every criteria configured on a routing must match; criteria left empty match any message.
+func (s *InboundSmsService) findRouting(device models.Device, simNumber, text string) (*models.SmsRouting, error) {
+	var routings []models.SmsRouting
+	if err := database.GetDB().Where("is_active = ? AND direction = ?", true, "inbound").
+		Order("priority DESC").
+		Find(&routings).Error; err != nil {
+		return nil, fmt.Errorf("failed to load inbound routings: %v", err)
+	}
+
+	for i := range routings {
+		routing := &routings[i]
+
+		if routing.SystemID == nil || *routing.SystemID == "" {
+			log.Printf("Inbound routing %d has no system_id, skipping", routing.ID)
+			continue
+		}
+
+		if routing.SimNumber != nil && *routing.SimNumber != "" &&
+			normalizePhoneNumber(*routing.SimNumber) != normalizePhoneNumber(simNumber) {
+			continue
+		}
+
+		if routing.Keyword != nil && *routing.Keyword != "" {
+			fields := strings.Fields(text)
+			if len(fields) == 0 || !strings.EqualFold(fields[0], strings.TrimSpace(*routing.Keyword)) {
+				continue
+			}
+		}
+
+		if routing.DeviceGroupIDs != nil && *routing.DeviceGroupIDs != "" {
+			var deviceGroupIDs []uint
+			if err := json.Unmarshal([]byte(*routing.DeviceGroupIDs), &deviceGroupIDs); err != nil {
+				log.Printf("Error parsing device group IDs of routing %d: %v", routing.ID, err)
+				continue
+			}
+			if len(deviceGroupIDs) > 0 && !containsUint(deviceGroupIDs, device.DeviceGroupID) {
+				continue
+			}
+		}
+
+		return routing, nil
+	}
+
+	return nil, nil
+}
+
+// normalizePhoneNumber strips formatting characters so that numbers can be compared
+func normalizePhoneNumber(number string) string {
+	return strings.NewReplacer("+", "", " ", "", "-", "").Replace(strings.TrimSpace(number))
+}
+
+func containsUint(values []uint, value uint) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
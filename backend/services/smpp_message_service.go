@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+
+	"gorm.io/gorm"
+)
+
+// ErrSmppMessageWithdrawn is returned when an SMPP message was cancelled or already dispatched
+var ErrSmppMessageWithdrawn = errors.New("smpp message is no longer pending")
+
+// pendingSmppMessageStates are the states of messages not handed to a device yet.
+// The state lists are ints because GORM binds a []uint8 as a single binary value instead of expanding it for IN.
+var pendingSmppMessageStates = []int{models.SmppMessageStateScheduled, models.SmppMessageStateEnroute}
+
+// finalSmppMessageStates are the states a message does not leave anymore
+var finalSmppMessageStates = []int{
+	models.SmppMessageStateDelivered,
+	models.SmppMessageStateExpired,
+	models.SmppMessageStateDeleted,
+	models.SmppMessageStateUndeliverable,
+	models.SmppMessageStateRejected,
+}
+
+type SmppMessageService struct{}
+
+func NewSmppMessageService() *SmppMessageService {
+	return &SmppMessageService{}
+}
+
+// ClaimForDispatch marks a pending SMPP message as handed to a device and returns its current content.
+// Once claimed, cancel_sm and replace_sm fail for the message.
+// gorm.ErrRecordNotFound is returned for messages the SMPP server does not track.
+func (s *SmppMessageService) ClaimForDispatch(messageID string) (*models.SmppMessage, error) {
+	db := database.GetDB()
+
+	now := time.Now()
+	result := db.Model(&models.SmppMessage{}).
+		Where("message_id = ? AND dispatched_at IS NULL AND message_state IN ?", messageID, pendingSmppMessageStates).
+		Updates(map[string]interface{}{
+			"message_state": models.SmppMessageStateEnroute,
+			"dispatched_at": &now,
+			"updated_at":    now,
+		})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to claim smpp message: %v", result.Error)
+	}
+
+	var message models.SmppMessage
+	if err := db.Where("message_id = ?", messageID).First(&message).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to load smpp message: %v", err)
+	}
+
+	if result.RowsAffected == 0 {
+		return &message, ErrSmppMessageWithdrawn
+	}
+
+	return &message, nil
+}
+
+// GetMessage returns the stored state of an SMPP message without claiming it.
+// gorm.ErrRecordNotFound is returned for messages the SMPP server does not track.
+func (s *SmppMessageService) GetMessage(messageID string) (*models.SmppMessage, error) {
+	var message models.SmppMessage
+	if err := database.GetDB().Where("message_id = ?", messageID).First(&message).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to load smpp message: %v", err)
+	}
+	return &message, nil
+}
+
+// ExpireMessage moves an SMPP message and its segments to EXPIRED unless they already reached a final state,
+// so that query_sm reports the expiry even when no delivery report was requested
+func (s *SmppMessageService) ExpireMessage(messageID string) error {
+	now := time.Now()
+	if err := database.GetDB().Model(&models.SmppMessage{}).
+		Where("(message_id = ? OR parent_message_id = ?) AND message_state NOT IN ?", messageID, messageID, finalSmppMessageStates).
+		Updates(map[string]interface{}{
+			"message_state": models.SmppMessageStateExpired,
+			"final_date":    &now,
+			"updated_at":    now,
+		}).Error; err != nil {
+		return fmt.Errorf("failed to expire smpp message: %v", err)
+	}
+	return nil
+}
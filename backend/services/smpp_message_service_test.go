@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// useTestDB points the database package at an in-memory SQLite database with the given models migrated
+func useTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens its own database
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		sqlDB.Close()
+	})
+	return db
+}
+
+func TestClaimForDispatch(t *testing.T) {
+	db := useTestDB(t, &models.SmppMessage{})
+
+	for _, message := range []*models.SmppMessage{
+		{MessageID: "scheduled", SystemID: "esme", MessageState: 0},
+		{MessageID: "enroute", SystemID: "esme", MessageState: 1},
+		{MessageID: "deleted", SystemID: "esme", MessageState: 4},
+	} {
+		message.SubmitDate = time.Now()
+		if err := db.Create(message).Error; err != nil {
+			t.Fatal(err)
+		}
+		// A zero state is replaced by the column default on create
+		if err := db.Model(message).UpdateColumn("message_state", message.MessageState).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service := NewSmppMessageService()
+	for _, messageID := range []string{"scheduled", "enroute"} {
+		message, err := service.ClaimForDispatch(messageID)
+		if err != nil {
+			t.Fatalf("ClaimForDispatch(%s) error = %v", messageID, err)
+		}
+		if message.DispatchedAt == nil || message.MessageState != models.SmppMessageStateEnroute {
+			t.Errorf("ClaimForDispatch(%s) = state %d dispatched %v, want ENROUTE and dispatched", messageID, message.MessageState, message.DispatchedAt)
+		}
+
+		// A message is claimed once
+		if _, err := service.ClaimForDispatch(messageID); !errors.Is(err, ErrSmppMessageWithdrawn) {
+			t.Errorf("second ClaimForDispatch(%s) error = %v, want ErrSmppMessageWithdrawn", messageID, err)
+		}
+	}
+
+	if _, err := service.ClaimForDispatch("deleted"); !errors.Is(err, ErrSmppMessageWithdrawn) {
+		t.Errorf("ClaimForDispatch(deleted) error = %v, want ErrSmppMessageWithdrawn", err)
+	}
+	if _, err := service.ClaimForDispatch("unknown"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("ClaimForDispatch(unknown) error = %v, want gorm.ErrRecordNotFound", err)
+	}
+}
+
+func TestExpireMessage(t *testing.T) {
+	db := useTestDB(t, &models.SmppMessage{})
+
+	for _, message := range []*models.SmppMessage{
+		{MessageID: "parent", ParentMessageID: "parent", SystemID: "esme", MessageState: 1},
+		{MessageID: "segment", ParentMessageID: "parent", SystemID: "esme", MessageState: 1},
+		{MessageID: "delivered", ParentMessageID: "parent", SystemID: "esme", MessageState: 2},
+		{MessageID: "other", SystemID: "esme", MessageState: 1},
+	} {
+		message.SubmitDate = time.Now()
+		if err := db.Create(message).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := NewSmppMessageService().ExpireMessage("parent"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]uint8{"parent": 3, "segment": 3, "delivered": 2, "other": 1}
+	for messageID, state := range want {
+		message, err := NewSmppMessageService().GetMessage(messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.MessageState != state {
+			t.Errorf("message %s state = %d, want %d", messageID, message.MessageState, state)
+		}
+	}
+}
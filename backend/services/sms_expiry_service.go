@@ -0,0 +1,84 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"tsimsocketserver/database"
+	"tsimsocketserver/models"
+)
+
+// smsExpiryBatchSize limits the number of messages expired in one run
+const smsExpiryBatchSize = 500
+
+// SmsExpiryService expires SMPP messages that did not get a final delivery report within their validity period
+type SmsExpiryService struct {
+	deliveryReportService *DeliveryReportService
+}
+
+// NewSmsExpiryService creates a new SMS expiry service
+func NewSmsExpiryService(deliveryReportService *DeliveryReportService) *SmsExpiryService {
+	return &SmsExpiryService{
+		deliveryReportService: deliveryReportService,
+	}
+}
+
+// ExpireOverdueMessages marks sent SMPP messages whose validity period has ended as expired, refunds them and
+// sends an EXPIRED delivery report. A delivery report arriving from the device afterwards is ignored.
+func (s *SmsExpiryService) ExpireOverdueMessages() error {
+	db := database.GetDB()
+	now := time.Now()
+
+	var smsLogs []models.SmsLog
+	if err := db.Where("source_connector = ? AND direction = ? AND status IN ? AND expires_at IS NOT NULL AND expires_at <= ?",
+		"smpp", "outbound", []string{"pending", "queued", "sent"}, now).
+		Limit(smsExpiryBatchSize).
+		Find(&smsLogs).Error; err != nil {
+		return fmt.Errorf("failed to load overdue messages: %v", err)
+	}
+
+	errorCode := FormatErrorCode(NewErrorCodeService().Resolve(models.ErrorSourceRouter, models.RouterFailureExpired))
+
+	expired := 0
+	for _, smsLog := range smsLogs {
+		// Only expire the message if no delivery report changed its status meanwhile
+		result := db.Model(&models.SmsLog{}).
+			Where("id = ? AND status = ?", smsLog.ID, smsLog.Status).
+			Updates(map[string]interface{}{
+				"status":                      "expired",
+				"error_message":               "Validity period expired",
+				"error_code":                  errorCode,
+				"delivery_report_status":      "expired",
+				"delivery_report_received_at": &now,
+			})
+		if result.Error != nil {
+			log.Printf("Failed to expire SMS log for message %s: %v", smsLog.MessageID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		expired++
+		smsLog.ErrorCode = errorCode
+
+		if err := NewSmppMessageService().ExpireMessage(smsLog.MessageID); err != nil {
+			log.Printf("Failed to expire SMPP message %s: %v", smsLog.MessageID, err)
+		}
+
+		if err := NewBillingService().RefundMessage(smsLog.MessageID, "Validity period expired"); err != nil {
+			log.Printf("Failed to refund expired message %s: %v", smsLog.MessageID, err)
+		}
+
+		if s.deliveryReportService != nil {
+			if err := s.deliveryReportService.PublishDeliveryReport(smsLog, "expired"); err != nil {
+				log.Printf("Failed to publish expired delivery report for message %s: %v", smsLog.MessageID, err)
+			}
+		}
+	}
+
+	if expired > 0 {
+		log.Printf("Expired %d SMPP messages without delivery report", expired)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package types
+
+// InboundSmsMessage represents an SMS received by a device that is forwarded to an SMPP client
+type InboundSmsMessage struct {
+	MessageID       string `json:"message_id"`
+	SystemID        string `json:"system_id"`
+	SourceAddr      string `json:"source_addr"`      // Sender's phone number
+	DestinationAddr string `json:"destination_addr"` // Receiving SIM number
+	Message         string `json:"message"`
+	DeviceIMEI      string `json:"device_imei"`
+	SimSlot         int    `json:"sim_slot"`
+	RoutingID       uint   `json:"routing_id"`
+	ReceivedAt      string `json:"received_at"` // 20060102150405
+}
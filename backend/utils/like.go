@@ -0,0 +1,12 @@
+package utils
+
+import "strings"
+
+// likeEscaper escapes the wildcards of a LIKE pattern with !, which needs no quoting in MySQL and SQLite alike
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// LikePrefix returns a pattern matching the values that start with prefix, wildcards in prefix match themselves.
+// The pattern must be used with LIKE ? ESCAPE '!'.
+func LikePrefix(prefix string) string {
+	return likeEscaper.Replace(prefix) + "%"
+}
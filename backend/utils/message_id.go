@@ -2,10 +2,35 @@ package utils
 
 import (
 	"strconv"
-	"time"
+
+	"tsimcloud/shared/idgen"
 )
 
+// messageIDGenerator generates the message IDs of this instance, set up by InitMessageIDGenerator
+var messageIDGenerator *idgen.Generator
+
+// InitMessageIDGenerator sets the node ID used for message IDs of this instance. The node ID must be configured
+// and unique across all instances of the backend and the SMPP server.
+func InitMessageIDGenerator(nodeID int) error {
+	generator, err := idgen.NewGenerator(nodeID)
+	if err != nil {
+		return err
+	}
+
+	messageIDGenerator = generator
+	return nil
+}
+
+// NextMessageID returns the next numeric message ID. IDs never repeat for a node,
+// even if the wall clock moves backwards.
+func NextMessageID() uint64 {
+	if messageIDGenerator == nil {
+		panic("message ID generator used before InitMessageIDGenerator")
+	}
+	return messageIDGenerator.Next()
+}
+
 // GenerateMessageID generates a unique message ID
 func GenerateMessageID() string {
-	return "msg_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	return "msg_" + strconv.FormatUint(NextMessageID(), 10)
 }
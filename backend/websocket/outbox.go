@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+
+	"tsimsocketserver/models"
+)
+
+// smsOutboxes hold the send_sms commands waiting for each SIM of each device. A SIM takes one command at a time
+// and is held for its guard interval after each, so that the commands queued meanwhile leave highest priority
+// first, and in the order they were queued within a priority.
+type smsOutboxes struct {
+	mutex    sync.Mutex
+	outboxes map[string]*smsOutbox
+
+	write func(deviceID string, message models.WebSocketMessage) error
+	hold  func(deviceID string, simSlot int) time.Duration // How long a SIM is held after a command was written
+}
+
+// smsOutbox holds the send_sms commands of a SIM of a device
+type smsOutbox struct {
+	commands outboxCommands
+	sending  bool // A sender is draining the outbox
+	next     uint64
+}
+
+// outboxCommand is a send_sms command waiting in an outbox
+type outboxCommand struct {
+	message  models.WebSocketMessage
+	priority int
+	sequence uint64
+	result   chan error // Receives the write error once the command was written
+}
+
+// outboxCommands is a heap of commands, highest priority first
+type outboxCommands []outboxCommand
+
+func (c outboxCommands) Len() int { return len(c) }
+
+func (c outboxCommands) Less(i, j int) bool {
+	if c[i].priority != c[j].priority {
+		return c[i].priority > c[j].priority
+	}
+	return c[i].sequence < c[j].sequence
+}
+
+func (c outboxCommands) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c *outboxCommands) Push(x any) { *c = append(*c, x.(outboxCommand)) }
+
+func (c *outboxCommands) Pop() any {
+	old := *c
+	command := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return command
+}
+
+func newSmsOutboxes(write func(deviceID string, message models.WebSocketMessage) error, hold func(deviceID string, simSlot int) time.Duration) *smsOutboxes {
+	return &smsOutboxes{
+		outboxes: make(map[string]*smsOutbox),
+		write:    write,
+		hold:     hold,
+	}
+}
+
+// send puts a send_sms command into the outbox of a SIM of a device and waits until it was written to the device.
+// It returns the write error, so that a message is only acknowledged once the device has its command.
+func (o *smsOutboxes) send(deviceID string, simSlot int, message models.WebSocketMessage, priority int) error {
+	result := make(chan error, 1)
+	key := outboxKey(deviceID, simSlot)
+
+	o.mutex.Lock()
+	outbox, exists := o.outboxes[key]
+	if !exists {
+		outbox = &smsOutbox{}
+		o.outboxes[key] = outbox
+	}
+	heap.Push(&outbox.commands, outboxCommand{message: message, priority: priority, sequence: outbox.next, result: result})
+	outbox.next++
+
+	if !outbox.sending {
+		outbox.sending = true
+		go o.drain(key, deviceID, simSlot, outbox)
+	}
+	o.mutex.Unlock()
+
+	return <-result
+}
+
+// waiting returns the number of commands waiting in the outbox of a SIM of a device
+func (o *smsOutboxes) waiting(deviceID string, simSlot int) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	outbox, exists := o.outboxes[outboxKey(deviceID, simSlot)]
+	if !exists {
+		return 0
+	}
+	return outbox.commands.Len()
+}
+
+// drain writes the commands of an outbox to the device one at a time, holding the SIM after each,
+// until the outbox is empty
+func (o *smsOutboxes) drain(key, deviceID string, simSlot int, outbox *smsOutbox) {
+	for {
+		o.mutex.Lock()
+		if outbox.commands.Len() == 0 {
+			outbox.sending = false
+			delete(o.outboxes, key)
+			o.mutex.Unlock()
+			return
+		}
+		command := heap.Pop(&outbox.commands).(outboxCommand)
+		o.mutex.Unlock()
+
+		err := o.write(deviceID, command.message)
+		command.result <- err
+
+		// The device sends the SMS in the meantime, commands queued until then are ordered by priority
+		if err == nil {
+			if hold := o.hold(deviceID, simSlot); hold > 0 {
+				time.Sleep(hold)
+			}
+		}
+	}
+}
+
+// outboxKey identifies the outbox of a SIM of a device
+func outboxKey(deviceID string, simSlot int) string {
+	return fmt.Sprintf("%s/%d", deviceID, simSlot)
+}
+
+// smsGuardInterval returns how long a SIM of a connected device waits between two SMS
+func (ws *WebSocketServer) smsGuardInterval(deviceID string, simSlot int) time.Duration {
+	ws.mutex.RLock()
+	conn, exists := ws.connections[deviceID]
+	ws.mutex.RUnlock()
+	if !exists {
+		return 0
+	}
+
+	seconds := conn.Sim1GuardInterval
+	if simSlot == 2 {
+		seconds = conn.Sim2GuardInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,174 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"tsimsocketserver/models"
+)
+
+// recordWriter records the commands written to devices. The first write blocks until release is closed.
+type recordWriter struct {
+	mutex   sync.Mutex
+	written []string
+	release chan struct{}
+	err     error
+}
+
+func (w *recordWriter) write(deviceID string, message models.WebSocketMessage) error {
+	w.mutex.Lock()
+	first := len(w.written) == 0
+	w.written = append(w.written, message.Data.(models.SendSmsData).MessageID)
+	w.mutex.Unlock()
+
+	if first && w.release != nil {
+		<-w.release
+	}
+	return w.err
+}
+
+func (w *recordWriter) messageIDs() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string(nil), w.written...)
+}
+
+func noHold(deviceID string, simSlot int) time.Duration { return 0 }
+
+func smsCommand(messageID, priority string) models.WebSocketMessage {
+	return models.WebSocketMessage{Type: "send_sms", Data: models.SendSmsData{SimSlot: 1, MessageID: messageID, Priority: priority}}
+}
+
+// waitForWaiting waits until count commands wait in the outbox of a SIM
+func waitForWaiting(t *testing.T, outboxes *smsOutboxes, deviceID string, simSlot, count int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for outboxes.waiting(deviceID, simSlot) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiting commands, got %d", count, outboxes.waiting(deviceID, simSlot))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOutboxSendsHigherPrioritiesFirst(t *testing.T) {
+	writer := &recordWriter{release: make(chan struct{})}
+	outboxes := newSmsOutboxes(writer.write, noHold)
+
+	var wg sync.WaitGroup
+	send := func(messageID, priority string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := outboxes.send("device1", 1, smsCommand(messageID, priority), models.SmsPriorityLevel(priority)); err != nil {
+				t.Errorf("send %s: %v", messageID, err)
+			}
+		}()
+	}
+
+	// The first command holds the SIM while the others are queued
+	send("first", "low")
+	for len(writer.messageIDs()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	send("bulk1", "low")
+	waitForWaiting(t, outboxes, "device1", 1, 1)
+	send("normal", "normal")
+	waitForWaiting(t, outboxes, "device1", 1, 2)
+	send("otp", "urgent")
+	waitForWaiting(t, outboxes, "device1", 1, 3)
+	send("bulk2", "low")
+	waitForWaiting(t, outboxes, "device1", 1, 4)
+
+	close(writer.release)
+	wg.Wait()
+
+	expected := []string{"first", "otp", "normal", "bulk1", "bulk2"}
+	written := writer.messageIDs()
+	if len(written) != len(expected) {
+		t.Fatalf("expected %v to be written, got %v", expected, written)
+	}
+	for i := range expected {
+		if written[i] != expected[i] {
+			t.Fatalf("expected %v to be written, got %v", expected, written)
+		}
+	}
+}
+
+func TestOutboxReturnsOnlyOnceTheCommandWasWritten(t *testing.T) {
+	writer := &recordWriter{release: make(chan struct{})}
+	outboxes := newSmsOutboxes(writer.write, noHold)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- outboxes.send("device1", 1, smsCommand("m1", "normal"), 1)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("send returned before the command was written")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(writer.release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestOutboxReturnsWriteError(t *testing.T) {
+	writeErr := errors.New("device not connected")
+	writer := &recordWriter{err: writeErr}
+	outboxes := newSmsOutboxes(writer.write, noHold)
+
+	if err := outboxes.send("device1", 1, smsCommand("m1", "normal"), 1); !errors.Is(err, writeErr) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if waiting := outboxes.waiting("device1", 1); waiting != 0 {
+		t.Fatalf("expected an empty outbox, got %d waiting commands", waiting)
+	}
+}
+
+func TestOutboxHoldsTheSimBetweenCommands(t *testing.T) {
+	const hold = 30 * time.Millisecond
+	writer := &recordWriter{}
+	outboxes := newSmsOutboxes(writer.write, func(deviceID string, simSlot int) time.Duration { return hold })
+
+	start := time.Now()
+	if err := outboxes.send("device1", 1, smsCommand("m1", "normal"), 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := outboxes.send("device1", 1, smsCommand("m2", "normal"), 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < hold {
+		t.Fatalf("expected the second command to wait for the guard interval, it was written after %v", elapsed)
+	}
+
+	// Another SIM is not held by the first
+	start = time.Now()
+	if err := outboxes.send("device1", 2, smsCommand("m3", "normal"), 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= hold {
+		t.Fatalf("expected the other SIM to be free, its command was written after %v", elapsed)
+	}
+}
+
+func TestSmsGuardIntervalOfConnectedDevice(t *testing.T) {
+	ws := &WebSocketServer{connections: map[string]*models.DeviceConnection{
+		"device1": {DeviceID: "device1", Sim1GuardInterval: 1, Sim2GuardInterval: 3},
+	}}
+
+	if interval := ws.smsGuardInterval("device1", 1); interval != time.Second {
+		t.Fatalf("expected 1s for SIM 1, got %v", interval)
+	}
+	if interval := ws.smsGuardInterval("device1", 2); interval != 3*time.Second {
+		t.Fatalf("expected 3s for SIM 2, got %v", interval)
+	}
+	if interval := ws.smsGuardInterval("unknown", 1); interval != 0 {
+		t.Fatalf("expected no hold for a device that is not connected, got %v", interval)
+	}
+}
@@ -26,6 +26,7 @@ type WebSocketServer struct {
 	frontendConns map[string]*websocket.Conn
 	mutex         sync.RWMutex
 	connMutexes   map[string]*sync.Mutex // Mutex for each connection
+	outboxes      *smsOutboxes           // SMS commands waiting for each SIM of each device
 	cfg           *config.Config
 	redisService  *redis.RedisService
 	serverID      string // Unique server instance ID
@@ -46,6 +47,7 @@ func NewWebSocketServer(cfg *config.Config) *WebSocketServer {
 		cfg:           cfg,
 		serverID:      serverID,
 	}
+	ws.outboxes = newSmsOutboxes(ws.sendToDevice, ws.smsGuardInterval)
 
 	// Initialize Redis service if available
 	if redisService, err := redis.NewRedisService(cfg.Redis.URL); err == nil {
@@ -226,6 +228,9 @@ func (ws *WebSocketServer) handleAndroidConnection(conn *websocket.Conn) {
 		CountrySite: deviceGroup.CountrySite,
 		Conn:        conn,
 		IsHandicap:  false, // All devices use same authentication now
+
+		Sim1GuardInterval: deviceGroup.Sim1GuardInterval,
+		Sim2GuardInterval: deviceGroup.Sim2GuardInterval,
 	}
 	ws.mutex.Unlock()
 
@@ -736,7 +741,8 @@ func (ws *WebSocketServer) handleMessage(deviceID string, message models.WebSock
 	log.Printf("=========================")
 }
 
-func (ws *WebSocketServer) sendToDevice(deviceID string, message models.WebSocketMessage) {
+// sendToDevice writes a message to the connection of a device and returns the write error
+func (ws *WebSocketServer) sendToDevice(deviceID string, message models.WebSocketMessage) error {
 	log.Printf("=== SENDING MESSAGE TO DEVICE ===")
 	log.Printf("Device ID: %s", deviceID)
 	log.Printf("Message Type: %s", message.Type)
@@ -775,13 +781,14 @@ func (ws *WebSocketServer) sendToDevice(deviceID string, message models.WebSocke
 	ws.mutex.RUnlock()
 
 	if frontendExists {
-		if err := frontendConn.WriteJSON(message); err != nil {
+		err := frontendConn.WriteJSON(message)
+		if err != nil {
 			log.Printf("ERROR: Failed to send message to frontend %s: %v", deviceID, err)
 		} else {
 			log.Printf("Message sent successfully to frontend: %s", deviceID)
 		}
 		log.Printf("=== MESSAGE SEND COMPLETED ===")
-		return
+		return err
 	}
 
 	// Then check if it's a device connection
@@ -789,21 +796,25 @@ func (ws *WebSocketServer) sendToDevice(deviceID string, message models.WebSocke
 	conn, exists := ws.connections[deviceID]
 	ws.mutex.RUnlock()
 
+	var err error
 	if exists {
 		if wsConn, ok := conn.Conn.(*websocket.Conn); ok {
-			if err := wsConn.WriteJSON(message); err != nil {
+			if err = wsConn.WriteJSON(message); err != nil {
 				log.Printf("ERROR: Failed to send message to device %s: %v", deviceID, err)
 			} else {
 				log.Printf("Message sent successfully to device: %s", deviceID)
 			}
 		} else {
+			err = fmt.Errorf("invalid connection type for device %s", deviceID)
 			log.Printf("ERROR: Invalid connection type for device %s", deviceID)
 		}
 	} else {
+		err = fmt.Errorf("device %s not found in local connections", deviceID)
 		log.Printf("ERROR: Device %s not found in local connections", deviceID)
 	}
 
 	log.Printf("=== MESSAGE SEND COMPLETED ===")
+	return err
 }
 
 // BroadcastMessage is a public method to broadcast messages to frontend clients
@@ -896,7 +907,8 @@ func (ws *WebSocketServer) getDefaultDeviceSettings() models.DeviceSettings {
 	}
 }
 
-// SendSms sends SMS command to device
+// SendSms sends an SMS command to a device and returns once it was written. Commands wait in the outbox of the SIM
+// while it is busy with earlier ones, higher priorities first.
 func (ws *WebSocketServer) SendSms(deviceID string, data models.SendSmsData) error {
 	log.Printf("=== SENDING SMS COMMAND ===")
 	log.Printf("Device ID: %s", deviceID)
@@ -912,7 +924,9 @@ func (ws *WebSocketServer) SendSms(deviceID string, data models.SendSmsData) err
 		Timestamp: time.Now().UnixMilli(),
 	}
 
-	ws.sendToDevice(deviceID, message)
+	if err := ws.outboxes.send(deviceID, data.SimSlot, message, models.SmsPriorityLevel(data.Priority)); err != nil {
+		return err
+	}
 	log.Printf("=== SMS COMMAND COMPLETED ===")
 	return nil
 }
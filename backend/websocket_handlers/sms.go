@@ -15,12 +15,18 @@ import (
 // Global service instances
 var deliveryReportService *services.DeliveryReportService
 var smsMonitoringService *services.SmsMonitoringService
+var inboundSmsService *services.InboundSmsService
 
 // SetDeliveryReportService sets the global delivery report service
 func SetDeliveryReportService(service *services.DeliveryReportService) {
 	deliveryReportService = service
 }
 
+// SetInboundSmsService sets the global inbound SMS service
+func SetInboundSmsService(service *services.InboundSmsService) {
+	inboundSmsService = service
+}
+
 // SetSmsMonitoringService sets the global SMS monitoring service
 func SetSmsMonitoringService(service *services.SmsMonitoringService) {
 	smsMonitoringService = service
@@ -32,8 +38,9 @@ func HandleSmsLog(wsServer interfaces.WebSocketServerInterface, deviceID string,
 
 	// Update SMS log in database
 	var smsLog models.SmsLog
+	// Messages expired at the end of their validity period keep their final status
 	if err := database.GetDB().Where("device_id = ? AND destination_addr = ? AND message = ?",
-		deviceID, data.PhoneNumber, data.Message).Order("created_at DESC").First(&smsLog).Error; err == nil {
+		deviceID, data.PhoneNumber, data.Message).Order("created_at DESC").First(&smsLog).Error; err == nil && smsLog.Status != "expired" {
 
 		now := time.Now()
 		updates := map[string]interface{}{
@@ -49,10 +56,24 @@ func HandleSmsLog(wsServer interfaces.WebSocketServerInterface, deviceID string,
 			updates["delivery_report_status"] = "delivered"
 		case "failed":
 			updates["error_message"] = "SMS sending failed"
+			updates["error_code"] = services.FormatErrorCode(services.NewErrorCodeService().ResolveDeviceFailure(data.Status, data.ResultCode))
 		}
 
 		database.GetDB().Model(&smsLog).Updates(updates)
 
+		// A message the device handed to the network is ACCEPTED, reported to SMPP clients asking for intermediate notifications
+		if data.Status == "sent" && deliveryReportService != nil {
+			if err := deliveryReportService.PublishDeliveryReport(smsLog, data.Status); err != nil {
+				log.Printf("Failed to publish intermediate notification for message %s: %v", smsLog.MessageID, err)
+			}
+		}
+
+		if data.Status == "failed" && smsLog.SourceConnector != nil && *smsLog.SourceConnector == "smpp" {
+			if err := services.NewBillingService().RefundMessage(smsLog.MessageID, "SMS sending failed"); err != nil {
+				log.Printf("Failed to refund message %s: %v", smsLog.MessageID, err)
+			}
+		}
+
 		// Trigger SMS delivery monitoring after updating status
 		if smsMonitoringService != nil {
 			go func() {
@@ -136,6 +157,13 @@ func HandleSmsMessage(wsServer interfaces.WebSocketServerInterface, deviceID str
 			log.Printf("Error creating inbound SMS log: %v", err)
 		} else {
 			log.Printf("Inbound SMS logged successfully: %s from %s to device %s", messageID, data.PhoneNumber, deviceID)
+
+			// Forward to SMPP clients according to inbound routings
+			if inboundSmsService != nil {
+				if err := inboundSmsService.RouteInboundSms(smsLog, device); err != nil {
+					log.Printf("Failed to route inbound SMS %s: %v", messageID, err)
+				}
+			}
 		}
 	}
 
@@ -153,7 +181,11 @@ func HandleSmsDeliveryReport(wsServer interfaces.WebSocketServerInterface, devic
 
 	// Update SMS log in database
 	var smsLog models.SmsLog
-	if err := database.GetDB().Where("message_id = ?", data.MessageID).First(&smsLog).Error; err == nil {
+	err := database.GetDB().Where("message_id = ?", data.MessageID).First(&smsLog).Error
+	if err == nil && smsLog.Status == "expired" {
+		// The validity period ended before the device reported, the expiry was already reported to the client
+		log.Printf("Ignoring delivery report for expired message: %s", data.MessageID)
+	} else if err == nil {
 		now := time.Now()
 		updates := map[string]interface{}{
 			"delivery_report_status":      data.Status,
@@ -169,6 +201,12 @@ func HandleSmsDeliveryReport(wsServer interfaces.WebSocketServerInterface, devic
 		case "failed", "undelivered", "expired", "rejected":
 			updates["status"] = "failed"
 			updates["error_message"] = fmt.Sprintf("Delivery %s", data.Status)
+
+			// A send failure recorded from the SMS log is more specific than a report without result code
+			if data.ResultCode != nil || smsLog.ErrorCode == nil {
+				smsLog.ErrorCode = services.FormatErrorCode(services.NewErrorCodeService().ResolveDeviceFailure(data.Status, data.ResultCode))
+				updates["error_code"] = smsLog.ErrorCode
+			}
 			log.Printf("SMS delivery failed: %s - Status: %s", data.MessageID, data.Status)
 		default:
 			// For unknown statuses, keep current status but update delivery report info
@@ -182,6 +220,13 @@ func HandleSmsDeliveryReport(wsServer interfaces.WebSocketServerInterface, devic
 			log.Printf("Updated SMS log %s with delivery report status: %s", data.MessageID, data.Status)
 		}
 
+		// Failed deliveries of SMPP messages are refunded
+		if updates["status"] == "failed" && smsLog.SourceConnector != nil && *smsLog.SourceConnector == "smpp" {
+			if err := services.NewBillingService().RefundMessage(data.MessageID, fmt.Sprintf("Delivery %s", data.Status)); err != nil {
+				log.Printf("Failed to refund message %s: %v", data.MessageID, err)
+			}
+		}
+
 		// Publish delivery report to SMPP server if this is an SMPP message and delivery report service is available
 		if deliveryReportService != nil && smsLog.SourceConnector != nil && *smsLog.SourceConnector == "smpp" {
 			if err := deliveryReportService.PublishDeliveryReport(smsLog, data.Status); err != nil {
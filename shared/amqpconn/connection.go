@@ -0,0 +1,261 @@
+// Package amqpconn keeps a RabbitMQ connection up, reconnecting with backoff whenever it is lost,
+// and starts the registered consumers again on every new channel.
+package amqpconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Backoff between reconnection attempts, doubled after every failed attempt
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+)
+
+// ErrNacked is returned when the broker refuses a published message
+var ErrNacked = errors.New("message not confirmed by RabbitMQ")
+
+// State describes the RabbitMQ connection for health checks
+type State struct {
+	Connected  bool      `json:"connected"`
+	Since      time.Time `json:"since"` // When the connection was established or lost
+	LastError  string    `json:"last_error,omitempty"`
+	Reconnects int       `json:"reconnects"` // Connections established after the first one
+}
+
+// Setup opens the channel of a new connection and declares the exchanges and queues used on it
+type Setup func(conn *amqp.Connection) (*amqp.Channel, error)
+
+// consumer is a queue consumer started on every new channel
+type consumer struct {
+	name  string
+	start func(ch *amqp.Channel) error
+}
+
+// Connection is a RabbitMQ connection that is established again whenever it or its channel closes
+type Connection struct {
+	url       string
+	setup     Setup
+	mutex     sync.RWMutex // Guards conn, channel, state, consumers and closed, which change on reconnection
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	state     State
+	consumers []consumer // Started again on every new channel
+	closed    bool
+	done      chan struct{} // Closed by Close to stop the supervisor
+}
+
+// New returns a connection that sets up every new channel with setup
+func New(setup Setup) *Connection {
+	return &Connection{setup: setup, done: make(chan struct{})}
+}
+
+// Connect connects to RabbitMQ and keeps the connection up in the background.
+// When the broker is not reachable the error of the first attempt is returned and the connection is made later.
+func (c *Connection) Connect(url string) error {
+	c.url = url
+	err := c.connect()
+	go c.supervise()
+	return err
+}
+
+// connect dials RabbitMQ, sets up a channel and starts the registered consumers on it
+func (c *Connection) connect() error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		c.setDisconnected(err)
+		return fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+
+	ch, err := c.setup(conn)
+	if err != nil {
+		conn.Close()
+		c.setDisconnected(err)
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Close may have run while connecting, the connection would then never be closed
+	if c.closed {
+		conn.Close()
+		return amqp.ErrClosed
+	}
+	if c.conn != nil {
+		c.state.Reconnects++
+	}
+	c.conn = conn
+	c.channel = ch
+	c.state.Connected = true
+	c.state.Since = time.Now()
+	c.state.LastError = ""
+	log.Printf("Connected to RabbitMQ")
+
+	// Consumers are started under the lock so that one registered meanwhile is not started twice
+	for _, consumer := range c.consumers {
+		if err := consumer.start(ch); err != nil {
+			log.Printf("Failed to start %s: %v", consumer.name, err)
+		}
+	}
+	return nil
+}
+
+// supervise reconnects with exponential backoff whenever the connection or its channel closes
+func (c *Connection) supervise() {
+	for !c.isClosed() {
+		c.mutex.RLock()
+		conn, ch := c.conn, c.channel
+		c.mutex.RUnlock()
+
+		if conn != nil && !conn.IsClosed() {
+			var reason *amqp.Error
+			select {
+			case reason = <-conn.NotifyClose(make(chan *amqp.Error, 1)):
+			case reason = <-ch.NotifyClose(make(chan *amqp.Error, 1)):
+				// A channel error leaves the connection open, start over with a new one
+				conn.Close()
+			case <-c.done:
+				return
+			}
+			if c.isClosed() {
+				return
+			}
+			var err error = amqp.ErrClosed
+			if reason != nil {
+				err = reason
+			}
+			c.setDisconnected(err)
+			log.Printf("RabbitMQ connection lost: %v", err)
+		}
+
+		backoff := reconnectMinBackoff
+		for !c.isClosed() {
+			err := c.connect()
+			if err == nil {
+				break
+			}
+			log.Printf("Reconnecting to RabbitMQ in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-c.done:
+				return
+			}
+			backoff = min(backoff*2, reconnectMaxBackoff)
+		}
+	}
+}
+
+// AddConsumer registers a consumer and starts it when RabbitMQ is connected.
+// Registered consumers are started again after every reconnection.
+func (c *Connection) AddConsumer(name string, start func(ch *amqp.Channel) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.consumers = append(c.consumers, consumer{name: name, start: start})
+
+	if !c.state.Connected {
+		log.Printf("RabbitMQ not connected, %s starts once it is", name)
+		return nil
+	}
+	return start(c.channel)
+}
+
+// setDisconnected records a lost connection or a failed connection attempt
+func (c *Connection) setDisconnected(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state.Connected || c.state.Since.IsZero() {
+		c.state.Since = time.Now()
+	}
+	c.state.Connected = false
+	c.state.LastError = err.Error()
+}
+
+// isClosed reports whether Close was called
+func (c *Connection) isClosed() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.closed
+}
+
+// Channel returns the channel of the current connection, nil before the first connection
+func (c *Connection) Channel() *amqp.Channel {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.channel
+}
+
+// Conn returns the current connection, nil before the first connection
+func (c *Connection) Conn() *amqp.Connection {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.conn
+}
+
+// IsConnected reports whether messages can be published
+func (c *Connection) IsConnected() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.state.Connected && c.channel != nil && !c.channel.IsClosed()
+}
+
+// State returns the state of the RabbitMQ connection
+func (c *Connection) State() State {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.state
+}
+
+// Close stops reconnecting and closes the connection
+func (c *Connection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	c.state.Connected = false
+	if c.channel != nil {
+		if err := c.channel.Close(); err != nil && err != amqp.ErrClosed {
+			return fmt.Errorf("failed to close channel: %v", err)
+		}
+	}
+	if c.conn != nil {
+		if err := c.conn.Close(); err != nil && err != amqp.ErrClosed {
+			return fmt.Errorf("failed to close connection: %v", err)
+		}
+	}
+	return nil
+}
+
+// PublishConfirmed publishes a message on a channel in confirm mode and waits up to timeout for the broker confirm.
+// ErrNacked is returned when the broker refuses the message.
+func PublishConfirmed(ch *amqp.Channel, exchange, key string, msg amqp.Publishing, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		// Pending confirms are released unacknowledged when the channel closes
+		if ch.IsClosed() {
+			return amqp.ErrClosed
+		}
+		return ErrNacked
+	}
+	return nil
+}
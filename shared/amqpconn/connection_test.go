@@ -0,0 +1,269 @@
+package amqpconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker accepts AMQP connections and answers just enough of the handshake to open connections and channels
+type fakeBroker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+	nack     bool // Refuse published messages
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		b.dropConnections()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mutex.Lock()
+			b.conns = append(b.conns, conn)
+			b.mutex.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "amqp://guest:guest@" + b.listener.Addr().String() + "/"
+}
+
+// dropConnections closes every connection accepted so far, as a broker restart would
+func (b *fakeBroker) dropConnections() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+// serve answers the method frames of one client connection
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	// connection.start: version 0-9, no server properties, PLAIN authentication
+	writeMethod(conn, 0, 10, 10, []byte{0, 9}, uint32Bytes(0), longString("PLAIN"), longString("en_US"))
+
+	var deliveryTag uint64
+	for {
+		frameHeader := make([]byte, 7)
+		if _, err := io.ReadFull(conn, frameHeader); err != nil {
+			return
+		}
+		channel := binary.BigEndian.Uint16(frameHeader[1:3])
+		payload := make([]byte, binary.BigEndian.Uint32(frameHeader[3:7])+1)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		if frameHeader[0] != 1 {
+			continue // Heartbeats
+		}
+
+		switch method := [2]uint16{binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])}; method {
+		case [2]uint16{10, 11}: // connection.start-ok, answered with connection.tune
+			writeMethod(conn, 0, 10, 30, uint16Bytes(0), uint32Bytes(131072), uint16Bytes(0))
+		case [2]uint16{10, 40}: // connection.open
+			writeMethod(conn, 0, 10, 41, []byte{0})
+		case [2]uint16{10, 50}: // connection.close
+			writeMethod(conn, 0, 10, 51)
+			return
+		case [2]uint16{20, 10}: // channel.open
+			writeMethod(conn, channel, 20, 11, uint32Bytes(0))
+		case [2]uint16{20, 40}: // channel.close
+			writeMethod(conn, channel, 20, 41)
+		case [2]uint16{85, 10}: // confirm.select
+			writeMethod(conn, channel, 85, 11)
+		case [2]uint16{60, 40}: // basic.publish, confirmed before its content arrives
+			deliveryTag++
+			if b.nack {
+				writeMethod(conn, channel, 60, 120, binary.BigEndian.AppendUint64(nil, deliveryTag), []byte{0})
+			} else {
+				writeMethod(conn, channel, 60, 80, binary.BigEndian.AppendUint64(nil, deliveryTag), []byte{0})
+			}
+		}
+	}
+}
+
+func writeMethod(w io.Writer, channel, classID, methodID uint16, arguments ...[]byte) {
+	payload := append(uint16Bytes(classID), uint16Bytes(methodID)...)
+	payload = append(payload, bytes.Join(arguments, nil)...)
+
+	frame := append([]byte{1}, uint16Bytes(channel)...)
+	frame = append(frame, uint32Bytes(uint32(len(payload)))...)
+	frame = append(frame, payload...)
+	w.Write(append(frame, 0xCE))
+}
+
+func uint16Bytes(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func uint32Bytes(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func longString(s string) []byte {
+	return append(uint32Bytes(uint32(len(s))), s...)
+}
+
+func openChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	return conn.Channel()
+}
+
+// waitFor polls condition until it holds or the test times out
+func waitFor(t *testing.T, condition func() bool, description string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectStartsConsumersAgainAfterReconnecting(t *testing.T) {
+	broker := newFakeBroker(t)
+	c := New(openChannel)
+	t.Cleanup(func() { c.Close() })
+
+	var mutex sync.Mutex
+	started := 0
+	if err := c.AddConsumer("test consumer", func(ch *amqp.Channel) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		started++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Connect(broker.url()); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsConnected() {
+		t.Fatal("not connected after Connect")
+	}
+
+	broker.dropConnections()
+	waitFor(t, func() bool { return c.State().Reconnects == 1 && c.IsConnected() }, "reconnected")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if started != 2 {
+		t.Errorf("consumer started %d times, want once per connection", started)
+	}
+}
+
+func TestConnectRecordsFailedAttempts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	c := New(openChannel)
+	if err := c.Connect("amqp://guest:guest@" + addr + "/"); err == nil {
+		t.Fatal("Connect to a closed port succeeded")
+	}
+	state := c.State()
+	if state.Connected || state.LastError == "" || state.Since.IsZero() {
+		t.Errorf("state = %+v, want disconnected with the error", state)
+	}
+
+	// Close interrupts the backoff of the supervisor
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectAfterCloseClosesTheNewConnection(t *testing.T) {
+	broker := newFakeBroker(t)
+
+	settingUp := make(chan *amqp.Connection)
+	closed := make(chan struct{})
+	c := New(func(conn *amqp.Connection) (*amqp.Channel, error) {
+		settingUp <- conn
+		<-closed
+		return conn.Channel()
+	})
+	c.url = broker.url()
+
+	connected := make(chan error)
+	go func() { connected <- c.connect() }()
+
+	// Close runs while the connection is being set up
+	conn := <-settingUp
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(closed)
+
+	if err := <-connected; err != amqp.ErrClosed {
+		t.Errorf("connect error = %v, want amqp.ErrClosed", err)
+	}
+	if !conn.IsClosed() {
+		t.Error("connection made after Close was left open")
+	}
+	if c.Conn() != nil || c.IsConnected() {
+		t.Error("connection made after Close was installed")
+	}
+}
+
+func TestPublishConfirmedWaitsForBrokerConfirm(t *testing.T) {
+	for _, nack := range []bool{false, true} {
+		broker := newFakeBroker(t)
+		broker.nack = nack
+
+		conn, err := amqp.Dial(broker.url())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.Confirm(false); err != nil {
+			t.Fatal(err)
+		}
+
+		err = PublishConfirmed(ch, "", "queue", amqp.Publishing{Body: []byte("message")}, time.Second)
+		if nack && err != ErrNacked {
+			t.Errorf("PublishConfirmed of a refused message error = %v, want ErrNacked", err)
+		}
+		if !nack && err != nil {
+			t.Errorf("PublishConfirmed error = %v", err)
+		}
+	}
+}
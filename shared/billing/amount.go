@@ -0,0 +1,54 @@
+// Package billing holds the balance arithmetic and ledger helpers shared by the backend and the SMPP server,
+// so that both read and write prepaid balances, rates and ledger entries the same way.
+package billing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AmountScale is the number of ten-thousandths in one currency unit, amounts are kept with 4 decimals
+const AmountScale = 10000
+
+// ParseAmount parses a decimal amount into ten-thousandths of a currency unit
+func ParseAmount(value string) (int64, error) {
+	text := strings.TrimSpace(value)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+
+	whole, fraction, _ := strings.Cut(text, ".")
+	fraction = strings.TrimRight(fraction, "0")
+	if !IsDigits(whole) || whole == "" || !IsDigits(fraction) || len(fraction) > 4 {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+
+	amount, err := strconv.ParseInt(whole+(fraction + "0000")[:4], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// FormatAmount formats ten-thousandths of a currency unit as a decimal amount
+func FormatAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%04d", sign, amount/AmountScale, amount%AmountScale)
+}
+
+// IsDigits reports whether text only holds decimal digits
+func IsDigits(text string) bool {
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
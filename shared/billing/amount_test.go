@@ -0,0 +1,70 @@
+package billing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"0", 0},
+		{"1", 10000},
+		{"0.05", 500},
+		{" 12.3400 ", 123400},
+		{"-1.5", -15000},
+		{"0.0001", 1},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", ".5", "1.00001", "1e3", "abc", "1,5", "--1"} {
+		if got, err := ParseAmount(value); err == nil {
+			t.Errorf("ParseAmount(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount int64
+		want   string
+	}{
+		{0, "0.0000"},
+		{1, "0.0001"},
+		{123400, "12.3400"},
+		{-15000, "-1.5000"},
+	}
+	for _, tt := range tests {
+		if got := FormatAmount(tt.amount); got != tt.want {
+			t.Errorf("FormatAmount(%d) = %q, want %q", tt.amount, got, tt.want)
+		}
+		if parsed, err := ParseAmount(tt.want); err != nil || parsed != tt.amount {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", tt.want, parsed, err, tt.amount)
+		}
+	}
+}
+
+func TestIsDuplicateEntry(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'x' for key 'idx_smpp_balance_message_type'"}
+	if !IsDuplicateEntry(duplicate) {
+		t.Error("IsDuplicateEntry(ER_DUP_ENTRY) = false")
+	}
+	if !IsDuplicateEntry(fmt.Errorf("failed to record refund: %w", duplicate)) {
+		t.Error("IsDuplicateEntry(wrapped ER_DUP_ENTRY) = false")
+	}
+	if IsDuplicateEntry(&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}) {
+		t.Error("IsDuplicateEntry(deadlock) = true")
+	}
+	if IsDuplicateEntry(fmt.Errorf("Duplicate entry 'x'")) {
+		t.Error("IsDuplicateEntry of a non MySQL error = true")
+	}
+}
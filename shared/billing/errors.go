@@ -0,0 +1,17 @@
+package billing
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlDuplicateEntry is the MySQL error number of a unique index violation (ER_DUP_ENTRY)
+const mysqlDuplicateEntry = 1062
+
+// IsDuplicateEntry reports whether err is a MySQL unique index violation,
+// which the ledger raises when a message is charged or refunded a second time
+func IsDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
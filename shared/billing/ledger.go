@@ -0,0 +1,183 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInsufficientBalance is returned when the prepaid balance or SMS count of a user cannot pay for a message
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// Types of balance ledger entries
+const (
+	LedgerTopUp  = "top_up"
+	LedgerCharge = "charge"
+	LedgerRefund = "refund"
+)
+
+// Transaction is an entry of the balance ledger of an SMPP user.
+// Charges are recorded by the SMPP server when a message is accepted, refunds when it is not sent after all.
+// Charges and refunds refer to the message they were made for, a message is charged and refunded at most once.
+type Transaction struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	SmppUserID  uint      `json:"smpp_user_id" gorm:"not null;index"`
+	SystemID    string    `json:"system_id" gorm:"not null;size:50;index"`
+	Type        string    `json:"type" gorm:"not null;size:20;uniqueIndex:idx_smpp_balance_message_type"`
+	MessageID   *string   `json:"message_id" gorm:"size:64;uniqueIndex:idx_smpp_balance_message_type"`
+	Amount      string    `json:"amount" gorm:"type:decimal(20,4);not null;default:0"`
+	SmsCount    int       `json:"sms_count" gorm:"not null;default:0"`
+	Segments    int       `json:"segments" gorm:"not null;default:0"`
+	Rate        string    `json:"rate" gorm:"type:decimal(20,4);not null;default:0"`
+	Description string    `json:"description" gorm:"size:255"`
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
+}
+
+// TableName specifies the table name for Transaction
+func (Transaction) TableName() string {
+	return "smpp_balance_transactions"
+}
+
+// RefundMessage gives back the charge of a single message or segment to the balance and SMS count of its user
+// and records it in the ledger. It returns the refund entry, or nil when the message was not charged or was
+// already refunded, so that refunding twice is harmless.
+func RefundMessage(db *gorm.DB, messageID, reason string) (*Transaction, error) {
+	var refund *Transaction
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var charge Transaction
+		if err := tx.Where("message_id = ? AND type = ?", messageID, LedgerCharge).First(&charge).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return fmt.Errorf("failed to load charge of message %s: %v", messageID, err)
+		}
+
+		amount, err := ParseAmount(charge.Amount)
+		if err != nil {
+			return fmt.Errorf("invalid charge of message %s: %v", messageID, err)
+		}
+
+		// A refund recorded concurrently is caught by the unique index on message and type
+		var refunded int64
+		tx.Model(&Transaction{}).Where("message_id = ? AND type = ?", messageID, LedgerRefund).Count(&refunded)
+		if refunded > 0 {
+			return nil
+		}
+		entry := &Transaction{
+			SmppUserID:  charge.SmppUserID,
+			SystemID:    charge.SystemID,
+			Type:        LedgerRefund,
+			MessageID:   &messageID,
+			Amount:      FormatAmount(-amount),
+			SmsCount:    -charge.SmsCount,
+			Segments:    charge.Segments,
+			Rate:        charge.Rate,
+			Description: reason,
+			CreatedAt:   time.Now(),
+		}
+		if err := tx.Create(entry).Error; err != nil {
+			if IsDuplicateEntry(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to record refund of message %s: %v", messageID, err)
+		}
+
+		updates := map[string]interface{}{}
+		if amount != 0 {
+			updates["mt_balance"] = gorm.Expr("CAST(CAST(mt_balance AS DECIMAL(20,4)) + CAST(? AS DECIMAL(20,4)) AS CHAR)", FormatAmount(-amount))
+		}
+		if charge.SmsCount != 0 {
+			updates["mt_sms_count"] = gorm.Expr("CAST(CAST(mt_sms_count AS SIGNED) + ? AS CHAR)", -charge.SmsCount)
+		}
+		if len(updates) > 0 {
+			if err := tx.Table("smpp_users").Where("id = ?", charge.SmppUserID).Updates(updates).Error; err != nil {
+				return fmt.Errorf("failed to refund balance: %v", err)
+			}
+		}
+
+		refund = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// RepriceMessage changes the charge of a message to a new number of segments at the rate it was charged with,
+// reserving or giving back the difference. A balance or SMS count is only touched when the charge took from it.
+// It returns ErrInsufficientBalance when the balance cannot cover the extra segments. Messages that were not
+// charged or were refunded already keep their ledger as it is. Run it in the transaction that changes the message.
+func RepriceMessage(tx *gorm.DB, messageID string, segments int) error {
+	var charge Transaction
+	if err := tx.Where("message_id = ? AND type = ?", messageID, LedgerCharge).First(&charge).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load charge of message %s: %v", messageID, err)
+	}
+	if charge.Segments == segments {
+		return nil
+	}
+
+	var refunded int64
+	if err := tx.Model(&Transaction{}).Where("message_id = ? AND type = ?", messageID, LedgerRefund).Count(&refunded).Error; err != nil {
+		return fmt.Errorf("failed to load refund of message %s: %v", messageID, err)
+	}
+	if refunded > 0 {
+		return nil
+	}
+
+	rate, err := ParseAmount(charge.Rate)
+	if err != nil {
+		return fmt.Errorf("invalid rate of message %s: %v", messageID, err)
+	}
+	amount, err := ParseAmount(charge.Amount)
+	if err != nil {
+		return fmt.Errorf("invalid charge of message %s: %v", messageID, err)
+	}
+	limitBalance := amount != 0
+	limitSmsCount := charge.SmsCount != 0
+	extraSegments := segments - charge.Segments
+
+	if limitBalance || limitSmsCount {
+		query := tx.Table("smpp_users").Where("id = ?", charge.SmppUserID)
+		updates := map[string]interface{}{}
+		if limitBalance {
+			extraAmount := FormatAmount(rate * int64(extraSegments))
+			if extraSegments > 0 {
+				query = query.Where("CAST(mt_balance AS DECIMAL(20,4)) >= CAST(? AS DECIMAL(20,4))", extraAmount)
+			}
+			updates["mt_balance"] = gorm.Expr("CAST(CAST(mt_balance AS DECIMAL(20,4)) - CAST(? AS DECIMAL(20,4)) AS CHAR)", extraAmount)
+		}
+		if limitSmsCount {
+			if extraSegments > 0 {
+				query = query.Where("CAST(mt_sms_count AS SIGNED) >= ?", extraSegments)
+			}
+			updates["mt_sms_count"] = gorm.Expr("CAST(CAST(mt_sms_count AS SIGNED) - ? AS CHAR)", extraSegments)
+		}
+
+		result := query.Updates(updates)
+		if result.Error != nil {
+			return fmt.Errorf("failed to reprice message %s: %v", messageID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrInsufficientBalance
+		}
+	}
+
+	// The charge keeps recording what the message holds, so that a later refund gives back the right amount
+	updates := map[string]interface{}{"segments": segments}
+	if limitBalance {
+		updates["amount"] = FormatAmount(-rate * int64(segments))
+	}
+	if limitSmsCount {
+		updates["sms_count"] = -segments
+	}
+	if err := tx.Model(&Transaction{}).Where("id = ?", charge.ID).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to record new charge of message %s: %v", messageID, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// testUser holds the balance columns of smpp_users that refunds update
+type testUser struct {
+	ID         uint
+	MtBalance  *string
+	MtSmsCount *string
+}
+
+func (testUser) TableName() string {
+	return "smpp_users"
+}
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens its own database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&testUser{}, &Transaction{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRefundMessage(t *testing.T) {
+	db := newTestDB(t)
+
+	balance, smsCount := "0.2000", "8"
+	user := &testUser{MtBalance: &balance, MtSmsCount: &smsCount}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	messageID := "msg-1"
+	if err := db.Create(&Transaction{SmppUserID: user.ID, SystemID: "esme", Type: LedgerCharge, MessageID: &messageID,
+		Amount: "-0.8000", SmsCount: -2, Segments: 2, Rate: "0.4000"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	refund, err := RefundMessage(db, messageID, "RabbitMQ publish failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund == nil || refund.Amount != "0.8000" || refund.SmsCount != 2 || refund.Description != "RabbitMQ publish failed" {
+		t.Fatalf("refund = %+v, want 0.8000 and 2 SMS", refund)
+	}
+
+	// Refunding again and refunding an uncharged message change nothing
+	for _, id := range []string{messageID, "uncharged"} {
+		if refund, err := RefundMessage(db, id, "again"); err != nil || refund != nil {
+			t.Errorf("RefundMessage(%s) = %+v, %v, want no refund", id, refund, err)
+		}
+	}
+
+	var stored testUser
+	if err := db.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if amount, _ := ParseAmount(*stored.MtBalance); amount != 10000 {
+		t.Errorf("balance = %s, want 1.0000", *stored.MtBalance)
+	}
+	if *stored.MtSmsCount != "10" {
+		t.Errorf("SMS count = %s, want 10", *stored.MtSmsCount)
+	}
+}
+
+func TestRepriceMessage(t *testing.T) {
+	db := newTestDB(t)
+
+	balance, smsCount := "1.0000", "3"
+	user := &testUser{MtBalance: &balance, MtSmsCount: &smsCount}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	messageID := "msg-1"
+	if err := db.Create(&Transaction{SmppUserID: user.ID, SystemID: "esme", Type: LedgerCharge, MessageID: &messageID,
+		Amount: "-0.4000", SmsCount: -1, Segments: 1, Rate: "0.4000"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Two more segments fit in the balance and SMS count, five more do not
+	if err := RepriceMessage(db, messageID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := RepriceMessage(db, messageID, 6); err != ErrInsufficientBalance {
+		t.Fatalf("RepriceMessage beyond the balance = %v, want ErrInsufficientBalance", err)
+	}
+	assertBalance(t, db, user.ID, 2000, "1")
+	assertCharge(t, db, messageID, "-1.2000", -3, 3)
+
+	// Fewer segments give the difference back
+	if err := RepriceMessage(db, messageID, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, db, user.ID, 6000, "2")
+	assertCharge(t, db, messageID, "-0.8000", -2, 2)
+
+	// The refund gives back what the repriced charge holds
+	if _, err := RefundMessage(db, messageID, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, db, user.ID, 14000, "4")
+
+	// Refunded and uncharged messages are not repriced
+	for _, id := range []string{messageID, "uncharged"} {
+		if err := RepriceMessage(db, id, 5); err != nil {
+			t.Errorf("RepriceMessage(%s) = %v", id, err)
+		}
+	}
+	assertBalance(t, db, user.ID, 14000, "4")
+}
+
+func assertBalance(t *testing.T, db *gorm.DB, userID uint, balance int64, smsCount string) {
+	t.Helper()
+	var stored testUser
+	if err := db.First(&stored, userID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if amount, _ := ParseAmount(*stored.MtBalance); amount != balance || *stored.MtSmsCount != smsCount {
+		t.Errorf("balance = %s, SMS count = %s; want %s and %s", *stored.MtBalance, *stored.MtSmsCount, FormatAmount(balance), smsCount)
+	}
+}
+
+func assertCharge(t *testing.T, db *gorm.DB, messageID, amount string, smsCount, segments int) {
+	t.Helper()
+	var charge Transaction
+	if err := db.Where("message_id = ? AND type = ?", messageID, LedgerCharge).First(&charge).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := ParseAmount(charge.Amount); FormatAmount(stored) != amount || charge.SmsCount != smsCount || charge.Segments != segments {
+		t.Errorf("charge = %s, %d SMS, %d segments; want %s, %d SMS, %d segments", charge.Amount, charge.SmsCount, charge.Segments, amount, smsCount, segments)
+	}
+}
@@ -0,0 +1,55 @@
+// Package dlr decides which delivery reports an SMPP message asked for with its registered_delivery field.
+// It is shared by the backend, which reports the outcome of messages sent by devices, and the SMPP server,
+// which reports the messages it cancels or rejects itself.
+package dlr
+
+// Message states of SMPP 3.4, as reported by query_sm and delivery reports
+const (
+	StateScheduled     = 0
+	StateEnroute       = 1
+	StateDelivered     = 2
+	StateExpired       = 3
+	StateDeleted       = 4
+	StateUndeliverable = 5
+	StateAccepted      = 6
+	StateUnknown       = 7
+	StateRejected      = 8
+)
+
+// Bits of the registered_delivery field of SMPP 3.4
+const (
+	RegisteredDeliverySmscReceipt  = 0x01 // SMSC delivery receipt on success or failure
+	RegisteredDeliverySmscFailure  = 0x02 // SMSC delivery receipt on failure only
+	RegisteredDeliverySmscMask     = 0x03 // 0x03 is reserved and requests no receipt
+	RegisteredDeliveryIntermediate = 0x10 // Intermediate notifications
+)
+
+// Wanted reports whether the registered_delivery field of a message asks for a delivery report in a message state.
+// Final states are reported as SMSC delivery receipts, either on success and failure or on failure only;
+// ENROUTE and ACCEPTED are intermediate notifications.
+// SME originated acknowledgements (bits 3-2) come from the recipient SME and never from the SMSC, so they select no report.
+func Wanted(registeredDelivery, messageState uint8) bool {
+	receipt := registeredDelivery & RegisteredDeliverySmscMask
+
+	switch messageState {
+	case StateDelivered:
+		return receipt == RegisteredDeliverySmscReceipt
+	case StateExpired, StateDeleted, StateUndeliverable, StateRejected:
+		return receipt == RegisteredDeliverySmscReceipt || receipt == RegisteredDeliverySmscFailure
+	case StateEnroute, StateAccepted:
+		return registeredDelivery&RegisteredDeliveryIntermediate != 0
+	}
+	return false
+}
+
+// Requested reports whether the registered_delivery field of a message asks for any delivery report
+func Requested(registeredDelivery uint8) bool {
+	receipt := registeredDelivery & RegisteredDeliverySmscMask
+	return receipt == RegisteredDeliverySmscReceipt || receipt == RegisteredDeliverySmscFailure ||
+		registeredDelivery&RegisteredDeliveryIntermediate != 0
+}
+
+// IsIntermediate reports whether a message state is sent as an intermediate notification rather than a receipt
+func IsIntermediate(messageState uint8) bool {
+	return messageState == StateEnroute || messageState == StateAccepted
+}
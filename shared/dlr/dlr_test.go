@@ -0,0 +1,40 @@
+package dlr
+
+import "testing"
+
+func TestWanted(t *testing.T) {
+	tests := []struct {
+		name               string
+		registeredDelivery uint8
+		messageState       uint8
+		want               bool
+	}{
+		{"no receipt delivered", 0x00, StateDelivered, false},
+		{"receipt delivered", 0x01, StateDelivered, true},
+		{"receipt undeliverable", 0x01, StateUndeliverable, true},
+		{"failure receipt delivered", 0x02, StateDelivered, false},
+		{"failure receipt expired", 0x02, StateExpired, true},
+		{"failure receipt rejected", 0x02, StateRejected, true},
+		{"failure receipt deleted", 0x02, StateDeleted, true},
+		{"reserved receipt", 0x03, StateUndeliverable, false},
+		{"SME acknowledgement only", 0x0C, StateDelivered, false},
+		{"receipt without intermediate", 0x01, StateAccepted, false},
+		{"intermediate accepted", 0x10, StateAccepted, true},
+		{"intermediate enroute", 0x11, StateEnroute, true},
+		{"intermediate delivered", 0x10, StateDelivered, false},
+		{"unknown state", 0x13, StateUnknown, false},
+	}
+	for _, tt := range tests {
+		if got := Wanted(tt.registeredDelivery, tt.messageState); got != tt.want {
+			t.Errorf("%s: Wanted(0x%02X, %d) = %v, want %v", tt.name, tt.registeredDelivery, tt.messageState, got, tt.want)
+		}
+	}
+}
+
+func TestRequested(t *testing.T) {
+	for registeredDelivery, want := range map[uint8]bool{0x00: false, 0x01: true, 0x02: true, 0x03: false, 0x04: false, 0x10: true, 0x1C: true} {
+		if got := Requested(registeredDelivery); got != want {
+			t.Errorf("Requested(0x%02X) = %v, want %v", registeredDelivery, got, want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+module tsimcloud/shared
+
+go 1.21
+
+require (
+	github.com/glebarez/sqlite v1.7.0
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/rabbitmq/amqp091-go v1.9.0
+	golang.org/x/crypto v0.17.0
+	gorm.io/gorm v1.25.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/glebarez/go-sqlite v1.20.3 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/mattn/go-isatty v0.0.17 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230126093431-47fa9a501578 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	modernc.org/libc v1.22.2 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.5.0 // indirect
+	modernc.org/sqlite v1.20.3 // indirect
+)
@@ -0,0 +1,61 @@
+package idgen
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Message ID formats that can be configured per SMPP user
+const (
+	FormatDecimal = "decimal"
+	FormatHex     = "hex"
+	FormatUUID    = "uuid"
+)
+
+// IsValidFormat reports whether format is a known message ID format
+func IsValidFormat(format string) bool {
+	return format == FormatDecimal || format == FormatHex || format == FormatUUID
+}
+
+// MaxLength returns the length of the longest ID a format renders. An empty or unknown format renders decimal.
+func MaxLength(format string) int {
+	switch format {
+	case FormatHex:
+		return 16 // 63 bits in hex
+	case FormatUUID:
+		return 36
+	default:
+		return 19 // 63 bits in decimal
+	}
+}
+
+// FitsLength reports whether every ID of a format fits in maxLength characters, 0 meaning no limit.
+// IDs are never shortened, so a format only goes with a max length it fits.
+func FitsLength(format string, maxLength int) bool {
+	return maxLength == 0 || maxLength >= MaxLength(format)
+}
+
+// Format renders an ID in the given format. An empty or unknown format renders decimal.
+func Format(id uint64, format string) string {
+	switch format {
+	case FormatHex:
+		return strconv.FormatUint(id, 16)
+	case FormatUUID:
+		return formatUUID(id)
+	default:
+		return strconv.FormatUint(id, 10)
+	}
+}
+
+// formatUUID spreads the 64 bits of an ID over a version 8 (custom) UUID
+func formatUUID(id uint64) string {
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(id >> (56 - 8*i))
+	}
+	b[6] = 0x80 | byte(id>>12)&0x0F // version 8
+	b[7] = byte(id >> 4)
+	b[8] = 0x80 | byte(id)&0x0F // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,66 @@
+package idgen
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		id     uint64
+		want   string
+	}{
+		{FormatDecimal, 1234567890, "1234567890"},
+		{"", 1234567890, "1234567890"},
+		{"unknown", 255, "255"},
+		{FormatHex, 255, "ff"},
+		{FormatUUID, 0x0123456789ABCDEF, "01234567-89ab-8cde-8f00-000000000000"},
+	}
+
+	for _, tt := range tests {
+		if got := Format(tt.id, tt.format); got != tt.want {
+			t.Errorf("Format(%d, %q) = %q, want %q", tt.id, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestFormatUUIDIsVersion8(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-8[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, id := range []uint64{0, 1, 1 << 40, 1<<63 - 1} {
+		if got := Format(id, FormatUUID); !uuid.MatchString(got) {
+			t.Errorf("Format(%d, uuid) = %q, not a version 8 UUID", id, got)
+		}
+	}
+}
+
+func TestMaxLengthCoversEveryID(t *testing.T) {
+	const maxID = 1<<63 - 1
+	for _, format := range []string{FormatDecimal, FormatHex, FormatUUID} {
+		if got := len(Format(maxID, format)); got != MaxLength(format) {
+			t.Errorf("longest %s ID has %d characters, MaxLength() = %d", format, got, MaxLength(format))
+		}
+	}
+}
+
+func TestFitsLength(t *testing.T) {
+	tests := []struct {
+		format    string
+		maxLength int
+		want      bool
+	}{
+		{FormatDecimal, 0, true},
+		{FormatDecimal, 19, true},
+		{FormatDecimal, 18, false},
+		{FormatHex, 16, true},
+		{FormatHex, 10, false},
+		{FormatUUID, 36, true},
+		{FormatUUID, 32, false},
+	}
+
+	for _, tt := range tests {
+		if got := FitsLength(tt.format, tt.maxLength); got != tt.want {
+			t.Errorf("FitsLength(%q, %d) = %v, want %v", tt.format, tt.maxLength, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package idgen
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The generator is used by the SMPP server and the backend, which share the message ID space.
+//
+// An ID is a 63-bit number made of:
+//   - 41 bits of milliseconds since epoch (good until 2093)
+//   - 10 bits of node ID, configured explicitly and unique per running instance of either service
+//   - 12 bits of sequence within the millisecond
+const (
+	nodeBits     = 10
+	sequenceBits = 12
+
+	MaxNodeID   = 1<<nodeBits - 1
+	maxSequence = 1<<sequenceBits - 1
+)
+
+// epoch is the start of the ID timestamp (2024-01-01T00:00:00Z)
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Generator produces unique, monotonically increasing message IDs for one node
+type Generator struct {
+	mutex    sync.Mutex
+	nodeID   uint64
+	lastTime int64
+	sequence uint64
+}
+
+// NewGenerator creates a generator for the given node ID (1-1023). 0 is not a node ID, so that an instance
+// without a configured node ID cannot start and share IDs with another one.
+func NewGenerator(nodeID int) (*Generator, error) {
+	if nodeID < 1 || nodeID > MaxNodeID {
+		return nil, fmt.Errorf("node ID must be configured between 1 and %d, got %d", MaxNodeID, nodeID)
+	}
+
+	return &Generator{
+		nodeID: uint64(nodeID),
+	}, nil
+}
+
+// NodeID returns the node ID of the generator
+func (g *Generator) NodeID() int {
+	return int(g.nodeID)
+}
+
+// Next returns the next ID. IDs never repeat for a node, even if the wall clock moves backwards.
+func (g *Generator) Next() uint64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Since(epoch).Milliseconds()
+
+	// Keep using the last timestamp if the clock went backwards
+	if now < g.lastTime {
+		now = g.lastTime
+	}
+
+	if now == g.lastTime {
+		g.sequence = (g.sequence + 1) & maxSequence
+		if g.sequence == 0 {
+			// Sequence exhausted for this millisecond, move on to the next one
+			now++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastTime = now
+
+	return uint64(now)<<(nodeBits+sequenceBits) | g.nodeID<<sequenceBits | g.sequence
+}
@@ -0,0 +1,83 @@
+package idgen
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNewGeneratorRejectsUnconfiguredNodeID(t *testing.T) {
+	for _, nodeID := range []int{-1, 0, MaxNodeID + 1} {
+		if _, err := NewGenerator(nodeID); err == nil {
+			t.Errorf("NewGenerator(%d) succeeded, want an error", nodeID)
+		}
+	}
+	for _, nodeID := range []int{1, MaxNodeID} {
+		if _, err := NewGenerator(nodeID); err != nil {
+			t.Errorf("NewGenerator(%d) error = %v", nodeID, err)
+		}
+	}
+}
+
+func TestNextIsUniqueAndIncreasing(t *testing.T) {
+	generator, err := NewGenerator(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	for i := 0; i < 100000; i++ {
+		id := generator.Next()
+		if id <= last {
+			t.Fatalf("ID %d after %d is not increasing", id, last)
+		}
+		if node := int(id>>sequenceBits) & MaxNodeID; node != 7 {
+			t.Fatalf("ID %d carries node %d, want 7", id, node)
+		}
+		last = id
+	}
+}
+
+func TestNextIsUniqueAcrossGoroutines(t *testing.T) {
+	generator, err := NewGenerator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines, perGoroutine = 8, 10000
+	ids := make(chan uint64, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				ids <- generator.Next()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint64]bool, goroutines*perGoroutine)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %d generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNodesDoNotCollide(t *testing.T) {
+	first, _ := NewGenerator(1)
+	second, _ := NewGenerator(2)
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 10000; i++ {
+		for _, id := range []uint64{first.Next(), second.Next()} {
+			if seen[id] {
+				t.Fatalf("ID %d generated by both nodes", id)
+			}
+			seen[id] = true
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Package password checks SMPP user passwords, which are stored as bcrypt hashes or, until they are migrated, in clear text.
+// It is shared by the backend and the SMPP server so that both accept the same passwords.
+package password
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashCost is the bcrypt cost of stored password hashes
+const HashCost = 12
+
+// dummyHash is compared against when a user does not exist, so that unknown system IDs
+// take as long to reject as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), HashCost)
+
+// Hash returns the bcrypt hash of a password
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), HashCost)
+	return string(hash), err
+}
+
+// IsHash reports whether a stored password is a bcrypt hash rather than legacy clear text
+func IsHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// Check compares a password with the stored hash, or in constant time with a legacy clear text password
+func Check(stored, password string) bool {
+	if IsHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// CheckUnknownUser spends the time of a password check for a user that does not exist
+func CheckUnknownUser(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
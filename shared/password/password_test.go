@@ -0,0 +1,47 @@
+package password
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	hash, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsHash(hash) {
+		t.Fatalf("Hash() = %q, not recognised as a hash", hash)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"hash", hash, "secret", true},
+		{"hash with wrong password", hash, "wrong", false},
+		{"clear text", "secret", "secret", true},
+		{"clear text with wrong password", "secret", "wrong", false},
+		{"clear text prefix", "secret", "secre", false},
+		{"hash given as password", hash, hash, false},
+	}
+
+	for _, tt := range tests {
+		if got := Check(tt.stored, tt.password); got != tt.want {
+			t.Errorf("%s: Check() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsHash(t *testing.T) {
+	for stored, want := range map[string]bool{
+		"$2a$12$abcdefghijklmnopqrstuv": true,
+		"$2b$12$abcdefghijklmnopqrstuv": true,
+		"$2y$12$abcdefghijklmnopqrstuv": true,
+		"password":                      false,
+		"":                              false,
+	} {
+		if got := IsHash(stored); got != want {
+			t.Errorf("IsHash(%q) = %v, want %v", stored, got, want)
+		}
+	}
+}
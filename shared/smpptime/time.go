@@ -0,0 +1,68 @@
+// Package smpptime parses and formats the SMPP 3.4 time fields schedule_delivery_time and validity_period.
+// It is shared by the SMPP server, which rewrites relative times as absolute times on submit, and the backend,
+// which still accepts relative times from other producers.
+package smpptime
+
+import (
+	"fmt"
+	"time"
+)
+
+// FormatAbsolute formats t in the SMPP absolute time format "YYMMDDhhmmsstnnp"
+func FormatAbsolute(t time.Time) string {
+	_, offset := t.Zone()
+
+	direction := "+"
+	if offset < 0 {
+		direction = "-"
+		offset = -offset
+	}
+
+	// Offset from UTC is expressed in quarter hours
+	quarterHours := offset / (15 * 60)
+
+	return fmt.Sprintf("%s%d%02d%s", t.Format("060102150405"), t.Nanosecond()/100000000, quarterHours, direction)
+}
+
+// Parse parses an SMPP time field, either absolute "YYMMDDhhmmsstnnp" or relative "YYMMDDhhmmss000R".
+// Relative times are added to now. An empty field returns the zero time.
+func Parse(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if len(value) != 16 {
+		return time.Time{}, fmt.Errorf("invalid SMPP time %q: length %d", value, len(value))
+	}
+
+	var fields [8]int
+	widths := [8]int{2, 2, 2, 2, 2, 2, 1, 2}
+	position := 0
+	for i, width := range widths {
+		for _, c := range value[position : position+width] {
+			if c < '0' || c > '9' {
+				return time.Time{}, fmt.Errorf("invalid SMPP time %q", value)
+			}
+			fields[i] = fields[i]*10 + int(c-'0')
+		}
+		position += width
+	}
+	years, months, days, hours, minutes, seconds, tenths, quarterHours := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6], fields[7]
+
+	switch value[15] {
+	case 'R':
+		return now.AddDate(years, months, days).Add(time.Duration(hours)*time.Hour +
+			time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second), nil
+	case '+', '-':
+		if months < 1 || months > 12 || days < 1 || days > 31 || hours > 23 || minutes > 59 || seconds > 59 || quarterHours > 48 {
+			return time.Time{}, fmt.Errorf("invalid SMPP time %q", value)
+		}
+		offset := quarterHours * 15 * 60
+		if value[15] == '-' {
+			offset = -offset
+		}
+		location := time.FixedZone("", offset)
+		return time.Date(2000+years, time.Month(months), days, hours, minutes, seconds, tenths*100000000, location), nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid SMPP time %q: unknown direction %q", value, value[15])
+	}
+}
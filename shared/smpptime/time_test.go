@@ -0,0 +1,64 @@
+package smpptime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	reference := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"240315083000004+", time.Date(2024, time.March, 15, 7, 30, 0, 0, time.UTC)},
+		{"240315083000508-", time.Date(2024, time.March, 15, 10, 30, 0, 500000000, time.UTC)},
+		{"000001020304000R", reference.AddDate(0, 0, 1).Add(2*time.Hour + 3*time.Minute + 4*time.Second)},
+		{"000100000000000R", time.Date(2024, time.April, 10, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.value, reference)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{
+		"2403150830000",    // Too short
+		"240315083000004X", // Unknown direction
+		"241315083000004+", // Month 13
+		"240315243000004+", // Hour 24
+		"240315083000049+", // Offset over 12 hours
+		"24031508300a004+", // Not a digit
+	} {
+		if got, err := Parse(value, reference); err == nil {
+			t.Errorf("Parse(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestFormatAbsolute(t *testing.T) {
+	tests := []struct {
+		time time.Time
+		want string
+	}{
+		{time.Date(2024, time.March, 15, 8, 30, 0, 0, time.UTC), "240315083000000+"},
+		{time.Date(2024, time.March, 15, 8, 30, 0, 700000000, time.FixedZone("", 3*3600)), "240315083000712+"},
+		{time.Date(2024, time.March, 15, 8, 30, 0, 0, time.FixedZone("", -(5*3600+30*60))), "240315083000022-"},
+	}
+	for _, tt := range tests {
+		got := FormatAbsolute(tt.time)
+		if got != tt.want {
+			t.Errorf("FormatAbsolute(%v) = %q, want %q", tt.time, got, tt.want)
+		}
+		if parsed, err := Parse(got, time.Now()); err != nil || !parsed.Equal(tt.time) {
+			t.Errorf("Parse(FormatAbsolute(%v)) = %v, %v", tt.time, parsed, err)
+		}
+	}
+}
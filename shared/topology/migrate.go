@@ -0,0 +1,110 @@
+package topology
+
+import (
+	"fmt"
+	"time"
+
+	"tsimcloud/shared/amqpconn"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// migrateConfirmTimeout is how long moving a message waits for the broker confirm
+const migrateConfirmTimeout = 5 * time.Second
+
+// MigratingQueue returns the queue holding the messages of a queue while it is declared again
+func MigratingQueue(queueName string) string {
+	return queueName + ".migrating"
+}
+
+// MigrateQueue declares a queue with new arguments. The arguments of an existing queue cannot be changed, so when
+// they differ its messages are moved to a temporary queue, the queue is deleted, declared with the new arguments and
+// the messages are moved back. The bindings of the queue must be declared again afterwards.
+// Nothing may publish to or consume from the queue meanwhile. A migration that stopped halfway is finished
+// by running it again. migrated reports whether the queue had other arguments.
+func MigrateQueue(conn *amqp.Connection, queueName string, args amqp.Table) (migrated bool, err error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	_, err = ch.QueueDeclare(queueName, true, false, false, false, args)
+	if err == nil {
+		ch.Close()
+		return false, finishMigration(conn, queueName)
+	}
+	if !IsArgumentsMismatch(err) {
+		return false, err
+	}
+
+	// The failed declaration closed the channel
+	ch, err = openConfirmChannel(conn)
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+
+	if _, err := ch.QueueDeclare(MigratingQueue(queueName), true, false, false, false, nil); err != nil {
+		return false, err
+	}
+	if err := moveMessages(ch, queueName, MigratingQueue(queueName)); err != nil {
+		return false, err
+	}
+	if _, err := ch.QueueDelete(queueName, false, true, false); err != nil {
+		return false, fmt.Errorf("queue %s received messages while it was migrated, stop every publisher and run the migration again: %v", queueName, err)
+	}
+	if _, err := ch.QueueDeclare(queueName, true, false, false, false, args); err != nil {
+		return false, err
+	}
+	return true, finishMigration(conn, queueName)
+}
+
+// finishMigration moves the messages of a migration back to their queue and deletes the temporary queue
+func finishMigration(conn *amqp.Connection, queueName string) error {
+	ch, err := openConfirmChannel(conn)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	// Declaring the queue passively fails when no migration is pending, which closes the channel
+	if _, err := ch.QueueDeclarePassive(MigratingQueue(queueName), true, false, false, false, nil); err != nil {
+		return nil
+	}
+	if err := moveMessages(ch, MigratingQueue(queueName), queueName); err != nil {
+		return err
+	}
+	_, err = ch.QueueDelete(MigratingQueue(queueName), false, true, false)
+	return err
+}
+
+// moveMessages moves every message of a queue to another queue, acknowledging each once its copy is confirmed
+func moveMessages(ch *amqp.Channel, from, to string) error {
+	for {
+		msg, ok, err := ch.Get(from, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := amqpconn.PublishConfirmed(ch, "", to, Copy(msg, msg.Headers), migrateConfirmTimeout); err != nil {
+			return fmt.Errorf("failed to move message from %s to %s: %v", from, to, err)
+		}
+		if err := msg.Ack(false); err != nil {
+			return err
+		}
+	}
+}
+
+// openConfirmChannel opens a channel with publisher confirms
+func openConfirmChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
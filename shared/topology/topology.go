@@ -0,0 +1,214 @@
+// Package topology holds the RabbitMQ conventions shared by the backend and the SMPP server: the arguments of the
+// queues both of them declare, the retry queues, and the dead-letter exchange, queues and headers.
+package topology
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers of dead-lettered, retried and replayed messages
+const (
+	HeaderDeadLetterReason = "x-dead-letter-reason"
+	HeaderDeadLetterError  = "x-dead-letter-error"
+	HeaderOriginalQueue    = "x-original-queue"
+	HeaderFailedAt         = "x-failed-at"
+	HeaderRetryCount       = "x-retry-count"  // How many times a failed message was queued again
+	HeaderReplayCount      = "x-replay-count" // How many times a message was replayed from its dead-letter queue
+)
+
+// Reasons a message was dead-lettered
+const (
+	ReasonUnprocessable = "unprocessable" // The message can never be handled, such as malformed JSON
+	ReasonFailed        = "failed"        // Handling still failed after the message was retried
+)
+
+// DeadLetterExchange returns the exchange the failed messages of the queues bound to an exchange are dead-lettered to,
+// with their queue as routing key
+func DeadLetterExchange(exchange string) string {
+	return exchange + ".dlx"
+}
+
+// DeadLetterQueue returns the queue holding the dead-lettered messages of a queue
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// QueueArguments returns the arguments of a queue bound to an exchange. Messages the broker dead-letters itself,
+// such as rejected ones, go to the dead-letter queue of the queue like the ones dead-lettered by the consumers.
+func QueueArguments(exchange, queueName string) amqp.Table {
+	return amqp.Table{
+		"x-dead-letter-exchange":    DeadLetterExchange(exchange),
+		"x-dead-letter-routing-key": queueName,
+	}
+}
+
+// MaxPriority is the highest priority of the SMPP router queue, one level per SMPP priority_flag value
+const MaxPriority = 3
+
+// PriorityQueueArguments returns the arguments of a queue bound to an exchange that delivers higher priorities first.
+// RabbitMQ cannot add a priority to an existing queue, an existing queue is migrated with MigrateQueue.
+func PriorityQueueArguments(exchange, queueName string) amqp.Table {
+	args := QueueArguments(exchange, queueName)
+	args["x-max-priority"] = int32(MaxPriority)
+	return args
+}
+
+// DeclareDeadLetterQueue declares the dead-letter exchange of an exchange and the dead-letter queue of a queue
+func DeclareDeadLetterQueue(ch *amqp.Channel, exchange, queueName string) error {
+	err := ch.ExchangeDeclare(
+		DeadLetterExchange(exchange), // name
+		"direct",                     // type
+		true,                         // durable
+		false,                        // auto-deleted
+		false,                        // internal
+		false,                        // no-wait
+		nil,                          // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(
+		DeadLetterQueue(queueName), // name
+		true,                       // durable
+		false,                      // delete when unused
+		false,                      // exclusive
+		false,                      // no-wait
+		nil,                        // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		DeadLetterQueue(queueName),   // queue name
+		queueName,                    // routing key
+		DeadLetterExchange(exchange), // exchange
+		false,
+		nil,
+	)
+}
+
+// MaxRetries is how many times a failed message is queued again before it is dead-lettered
+const MaxRetries = 3
+
+// RetryDelays are how long a failed message waits before each of its retries, so that an outage of a few minutes
+// does not use up its retries at once
+var RetryDelays = [MaxRetries]time.Duration{10 * time.Second, time.Minute, 5 * time.Minute}
+
+// RetryQueue returns the queue a failed message of a queue waits in before its retry with the given number
+func RetryQueue(queueName string, retries int64) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, retries)
+}
+
+// RetryQueueArguments returns the arguments of the retry queue of a queue with the given delay. The queue hands
+// its messages back to the queue through the default exchange once they have waited for the delay.
+func RetryQueueArguments(queueName string, delay time.Duration) amqp.Table {
+	return amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queueName,
+	}
+}
+
+// DeclareRetryQueues declares the retry queues of a queue, one per retry with its delay
+func DeclareRetryQueues(ch *amqp.Channel, queueName string) error {
+	for i, delay := range RetryDelays {
+		_, err := ch.QueueDeclare(
+			RetryQueue(queueName, int64(i+1)),     // name
+			true,                                  // durable
+			false,                                 // delete when unused
+			false,                                 // exclusive
+			false,                                 // no-wait
+			RetryQueueArguments(queueName, delay), // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetryMessage returns the copy of a message that failed in a queue for its next retry, with its retry count raised,
+// and the retry queue it waits in
+func RetryMessage(msg amqp.Delivery, queueName string) (retryQueue string, copied amqp.Publishing) {
+	retries := CountHeader(msg.Headers, HeaderRetryCount) + 1
+	headers := CopyHeaders(msg.Headers)
+	headers[HeaderRetryCount] = retries
+	return RetryQueue(queueName, retries), Copy(msg, headers)
+}
+
+// IsArgumentsMismatch reports whether declaring a queue failed because the queue exists with other arguments
+func IsArgumentsMismatch(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed
+}
+
+// DeadLetterMessage returns the copy of a message that failed in a queue for its dead-letter queue,
+// with the reason in its headers and a message ID of its own
+func DeadLetterMessage(msg amqp.Delivery, queueName, reason string, cause error) amqp.Publishing {
+	headers := CopyHeaders(msg.Headers)
+	headers[HeaderDeadLetterReason] = reason
+	headers[HeaderDeadLetterError] = cause.Error()
+	headers[HeaderOriginalQueue] = queueName
+	headers[HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	publishing := Copy(msg, headers)
+	publishing.MessageId = newMessageID()
+	return publishing
+}
+
+// Copy returns a persistent copy of a consumed message with the given headers
+func Copy(msg amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        msg.Priority,
+		Body:            msg.Body,
+	}
+}
+
+// CopyHeaders returns a copy of message headers that can be changed
+func CopyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return copied
+}
+
+// CountHeader returns a counter kept in a message header, 0 when it is not set
+func CountHeader(headers amqp.Table, key string) int64 {
+	switch count := headers[key].(type) {
+	case int64:
+		return count
+	case int32:
+		return int64(count)
+	case int:
+		return int64(count)
+	}
+	return 0
+}
+
+// newMessageID returns a random message ID, so that the dead-lettered messages of every service are told apart
+// without coordinating node IDs
+func newMessageID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,109 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueArgumentsDeadLetterToTheQueue(t *testing.T) {
+	args := QueueArguments("tsimcloudrouter", "sms_queue")
+	if args["x-dead-letter-exchange"] != "tsimcloudrouter.dlx" || args["x-dead-letter-routing-key"] != "sms_queue" {
+		t.Errorf("arguments = %v, want the dead-letter exchange with the queue as routing key", args)
+	}
+	if queue := DeadLetterQueue("sms_queue"); queue != "sms_queue.dlq" {
+		t.Errorf("dead-letter queue = %s, want sms_queue.dlq", queue)
+	}
+}
+
+func TestPriorityQueueArgumentsKeepTheDeadLetterArguments(t *testing.T) {
+	args := PriorityQueueArguments("tsimcloudrouter", "tsimcloudrouter")
+	if args["x-max-priority"] != int32(MaxPriority) {
+		t.Errorf("x-max-priority = %v, want %d", args["x-max-priority"], MaxPriority)
+	}
+	if args["x-dead-letter-exchange"] != "tsimcloudrouter.dlx" || args["x-dead-letter-routing-key"] != "tsimcloudrouter" {
+		t.Errorf("arguments = %v, want the dead-letter arguments of the queue", args)
+	}
+	if _, ok := QueueArguments("tsimcloudrouter", "sms_queue")["x-max-priority"]; ok {
+		t.Error("queue arguments of a plain queue include a priority")
+	}
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	msg := amqp.Delivery{
+		MessageId:   "original",
+		ContentType: "application/json",
+		Priority:    2,
+		Headers:     amqp.Table{"trace": "abc"},
+		Body:        []byte(`{"message_id":"1"}`),
+	}
+
+	first := DeadLetterMessage(msg, "sms_queue", ReasonFailed, errors.New("device offline"))
+	second := DeadLetterMessage(msg, "sms_queue", ReasonFailed, errors.New("device offline"))
+
+	if first.MessageId == "" || first.MessageId == msg.MessageId || first.MessageId == second.MessageId {
+		t.Errorf("message IDs %q and %q, want new distinct IDs", first.MessageId, second.MessageId)
+	}
+	if first.Headers[HeaderDeadLetterReason] != ReasonFailed || first.Headers[HeaderDeadLetterError] != "device offline" || first.Headers[HeaderOriginalQueue] != "sms_queue" {
+		t.Errorf("headers = %v, want the reason, error and queue", first.Headers)
+	}
+	if first.Headers["trace"] != "abc" || first.Priority != 2 || string(first.Body) != string(msg.Body) || first.DeliveryMode != amqp.Persistent {
+		t.Errorf("copy = %+v, want the persistent message with its headers and priority", first)
+	}
+	if _, changed := msg.Headers[HeaderDeadLetterReason]; changed {
+		t.Error("headers of the original message were changed")
+	}
+}
+
+func TestRetryMessageWaitsInTheQueueOfItsAttempt(t *testing.T) {
+	msg := amqp.Delivery{MessageId: "original", Priority: 2, Headers: amqp.Table{HeaderRetryCount: int32(1)}, Body: []byte(`{}`)}
+
+	queue, copied := RetryMessage(msg, "sms_queue")
+	if queue != "sms_queue.retry.2" {
+		t.Errorf("retry queue = %s, want sms_queue.retry.2", queue)
+	}
+	if CountHeader(copied.Headers, HeaderRetryCount) != 2 || copied.MessageId != "original" || copied.Priority != 2 {
+		t.Errorf("copy = %+v, want the message with its retry count raised", copied)
+	}
+	if CountHeader(msg.Headers, HeaderRetryCount) != 1 {
+		t.Error("headers of the original message were changed")
+	}
+
+	// The retry queue hands the message back to its queue once the delay passed
+	args := RetryQueueArguments("sms_queue", RetryDelays[1])
+	if args["x-message-ttl"] != RetryDelays[1].Milliseconds() || args["x-dead-letter-exchange"] != "" || args["x-dead-letter-routing-key"] != "sms_queue" {
+		t.Errorf("retry queue arguments = %v, want the delay and the queue as dead-letter routing key", args)
+	}
+}
+
+func TestRetryDelaysGrow(t *testing.T) {
+	if RetryDelays[0] <= 0 {
+		t.Errorf("first retry waits %v, want a delay", RetryDelays[0])
+	}
+	for i := 1; i < len(RetryDelays); i++ {
+		if RetryDelays[i] <= RetryDelays[i-1] {
+			t.Errorf("retry %d waits %v, no longer than retry %d (%v)", i+1, RetryDelays[i], i, RetryDelays[i-1])
+		}
+	}
+}
+
+func TestCountHeader(t *testing.T) {
+	headers := amqp.Table{"a": int32(2), "b": int64(3), "c": 4, "d": "5"}
+	for key, want := range map[string]int64{"a": 2, "b": 3, "c": 4, "d": 0, "missing": 0} {
+		if count := CountHeader(headers, key); count != want {
+			t.Errorf("CountHeader(%s) = %d, want %d", key, count, want)
+		}
+	}
+}
+
+func TestIsArgumentsMismatch(t *testing.T) {
+	mismatch := &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'x-max-priority'"}
+	if !IsArgumentsMismatch(fmt.Errorf("failed to declare queue: %w", mismatch)) {
+		t.Error("wrapped PRECONDITION_FAILED not detected")
+	}
+	if IsArgumentsMismatch(amqp.ErrClosed) || IsArgumentsMismatch(errors.New("timeout")) {
+		t.Error("other errors reported as an arguments mismatch")
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"tsimcloud/shared/billing"
+
+	"gorm.io/gorm"
+)
+
+// ErrInsufficientBalance is returned when the prepaid balance or SMS count of a user cannot pay for a message
+var ErrInsufficientBalance = billing.ErrInsufficientBalance
+
+// Types of balance ledger entries
+const (
+	LedgerTopUp  = billing.LedgerTopUp
+	LedgerCharge = billing.LedgerCharge
+	LedgerRefund = billing.LedgerRefund
+)
+
+// SmppRate is the price of one message segment to destinations starting with a prefix.
+// Rates without a user apply to every user that has no rate of its own for the prefix.
+type SmppRate struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	SmppUserID *uint     `json:"smpp_user_id" gorm:"index"`
+	Prefix     string    `json:"prefix" gorm:"not null;size:20;index"`
+	Rate       string    `json:"rate" gorm:"type:decimal(20,4);not null;default:0"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SmppRate
+func (SmppRate) TableName() string {
+	return "smpp_rates"
+}
+
+// SmppBalanceTransaction is an entry of the balance ledger of a user, shared with the backend
+type SmppBalanceTransaction = billing.Transaction
+
+// ChargeMessage reserves the price of a message from the prepaid balance and SMS count of a user and records it
+// in the ledger. Every segment is charged at the rate of the longest prefix matching the destination.
+// An unset balance or SMS count is not limited.
+func (am *MySQLAuthManager) ChargeMessage(smppUser *SmppUser, messageID, destinationAddr string, segments int) error {
+	rate, err := am.resolveRate(smppUser.ID, destinationAddr)
+	if err != nil {
+		return err
+	}
+	amount := rate * int64(segments)
+
+	limitBalance := isLimitSet(smppUser.MtBalance)
+	limitSmsCount := isLimitSet(smppUser.MtSmsCount)
+
+	return am.db.Transaction(func(tx *gorm.DB) error {
+		if limitBalance || limitSmsCount {
+			query := tx.Model(&SmppUser{}).Where("id = ?", smppUser.ID)
+			updates := map[string]interface{}{}
+			if limitBalance {
+				query = query.Where("CAST(mt_balance AS DECIMAL(20,4)) >= CAST(? AS DECIMAL(20,4))", billing.FormatAmount(amount))
+				updates["mt_balance"] = gorm.Expr("CAST(CAST(mt_balance AS DECIMAL(20,4)) - CAST(? AS DECIMAL(20,4)) AS CHAR)", billing.FormatAmount(amount))
+			}
+			if limitSmsCount {
+				query = query.Where("CAST(mt_sms_count AS SIGNED) >= ?", segments)
+				updates["mt_sms_count"] = gorm.Expr("CAST(CAST(mt_sms_count AS SIGNED) - ? AS CHAR)", segments)
+			}
+
+			result := query.Updates(updates)
+			if result.Error != nil {
+				return fmt.Errorf("failed to reserve balance: %v", result.Error)
+			}
+			if result.RowsAffected == 0 {
+				return ErrInsufficientBalance
+			}
+		}
+
+		// The ledger only records what was taken from a limited balance or SMS count
+		reserved := int64(0)
+		if limitBalance {
+			reserved = amount
+		}
+		smsCount := 0
+		if limitSmsCount {
+			smsCount = -segments
+		}
+
+		if err := tx.Create(&SmppBalanceTransaction{
+			SmppUserID:  smppUser.ID,
+			SystemID:    smppUser.SystemID,
+			Type:        LedgerCharge,
+			MessageID:   &messageID,
+			Amount:      billing.FormatAmount(-reserved),
+			SmsCount:    smsCount,
+			Segments:    segments,
+			Rate:        billing.FormatAmount(rate),
+			Description: fmt.Sprintf("%d segment(s) to %s", segments, destinationAddr),
+			CreatedAt:   time.Now(),
+		}).Error; err != nil {
+			return fmt.Errorf("failed to record charge: %v", err)
+		}
+		return nil
+	})
+}
+
+// RefundMessage gives back the charge of a message that was not accepted after all and records it in the ledger.
+// A message is refunded at most once.
+func (am *MySQLAuthManager) RefundMessage(messageID, reason string) error {
+	_, err := billing.RefundMessage(am.db, messageID, reason)
+	return err
+}
+
+// resolveRate returns the rate of the longest prefix matching a destination, preferring the rates of the user.
+// Destinations without a rate are free.
+func (am *MySQLAuthManager) resolveRate(smppUserID uint, destinationAddr string) (int64, error) {
+	var rate SmppRate
+	// The prefix is compared as a string, a LIKE pattern would treat % and _ in it as wildcards
+	err := am.db.Where("(smpp_user_id = ? OR smpp_user_id IS NULL) AND SUBSTR(?, 1, LENGTH(prefix)) = prefix", smppUserID, destinationAddr).
+		Order("LENGTH(prefix) DESC, smpp_user_id IS NULL").
+		First(&rate).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to resolve rate: %v", err)
+	}
+
+	amount, err := billing.ParseAmount(rate.Rate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate for prefix %s: %v", rate.Prefix, err)
+	}
+	return amount, nil
+}
+
+// isLimitSet reports whether a prepaid balance or SMS count is configured
+func isLimitSet(value *string) bool {
+	return value != nil && strings.TrimSpace(*value) != ""
+}
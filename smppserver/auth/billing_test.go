@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"tsimcloud/shared/billing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestAuthManager returns an auth manager backed by an in-memory SQLite database with the billing tables migrated
+func newTestAuthManager(t *testing.T) *MySQLAuthManager {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens its own database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&SmppUser{}, &SmppRate{}, &SmppBalanceTransaction{}); err != nil {
+		t.Fatal(err)
+	}
+	return &MySQLAuthManager{db: db}
+}
+
+func createRate(t *testing.T, am *MySQLAuthManager, smppUserID *uint, prefix, rate string) {
+	t.Helper()
+	if err := am.db.Create(&SmppRate{SmppUserID: smppUserID, Prefix: prefix, Rate: rate}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveRate(t *testing.T) {
+	am := newTestAuthManager(t)
+	userID := uint(1)
+	createRate(t, am, nil, "90", "0.10")
+	createRate(t, am, nil, "90555", "0.20")
+	createRate(t, am, &userID, "90", "0.05")
+	// Wildcards in a prefix must not match other destinations
+	createRate(t, am, nil, "4_", "9.00")
+	createRate(t, am, nil, "%", "9.00")
+
+	tests := []struct {
+		userID      uint
+		destination string
+		want        string
+	}{
+		{1, "905551112233", "0.2000"}, // Longest prefix wins over the rate of the user
+		{1, "905321112233", "0.0500"}, // Rate of the user wins over the default rate
+		{2, "905321112233", "0.1000"},
+		{2, "441234567890", "0.0000"},
+		{2, "4_1234", "9.0000"},
+	}
+	for _, tt := range tests {
+		rate, err := am.resolveRate(tt.userID, tt.destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := billing.FormatAmount(rate); got != tt.want {
+			t.Errorf("resolveRate(%d, %s) = %s, want %s", tt.userID, tt.destination, got, tt.want)
+		}
+	}
+}
+
+func TestChargeAndRefundMessage(t *testing.T) {
+	am := newTestAuthManager(t)
+	balance := "1.0000"
+	user := &SmppUser{SystemID: "esme", Password: "secret", MtBalance: &balance}
+	if err := am.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	createRate(t, am, nil, "90", "0.40")
+
+	userBalance := func() int64 {
+		t.Helper()
+		var stored SmppUser
+		if err := am.db.First(&stored, user.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		amount, err := billing.ParseAmount(*stored.MtBalance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return amount
+	}
+
+	if err := am.ChargeMessage(user, "msg-1", "905551112233", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := userBalance(); got != 2000 {
+		t.Errorf("balance after charge = %s, want 0.2000", billing.FormatAmount(got))
+	}
+	if err := am.ChargeMessage(user, "msg-2", "905551112233", 1); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("ChargeMessage over the balance error = %v, want ErrInsufficientBalance", err)
+	}
+
+	// A message is refunded once however often the refund is requested
+	for i := 0; i < 2; i++ {
+		if err := am.RefundMessage("msg-1", "RabbitMQ publish failed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := userBalance(); got != 10000 {
+		t.Errorf("balance after refund = %s, want 1.0000", billing.FormatAmount(got))
+	}
+
+	var refunds int64
+	am.db.Model(&SmppBalanceTransaction{}).Where("message_id = ? AND type = ?", "msg-1", LedgerRefund).Count(&refunds)
+	if refunds != 1 {
+		t.Errorf("%d refunds recorded, want 1", refunds)
+	}
+}
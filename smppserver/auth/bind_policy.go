@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Bind modes accepted in SmppUser.AllowedBindModes
+const (
+	BindModeTX  = "tx"
+	BindModeRX  = "rx"
+	BindModeTRX = "trx"
+)
+
+// SmppBindAudit records a bind that was refused by the source address or bind mode restrictions of a user
+type SmppBindAudit struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	SystemID   string    `json:"system_id" gorm:"not null;size:50;index"`
+	RemoteAddr string    `json:"remote_addr" gorm:"not null;size:64"`
+	BindType   string    `json:"bind_type" gorm:"not null;size:20"`
+	Reason     string    `json:"reason" gorm:"not null;size:255"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+// TableName specifies the table name for SmppBindAudit
+func (SmppBindAudit) TableName() string {
+	return "smpp_bind_audits"
+}
+
+// splitList splits a comma separated column into its trimmed, non empty entries
+func splitList(value *string) []string {
+	if value == nil {
+		return nil
+	}
+
+	var entries []string
+	for _, entry := range strings.Split(*value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// AllowsBindMode reports whether the user may bind with the given mode, an empty list allows every mode
+func (u *SmppUser) AllowsBindMode(mode string) bool {
+	modes := splitList(u.AllowedBindModes)
+	if len(modes) == 0 {
+		return true
+	}
+
+	for _, allowed := range modes {
+		if strings.EqualFold(allowed, mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRemoteAddr reports whether the user may bind from the given address, an empty list allows every address.
+// Entries are CIDR ranges or single IP addresses.
+func (u *SmppUser) AllowsRemoteAddr(addr net.Addr) (bool, error) {
+	ranges := splitList(u.AllowedIPs)
+	if len(ranges) == 0 {
+		return true, nil
+	}
+
+	ip, err := remoteIP(addr)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range ranges {
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return false, fmt.Errorf("invalid CIDR %q in allowed IPs of %s", entry, u.SystemID)
+			}
+			if network.Contains(ip) {
+				return true, nil
+			}
+			continue
+		}
+
+		allowed := net.ParseIP(entry)
+		if allowed == nil {
+			return false, fmt.Errorf("invalid IP %q in allowed IPs of %s", entry, u.SystemID)
+		}
+		if allowed.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// remoteIP extracts the IP address of a connection peer
+func remoteIP(addr net.Addr) (net.IP, error) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("cannot determine IP of remote address %s", addr)
+	}
+	return ip, nil
+}
+
+// RecordBindViolation writes a refused bind to the audit trail
+func (am *MySQLAuthManager) RecordBindViolation(systemID, remoteAddr, bindType, reason string) error {
+	audit := SmppBindAudit{
+		SystemID:   systemID,
+		RemoteAddr: remoteAddr,
+		BindType:   bindType,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	}
+
+	if err := am.db.Create(&audit).Error; err != nil {
+		return fmt.Errorf("failed to record bind violation: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"net"
+	"testing"
+)
+
+// pipeAddr is a remote address that is not a *net.TCPAddr
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+func stringPointer(value string) *string { return &value }
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func TestAllowsRemoteAddr(t *testing.T) {
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	tests := []struct {
+		name       string
+		allowedIPs *string
+		addr       net.Addr
+		allowed    bool
+		wantErr    bool
+	}{
+		{"no allowlist", nil, tcp("203.0.113.7"), true, false},
+		{"empty allowlist", stringPointer(" , "), tcp("203.0.113.7"), true, false},
+		{"inside CIDR", stringPointer("10.0.0.0/8"), tcp("10.20.30.40"), true, false},
+		{"outside CIDR", stringPointer("10.0.0.0/8"), tcp("11.0.0.1"), false, false},
+		{"single IP", stringPointer("192.0.2.1, 203.0.113.7"), tcp("203.0.113.7"), true, false},
+		{"other single IP", stringPointer("192.0.2.1"), tcp("192.0.2.2"), false, false},
+		{"IPv6 CIDR", stringPointer("2001:db8::/32"), tcp("2001:db8::1"), true, false},
+		{"IPv6 outside CIDR", stringPointer("2001:db8::/32"), tcp("2001:db9::1"), false, false},
+		{"single IPv6", stringPointer("2001:db8::1"), tcp("2001:db8:0:0::1"), true, false},
+		{"IPv4 mapped IPv6 peer", stringPointer("192.0.2.0/24"), tcp("::ffff:192.0.2.10"), true, false},
+		{"address without TCP type", stringPointer("192.0.2.1"), pipeAddr("192.0.2.1:2775"), true, false},
+		{"invalid CIDR", stringPointer("10.0.0.0/33"), tcp("10.0.0.1"), false, true},
+		{"invalid IP", stringPointer("not-an-ip"), tcp("10.0.0.1"), false, true},
+		{"match before invalid entry", stringPointer("10.0.0.1, garbage"), tcp("10.0.0.1"), true, false},
+		{"unknown peer address", stringPointer("10.0.0.1"), pipeAddr("pipe"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &SmppUser{SystemID: "esme", AllowedIPs: tt.allowedIPs}
+			allowed, err := user.AllowsRemoteAddr(tt.addr)
+			if allowed != tt.allowed || (err != nil) != tt.wantErr {
+				t.Errorf("AllowsRemoteAddr(%s) = %v, %v; want %v, error %v", tt.addr, allowed, err, tt.allowed, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowsBindMode(t *testing.T) {
+	tests := []struct {
+		modes   *string
+		mode    string
+		allowed bool
+	}{
+		{nil, BindModeTRX, true},
+		{stringPointer(""), BindModeTX, true},
+		{stringPointer("tx,rx"), BindModeTX, true},
+		{stringPointer("tx,rx"), BindModeRX, true},
+		{stringPointer("tx,rx"), BindModeTRX, false},
+		{stringPointer(" TRX "), BindModeTRX, true},
+		{stringPointer("rx"), BindModeTX, false},
+	}
+	for _, tt := range tests {
+		user := &SmppUser{AllowedBindModes: tt.modes}
+		if allowed := user.AllowsBindMode(tt.mode); allowed != tt.allowed {
+			t.Errorf("AllowsBindMode(%s) with modes %q = %v, want %v", tt.mode, stringValue(tt.modes), allowed, tt.allowed)
+		}
+	}
+}
+
+func TestRecordBindViolationWritesAuditRow(t *testing.T) {
+	am := newTestAuthManager(t)
+	if err := am.db.AutoMigrate(&SmppBindAudit{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := am.RecordBindViolation("esme", "203.0.113.7:40000", "bind_transmitter", "bind mode tx not allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	var audits []SmppBindAudit
+	if err := am.db.Find(&audits).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 1 {
+		t.Fatalf("%d audit rows, want 1", len(audits))
+	}
+	audit := audits[0]
+	if audit.SystemID != "esme" || audit.RemoteAddr != "203.0.113.7:40000" || audit.BindType != "bind_transmitter" || audit.Reason != "bind mode tx not allowed" || audit.CreatedAt.IsZero() {
+		t.Errorf("audit row = %+v", audit)
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Formats of the message ID in the text of a delivery report
+const (
+	DlrIDFormatAsIssued = "as_issued" // The message ID as returned in submit_sm_resp
+	DlrIDFormatHex      = "hex"       // Decimal message IDs converted to lowercase hexadecimal
+	DlrIDFormatHexUpper = "hex_upper" // Decimal message IDs converted to uppercase hexadecimal
+	DlrIDFormatDecimal  = "decimal"   // Hexadecimal message IDs converted to decimal
+)
+
+// SmppDlrProfile is a named layout of the delivery reports sent to the users it is attached to.
+// Users without a profile receive the built-in layout.
+type SmppDlrProfile struct {
+	ID   uint   `json:"id" gorm:"primaryKey"`
+	Name string `json:"name" gorm:"uniqueIndex;not null;size:50"`
+
+	// Text of the receipt with the placeholders {id}, {sub}, {dlvrd}, {submit_date}, {done_date}, {stat}, {err} and {text}
+	TextTemplate string `json:"text_template" gorm:"type:text;not null"`
+	IDFormat     string `json:"id_format" gorm:"size:20;not null;default:'as_issued'"`
+	DateFormat   string `json:"date_format" gorm:"size:20;not null;default:'0601021504'"` // Go time layout of the submit and done dates
+
+	// Addressing of the deliver_sm carrying the receipt. Numbers and flags have no column default so that zeros are stored as given.
+	SourceAddrTON uint8 `json:"source_addr_ton" gorm:"not null"`
+	SourceAddrNPI uint8 `json:"source_addr_npi" gorm:"not null"`
+	DestAddrTON   uint8 `json:"dest_addr_ton" gorm:"not null"`
+	DestAddrNPI   uint8 `json:"dest_addr_npi" gorm:"not null"`
+
+	// TLVs added to the receipt
+	IncludeReceiptedMessageID bool  `json:"include_receipted_message_id" gorm:"not null"`
+	IncludeMessageState       bool  `json:"include_message_state" gorm:"not null"`
+	IncludeNetworkErrorCode   bool  `json:"include_network_error_code" gorm:"not null"`
+	NetworkType               uint8 `json:"network_type" gorm:"not null"` // Network type of network_error_code, 3 is GSM
+
+	// Comma separated "key=value" pairs replacing the err field, keys are error codes or stat values such as UNDELIV
+	ErrorCodeMap *string `json:"error_code_map" gorm:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SmppDlrProfile
+func (SmppDlrProfile) TableName() string {
+	return "smpp_dlr_profiles"
+}
+
+// GetDlrProfile returns the delivery report profile attached to a user, nil when the user has none
+func (am *MySQLAuthManager) GetDlrProfile(systemID string) (*SmppDlrProfile, error) {
+	var profile SmppDlrProfile
+	err := am.db.Joins("JOIN smpp_users ON smpp_users.dlr_profile_id = smpp_dlr_profiles.id").
+		Where("smpp_users.system_id = ?", systemID).
+		First(&profile).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load DLR profile: %v", err)
+	}
+	return &profile, nil
+}
@@ -3,12 +3,19 @@ package auth
 // AuthManager interface defines the methods that any auth manager must implement
 type AuthManager interface {
 	AuthenticateUser(systemID, password string) (*SmppUser, error)
+	AuthenticateCertificate(fingerprint string) (*SmppUser, error)
+	GetUser(systemID string) (*SmppUser, error)
 	GetActiveSessionsCount(systemID string) (int, error)
 	IncrementMessageCount(systemID string, isSent bool) error
+	IncrementRejectedCount(systemID string) error
 	AddSession(systemID, sessionID, remoteAddr, bindType string) error
 	RemoveSession(systemID, sessionID string) error
+	RecordBindViolation(systemID, remoteAddr, bindType, reason string) error
 	UpdateSessionActivity(sessionID string) error
 	CheckRateLimit(systemID string) (bool, error)
+	ChargeMessage(smppUser *SmppUser, messageID, destinationAddr string, segments int) error
+	RefundMessage(messageID, reason string) error
+	GetDlrProfile(systemID string) (*SmppDlrProfile, error)
 	StartCleanupRoutine()
 	DisconnectUserSessions(systemID string)
 	Close() error
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"smppserver/session"
+	"tsimcloud/shared/password"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
@@ -18,7 +19,7 @@ import (
 type SmppUser struct {
 	ID                    uint       `json:"id" gorm:"primaryKey"`
 	SystemID              string     `json:"system_id" gorm:"uniqueIndex;not null;size:50"`
-	Password              string     `json:"password" gorm:"not null;size:100"`
+	Password              string     `json:"-" gorm:"not null;size:100"` // bcrypt hash, clear text until migrated
 	MaxConnectionSpeed    int        `json:"max_connection_speed" gorm:"not null;default:100"`
 	IsActive              bool       `json:"is_active" gorm:"not null;default:true"`
 	IsOnline              bool       `json:"is_online" gorm:"not null;default:false"`
@@ -28,6 +29,7 @@ type SmppUser struct {
 	ConnectionCount       int        `json:"connection_count" gorm:"not null;default:0"`
 	TotalMessagesSent     int        `json:"total_messages_sent" gorm:"not null;default:0"`
 	TotalMessagesReceived int        `json:"total_messages_received" gorm:"not null;default:0"`
+	TotalMessagesRejected int        `json:"total_messages_rejected" gorm:"not null;default:0"`
 
 	// MT Messaging Credentials
 	MtSrcAddr              *string `json:"mt_src_addr" gorm:"size:50"`
@@ -54,6 +56,23 @@ type SmppUser struct {
 	MtHttpBulk             bool    `json:"mt_http_bulk" gorm:"default:false"`
 	MtHexContent           bool    `json:"mt_hex_content" gorm:"default:true"`
 
+	// DataSmDlrPdu selects the PDU used for delivery reports of messages submitted with data_sm
+	DataSmDlrPdu string `json:"data_sm_dlr_pdu" gorm:"size:20;not null;default:'deliver_sm'"`
+
+	// Message ID format returned in submit_sm_resp and delivery reports
+	MessageIDFormat    string `json:"message_id_format" gorm:"size:20;not null;default:'decimal'"`
+	MessageIDMaxLength int    `json:"message_id_max_length" gorm:"not null;default:0"`
+
+	// SHA-256 fingerprint (hex) of the TLS client certificate that authenticates this user
+	TLSCertFingerprint *string `json:"tls_cert_fingerprint" gorm:"size:64;index"`
+
+	// Comma separated CIDR ranges or IPs the user may bind from, and bind modes (tx, rx, trx) it may use; empty allows all
+	AllowedIPs       *string `json:"allowed_ips" gorm:"type:text"`
+	AllowedBindModes *string `json:"allowed_bind_modes" gorm:"size:20"`
+
+	// DLR profile laying out the delivery reports of this user, the built-in layout when unset
+	DlrProfileID *uint `json:"dlr_profile_id" gorm:"index"`
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -95,7 +114,7 @@ func NewMySQLAuthManager(dsn string, sessionManager interface{}) (*MySQLAuthMana
 	}
 
 	// Auto migrate tables
-	if err := db.AutoMigrate(&SmppUser{}, &SmppSession{}); err != nil {
+	if err := db.AutoMigrate(&SmppUser{}, &SmppSession{}, &SmppBindAudit{}, &SmppRate{}, &SmppBalanceTransaction{}, &SmppDlrProfile{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate tables: %v", err)
 	}
 
@@ -109,21 +128,80 @@ func NewMySQLAuthManager(dsn string, sessionManager interface{}) (*MySQLAuthMana
 	return authManager, nil
 }
 
-// AuthenticateUser authenticates a user via MySQL
-func (am *MySQLAuthManager) AuthenticateUser(systemID, password string) (*SmppUser, error) {
+// AuthenticateUser authenticates a user via MySQL.
+// Users still stored with a clear text password are migrated to a hash on their first successful bind.
+func (am *MySQLAuthManager) AuthenticateUser(systemID, secret string) (*SmppUser, error) {
 	var smppUser SmppUser
 
 	// Query user from database
-	err := am.db.Where("system_id = ? AND password = ? AND is_active = ?",
-		systemID, password, true).First(&smppUser).Error
-
+	err := am.db.Where("system_id = ? AND is_active = ?", systemID, true).First(&smppUser).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
+			password.CheckUnknownUser(secret)
 			return nil, fmt.Errorf("user not found or invalid credentials")
 		}
 		return nil, fmt.Errorf("database error: %v", err)
 	}
 
+	if !password.Check(smppUser.Password, secret) {
+		return nil, fmt.Errorf("user not found or invalid credentials")
+	}
+
+	if !password.IsHash(smppUser.Password) {
+		am.migratePassword(&smppUser, secret)
+	}
+
+	return &smppUser, nil
+}
+
+// migratePassword replaces the clear text password of a user with its hash
+func (am *MySQLAuthManager) migratePassword(smppUser *SmppUser, secret string) {
+	hash, err := password.Hash(secret)
+	if err != nil {
+		log.Printf("Failed to hash password of %s: %v", smppUser.SystemID, err)
+		return
+	}
+
+	// Only replace the password that was verified, in case it was changed meanwhile
+	result := am.db.Model(&SmppUser{}).
+		Where("id = ? AND password = ?", smppUser.ID, smppUser.Password).
+		Update("password", hash)
+	if result.Error != nil {
+		log.Printf("Failed to migrate password of %s: %v", smppUser.SystemID, result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		smppUser.Password = hash
+		log.Printf("Migrated password of %s to a hash", smppUser.SystemID)
+	}
+}
+
+// AuthenticateCertificate returns the active user a verified TLS client certificate fingerprint is mapped to
+func (am *MySQLAuthManager) AuthenticateCertificate(fingerprint string) (*SmppUser, error) {
+	var smppUser SmppUser
+
+	err := am.db.Where("tls_cert_fingerprint = ? AND is_active = ?", fingerprint, true).First(&smppUser).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fmt.Errorf("no user for client certificate %s", fingerprint)
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	return &smppUser, nil
+}
+
+// GetUser returns the SMPP user with the given system ID
+func (am *MySQLAuthManager) GetUser(systemID string) (*SmppUser, error) {
+	var smppUser SmppUser
+	err := am.db.Where("system_id = ?", systemID).First(&smppUser).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fmt.Errorf("user not found: %s", systemID)
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
 	return &smppUser, nil
 }
 
@@ -196,6 +274,19 @@ func (am *MySQLAuthManager) IncrementMessageCount(systemID string, isSent bool)
 	return nil
 }
 
+// IncrementRejectedCount counts a message of a user rejected by its MT filters
+func (am *MySQLAuthManager) IncrementRejectedCount(systemID string) error {
+	err := am.db.Model(&SmppUser{}).
+		Where("system_id = ?", systemID).
+		Update("total_messages_rejected", gorm.Expr("total_messages_rejected + ?", 1)).Error
+
+	if err != nil {
+		return fmt.Errorf("failed to increment rejected message counter: %v", err)
+	}
+
+	return nil
+}
+
 // AddSession adds a session to MySQL
 func (am *MySQLAuthManager) AddSession(systemID, sessionID, remoteAddr, bindType string) error {
 	session := SmppSession{
@@ -411,6 +502,7 @@ func (am *MySQLAuthManager) GetUserStats(systemID string) (map[string]interface{
 		"connection_count":        user.ConnectionCount,
 		"total_messages_sent":     user.TotalMessagesSent,
 		"total_messages_received": user.TotalMessagesReceived,
+		"total_messages_rejected": user.TotalMessagesRejected,
 		"active_sessions":         activeSessions,
 		"last_connected_at":       user.LastConnectedAt,
 		"last_disconnected_at":    user.LastDisconnectedAt,
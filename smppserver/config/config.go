@@ -27,6 +27,22 @@ type ServerConfig struct {
 	TCPKeepalive         bool          `mapstructure:"tcp_keepalive"`
 	TCPKeepalivePeriod   time.Duration `mapstructure:"tcp_keepalive_period"`
 	TCPLinger            time.Duration `mapstructure:"tcp_linger"`
+	NodeID               int           `mapstructure:"node_id"`
+	WindowSize           int           `mapstructure:"window_size"`
+	ResponseTimeout      time.Duration `mapstructure:"response_timeout"`
+	TLS                  TLSConfig     `mapstructure:"tls"`
+	HealthPort           int           `mapstructure:"health_port"`
+}
+
+// TLSConfig holds the configuration of the SMPP over TLS listener
+type TLSConfig struct {
+	Enabled           bool          `mapstructure:"enabled"`
+	Port              int           `mapstructure:"port"`
+	CertFile          string        `mapstructure:"cert_file"`
+	KeyFile           string        `mapstructure:"key_file"`
+	ClientCAFile      string        `mapstructure:"client_ca_file"`      // Enables client certificate authentication
+	RequireClientCert bool          `mapstructure:"require_client_cert"` // Reject clients without a valid certificate
+	ReloadInterval    time.Duration `mapstructure:"reload_interval"`
 }
 
 type SMPServerConfig struct {
@@ -47,15 +63,22 @@ type DatabaseConfig struct {
 // RedisConfig removed - using MySQL for authentication
 
 type RabbitMQConfig struct {
-	URL                 string `mapstructure:"url"`
-	Exchange            string `mapstructure:"exchange"`
-	Queue               string `mapstructure:"queue"`
-	DeliveryReportQueue string `mapstructure:"delivery_report_queue"`
+	URL                 string        `mapstructure:"url"`
+	Exchange            string        `mapstructure:"exchange"`
+	Queue               string        `mapstructure:"queue"`
+	DeliveryReportQueue string        `mapstructure:"delivery_report_queue"`
+	InboundQueue        string        `mapstructure:"inbound_queue"`
+	ConfirmTimeout      time.Duration `mapstructure:"confirm_timeout"`
 }
 
 type SMPPConfig struct {
-	EnquireLinkInterval time.Duration `mapstructure:"enquire_link_interval"`
-	SessionTimeout      time.Duration `mapstructure:"session_timeout"`
+	EnquireLinkInterval  time.Duration `mapstructure:"enquire_link_interval"`
+	SessionTimeout       time.Duration `mapstructure:"session_timeout"`
+	MessageRetention     time.Duration `mapstructure:"message_retention"`
+	DLRRetention         time.Duration `mapstructure:"dlr_retention"`
+	DLRQueueLimit        int           `mapstructure:"dlr_queue_limit"`
+	NationalLanguage     string        `mapstructure:"national_language"`
+	ConcatenationTimeout time.Duration `mapstructure:"concatenation_timeout"`
 }
 
 type LoggingConfig struct {
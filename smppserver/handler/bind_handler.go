@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"fmt"
 	"log"
 	"smppserver/auth"
 	"smppserver/protocol"
+	"smppserver/rabbitmq"
 	"smppserver/session"
 )
 
@@ -11,13 +13,15 @@ import (
 type BindHandler struct {
 	authManager    auth.AuthManager
 	sessionManager *session.SessionManager
+	rabbitMQClient *rabbitmq.RabbitMQClient
 }
 
 // NewBindHandler creates a new bind handler
-func NewBindHandler(authManager auth.AuthManager, sessionManager *session.SessionManager) *BindHandler {
+func NewBindHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, rabbitMQClient *rabbitmq.RabbitMQClient) *BindHandler {
 	return &BindHandler{
 		authManager:    authManager,
 		sessionManager: sessionManager,
+		rabbitMQClient: rabbitMQClient,
 	}
 }
 
@@ -38,27 +42,26 @@ func (h *BindHandler) HandleBindReceiver(session *session.Session, pdu *protocol
 
 	log.Printf("Session %s: Parsed bind request - SystemID: %s, SystemType: %s", session.ID, bind.SystemID, bind.SystemType)
 
-	// Check for empty system ID or password
+	// Check for empty system ID
 	if bind.SystemID == "" {
 		log.Printf("Session %s: Empty system ID", session.ID)
 		return session.SendResponse(protocol.BIND_RECEIVER_RESP, protocol.ESME_RINVSYSID, nil, pdu.SequenceNumber)
 	}
 
-	if bind.Password == "" {
-		log.Printf("Session %s: Empty password", session.ID)
-		return session.SendResponse(protocol.BIND_RECEIVER_RESP, protocol.ESME_RINVPASWD, nil, pdu.SequenceNumber)
-	}
-
 	// Authenticate user
 	log.Printf("Session %s: Authenticating user %s", session.ID, bind.SystemID)
-	smppUser, err := h.authManager.AuthenticateUser(bind.SystemID, bind.Password)
-	if err != nil {
-		log.Printf("Session %s: Authentication failed for %s: %v", session.ID, bind.SystemID, err)
-		return session.SendResponse(protocol.BIND_RECEIVER_RESP, protocol.ESME_RINVPASWD, nil, pdu.SequenceNumber)
+	smppUser, status := h.authenticate(session, bind)
+	if status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.BIND_RECEIVER_RESP, status, nil, pdu.SequenceNumber)
 	}
 
 	log.Printf("Session %s: Authentication successful for user %s", session.ID, bind.SystemID)
 
+	// Check the source address and bind mode restrictions of the user
+	if status := h.checkBindPolicy(session, smppUser, auth.BindModeRX, "receiver"); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.BIND_RECEIVER_RESP, status, nil, pdu.SequenceNumber)
+	}
+
 	// Check connection limits (using MaxConnectionSpeed as max connections)
 	activeCount, err := h.authManager.GetActiveSessionsCount(bind.SystemID)
 	if err != nil {
@@ -75,11 +78,11 @@ func (h *BindHandler) HandleBindReceiver(session *session.Session, pdu *protocol
 
 	// Update session with user info
 	session.SystemID = bind.SystemID
-	session.Password = bind.Password
 	session.SystemType = bind.SystemType
 	session.InterfaceVersion = bind.InterfaceVersion
 	session.AddressRange = bind.AddressRange
 	session.IsAuthenticated = true
+	session.User = smppUser
 
 	// Set session state
 	session.SetState(1) // StateBoundRX
@@ -107,6 +110,8 @@ func (h *BindHandler) HandleBindReceiver(session *session.Session, pdu *protocol
 	}
 
 	log.Printf("Session %s: Bind receiver successful for %s", session.ID, bind.SystemID)
+
+	h.deliverQueuedMessages(bind.SystemID)
 	return nil
 }
 
@@ -127,27 +132,26 @@ func (h *BindHandler) HandleBindTransmitter(session *session.Session, pdu *proto
 
 	log.Printf("Session %s: Parsed bind request - SystemID: %s, SystemType: %s", session.ID, bind.SystemID, bind.SystemType)
 
-	// Check for empty system ID or password
+	// Check for empty system ID
 	if bind.SystemID == "" {
 		log.Printf("Session %s: Empty system ID", session.ID)
 		return session.SendResponse(protocol.BIND_TRANSMITTER_RESP, protocol.ESME_RINVSYSID, nil, pdu.SequenceNumber)
 	}
 
-	if bind.Password == "" {
-		log.Printf("Session %s: Empty password", session.ID)
-		return session.SendResponse(protocol.BIND_TRANSMITTER_RESP, protocol.ESME_RINVPASWD, nil, pdu.SequenceNumber)
-	}
-
 	// Authenticate user
 	log.Printf("Session %s: Authenticating user %s", session.ID, bind.SystemID)
-	smppUser, err := h.authManager.AuthenticateUser(bind.SystemID, bind.Password)
-	if err != nil {
-		log.Printf("Session %s: Authentication failed for %s: %v", session.ID, bind.SystemID, err)
-		return session.SendResponse(protocol.BIND_TRANSMITTER_RESP, protocol.ESME_RINVPASWD, nil, pdu.SequenceNumber)
+	smppUser, status := h.authenticate(session, bind)
+	if status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.BIND_TRANSMITTER_RESP, status, nil, pdu.SequenceNumber)
 	}
 
 	log.Printf("Session %s: Authentication successful for user %s", session.ID, bind.SystemID)
 
+	// Check the source address and bind mode restrictions of the user
+	if status := h.checkBindPolicy(session, smppUser, auth.BindModeTX, "transmitter"); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.BIND_TRANSMITTER_RESP, status, nil, pdu.SequenceNumber)
+	}
+
 	// Check connection limits (using MaxConnectionSpeed as max connections)
 	activeCount, err := h.authManager.GetActiveSessionsCount(bind.SystemID)
 	if err != nil {
@@ -164,11 +168,11 @@ func (h *BindHandler) HandleBindTransmitter(session *session.Session, pdu *proto
 
 	// Update session with user info
 	session.SystemID = bind.SystemID
-	session.Password = bind.Password
 	session.SystemType = bind.SystemType
 	session.InterfaceVersion = bind.InterfaceVersion
 	session.AddressRange = bind.AddressRange
 	session.IsAuthenticated = true
+	session.User = smppUser
 
 	// Set session state
 	session.SetState(2) // StateBoundTX
@@ -217,27 +221,26 @@ func (h *BindHandler) HandleBindTransceiver(session *session.Session, pdu *proto
 
 	log.Printf("Session %s: Parsed bind request - SystemID: %s, SystemType: %s", session.ID, bind.SystemID, bind.SystemType)
 
-	// Check for empty system ID or password
+	// Check for empty system ID
 	if bind.SystemID == "" {
 		log.Printf("Session %s: Empty system ID", session.ID)
 		return session.SendResponse(protocol.BIND_TRANSCEIVER_RESP, protocol.ESME_RINVSYSID, nil, pdu.SequenceNumber)
 	}
 
-	if bind.Password == "" {
-		log.Printf("Session %s: Empty password", session.ID)
-		return session.SendResponse(protocol.BIND_TRANSCEIVER_RESP, protocol.ESME_RINVPASWD, nil, pdu.SequenceNumber)
-	}
-
 	// Authenticate user
 	log.Printf("Session %s: Authenticating user %s", session.ID, bind.SystemID)
-	smppUser, err := h.authManager.AuthenticateUser(bind.SystemID, bind.Password)
-	if err != nil {
-		log.Printf("Session %s: Authentication failed for %s: %v", session.ID, bind.SystemID, err)
-		return session.SendResponse(protocol.BIND_TRANSCEIVER_RESP, protocol.ESME_RINVPASWD, nil, pdu.SequenceNumber)
+	smppUser, status := h.authenticate(session, bind)
+	if status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.BIND_TRANSCEIVER_RESP, status, nil, pdu.SequenceNumber)
 	}
 
 	log.Printf("Session %s: Authentication successful for user %s", session.ID, bind.SystemID)
 
+	// Check the source address and bind mode restrictions of the user
+	if status := h.checkBindPolicy(session, smppUser, auth.BindModeTRX, "transceiver"); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.BIND_TRANSCEIVER_RESP, status, nil, pdu.SequenceNumber)
+	}
+
 	// Check connection limits (using MaxConnectionSpeed as max connections)
 	activeCount, err := h.authManager.GetActiveSessionsCount(bind.SystemID)
 	if err != nil {
@@ -254,11 +257,11 @@ func (h *BindHandler) HandleBindTransceiver(session *session.Session, pdu *proto
 
 	// Update session with user info
 	session.SystemID = bind.SystemID
-	session.Password = bind.Password
 	session.SystemType = bind.SystemType
 	session.InterfaceVersion = bind.InterfaceVersion
 	session.AddressRange = bind.AddressRange
 	session.IsAuthenticated = true
+	session.User = smppUser
 
 	// Set session state
 	session.SetState(3) // StateBoundTRX
@@ -286,5 +289,72 @@ func (h *BindHandler) HandleBindTransceiver(session *session.Session, pdu *proto
 	}
 
 	log.Printf("Session %s: Bind transceiver successful for %s", session.ID, bind.SystemID)
+
+	h.deliverQueuedMessages(bind.SystemID)
 	return nil
 }
+
+// authenticate checks the credentials of a bind request and returns the user with the status to answer.
+// A verified TLS client certificate mapped to the requested system_id replaces the password.
+func (h *BindHandler) authenticate(session *session.Session, bind *protocol.BindPDU) (*auth.SmppUser, uint32) {
+	if session.ClientCertFingerprint != "" {
+		smppUser, err := h.authManager.AuthenticateCertificate(session.ClientCertFingerprint)
+		switch {
+		case err != nil:
+			log.Printf("Session %s: Client certificate not mapped to a user, falling back to password: %v", session.ID, err)
+		case smppUser.SystemID != bind.SystemID:
+			// The certificate proves nothing about this system ID, its password still may
+			log.Printf("Session %s: Client certificate belongs to %s, not %s, falling back to password", session.ID, smppUser.SystemID, bind.SystemID)
+		default:
+			log.Printf("Session %s: Authenticated %s by client certificate", session.ID, bind.SystemID)
+			return smppUser, protocol.ESME_ROK
+		}
+	}
+
+	if bind.Password == "" {
+		log.Printf("Session %s: Empty password", session.ID)
+		return nil, protocol.ESME_RINVPASWD
+	}
+
+	smppUser, err := h.authManager.AuthenticateUser(bind.SystemID, bind.Password)
+	if err != nil {
+		log.Printf("Session %s: Authentication failed for %s: %v", session.ID, bind.SystemID, err)
+		return nil, protocol.ESME_RINVPASWD
+	}
+	return smppUser, protocol.ESME_ROK
+}
+
+// checkBindPolicy refuses binds from addresses outside the allowlist of the user or with a bind mode it may not use.
+// Refused binds are written to the audit trail.
+func (h *BindHandler) checkBindPolicy(session *session.Session, smppUser *auth.SmppUser, mode, bindType string) uint32 {
+	remoteAddr := session.Conn.RemoteAddr()
+
+	var reason string
+	if allowed, err := smppUser.AllowsRemoteAddr(remoteAddr); err != nil {
+		reason = err.Error()
+	} else if !allowed {
+		reason = fmt.Sprintf("source address %s not in allowed IPs", remoteAddr)
+	} else if !smppUser.AllowsBindMode(mode) {
+		reason = fmt.Sprintf("bind mode %s not allowed", mode)
+	} else {
+		return protocol.ESME_ROK
+	}
+
+	log.Printf("Session %s: Refusing %s bind of %s: %s", session.ID, bindType, smppUser.SystemID, reason)
+	if err := h.authManager.RecordBindViolation(smppUser.SystemID, remoteAddr.String(), bindType, reason); err != nil {
+		log.Printf("Session %s: %v", session.ID, err)
+	}
+	return protocol.ESME_RBINDFAIL
+}
+
+// deliverQueuedMessages sends delivery reports and inbound messages queued while the SMPP user had no receiver bound
+func (h *BindHandler) deliverQueuedMessages(systemID string) {
+	if h.rabbitMQClient == nil {
+		return
+	}
+
+	go func() {
+		h.rabbitMQClient.DeliverQueuedReports(h.sessionManager, systemID)
+		h.rabbitMQClient.DeliverQueuedInbound(h.sessionManager, systemID)
+	}()
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"smppserver/auth"
+	"smppserver/protocol"
+)
+
+// credentialStore authenticates the users it knows by password or client certificate fingerprint
+type credentialStore struct {
+	auth.AuthManager
+	passwords    map[string]string // system ID -> password
+	certificates map[string]string // fingerprint -> system ID
+}
+
+func (c *credentialStore) AuthenticateUser(systemID, password string) (*auth.SmppUser, error) {
+	if expected, exists := c.passwords[systemID]; !exists || expected != password {
+		return nil, errors.New("invalid credentials")
+	}
+	return &auth.SmppUser{SystemID: systemID}, nil
+}
+
+func (c *credentialStore) AuthenticateCertificate(fingerprint string) (*auth.SmppUser, error) {
+	systemID, exists := c.certificates[fingerprint]
+	if !exists {
+		return nil, errors.New("certificate not mapped")
+	}
+	return &auth.SmppUser{SystemID: systemID}, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := &BindHandler{authManager: &credentialStore{
+		passwords:    map[string]string{"esme": "secret", "other-esme": "other"},
+		certificates: map[string]string{"esme-cert": "esme", "other-cert": "other-esme"},
+	}}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		password    string
+		status      uint32
+	}{
+		{"certificate of the system ID", "esme-cert", "", protocol.ESME_ROK},
+		{"certificate replaces a wrong password", "esme-cert", "wrong", protocol.ESME_ROK},
+		{"certificate of another system ID falls back to the password", "other-cert", "secret", protocol.ESME_ROK},
+		{"certificate of another system ID without password", "other-cert", "", protocol.ESME_RINVPASWD},
+		{"certificate of another system ID with its password", "other-cert", "other", protocol.ESME_RINVPASWD},
+		{"unmapped certificate falls back to the password", "unknown-cert", "secret", protocol.ESME_ROK},
+		{"password without certificate", "", "secret", protocol.ESME_ROK},
+		{"wrong password", "", "wrong", protocol.ESME_RINVPASWD},
+		{"empty password", "", "", protocol.ESME_RINVPASWD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := boundSession(t, "")
+			s.ClientCertFingerprint = tt.fingerprint
+
+			user, status := h.authenticate(s, &protocol.BindPDU{SystemID: "esme", Password: tt.password})
+			if status != tt.status {
+				t.Fatalf("status = %#x, want %#x", status, tt.status)
+			}
+			if status == protocol.ESME_ROK && user.SystemID != "esme" {
+				t.Errorf("authenticated as %s, want esme", user.SystemID)
+			}
+		})
+	}
+}
+
+// bindAudit is a refused bind written to the audit trail
+type bindAudit struct {
+	systemID, remoteAddr, bindType, reason string
+}
+
+// auditRecorder records the refused binds
+type auditRecorder struct {
+	auth.AuthManager
+	audits []bindAudit
+}
+
+func (a *auditRecorder) RecordBindViolation(systemID, remoteAddr, bindType, reason string) error {
+	a.audits = append(a.audits, bindAudit{systemID, remoteAddr, bindType, reason})
+	return nil
+}
+
+// remoteConn reports a fixed remote address for a connection
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestCheckBindPolicyAuditsRefusedBinds(t *testing.T) {
+	allowedIPs := "10.0.0.0/8, 192.0.2.1, 2001:db8::/32"
+	txOnly := "tx"
+	invalid := "10.0.0.0/33"
+
+	tests := []struct {
+		name       string
+		user       auth.SmppUser
+		remoteIP   string
+		mode       string
+		status     uint32
+		reasonPart string // Part of the audited reason, empty when the bind is allowed
+	}{
+		{"allowed CIDR", auth.SmppUser{AllowedIPs: &allowedIPs}, "10.1.2.3", auth.BindModeTRX, protocol.ESME_ROK, ""},
+		{"allowed single IP", auth.SmppUser{AllowedIPs: &allowedIPs}, "192.0.2.1", auth.BindModeTRX, protocol.ESME_ROK, ""},
+		{"allowed IPv6", auth.SmppUser{AllowedIPs: &allowedIPs}, "2001:db8::7", auth.BindModeTRX, protocol.ESME_ROK, ""},
+		{"address outside the allowlist", auth.SmppUser{AllowedIPs: &allowedIPs}, "203.0.113.7", auth.BindModeTRX, protocol.ESME_RBINDFAIL, "not in allowed IPs"},
+		{"IPv6 outside the allowlist", auth.SmppUser{AllowedIPs: &allowedIPs}, "2001:db9::7", auth.BindModeTRX, protocol.ESME_RBINDFAIL, "not in allowed IPs"},
+		{"invalid allowlist entry", auth.SmppUser{AllowedIPs: &invalid}, "10.1.2.3", auth.BindModeTRX, protocol.ESME_RBINDFAIL, "invalid CIDR"},
+		{"bind mode not allowed", auth.SmppUser{AllowedBindModes: &txOnly}, "10.1.2.3", auth.BindModeRX, protocol.ESME_RBINDFAIL, "bind mode rx not allowed"},
+		{"allowed bind mode", auth.SmppUser{AllowedBindModes: &txOnly}, "10.1.2.3", auth.BindModeTX, protocol.ESME_ROK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audits := &auditRecorder{}
+			h := &BindHandler{authManager: audits}
+			s, _ := boundSession(t, "")
+			remote := &net.TCPAddr{IP: net.ParseIP(tt.remoteIP), Port: 40000}
+			s.Conn = remoteConn{Conn: s.Conn, remote: remote}
+			user := tt.user
+			user.SystemID = "esme"
+
+			if status := h.checkBindPolicy(s, &user, tt.mode, "bind_transceiver"); status != tt.status {
+				t.Fatalf("status = %#x, want %#x", status, tt.status)
+			}
+
+			if tt.reasonPart == "" {
+				if len(audits.audits) != 0 {
+					t.Errorf("allowed bind audited as %+v", audits.audits)
+				}
+				return
+			}
+			if len(audits.audits) != 1 {
+				t.Fatalf("%d audit rows, want 1", len(audits.audits))
+			}
+			audit := audits.audits[0]
+			if audit.systemID != "esme" || audit.remoteAddr != remote.String() || audit.bindType != "bind_transceiver" || !strings.Contains(audit.reason, tt.reasonPart) {
+				t.Errorf("audit = %+v, want esme from %s with a reason containing %q", audit, remote, tt.reasonPart)
+			}
+		})
+	}
+}
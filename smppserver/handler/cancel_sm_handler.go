@@ -4,26 +4,34 @@ import (
 	"log"
 	"smppserver/auth"
 	"smppserver/protocol"
+	"smppserver/rabbitmq"
 	"smppserver/session"
+	"smppserver/store"
+	"time"
+	"tsimcloud/shared/dlr"
 )
 
 // CancelSMHandler handles cancel_sm operations
 type CancelSMHandler struct {
 	authManager    auth.AuthManager
 	sessionManager *session.SessionManager
+	rabbitMQClient *rabbitmq.RabbitMQClient
+	messageStore   store.MessageStore
 }
 
 // NewCancelSMHandler creates a new cancel SM handler
-func NewCancelSMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager) *CancelSMHandler {
+func NewCancelSMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, rabbitMQClient *rabbitmq.RabbitMQClient, messageStore store.MessageStore) *CancelSMHandler {
 	return &CancelSMHandler{
 		authManager:    authManager,
 		sessionManager: sessionManager,
+		rabbitMQClient: rabbitMQClient,
+		messageStore:   messageStore,
 	}
 }
 
 // HandleCancelSM handles cancel_sm requests
 func (h *CancelSMHandler) HandleCancelSM(session *session.Session, pdu *protocol.PDU) error {
-	if !session.IsBound() {
+	if !session.CanTransmit() {
 		return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_RINVBNDSTS, nil, pdu.SequenceNumber)
 	}
 
@@ -33,7 +41,52 @@ func (h *CancelSMHandler) HandleCancelSM(session *session.Session, pdu *protocol
 		return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_RINVCMDLEN, nil, pdu.SequenceNumber)
 	}
 
-	log.Printf("Session %s: Cancel SM for message ID: %s", session.ID, cancel.MessageID)
+	log.Printf("Session %s: Cancel SM for message ID: %s, service type: %s, from %s to %s",
+		session.ID, cancel.MessageID, cancel.ServiceType, cancel.SourceAddr, cancel.DestinationAddr)
+
+	if h.messageStore == nil {
+		log.Printf("Session %s: Message store not available for cancel_sm", session.ID)
+		return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_RCANCELFAIL, nil, pdu.SequenceNumber)
+	}
+
+	var cancelled []store.SmppMessage
+	if cancel.MessageID != "" {
+		// Cancel a single message; source_addr must match the originator when it is given
+		message, err := h.messageStore.GetMessage(session.SystemID, cancel.MessageID)
+		if err == nil && cancel.SourceAddr != "" && cancel.SourceAddr != message.SourceAddr {
+			err = store.ErrMessageNotFound
+		}
+		if err == nil {
+			message, err = concatenatedParent(h.messageStore, message)
+		}
+		if err == nil {
+			err = h.messageStore.CancelMessage(message)
+		}
+		if err != nil {
+			log.Printf("Session %s: Cancel SM failed for message ID %s: %v", session.ID, cancel.MessageID, err)
+			return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_RCANCELFAIL, nil, pdu.SequenceNumber)
+		}
+		cancelled = append(cancelled, *message)
+	} else {
+		// Cancel all pending messages matching service_type, source and destination
+		if cancel.SourceAddr == "" || cancel.DestinationAddr == "" {
+			log.Printf("Session %s: Cancel SM without message ID requires source and destination addresses", session.ID)
+			return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_RCANCELFAIL, nil, pdu.SequenceNumber)
+		}
+
+		cancelled, err = h.messageStore.CancelMessages(session.SystemID, cancel.ServiceType, cancel.SourceAddr, cancel.DestinationAddr)
+		if err != nil {
+			log.Printf("Session %s: Cancel SM failed for %s -> %s: %v", session.ID, cancel.SourceAddr, cancel.DestinationAddr, err)
+			return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_RCANCELFAIL, nil, pdu.SequenceNumber)
+		}
+	}
+
+	log.Printf("Session %s: Cancelled %d message(s)", session.ID, len(cancelled))
+
+	// Send DELETED delivery reports where they were requested
+	for i := range cancelled {
+		h.sendDeletedReport(&cancelled[i])
+	}
 
 	// Send cancel_sm response
 	responseBody := protocol.SerializeCancelSMRespPDU()
@@ -41,6 +94,36 @@ func (h *CancelSMHandler) HandleCancelSM(session *session.Session, pdu *protocol
 	return session.SendResponse(protocol.CANCEL_SM_RESP, protocol.ESME_ROK, responseBody, pdu.SequenceNumber)
 }
 
+// sendDeletedReport publishes a DELETED delivery report for a cancelled message if the ESME asked for receipts
+func (h *CancelSMHandler) sendDeletedReport(message *store.SmppMessage) {
+	if !dlr.Wanted(message.RegisteredDelivery, protocol.MESSAGE_STATE_DELETED) {
+		return
+	}
+	if h.rabbitMQClient == nil {
+		log.Printf("RabbitMQ not available, DELETED report for message %s not sent", message.MessageID)
+		return
+	}
+
+	now := time.Now().Format("20060102150405")
+	report := &rabbitmq.DeliveryReportMessage{
+		MessageID:       message.MessageID,
+		SystemID:        message.SystemID,
+		SourceAddr:      message.SourceAddr,
+		DestinationAddr: message.DestinationAddr,
+		MessageState:    protocol.MESSAGE_STATE_DELETED,
+		FinalDate:       now,
+		SubmitDate:      message.SubmitDate.Format("20060102150405"),
+		DoneDate:        now,
+		FailureReason:   "Message cancelled",
+		OriginalText:    message.ShortMessage,
+		DataCoding:      message.DataCoding,
+	}
+
+	if err := h.rabbitMQClient.PublishDeliveryReport(report); err != nil {
+		log.Printf("Failed to publish DELETED report for message %s: %v", message.MessageID, err)
+	}
+}
+
 // HandleCancelSMResp handles cancel_sm_resp responses
 func (h *CancelSMHandler) HandleCancelSMResp(session *session.Session, pdu *protocol.PDU) error {
 	log.Printf("Session %s: Received cancel_sm_resp", session.ID)
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"log"
+	"smppserver/rabbitmq"
+	"smppserver/store"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConcatenationTimeout is how long segments of a concatenated message wait for the missing ones
+const DefaultConcatenationTimeout = 60 * time.Second
+
+// segmentKey identifies the segments of one concatenated message
+type segmentKey struct {
+	systemID        string
+	sourceAddr      string
+	destinationAddr string
+	reference       uint16
+}
+
+// messageSegment is a received segment of a concatenated message
+type messageSegment struct {
+	messageID string
+	text      string
+}
+
+// concatenatedMessage buffers the segments of a concatenated message received so far
+type concatenatedMessage struct {
+	total    uint8
+	segments map[uint8]messageSegment
+	message  *rabbitmq.SubmitSMMessage // First segment received, template of the assembled message
+	dlrPdu   string
+	timer    *time.Timer
+}
+
+// SegmentAssembler reassembles the segments of concatenated messages before they are published.
+// A message is completed once all its segments arrived, or with the segments received so far when
+// the timeout expires so that accepted segments are never lost.
+type SegmentAssembler struct {
+	pending  map[segmentKey]*concatenatedMessage
+	mutex    sync.Mutex
+	timeout  time.Duration
+	complete func(message *rabbitmq.SubmitSMMessage, segmentIDs []string, dlrPdu string)
+}
+
+// NewSegmentAssembler creates a new segment assembler calling complete with every assembled message
+func NewSegmentAssembler(timeout time.Duration, complete func(message *rabbitmq.SubmitSMMessage, segmentIDs []string, dlrPdu string)) *SegmentAssembler {
+	if timeout <= 0 {
+		timeout = DefaultConcatenationTimeout
+	}
+	return &SegmentAssembler{
+		pending:  make(map[segmentKey]*concatenatedMessage),
+		timeout:  timeout,
+		complete: complete,
+	}
+}
+
+// AddSegment buffers a segment; message holds the decoded text and message ID of the segment
+func (a *SegmentAssembler) AddSegment(message *rabbitmq.SubmitSMMessage, concatenation *rabbitmq.ConcatenationInfo, dlrPdu string) {
+	key := segmentKey{
+		systemID:        message.SystemID,
+		sourceAddr:      message.SourceAddr,
+		destinationAddr: message.DestinationAddr,
+		reference:       concatenation.ReferenceNumber,
+	}
+
+	a.mutex.Lock()
+	pending, exists := a.pending[key]
+	if exists && pending.total != concatenation.TotalSegments {
+		// The reference was reused for another message, complete the old one with what it has
+		log.Printf("Concatenated message %d from %s reused with %d segments instead of %d, completing previous message",
+			key.reference, key.systemID, concatenation.TotalSegments, pending.total)
+		a.flushLocked(key)
+		exists = false
+	}
+	if !exists {
+		pending = &concatenatedMessage{
+			total:    concatenation.TotalSegments,
+			segments: make(map[uint8]messageSegment),
+			message:  message,
+			dlrPdu:   dlrPdu,
+		}
+		pending.timer = time.AfterFunc(a.timeout, func() { a.expire(key, pending) })
+		a.pending[key] = pending
+	}
+
+	if _, duplicate := pending.segments[concatenation.SequenceNumber]; duplicate {
+		log.Printf("Duplicate segment %d of concatenated message %d from %s replaces the previous one",
+			concatenation.SequenceNumber, key.reference, key.systemID)
+	}
+	pending.segments[concatenation.SequenceNumber] = messageSegment{messageID: message.MessageID, text: message.ShortMessage}
+
+	if len(pending.segments) < int(pending.total) {
+		a.mutex.Unlock()
+		return
+	}
+	assembled, segmentIDs := a.removeLocked(key)
+	a.mutex.Unlock()
+
+	a.complete(assembled, segmentIDs, pending.dlrPdu)
+}
+
+// expire completes a message whose missing segments did not arrive in time
+func (a *SegmentAssembler) expire(key segmentKey, expired *concatenatedMessage) {
+	a.mutex.Lock()
+	if a.pending[key] != expired {
+		a.mutex.Unlock()
+		return
+	}
+	log.Printf("Concatenated message %d from %s timed out with %d of %d segments",
+		key.reference, key.systemID, len(expired.segments), expired.total)
+	assembled, segmentIDs := a.removeLocked(key)
+	a.mutex.Unlock()
+
+	a.complete(assembled, segmentIDs, expired.dlrPdu)
+}
+
+// flushLocked completes a pending message in the background, the caller holds the mutex
+func (a *SegmentAssembler) flushLocked(key segmentKey) {
+	dlrPdu := a.pending[key].dlrPdu
+	assembled, segmentIDs := a.removeLocked(key)
+	go a.complete(assembled, segmentIDs, dlrPdu)
+}
+
+// removeLocked removes a pending message and joins its segments in order.
+// The assembled message is published under the message ID of its first segment.
+func (a *SegmentAssembler) removeLocked(key segmentKey) (*rabbitmq.SubmitSMMessage, []string) {
+	pending := a.pending[key]
+	delete(a.pending, key)
+	pending.timer.Stop()
+
+	sequences := make([]int, 0, len(pending.segments))
+	for sequence := range pending.segments {
+		sequences = append(sequences, int(sequence))
+	}
+	sort.Ints(sequences)
+
+	var text strings.Builder
+	segmentIDs := make([]string, 0, len(sequences))
+	for _, sequence := range sequences {
+		segment := pending.segments[uint8(sequence)]
+		text.WriteString(segment.text)
+		segmentIDs = append(segmentIDs, segment.messageID)
+	}
+
+	assembled := *pending.message
+	assembled.MessageID = segmentIDs[0]
+	assembled.ShortMessage = text.String()
+	assembled.SegmentMessageIDs = segmentIDs
+	assembled.Concatenation = &rabbitmq.ConcatenationInfo{
+		ReferenceNumber: key.reference,
+		TotalSegments:   pending.total,
+	}
+	return &assembled, segmentIDs
+}
+
+// concatenatedParent returns the message a linked segment was published as, so that cancel_sm and replace_sm
+// given the message ID of any segment act on the whole message. Other messages are returned unchanged.
+func concatenatedParent(messageStore store.MessageStore, message *store.SmppMessage) (*store.SmppMessage, error) {
+	if message.ParentMessageID == "" || message.ParentMessageID == message.MessageID {
+		return message, nil
+	}
+	return messageStore.GetMessage(message.SystemID, message.ParentMessageID)
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"smppserver/auth"
+	"smppserver/protocol"
+	"smppserver/rabbitmq"
+	"smppserver/session"
+	"smppserver/store"
+)
+
+// segmentStore keeps messages in memory for the concatenation tests
+type segmentStore struct {
+	store.MessageStore
+	messages        map[string]*store.SmppMessage
+	linkedText      string
+	cancelledParent string
+	unassembled     []store.SmppMessage // Segments RejectUnassembledSegments finds
+	rejectedBefore  time.Time
+}
+
+func (s *segmentStore) UpdateMessageState(messageID string, state uint8, errorCode uint8, doneAt time.Time) error {
+	s.messages[messageID].MessageState = state
+	return nil
+}
+
+func (s *segmentStore) GetMessage(systemID, messageID string) (*store.SmppMessage, error) {
+	if message, exists := s.messages[messageID]; exists {
+		copied := *message
+		return &copied, nil
+	}
+	return nil, store.ErrMessageNotFound
+}
+
+func (s *segmentStore) LinkMessageSegments(systemID, parentMessageID string, messageIDs []string, shortMessage string) error {
+	for _, id := range messageIDs {
+		s.messages[id].ParentMessageID = parentMessageID
+	}
+	s.linkedText = shortMessage
+	return nil
+}
+
+func (s *segmentStore) GetMessageSegments(systemID, parentMessageID string) ([]store.SmppMessage, error) {
+	var segments []store.SmppMessage
+	for _, id := range []string{"seg-1", "seg-2"} {
+		if message := s.messages[id]; message.ParentMessageID == parentMessageID {
+			segments = append(segments, *message)
+		}
+	}
+	return segments, nil
+}
+
+func (s *segmentStore) CancelMessageSegments(systemID, parentMessageID string) error {
+	s.cancelledParent = parentMessageID
+	return nil
+}
+
+func (s *segmentStore) RejectUnassembledSegments(olderThan time.Time) ([]store.SmppMessage, error) {
+	s.rejectedBefore = olderThan
+	return s.unassembled, nil
+}
+
+// reportRecorder records the delivery reports raised by the server
+type reportRecorder struct {
+	reports []*rabbitmq.DeliveryReportMessage
+}
+
+func (r *reportRecorder) DeliverLocalReport(sessionManager *session.SessionManager, report *rabbitmq.DeliveryReportMessage) {
+	r.reports = append(r.reports, report)
+}
+
+// refundRecorder records the refunded message IDs and rejected messages of a user with the given MT filters
+type refundRecorder struct {
+	auth.AuthManager
+	user     auth.SmppUser
+	refunded []string
+	rejected int
+}
+
+func (r *refundRecorder) GetUser(systemID string) (*auth.SmppUser, error) {
+	user := r.user
+	return &user, nil
+}
+
+func (r *refundRecorder) IncrementRejectedCount(systemID string) error {
+	r.rejected++
+	return nil
+}
+
+func (r *refundRecorder) RefundMessage(messageID, reason string) error {
+	r.refunded = append(r.refunded, messageID)
+	return nil
+}
+
+func newSegmentStore() *segmentStore {
+	return &segmentStore{messages: map[string]*store.SmppMessage{
+		"seg-1": {MessageID: "seg-1", SystemID: "esme", SegmentNumber: 1, ShortMessage: "Hello ", MessageState: protocol.MESSAGE_STATE_ENROUTE},
+		"seg-2": {MessageID: "seg-2", SystemID: "esme", SegmentNumber: 2, ShortMessage: "world", MessageState: protocol.MESSAGE_STATE_ENROUTE},
+	}}
+}
+
+func TestConcatenatedParent(t *testing.T) {
+	messageStore := newSegmentStore()
+	messageStore.messages["seg-1"].ParentMessageID = "seg-1"
+	messageStore.messages["seg-2"].ParentMessageID = "seg-1"
+
+	for _, id := range []string{"seg-1", "seg-2"} {
+		message, _ := messageStore.GetMessage("esme", id)
+		parent, err := concatenatedParent(messageStore, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent.MessageID != "seg-1" {
+			t.Errorf("concatenatedParent(%s) = %s, want seg-1", id, parent.MessageID)
+		}
+	}
+
+	single := &store.SmppMessage{MessageID: "single", SystemID: "esme"}
+	if parent, _ := concatenatedParent(messageStore, single); parent != single {
+		t.Errorf("concatenatedParent of an unsegmented message = %s, want the message itself", parent.MessageID)
+	}
+}
+
+func TestPublishAssembledStoresAssembledText(t *testing.T) {
+	messageStore := newSegmentStore()
+	refunds := &refundRecorder{}
+	h := &SMSHandler{authManager: refunds, messageStore: messageStore}
+
+	h.publishAssembled(&rabbitmq.SubmitSMMessage{MessageID: "seg-1", SystemID: "esme", ShortMessage: "Hello world"}, []string{"seg-1", "seg-2"}, store.DlrPduDeliverSM)
+
+	if messageStore.linkedText != "Hello world" {
+		t.Errorf("linked text = %q, want the assembled text", messageStore.linkedText)
+	}
+	if messageStore.cancelledParent != "" {
+		t.Errorf("message without cancelled segments was cancelled")
+	}
+}
+
+func TestPublishAssembledRejectsUnpublishedMessage(t *testing.T) {
+	messageStore := newSegmentStore()
+	refunds := &refundRecorder{}
+	reports := &reportRecorder{}
+	// The broker refuses the assembled message
+	publisher := &publishRecorder{err: rabbitmq.ErrPublishNacked}
+	h := &SMSHandler{authManager: refunds, messageStore: messageStore, publisher: publisher, reporter: reports}
+
+	h.publishAssembled(&rabbitmq.SubmitSMMessage{MessageID: "seg-1", SystemID: "esme", ShortMessage: "Hello world", RegisteredDelivery: 1}, []string{"seg-1", "seg-2"}, store.DlrPduDeliverSM)
+
+	for _, id := range []string{"seg-1", "seg-2"} {
+		if state := messageStore.messages[id].MessageState; state != protocol.MESSAGE_STATE_REJECTED {
+			t.Errorf("segment %s state = %d, want REJECTED", id, state)
+		}
+	}
+	if len(refunds.refunded) != 2 {
+		t.Errorf("refunded %v, want both segments", refunds.refunded)
+	}
+	// The report does not depend on the broker that refused the message
+	if len(reports.reports) != 1 || reports.reports[0].MessageID != "seg-1" || reports.reports[0].MessageState != protocol.MESSAGE_STATE_REJECTED {
+		t.Errorf("reported %+v, want the REJECTED report of seg-1", reports.reports)
+	}
+}
+
+func TestRejectUnassembledSegments(t *testing.T) {
+	messageStore := newSegmentStore()
+	rejectedAt := time.Now()
+	messageStore.unassembled = []store.SmppMessage{
+		{MessageID: "lost-1", SystemID: "esme", SegmentNumber: 1, RegisteredDelivery: 1, MessageState: protocol.MESSAGE_STATE_REJECTED, FinalDate: &rejectedAt},
+		{MessageID: "lost-2", SystemID: "esme", SegmentNumber: 2, MessageState: protocol.MESSAGE_STATE_REJECTED, FinalDate: &rejectedAt},
+	}
+	refunds := &refundRecorder{}
+	reports := &reportRecorder{}
+	h := &SMSHandler{authManager: refunds, messageStore: messageStore, reporter: reports}
+	h.assembler = NewSegmentAssembler(time.Minute, h.publishAssembled)
+
+	h.RejectUnassembledSegments()
+
+	// Segments still within reach of an assembler are left alone
+	if age := time.Since(messageStore.rejectedBefore); age < 2*time.Minute {
+		t.Errorf("rejected segments submitted up to %v ago, want only those older than twice the timeout", age)
+	}
+	if len(refunds.refunded) != 2 {
+		t.Errorf("refunded %v, want both lost segments", refunds.refunded)
+	}
+	// Only the segment that asked for failure reports gets one
+	if len(reports.reports) != 1 || reports.reports[0].MessageID != "lost-1" || reports.reports[0].MessageState != protocol.MESSAGE_STATE_REJECTED {
+		t.Errorf("reported %+v, want the REJECTED report of lost-1", reports.reports)
+	}
+}
+
+func TestPublishAssembledDropsCancelledMessage(t *testing.T) {
+	messageStore := newSegmentStore()
+	// cancel_sm reached the second segment before the message was complete
+	messageStore.messages["seg-2"].MessageState = protocol.MESSAGE_STATE_DELETED
+	refunds := &refundRecorder{}
+	h := &SMSHandler{authManager: refunds, messageStore: messageStore}
+
+	h.publishAssembled(&rabbitmq.SubmitSMMessage{MessageID: "seg-1", SystemID: "esme", ShortMessage: "Hello world"}, []string{"seg-1", "seg-2"}, store.DlrPduDeliverSM)
+
+	if messageStore.cancelledParent != "seg-1" {
+		t.Errorf("cancelled segments of %q, want seg-1", messageStore.cancelledParent)
+	}
+	if len(refunds.refunded) != 2 {
+		t.Errorf("refunded %v, want both segments", refunds.refunded)
+	}
+}
+
+func TestPublishAssembledFiltersAssembledContent(t *testing.T) {
+	messageStore := newSegmentStore()
+	filter := "^Hello world$"
+	refunds := &refundRecorder{user: auth.SmppUser{MtContentFilter: &filter}}
+	h := &SMSHandler{authManager: refunds, messageStore: messageStore}
+
+	h.publishAssembled(&rabbitmq.SubmitSMMessage{MessageID: "seg-1", SystemID: "esme", ShortMessage: "Hello there"}, []string{"seg-1", "seg-2"}, store.DlrPduDeliverSM)
+
+	for _, id := range []string{"seg-1", "seg-2"} {
+		if state := messageStore.messages[id].MessageState; state != protocol.MESSAGE_STATE_REJECTED {
+			t.Errorf("segment %s state = %d, want REJECTED", id, state)
+		}
+	}
+	if len(refunds.refunded) != 2 {
+		t.Errorf("refunded %v, want both segments", refunds.refunded)
+	}
+	if refunds.rejected != 1 {
+		t.Errorf("rejected count = %d, want 1", refunds.rejected)
+	}
+}
@@ -4,26 +4,30 @@ import (
 	"log"
 	"smppserver/auth"
 	"smppserver/protocol"
+	"smppserver/rabbitmq"
 	"smppserver/session"
+	"smppserver/store"
 )
 
 // DataSMHandler handles data_sm operations
 type DataSMHandler struct {
 	authManager    auth.AuthManager
 	sessionManager *session.SessionManager
+	smsHandler     *SMSHandler
 }
 
 // NewDataSMHandler creates a new data SM handler
-func NewDataSMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager) *DataSMHandler {
+func NewDataSMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, smsHandler *SMSHandler) *DataSMHandler {
 	return &DataSMHandler{
 		authManager:    authManager,
 		sessionManager: sessionManager,
+		smsHandler:     smsHandler,
 	}
 }
 
 // HandleDataSM handles data_sm requests
 func (h *DataSMHandler) HandleDataSM(session *session.Session, pdu *protocol.PDU) error {
-	if !session.IsBound() {
+	if !session.CanTransmit() {
 		return session.SendResponse(protocol.DATA_SM_RESP, protocol.ESME_RINVBNDSTS, nil, pdu.SequenceNumber)
 	}
 
@@ -35,18 +39,104 @@ func (h *DataSMHandler) HandleDataSM(session *session.Session, pdu *protocol.PDU
 
 	log.Printf("Session %s: Data SM from %s to %s", session.ID, data.SourceAddr, data.DestinationAddr)
 
+	// Validate source address
+	if data.SourceAddr == "" {
+		log.Printf("Session %s: Empty source address", session.ID)
+		return session.SendResponse(protocol.DATA_SM_RESP, protocol.ESME_RINVSRCADR, nil, pdu.SequenceNumber)
+	}
+
+	// Validate destination address
+	if data.DestinationAddr == "" {
+		log.Printf("Session %s: Empty destination address", session.ID)
+		return session.SendResponse(protocol.DATA_SM_RESP, protocol.ESME_RINVDSTADR, nil, pdu.SequenceNumber)
+	}
+
+	// data_sm has no short_message field, the text is carried in the message_payload TLV
+	if status := data.PayloadStatus(); status != protocol.ESME_ROK {
+		log.Printf("Session %s: Missing or empty message payload", session.ID)
+		return session.SendResponse(protocol.DATA_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Strip the user data header and decode the payload, segments are reassembled like those of submit_sm
+	decodedMessage, concatenationInfo, err := decodeUserData(data.MessagePayload, data.ESMClass, data.DataCoding, data.OptionalParameters)
+	if err != nil {
+		log.Printf("Session %s: Failed to parse user data header: %v", session.ID, err)
+		return session.SendResponse(protocol.DATA_SM_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
+	}
+
+	// Create RabbitMQ message
+	rabbitMessage := &rabbitmq.SubmitSMMessage{
+		SystemID:           session.SystemID,
+		SourceAddr:         data.SourceAddr,
+		DestinationAddr:    data.DestinationAddr,
+		ShortMessage:       decodedMessage,
+		DataCoding:         data.DataCoding,
+		ESMClass:           data.ESMClass,
+		RegisteredDelivery: data.RegisteredDelivery,
+		ServiceType:        data.ServiceType,
+		OptionalParameters: rabbitmq.ConvertOptionalParamsToString(data.OptionalParameters),
+		Concatenation:      concatenationInfo,
+	}
+
+	// Enforce the MT filters of the user
+	if status := h.smsHandler.applyMTFilters(session, rabbitMessage); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.DATA_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Check rate limit
+	if status := h.smsHandler.checkRateLimit(session); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.DATA_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Generate message ID
+	messageID := h.smsHandler.GenerateMessageID(session)
+	rabbitMessage.MessageID = messageID
+
+	// Reserve the price of the message from the prepaid balance
+	if status := h.smsHandler.chargeMessage(session, rabbitMessage); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.DATA_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	log.Printf("Session %s: Data SM from %s to %s, data_coding: %d, decoded: %s",
+		session.ID, rabbitMessage.SourceAddr, data.DestinationAddr, data.DataCoding, decodedMessage)
+
+	// Store and publish the message, returning delivery reports with the PDU the user prefers
+	if status := h.smsHandler.acceptMessage(session, rabbitMessage, h.dlrPdu(session)); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.DATA_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Increment message counter
+	if err := h.authManager.IncrementMessageCount(session.SystemID, true); err != nil {
+		log.Printf("Session %s: Failed to increment message counter: %v", session.ID, err)
+	}
+
 	// Send data_sm response
 	responseBody := protocol.SerializeDataSMRespPDU(&protocol.DataSMRespPDU{
-		MessageID:          "",
+		MessageID:          messageID,
 		OptionalParameters: make(map[uint16][]byte),
 	})
 
 	return session.SendResponse(protocol.DATA_SM_RESP, protocol.ESME_ROK, responseBody, pdu.SequenceNumber)
 }
 
+// dlrPdu returns the PDU the user wants delivery reports of data_sm messages delivered with
+func (h *DataSMHandler) dlrPdu(session *session.Session) string {
+	smppUser, err := h.smsHandler.sessionUser(session)
+	if err != nil {
+		log.Printf("Session %s: Failed to load user settings: %v", session.ID, err)
+		return store.DlrPduDeliverSM
+	}
+
+	if smppUser.DataSmDlrPdu == store.DlrPduDataSM {
+		return store.DlrPduDataSM
+	}
+	return store.DlrPduDeliverSM
+}
+
 // HandleDataSMResp handles data_sm_resp responses
 func (h *DataSMHandler) HandleDataSMResp(session *session.Session, pdu *protocol.PDU) error {
-	log.Printf("Session %s: Received data_sm_resp", session.ID)
-	// For data_sm_resp, we just log it as it's a response to our data_sm
+	log.Printf("Session %s: Received data_sm_resp for sequence %d with status 0x%08X", session.ID, pdu.SequenceNumber, pdu.CommandStatus)
+	// Completes the data_sm waiting in the outbound window
+	session.HandleResponse(pdu)
 	return nil
 }
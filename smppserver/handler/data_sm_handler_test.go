@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"smppserver/auth"
+	"smppserver/protocol"
+	"smppserver/rabbitmq"
+	"smppserver/store"
+	"tsimcloud/shared/idgen"
+)
+
+// memoryStore keeps the stored messages in memory
+type memoryStore struct {
+	store.MessageStore
+	mutex        sync.Mutex
+	messages     map[string]*store.SmppMessage
+	replacements []store.MessageReplacement
+	replaceErr   error // Error of every replacement, as when the balance cannot pay for it
+	createErr    error // Error of every stored message
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{messages: make(map[string]*store.SmppMessage)}
+}
+
+func (s *memoryStore) CreateMessage(message *store.SmppMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.createErr != nil {
+		return s.createErr
+	}
+	copied := *message
+	s.messages[message.MessageID] = &copied
+	return nil
+}
+
+func (s *memoryStore) GetMessage(systemID, messageID string) (*store.SmppMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if message, exists := s.messages[messageID]; exists && message.SystemID == systemID {
+		copied := *message
+		return &copied, nil
+	}
+	return nil, store.ErrMessageNotFound
+}
+
+func (s *memoryStore) LinkMessageSegments(systemID, parentMessageID string, messageIDs []string, shortMessage string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, id := range messageIDs {
+		s.messages[id].ParentMessageID = parentMessageID
+	}
+	s.messages[parentMessageID].ShortMessage = shortMessage
+	return nil
+}
+
+func (s *memoryStore) GetMessageSegments(systemID, parentMessageID string) ([]store.SmppMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var segments []store.SmppMessage
+	for _, message := range s.messages {
+		if message.SystemID == systemID && message.ParentMessageID == parentMessageID {
+			segments = append(segments, *message)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].SegmentNumber < segments[j].SegmentNumber })
+	return segments, nil
+}
+
+func (s *memoryStore) UpdateMessageState(messageID string, state uint8, errorCode uint8, doneAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	message, exists := s.messages[messageID]
+	if !exists {
+		return store.ErrMessageNotFound
+	}
+	message.MessageState = state
+	return nil
+}
+
+func (s *memoryStore) ReplaceMessage(message *store.SmppMessage, replacement *store.MessageReplacement) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, exists := s.messages[message.MessageID]
+	if !exists {
+		return store.ErrMessageNotFound
+	}
+	if s.replaceErr != nil {
+		return s.replaceErr
+	}
+	s.replacements = append(s.replacements, *replacement)
+	if replacement.ShortMessage != "" {
+		stored.ShortMessage = replacement.ShortMessage
+	}
+	if replacement.ValidityPeriod != "" {
+		stored.ValidityPeriod = replacement.ValidityPeriod
+	}
+	stored.RegisteredDelivery = replacement.RegisteredDelivery
+	return nil
+}
+
+// publishRecorder records the messages published to the router
+type publishRecorder struct {
+	mutex     sync.Mutex
+	published []*rabbitmq.SubmitSMMessage
+	err       error
+}
+
+func (p *publishRecorder) IsConnected() bool { return true }
+
+func (p *publishRecorder) PublishSubmitSM(message *rabbitmq.SubmitSMMessage) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.published = append(p.published, message)
+	return p.err
+}
+
+func (p *publishRecorder) messages() []*rabbitmq.SubmitSMMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*rabbitmq.SubmitSMMessage(nil), p.published...)
+}
+
+// chargeRecorder accepts every message of a user and records the charged segments
+type chargeRecorder struct {
+	refundRecorder
+	charged map[string]int
+}
+
+func newChargeRecorder(user auth.SmppUser) *chargeRecorder {
+	return &chargeRecorder{refundRecorder: refundRecorder{user: user}, charged: make(map[string]int)}
+}
+
+func (c *chargeRecorder) CheckRateLimit(systemID string) (bool, error) { return true, nil }
+
+func (c *chargeRecorder) IncrementMessageCount(systemID string, isSent bool) error { return nil }
+
+func (c *chargeRecorder) ChargeMessage(smppUser *auth.SmppUser, messageID, destinationAddr string, segments int) error {
+	c.charged[messageID] = segments
+	return nil
+}
+
+// newTestSMSHandler returns an SMS handler publishing to publisher and storing messages in memory
+func newTestSMSHandler(t *testing.T, authManager auth.AuthManager, publisher submitPublisher) (*SMSHandler, *memoryStore) {
+	t.Helper()
+
+	generator, err := idgen.NewGenerator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageStore := newMemoryStore()
+	h := &SMSHandler{
+		authManager:  authManager,
+		publisher:    publisher,
+		messageStore: messageStore,
+		idGenerator:  generator,
+	}
+	h.assembler = NewSegmentAssembler(time.Minute, h.publishAssembled)
+	return h, messageStore
+}
+
+// sarDataSM returns a data_sm carrying one segment of a concatenated message in SAR TLVs
+func sarDataSM(sequenceNumber uint32, text string, segment, total uint8) *protocol.PDU {
+	return &protocol.PDU{
+		CommandID:      protocol.DATA_SM,
+		SequenceNumber: sequenceNumber,
+		Body: protocol.SerializeDataSMPDU(&protocol.DataSMPDU{
+			SourceAddr:      "sender",
+			DestinationAddr: "905551112233",
+			OptionalParameters: map[uint16][]byte{
+				protocol.OPT_PARAM_MESSAGE_PAYLOAD:    []byte(text),
+				protocol.OPT_PARAM_SAR_MSG_REF_NUM:    {0x01, 0x2C},
+				protocol.OPT_PARAM_SAR_TOTAL_SEGMENTS: {total},
+				protocol.OPT_PARAM_SAR_SEGMENT_SEQNUM: {segment},
+			},
+		}),
+	}
+}
+
+func TestDataSMSegmentsAreReassembled(t *testing.T) {
+	user := auth.SmppUser{SystemID: "esme", DataSmDlrPdu: store.DlrPduDataSM}
+	charges := newChargeRecorder(user)
+	publisher := &publishRecorder{}
+	smsHandler, messageStore := newTestSMSHandler(t, charges, publisher)
+	h := NewDataSMHandler(charges, nil, smsHandler)
+
+	var segmentIDs []string
+	for i, text := range []string{"Hello ", "world"} {
+		s, client := boundSession(t, "esme")
+		s.User = &user
+		resp := answer(t, client, func() error { return h.HandleDataSM(s, sarDataSM(uint32(i+1), text, uint8(i+1), 2)) })
+		if resp.CommandStatus != protocol.ESME_ROK {
+			t.Fatalf("segment %d: status %#x, want ESME_ROK", i+1, resp.CommandStatus)
+		}
+		segmentIDs = append(segmentIDs, string(resp.Body[:len(resp.Body)-1]))
+	}
+
+	published := publisher.messages()
+	if len(published) != 1 {
+		t.Fatalf("published %d messages, want the reassembled message only", len(published))
+	}
+	if published[0].ShortMessage != "Hello world" || published[0].MessageID != segmentIDs[0] {
+		t.Errorf("published %q as %s, want %q as %s", published[0].ShortMessage, published[0].MessageID, "Hello world", segmentIDs[0])
+	}
+
+	for i, id := range segmentIDs {
+		if charges.charged[id] != 1 {
+			t.Errorf("segment %s charged %d segments, want 1", id, charges.charged[id])
+		}
+		message, err := messageStore.GetMessage("esme", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.DlrPdu != store.DlrPduDataSM || message.SegmentNumber != uint8(i+1) || message.ParentMessageID != segmentIDs[0] {
+			t.Errorf("segment %s stored with DLR PDU %s, number %d, parent %s", id, message.DlrPdu, message.SegmentNumber, message.ParentMessageID)
+		}
+	}
+}
+
+func TestDataSMSegmentsAreFilteredAsAWhole(t *testing.T) {
+	filter := "^[^!]*$" // No exclamation mark anywhere in the message
+	user := auth.SmppUser{SystemID: "esme", MtContentFilter: &filter}
+	charges := newChargeRecorder(user)
+	publisher := &publishRecorder{}
+	smsHandler, messageStore := newTestSMSHandler(t, charges, publisher)
+	h := NewDataSMHandler(charges, nil, smsHandler)
+
+	for i, text := range []string{"Act now", "!"} {
+		s, client := boundSession(t, "esme")
+		s.User = &user
+		answer(t, client, func() error { return h.HandleDataSM(s, sarDataSM(uint32(i+1), text, uint8(i+1), 2)) })
+	}
+
+	if published := publisher.messages(); len(published) != 0 {
+		t.Fatalf("published %d messages, want the filtered message dropped", len(published))
+	}
+	for _, message := range messageStore.messages {
+		if message.MessageState != protocol.MESSAGE_STATE_REJECTED {
+			t.Errorf("segment %s state %d, want REJECTED", message.MessageID, message.MessageState)
+		}
+	}
+	if len(charges.refunded) != 2 {
+		t.Errorf("refunded %v, want both segments", charges.refunded)
+	}
+}
+
+func TestDataSMSegmentIsRejectedWhenItCannotBeStored(t *testing.T) {
+	user := auth.SmppUser{SystemID: "esme"}
+	charges := newChargeRecorder(user)
+	smsHandler, messageStore := newTestSMSHandler(t, charges, &publishRecorder{})
+	// Only the stored segment survives a restart while the message is assembled
+	messageStore.createErr = errors.New("database down")
+	h := NewDataSMHandler(charges, nil, smsHandler)
+
+	s, client := boundSession(t, "esme")
+	s.User = &user
+	resp := answer(t, client, func() error { return h.HandleDataSM(s, sarDataSM(1, "Hello ", 1, 2)) })
+	if resp.CommandStatus != protocol.ESME_RSYSERR {
+		t.Fatalf("status %#x, want ESME_RSYSERR", resp.CommandStatus)
+	}
+	if len(charges.refunded) != 1 {
+		t.Errorf("refunded %v, want the segment", charges.refunded)
+	}
+	if pending := len(smsHandler.assembler.pending); pending != 0 {
+		t.Errorf("%d messages buffered, want the segment dropped", pending)
+	}
+}
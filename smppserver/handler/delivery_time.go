@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"smppserver/protocol"
+	"time"
+	"tsimcloud/shared/smpptime"
+)
+
+// normalizeDeliveryTimes validates schedule_delivery_time and validity_period and returns them with relative times
+// rewritten as absolute times, so that they keep counting from the submission while the message is queued.
+// A schedule that has already passed is dropped and the message is delivered immediately.
+func normalizeDeliveryTimes(scheduleDeliveryTime, validityPeriod string, now time.Time) (string, string, uint32) {
+	schedule, err := smpptime.Parse(scheduleDeliveryTime, now)
+	if err != nil {
+		return "", "", protocol.ESME_RINVSCHED
+	}
+	expiry, err := smpptime.Parse(validityPeriod, now)
+	if err != nil {
+		return "", "", protocol.ESME_RINVEXPIRY
+	}
+
+	if !expiry.IsZero() {
+		if !expiry.After(now) {
+			return "", "", protocol.ESME_RINVEXPIRY
+		}
+		if !schedule.IsZero() && !schedule.Before(expiry) {
+			return "", "", protocol.ESME_RINVSCHED
+		}
+		validityPeriod = smpptime.FormatAbsolute(expiry)
+	}
+
+	if schedule.After(now) {
+		scheduleDeliveryTime = smpptime.FormatAbsolute(schedule)
+	} else {
+		scheduleDeliveryTime = ""
+	}
+
+	return scheduleDeliveryTime, validityPeriod, protocol.ESME_ROK
+}
+
+// initialMessageState is the state a message is stored with, SCHEDULED until a scheduled delivery time
+func initialMessageState(scheduleDeliveryTime string) uint8 {
+	if scheduleDeliveryTime != "" {
+		return protocol.MESSAGE_STATE_SCHEDULED
+	}
+	return protocol.MESSAGE_STATE_ENROUTE
+}
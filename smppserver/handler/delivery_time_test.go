@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"smppserver/protocol"
+)
+
+func TestNormalizeDeliveryTimes(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		schedule     string
+		validity     string
+		wantSchedule string
+		wantValidity string
+		wantStatus   uint32
+	}{
+		{"unset", "", "", "", "", protocol.ESME_ROK},
+		{"relative times", "000000010000000R", "000001000000000R", "240310130000000+", "240311120000000+", protocol.ESME_ROK},
+		{"past schedule", "240301000000000+", "", "", "", protocol.ESME_ROK},
+		{"past expiry", "", "240301000000000+", "", "", protocol.ESME_RINVEXPIRY},
+		{"schedule after expiry", "000000020000000R", "000000010000000R", "", "", protocol.ESME_RINVSCHED},
+		{"invalid schedule", "bad", "", "", "", protocol.ESME_RINVSCHED},
+	}
+	for _, tt := range tests {
+		schedule, validity, status := normalizeDeliveryTimes(tt.schedule, tt.validity, now)
+		if schedule != tt.wantSchedule || validity != tt.wantValidity || status != tt.wantStatus {
+			t.Errorf("%s: normalizeDeliveryTimes() = %q, %q, %#x, want %q, %q, %#x",
+				tt.name, schedule, validity, status, tt.wantSchedule, tt.wantValidity, tt.wantStatus)
+		}
+	}
+}
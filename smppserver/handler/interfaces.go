@@ -17,7 +17,7 @@ type SMSHandlerInterface interface {
 	HandleSubmitSM(session *session.Session, pdu *protocol.PDU) error
 	HandleDeliverSM(session *session.Session, pdu *protocol.PDU) error
 	SendDeliverSM(session *session.Session, deliver *protocol.DeliverSMPDU) error
-	GenerateMessageID() string
+	GenerateMessageID(session *session.Session) string
 }
 
 // SessionHandlerInterface defines the interface for session management operations
@@ -30,7 +30,7 @@ type SessionHandlerInterface interface {
 // DataSMHandlerInterface defines the interface for data_sm operations
 type DataSMHandlerInterface interface {
 	HandleDataSM(session *session.Session, pdu *protocol.PDU) error
-	GenerateMessageID() string
+	GenerateMessageID(session *session.Session) string
 }
 
 // QuerySMHandlerInterface defines the interface for query_sm operations
@@ -57,5 +57,5 @@ type AlertNotificationHandlerInterface interface {
 type SMPPHandlerInterface interface {
 	HandlePDU(session *session.Session, pdu *protocol.PDU) error
 	SendDeliverSM(session *session.Session, deliver *protocol.DeliverSMPDU) error
-	GenerateMessageID() string
+	GenerateMessageID(session *session.Session) string
 }
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"log"
+	"regexp"
+	"smppserver/auth"
+	"smppserver/protocol"
+	"smppserver/rabbitmq"
+	"smppserver/session"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tsimcloud/shared/smpptime"
+)
+
+// mtFilterPatterns caches the compiled regular expressions of the MT filters by pattern
+var mtFilterPatterns sync.Map
+
+// applyMTFilters enforces the MT messaging filters of the user on a message before it is accepted.
+// The source address is replaced by MtSrcAddr when the user may not choose it, and the priority and
+// validity period are capped. Messages failing the source, destination or content filters are rejected
+// with the returned status and counted in the user stats. The content of segments is filtered once the
+// message is reassembled, as a pattern may span several segments.
+func (h *SMSHandler) applyMTFilters(session *session.Session, message *rabbitmq.SubmitSMMessage) uint32 {
+	smppUser, err := h.sessionUser(session)
+	if err != nil {
+		log.Printf("Session %s: Failed to load MT filters: %v", session.ID, err)
+		return protocol.ESME_RSYSERR
+	}
+
+	if defaultSource := stringValue(smppUser.MtSrcAddr); defaultSource != "" && !smppUser.MtSrcAddrAuth {
+		message.SourceAddr = defaultSource
+	}
+
+	status := uint32(protocol.ESME_ROK)
+	if !matchMTFilter(smppUser.MtSrcAddrFilter, message.SourceAddr) {
+		log.Printf("Session %s: Source address %s rejected by filter", session.ID, message.SourceAddr)
+		status = protocol.ESME_RINVSRCADR
+	} else if !matchMTFilter(smppUser.MtDstAddrFilter, message.DestinationAddr) {
+		log.Printf("Session %s: Destination address %s rejected by filter", session.ID, message.DestinationAddr)
+		status = protocol.ESME_RINVDSTADR
+	} else if !isSegment(message.Concatenation) && !matchMTFilter(smppUser.MtContentFilter, message.ShortMessage) {
+		log.Printf("Session %s: Message content rejected by filter", session.ID)
+		status = protocol.ESME_RSUBMITFAIL
+	}
+	if status != protocol.ESME_ROK {
+		if err := h.authManager.IncrementRejectedCount(session.SystemID); err != nil {
+			log.Printf("Session %s: Failed to increment rejected message counter: %v", session.ID, err)
+		}
+		return status
+	}
+
+	if maxPriority, ok := parseMTLimit(smppUser.MtPriorityFilter); ok && maxPriority <= protocol.PRIORITY_LEVEL_3 && int(message.PriorityFlag) > maxPriority {
+		log.Printf("Session %s: Priority %d capped to %d", session.ID, message.PriorityFlag, maxPriority)
+		message.PriorityFlag = uint8(maxPriority)
+	}
+
+	message.ValidityPeriod = capValidityPeriod(session, smppUser, message.ValidityPeriod)
+	return protocol.ESME_ROK
+}
+
+// capValidityPeriod limits a validity period to the validity period filter of the user, the longest validity in minutes.
+// An empty validity period, which would last as long as the SMSC keeps messages, is capped as well.
+func capValidityPeriod(session *session.Session, smppUser *auth.SmppUser, validityPeriod string) string {
+	maxMinutes, ok := parseMTLimit(smppUser.MtValidityPeriodFilter)
+	if !ok {
+		return validityPeriod
+	}
+
+	now := time.Now()
+	maxExpiry := now.Add(time.Duration(maxMinutes) * time.Minute)
+	expiry, err := smpptime.Parse(validityPeriod, now)
+	if err != nil || expiry.IsZero() || expiry.After(maxExpiry) {
+		log.Printf("Session %s: Validity period %q capped to %d minutes", session.ID, validityPeriod, maxMinutes)
+		return smpptime.FormatAbsolute(maxExpiry)
+	}
+	return validityPeriod
+}
+
+// matchMTFilter reports whether value matches the regular expression of a filter, an unset filter matches everything.
+// An invalid expression rejects every message so that a misconfigured filter does not let traffic through.
+func matchMTFilter(filter *string, value string) bool {
+	pattern := stringValue(filter)
+	if pattern == "" {
+		return true
+	}
+
+	compiled, ok := mtFilterPatterns.Load(pattern)
+	if !ok {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Printf("Invalid MT filter %q: %v", pattern, err)
+			return false
+		}
+		compiled, _ = mtFilterPatterns.LoadOrStore(pattern, expression)
+	}
+	return compiled.(*regexp.Regexp).MatchString(value)
+}
+
+// parseMTLimit parses a numeric MT limit, reporting false when it is unset or invalid
+func parseMTLimit(value *string) (int, bool) {
+	limit, err := strconv.Atoi(strings.TrimSpace(stringValue(value)))
+	if err != nil || limit < 0 {
+		return 0, false
+	}
+	return limit, true
+}
+
+// stringValue dereferences an optional user setting
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
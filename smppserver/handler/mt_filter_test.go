@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"testing"
+
+	"smppserver/auth"
+	"smppserver/protocol"
+	"smppserver/rabbitmq"
+	"smppserver/session"
+)
+
+// staleUserManager fails the test when the user is loaded again instead of taken from the session
+type staleUserManager struct {
+	auth.AuthManager
+	t *testing.T
+}
+
+func (m *staleUserManager) GetUser(systemID string) (*auth.SmppUser, error) {
+	m.t.Errorf("GetUser(%s) called, want the user bound to the session", systemID)
+	return &auth.SmppUser{}, nil
+}
+
+func (m *staleUserManager) IncrementRejectedCount(systemID string) error {
+	return nil
+}
+
+func TestApplyMTFilters(t *testing.T) {
+	filter := "^Hello world$"
+	source := "^sender$"
+	h := &SMSHandler{authManager: &staleUserManager{t: t}}
+	boundSession := &session.Session{ID: "1", SystemID: "esme", User: &auth.SmppUser{MtContentFilter: &filter, MtSrcAddrFilter: &source}}
+
+	tests := []struct {
+		name    string
+		message *rabbitmq.SubmitSMMessage
+		want    uint32
+	}{
+		{"matching message", &rabbitmq.SubmitSMMessage{SourceAddr: "sender", ShortMessage: "Hello world"}, protocol.ESME_ROK},
+		{"content rejected", &rabbitmq.SubmitSMMessage{SourceAddr: "sender", ShortMessage: "Hello there"}, protocol.ESME_RSUBMITFAIL},
+		{"source rejected", &rabbitmq.SubmitSMMessage{SourceAddr: "other", ShortMessage: "Hello world"}, protocol.ESME_RINVSRCADR},
+		// The content of a segment is filtered once the message is reassembled
+		{"segment", &rabbitmq.SubmitSMMessage{SourceAddr: "sender", ShortMessage: "Hello ",
+			Concatenation: &rabbitmq.ConcatenationInfo{ReferenceNumber: 1, TotalSegments: 2, SequenceNumber: 1}}, protocol.ESME_ROK},
+	}
+
+	for _, tt := range tests {
+		if got := h.applyMTFilters(boundSession, tt.message); got != tt.want {
+			t.Errorf("%s: applyMTFilters() = %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -5,19 +5,23 @@ import (
 	"smppserver/auth"
 	"smppserver/protocol"
 	"smppserver/session"
+	"smppserver/store"
+	"tsimcloud/shared/smpptime"
 )
 
 // QuerySMHandler handles query_sm operations
 type QuerySMHandler struct {
 	authManager    auth.AuthManager
 	sessionManager *session.SessionManager
+	messageStore   store.MessageStore
 }
 
 // NewQuerySMHandler creates a new query SM handler
-func NewQuerySMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager) *QuerySMHandler {
+func NewQuerySMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, messageStore store.MessageStore) *QuerySMHandler {
 	return &QuerySMHandler{
 		authManager:    authManager,
 		sessionManager: sessionManager,
+		messageStore:   messageStore,
 	}
 }
 
@@ -35,12 +39,34 @@ func (h *QuerySMHandler) HandleQuerySM(session *session.Session, pdu *protocol.P
 
 	log.Printf("Session %s: Query SM for message ID: %s", session.ID, query.MessageID)
 
+	if h.messageStore == nil {
+		log.Printf("Session %s: Message store not available for query_sm", session.ID)
+		return session.SendResponse(protocol.QUERY_SM_RESP, protocol.ESME_RQUERYFAIL, nil, pdu.SequenceNumber)
+	}
+
+	message, err := h.messageStore.GetMessage(session.SystemID, query.MessageID)
+	if err != nil {
+		log.Printf("Session %s: Query SM failed for message ID %s: %v", session.ID, query.MessageID, err)
+		return session.SendResponse(protocol.QUERY_SM_RESP, protocol.ESME_RQUERYFAIL, nil, pdu.SequenceNumber)
+	}
+
+	// source_addr must match the originator of the message when it is given
+	if query.SourceAddr != "" && query.SourceAddr != message.SourceAddr {
+		log.Printf("Session %s: Query SM source address mismatch for message ID %s", session.ID, query.MessageID)
+		return session.SendResponse(protocol.QUERY_SM_RESP, protocol.ESME_RQUERYFAIL, nil, pdu.SequenceNumber)
+	}
+
+	finalDate := ""
+	if message.FinalDate != nil {
+		finalDate = smpptime.FormatAbsolute(*message.FinalDate)
+	}
+
 	// Send query_sm response
 	responseBody := protocol.SerializeQuerySMRespPDU(&protocol.QuerySMRespPDU{
-		MessageID:    query.MessageID,
-		FinalDate:    "",
-		MessageState: 0,
-		ErrorCode:    0,
+		MessageID:    message.MessageID,
+		FinalDate:    finalDate,
+		MessageState: message.MessageState,
+		ErrorCode:    message.ErrorCode,
 	})
 
 	return session.SendResponse(protocol.QUERY_SM_RESP, protocol.ESME_ROK, responseBody, pdu.SequenceNumber)
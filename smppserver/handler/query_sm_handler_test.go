@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"smppserver/protocol"
+	"smppserver/session"
+	"smppserver/store"
+)
+
+// boundSession returns a session bound as systemID and the ESME end of its connection
+func boundSession(t *testing.T, systemID string) (*session.Session, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s := session.NewSession(server, &session.SessionConfig{
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		ResponseTimeout: time.Second,
+	})
+	s.SystemID = systemID
+	s.SetState(session.StateBoundTRX)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return s, client
+}
+
+// answer runs handle and returns the response the ESME receives
+func answer(t *testing.T, client net.Conn, handle func() error) *protocol.PDU {
+	t.Helper()
+
+	errs := make(chan error, 1)
+	go func() { errs <- handle() }()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	pdu, err := protocol.ReadPDU(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return pdu
+}
+
+// queryStore returns the messages of one system
+type queryStore struct {
+	store.MessageStore
+	messages map[string]*store.SmppMessage
+}
+
+func (s *queryStore) GetMessage(systemID, messageID string) (*store.SmppMessage, error) {
+	if message, exists := s.messages[messageID]; exists && message.SystemID == systemID {
+		copied := *message
+		return &copied, nil
+	}
+	return nil, store.ErrMessageNotFound
+}
+
+func querySM(messageID, sourceAddr string) *protocol.PDU {
+	return &protocol.PDU{
+		CommandID:      protocol.QUERY_SM,
+		SequenceNumber: 5,
+		Body:           protocol.SerializeQuerySMPDU(&protocol.QuerySMPDU{MessageID: messageID, SourceAddr: sourceAddr}),
+	}
+}
+
+// parseQuerySMResp splits a query_sm_resp body into its fields
+func parseQuerySMResp(t *testing.T, body []byte) protocol.QuerySMRespPDU {
+	t.Helper()
+
+	fields := bytes.SplitN(body, []byte{0}, 3)
+	if len(fields) != 3 || len(fields[2]) != 2 {
+		t.Fatalf("malformed query_sm_resp body %x", body)
+	}
+	return protocol.QuerySMRespPDU{
+		MessageID:    string(fields[0]),
+		FinalDate:    string(fields[1]),
+		MessageState: fields[2][0],
+		ErrorCode:    fields[2][1],
+	}
+}
+
+func TestQuerySMAnswersStateOfKnownMessage(t *testing.T) {
+	finalDate := time.Date(2024, 3, 5, 14, 30, 45, 0, time.UTC)
+	messageStore := &queryStore{messages: map[string]*store.SmppMessage{
+		"pending":   {MessageID: "pending", SystemID: "esme", SourceAddr: "sender", MessageState: protocol.MESSAGE_STATE_ENROUTE},
+		"failed":    {MessageID: "failed", SystemID: "esme", SourceAddr: "sender", MessageState: protocol.MESSAGE_STATE_UNDELIVERABLE, ErrorCode: 0x45, FinalDate: &finalDate},
+		"delivered": {MessageID: "delivered", SystemID: "esme", SourceAddr: "sender", MessageState: protocol.MESSAGE_STATE_DELIVERED, FinalDate: &finalDate},
+	}}
+	h := NewQuerySMHandler(nil, nil, messageStore)
+
+	tests := []struct {
+		id        string
+		state     uint8
+		errorCode uint8
+		finalDate string
+	}{
+		{"pending", protocol.MESSAGE_STATE_ENROUTE, 0, ""},
+		{"failed", protocol.MESSAGE_STATE_UNDELIVERABLE, 0x45, "240305143045000+"},
+		{"delivered", protocol.MESSAGE_STATE_DELIVERED, 0, "240305143045000+"},
+	}
+	for _, tt := range tests {
+		s, client := boundSession(t, "esme")
+		resp := answer(t, client, func() error { return h.HandleQuerySM(s, querySM(tt.id, "sender")) })
+
+		if resp.CommandID != protocol.QUERY_SM_RESP || resp.CommandStatus != protocol.ESME_ROK || resp.SequenceNumber != 5 {
+			t.Fatalf("%s: response %#x status %#x sequence %d, want query_sm_resp ESME_ROK 5", tt.id, resp.CommandID, resp.CommandStatus, resp.SequenceNumber)
+		}
+		got := parseQuerySMResp(t, resp.Body)
+		if got.MessageID != tt.id || got.MessageState != tt.state || got.ErrorCode != tt.errorCode {
+			t.Errorf("%s: answered %+v, want state %d error code %#x", tt.id, got, tt.state, tt.errorCode)
+		}
+		if got.FinalDate != tt.finalDate {
+			t.Errorf("%s: final date %q, want %q", tt.id, got.FinalDate, tt.finalDate)
+		}
+	}
+}
+
+func TestQuerySMFailsForUnknownMessage(t *testing.T) {
+	messageStore := &queryStore{messages: map[string]*store.SmppMessage{
+		"other": {MessageID: "other", SystemID: "another-esme", SourceAddr: "sender"},
+		"mine":  {MessageID: "mine", SystemID: "esme", SourceAddr: "sender"},
+	}}
+	h := NewQuerySMHandler(nil, nil, messageStore)
+
+	tests := []struct {
+		name  string
+		query *protocol.PDU
+	}{
+		{"unknown message ID", querySM("missing", "")},
+		{"message of another system", querySM("other", "")},
+		{"other source address", querySM("mine", "someone-else")},
+	}
+	for _, tt := range tests {
+		s, client := boundSession(t, "esme")
+		resp := answer(t, client, func() error { return h.HandleQuerySM(s, tt.query) })
+		if resp.CommandStatus != protocol.ESME_RQUERYFAIL {
+			t.Errorf("%s: status %#x, want ESME_RQUERYFAIL", tt.name, resp.CommandStatus)
+		}
+	}
+
+	// Without a message store nothing can be queried
+	s, client := boundSession(t, "esme")
+	resp := answer(t, client, func() error { return NewQuerySMHandler(nil, nil, nil).HandleQuerySM(s, querySM("mine", "")) })
+	if resp.CommandStatus != protocol.ESME_RQUERYFAIL {
+		t.Errorf("without a store: status %#x, want ESME_RQUERYFAIL", resp.CommandStatus)
+	}
+}
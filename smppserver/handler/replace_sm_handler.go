@@ -1,29 +1,37 @@
 package handler
 
 import (
+	"errors"
 	"log"
 	"smppserver/auth"
 	"smppserver/protocol"
 	"smppserver/session"
+	"smppserver/store"
+	"time"
 )
 
 // ReplaceSMHandler handles replace_sm operations
 type ReplaceSMHandler struct {
 	authManager    auth.AuthManager
 	sessionManager *session.SessionManager
+	messageStore   store.MessageStore
+	// nationalLanguage selects the GSM 7-bit shift tables used to count the segments of replaced messages
+	nationalLanguage protocol.GSM7Language
 }
 
 // NewReplaceSMHandler creates a new replace SM handler
-func NewReplaceSMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager) *ReplaceSMHandler {
+func NewReplaceSMHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, messageStore store.MessageStore, nationalLanguage protocol.GSM7Language) *ReplaceSMHandler {
 	return &ReplaceSMHandler{
-		authManager:    authManager,
-		sessionManager: sessionManager,
+		authManager:      authManager,
+		sessionManager:   sessionManager,
+		messageStore:     messageStore,
+		nationalLanguage: nationalLanguage,
 	}
 }
 
 // HandleReplaceSM handles replace_sm requests
 func (h *ReplaceSMHandler) HandleReplaceSM(session *session.Session, pdu *protocol.PDU) error {
-	if !session.IsBound() {
+	if !session.CanTransmit() {
 		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RINVBNDSTS, nil, pdu.SequenceNumber)
 	}
 
@@ -35,6 +43,92 @@ func (h *ReplaceSMHandler) HandleReplaceSM(session *session.Session, pdu *protoc
 
 	log.Printf("Session %s: Replace SM for message ID: %s", session.ID, replace.MessageID)
 
+	if h.messageStore == nil {
+		log.Printf("Session %s: Message store not available for replace_sm", session.ID)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+
+	message, err := h.messageStore.GetMessage(session.SystemID, replace.MessageID)
+	if err != nil {
+		log.Printf("Session %s: Replace SM failed for message ID %s: %v", session.ID, replace.MessageID, err)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+
+	// source_addr must match the originator of the message when it is given
+	if replace.SourceAddr != "" && replace.SourceAddr != message.SourceAddr {
+		log.Printf("Session %s: Replace SM source address mismatch for message ID %s", session.ID, replace.MessageID)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+
+	// Segments are replaced as part of the message they were published as, which only exists once all of them arrived
+	if message.SegmentNumber > 0 && message.ParentMessageID == "" {
+		log.Printf("Session %s: Replace SM for segment %s of a message that is still being assembled", session.ID, replace.MessageID)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+	if message, err = concatenatedParent(h.messageStore, message); err != nil {
+		log.Printf("Session %s: Replace SM failed to load the message of segment %s: %v", session.ID, replace.MessageID, err)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+
+	// Validate the new delivery times, relative times count from now
+	scheduleDeliveryTime, validityPeriod, status := normalizeDeliveryTimes(replace.ScheduleDeliveryTime, replace.ValidityPeriod, time.Now())
+	if status != protocol.ESME_ROK {
+		log.Printf("Session %s: Invalid delivery times schedule %q validity %q", session.ID, replace.ScheduleDeliveryTime, replace.ValidityPeriod)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// replace_sm carries no data_coding, the new text uses the coding of the original message
+	var shortMessage string
+	if replace.SMLength > 0 {
+		shortMessage, err = protocol.DecodeShortMessage([]byte(replace.ShortMessage), message.DataCoding)
+		if err != nil {
+			log.Printf("Session %s: Failed to decode replacement message: %v", session.ID, err)
+			shortMessage = replace.ShortMessage
+		}
+	}
+
+	// The MT filters of the user apply to the replacement as they did to the submitted message
+	smppUser, err := boundUser(h.authManager, session)
+	if err != nil {
+		log.Printf("Session %s: Failed to load MT filters: %v", session.ID, err)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RSYSERR, nil, pdu.SequenceNumber)
+	}
+	if shortMessage != "" && !matchMTFilter(smppUser.MtContentFilter, shortMessage) {
+		log.Printf("Session %s: Replacement of message ID %s rejected by content filter", session.ID, replace.MessageID)
+		if err := h.authManager.IncrementRejectedCount(session.SystemID); err != nil {
+			log.Printf("Session %s: Failed to increment rejected message counter: %v", session.ID, err)
+		}
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+	// An empty validity period keeps the current one, which was capped when the message was submitted
+	if validityPeriod != "" {
+		validityPeriod = capValidityPeriod(session, smppUser, validityPeriod)
+	}
+
+	// A new text is charged by its own segment count, the difference is reserved or given back with the replacement
+	segments := 0
+	if shortMessage != "" {
+		segments = max(protocol.ChooseEncoding(shortMessage, h.nationalLanguage).SegmentCount, 1)
+	}
+
+	err = h.messageStore.ReplaceMessage(message, &store.MessageReplacement{
+		ShortMessage:         shortMessage,
+		ScheduleDeliveryTime: scheduleDeliveryTime,
+		ValidityPeriod:       validityPeriod,
+		RegisteredDelivery:   replace.RegisteredDelivery,
+		Segments:             segments,
+	})
+	if errors.Is(err, auth.ErrInsufficientBalance) {
+		log.Printf("Session %s: Insufficient balance for %d segment(s) of replaced message %s", session.ID, segments, replace.MessageID)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+	if err != nil {
+		log.Printf("Session %s: Replace SM failed for message ID %s: %v", session.ID, replace.MessageID, err)
+		return session.SendResponse(protocol.REPLACE_SM_RESP, protocol.ESME_RREPLACEFAIL, nil, pdu.SequenceNumber)
+	}
+
+	log.Printf("Session %s: Replaced message %s", session.ID, replace.MessageID)
+
 	// Send replace_sm response
 	responseBody := protocol.SerializeReplaceSMRespPDU()
 
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"smppserver/auth"
+	"smppserver/protocol"
+	"smppserver/store"
+	"tsimcloud/shared/smpptime"
+)
+
+func replaceSM(messageID, text, validityPeriod string) *protocol.PDU {
+	return &protocol.PDU{
+		CommandID:      protocol.REPLACE_SM,
+		SequenceNumber: 9,
+		Body: protocol.SerializeReplaceSMPDU(&protocol.ReplaceSMPDU{
+			MessageID:      messageID,
+			ValidityPeriod: validityPeriod,
+			SMLength:       uint8(len(text)),
+			ShortMessage:   text,
+		}),
+	}
+}
+
+func TestReplaceSMAppliesMTFilters(t *testing.T) {
+	filter := "^[^!]*$" // No exclamation mark anywhere in the message
+	maxValidity := "60"
+	user := auth.SmppUser{SystemID: "esme", MtContentFilter: &filter, MtValidityPeriodFilter: &maxValidity}
+
+	tests := []struct {
+		name           string
+		text           string
+		validityPeriod string
+		status         uint32
+		storedText     string
+		capped         bool // Whether the stored validity period is set and within the filter
+	}{
+		{"text rejected by the content filter", "Act now!", "", protocol.ESME_RREPLACEFAIL, "Original", false},
+		{"validity period capped", "Hello", "000002000000000R", protocol.ESME_ROK, "Hello", true},
+		{"validity period within the filter", "Hello", "000000003000000R", protocol.ESME_ROK, "Hello", true},
+		{"validity period kept", "Hello", "", protocol.ESME_ROK, "Hello", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageStore := newMemoryStore()
+			messageStore.CreateMessage(&store.SmppMessage{MessageID: "m1", SystemID: "esme", ShortMessage: "Original", MessageState: protocol.MESSAGE_STATE_ENROUTE})
+			rejections := &refundRecorder{user: user}
+			h := NewReplaceSMHandler(rejections, nil, messageStore, protocol.GSM7LanguageDefault)
+			s, client := boundSession(t, "esme")
+			s.User = &user
+
+			resp := answer(t, client, func() error { return h.HandleReplaceSM(s, replaceSM("m1", tt.text, tt.validityPeriod)) })
+			if resp.CommandStatus != tt.status {
+				t.Fatalf("status = %#x, want %#x", resp.CommandStatus, tt.status)
+			}
+
+			stored, _ := messageStore.GetMessage("esme", "m1")
+			if stored.ShortMessage != tt.storedText {
+				t.Errorf("stored text %q, want %q", stored.ShortMessage, tt.storedText)
+			}
+			if tt.status != protocol.ESME_ROK && rejections.rejected != 1 {
+				t.Errorf("rejected count = %d, want 1", rejections.rejected)
+			}
+			if !tt.capped {
+				if stored.ValidityPeriod != "" {
+					t.Errorf("validity period changed to %q", stored.ValidityPeriod)
+				}
+				return
+			}
+			expiry, err := smpptime.Parse(stored.ValidityPeriod, time.Now())
+			if err != nil || expiry.IsZero() || expiry.After(time.Now().Add(time.Hour)) {
+				t.Errorf("stored validity period %q (%v), want at most an hour", stored.ValidityPeriod, err)
+			}
+		})
+	}
+}
+
+func TestReplaceSMRepricesTheMessage(t *testing.T) {
+	user := auth.SmppUser{SystemID: "esme"}
+	tests := []struct {
+		name       string
+		text       string
+		replaceErr error
+		status     uint32
+		segments   int // Segments of the replacement passed to the store
+	}{
+		{"single segment", "Hello", nil, protocol.ESME_ROK, 1},
+		{"longer text", strings.Repeat("a", 200), nil, protocol.ESME_ROK, 2},
+		{"text kept", "", nil, protocol.ESME_ROK, 0},
+		{"balance too low", strings.Repeat("a", 200), auth.ErrInsufficientBalance, protocol.ESME_RREPLACEFAIL, 0},
+		{"store failure", "Hello", fmt.Errorf("database error"), protocol.ESME_RREPLACEFAIL, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageStore := newMemoryStore()
+			messageStore.CreateMessage(&store.SmppMessage{MessageID: "m1", SystemID: "esme", ShortMessage: "Original", MessageState: protocol.MESSAGE_STATE_ENROUTE})
+			messageStore.replaceErr = tt.replaceErr
+			h := NewReplaceSMHandler(&refundRecorder{user: user}, nil, messageStore, protocol.GSM7LanguageDefault)
+			s, client := boundSession(t, "esme")
+			s.User = &user
+
+			resp := answer(t, client, func() error { return h.HandleReplaceSM(s, replaceSM("m1", tt.text, "")) })
+			if resp.CommandStatus != tt.status {
+				t.Fatalf("status = %#x, want %#x", resp.CommandStatus, tt.status)
+			}
+			if tt.replaceErr != nil {
+				if stored, _ := messageStore.GetMessage("esme", "m1"); stored.ShortMessage != "Original" {
+					t.Errorf("stored text %q after a failed replacement", stored.ShortMessage)
+				}
+				return
+			}
+			if len(messageStore.replacements) != 1 || messageStore.replacements[0].Segments != tt.segments {
+				t.Errorf("replacements %+v, want one of %d segments", messageStore.replacements, tt.segments)
+			}
+		})
+	}
+}
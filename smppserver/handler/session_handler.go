@@ -25,6 +25,9 @@ func NewSessionHandler(authManager auth.AuthManager, sessionManager *session.Ses
 func (h *SessionHandler) HandleUnbind(session *session.Session, pdu *protocol.PDU) error {
 	log.Printf("Session %s: Received unbind request", session.ID)
 
+	// Messages still waiting for the broker are answered before the unbind
+	session.WaitDispatched()
+
 	// Remove session from Redis
 	if session.SystemID != "" {
 		if err := h.authManager.RemoveSession(session.SystemID, session.ID); err != nil {
@@ -6,7 +6,9 @@ import (
 	"smppserver/protocol"
 	"smppserver/rabbitmq"
 	"smppserver/session"
+	"smppserver/store"
 	"time"
+	"tsimcloud/shared/idgen"
 )
 
 // SMPPHandler handles SMPP protocol operations
@@ -17,6 +19,7 @@ type SMPPHandler struct {
 	// Separate handlers
 	bindHandler              *BindHandler
 	smsHandler               *SMSHandler
+	submitMultiHandler       *SubmitMultiHandler
 	sessionHandler           *SessionHandler
 	dataSMHandler            *DataSMHandler
 	querySMHandler           *QuerySMHandler
@@ -26,17 +29,20 @@ type SMPPHandler struct {
 }
 
 // NewSMPPHandler creates a new SMPP handler
-func NewSMPPHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, rabbitMQClient *rabbitmq.RabbitMQClient) *SMPPHandler {
+func NewSMPPHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, rabbitMQClient *rabbitmq.RabbitMQClient, messageStore store.MessageStore, idGenerator *idgen.Generator, concatenationTimeout time.Duration, nationalLanguage protocol.GSM7Language) *SMPPHandler {
+	smsHandler := NewSMSHandler(authManager, sessionManager, rabbitMQClient, messageStore, idGenerator, concatenationTimeout, nationalLanguage)
+
 	return &SMPPHandler{
 		authManager:              authManager,
 		sessionManager:           sessionManager,
-		bindHandler:              NewBindHandler(authManager, sessionManager),
-		smsHandler:               NewSMSHandler(authManager, sessionManager, rabbitMQClient),
+		bindHandler:              NewBindHandler(authManager, sessionManager, rabbitMQClient),
+		smsHandler:               smsHandler,
+		submitMultiHandler:       NewSubmitMultiHandler(authManager, sessionManager, smsHandler),
 		sessionHandler:           NewSessionHandler(authManager, sessionManager),
-		dataSMHandler:            NewDataSMHandler(authManager, sessionManager),
-		querySMHandler:           NewQuerySMHandler(authManager, sessionManager),
-		cancelSMHandler:          NewCancelSMHandler(authManager, sessionManager),
-		replaceSMHandler:         NewReplaceSMHandler(authManager, sessionManager),
+		dataSMHandler:            NewDataSMHandler(authManager, sessionManager, smsHandler),
+		querySMHandler:           NewQuerySMHandler(authManager, sessionManager, messageStore),
+		cancelSMHandler:          NewCancelSMHandler(authManager, sessionManager, rabbitMQClient, messageStore),
+		replaceSMHandler:         NewReplaceSMHandler(authManager, sessionManager, messageStore, nationalLanguage),
 		alertNotificationHandler: NewAlertNotificationHandler(authManager, sessionManager),
 	}
 }
@@ -63,18 +69,27 @@ func (h *SMPPHandler) HandlePDU(session *session.Session, pdu *protocol.PDU) err
 		return h.sessionHandler.HandleEnquireLink(session, pdu)
 	case protocol.ENQUIRE_LINK_RESP:
 		return h.sessionHandler.HandleEnquireLinkResp(session, pdu)
+	case protocol.GENERIC_NACK:
+		return h.handleGenericNACK(session, pdu)
 
-	// SMS operations
+	// SMS operations, messages wait for the broker confirmation off the read loop
 	case protocol.SUBMIT_SM:
-		return h.smsHandler.HandleSubmitSM(session, pdu)
+		session.Dispatch(pdu, func() error { return h.smsHandler.HandleSubmitSM(session, pdu) })
+		return nil
 	case protocol.SUBMIT_SM_RESP:
 		return h.smsHandler.HandleSubmitSMResp(session, pdu)
+	case protocol.SUBMIT_MULTI:
+		session.Dispatch(pdu, func() error { return h.submitMultiHandler.HandleSubmitMulti(session, pdu) })
+		return nil
+	case protocol.SUBMIT_MULTI_RESP:
+		return h.submitMultiHandler.HandleSubmitMultiResp(session, pdu)
 	case protocol.DELIVER_SM:
 		return h.smsHandler.HandleDeliverSM(session, pdu)
 	case protocol.DELIVER_SM_RESP:
 		return h.smsHandler.HandleDeliverSMResp(session, pdu)
 	case protocol.DATA_SM:
-		return h.dataSMHandler.HandleDataSM(session, pdu)
+		session.Dispatch(pdu, func() error { return h.dataSMHandler.HandleDataSM(session, pdu) })
+		return nil
 	case protocol.DATA_SM_RESP:
 		return h.dataSMHandler.HandleDataSMResp(session, pdu)
 
@@ -112,20 +127,34 @@ func (h *SMPPHandler) handleOutbind(session *session.Session, pdu *protocol.PDU)
 	return session.SendGenericNACK(pdu.SequenceNumber)
 }
 
+// handleGenericNACK handles generic_nack sent by the ESME in reply to one of our requests
+func (h *SMPPHandler) handleGenericNACK(session *session.Session, pdu *protocol.PDU) error {
+	log.Printf("Session %s: Received generic_nack for sequence %d with status 0x%08X", session.ID, pdu.SequenceNumber, pdu.CommandStatus)
+	// A generic_nack must never be answered
+	session.HandleResponse(pdu)
+	return nil
+}
+
 // SendDeliverSM sends a deliver_sm PDU to the session
 func (h *SMPPHandler) SendDeliverSM(session *session.Session, deliver *protocol.DeliverSMPDU) error {
 	// Convert to PDU
+	body := protocol.SerializeDeliverSMPDU(deliver)
 	pdu := &protocol.PDU{
-		CommandLength:  uint32(16 + len(protocol.SerializeSubmitSMPDU((*protocol.SubmitSMPDU)(deliver)))),
+		CommandLength:  uint32(16 + len(body)),
 		CommandID:      protocol.DELIVER_SM,
 		CommandStatus:  0,
 		SequenceNumber: session.GetNextSequenceNumber(),
-		Body:           protocol.SerializeSubmitSMPDU((*protocol.SubmitSMPDU)(deliver)),
+		Body:           body,
 	}
 	return session.SendPDU(pdu)
 }
 
 // GenerateMessageID generates a unique message ID
-func (h *SMPPHandler) GenerateMessageID() string {
-	return "MSG" + time.Now().Format("20060102150405")
+func (h *SMPPHandler) GenerateMessageID(session *session.Session) string {
+	return h.smsHandler.GenerateMessageID(session)
+}
+
+// StartSegmentRecovery rejects and refunds the stored segments of concatenated messages that were never assembled
+func (h *SMPPHandler) StartSegmentRecovery() {
+	h.smsHandler.StartSegmentRecovery()
 }
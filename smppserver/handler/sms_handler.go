@@ -1,28 +1,60 @@
 package handler
 
 import (
+	"errors"
 	"log"
 	"smppserver/auth"
 	"smppserver/protocol"
 	"smppserver/rabbitmq"
 	"smppserver/session"
+	"smppserver/store"
 	"time"
+	"tsimcloud/shared/dlr"
+	"tsimcloud/shared/idgen"
 )
 
+// submitPublisher publishes accepted messages to the router, implemented by the RabbitMQ client
+type submitPublisher interface {
+	IsConnected() bool
+	PublishSubmitSM(message *rabbitmq.SubmitSMMessage) error
+}
+
+// reportDeliverer sends delivery reports raised by this server to the ESME, implemented by the RabbitMQ client
+type reportDeliverer interface {
+	DeliverLocalReport(sessionManager *session.SessionManager, report *rabbitmq.DeliveryReportMessage)
+}
+
 // SMSHandler handles SMS-related operations
 type SMSHandler struct {
 	authManager    auth.AuthManager
 	sessionManager *session.SessionManager
 	rabbitMQClient *rabbitmq.RabbitMQClient
+	publisher      submitPublisher // nil without RabbitMQ
+	reporter       reportDeliverer // nil without RabbitMQ
+	messageStore   store.MessageStore
+	idGenerator    *idgen.Generator
+	assembler      *SegmentAssembler
+
+	// nationalLanguage selects the GSM 7-bit shift tables used to count the segments of charged messages
+	nationalLanguage protocol.GSM7Language
 }
 
 // NewSMSHandler creates a new SMS handler
-func NewSMSHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, rabbitMQClient *rabbitmq.RabbitMQClient) *SMSHandler {
-	return &SMSHandler{
-		authManager:    authManager,
-		sessionManager: sessionManager,
-		rabbitMQClient: rabbitMQClient,
+func NewSMSHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, rabbitMQClient *rabbitmq.RabbitMQClient, messageStore store.MessageStore, idGenerator *idgen.Generator, concatenationTimeout time.Duration, nationalLanguage protocol.GSM7Language) *SMSHandler {
+	h := &SMSHandler{
+		authManager:      authManager,
+		sessionManager:   sessionManager,
+		rabbitMQClient:   rabbitMQClient,
+		messageStore:     messageStore,
+		idGenerator:      idGenerator,
+		nationalLanguage: nationalLanguage,
 	}
+	if rabbitMQClient != nil {
+		h.publisher = rabbitMQClient
+		h.reporter = rabbitMQClient
+	}
+	h.assembler = NewSegmentAssembler(concatenationTimeout, h.publishAssembled)
+	return h
 }
 
 // HandleSubmitSM handles submit_sm requests
@@ -49,42 +81,35 @@ func (h *SMSHandler) HandleSubmitSM(session *session.Session, pdu *protocol.PDU)
 		return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_RINVDSTADR, nil, pdu.SequenceNumber)
 	}
 
-	// Check rate limit
-	if allowed, err := h.authManager.CheckRateLimit(session.SystemID); err != nil {
-		log.Printf("Session %s: Rate limit check failed: %v", session.ID, err)
-		return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_RSYSERR, nil, pdu.SequenceNumber)
-	} else if !allowed {
-		log.Printf("Session %s: Rate limit exceeded for user %s", session.ID, session.SystemID)
-		return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_RTHROTTLED, nil, pdu.SequenceNumber)
+	// The message body goes either in short_message or in message_payload, never both
+	if submit.HasShortMessageAndPayload() {
+		log.Printf("Session %s: Both short_message and message_payload present", session.ID)
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
 	}
-
-	// Generate message ID
-	messageID := h.GenerateMessageID()
-
-	// Increment message counter
-	if err := h.authManager.IncrementMessageCount(session.SystemID, true); err != nil {
-		log.Printf("Session %s: Failed to increment message counter: %v", session.ID, err)
+	if submit.HasEmptyPayload() {
+		log.Printf("Session %s: Empty message_payload", session.ID)
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
 	}
 
-	// Decode short message based on data coding
-	decodedMessage, err := protocol.DecodeShortMessage([]byte(submit.ShortMessage), submit.DataCoding)
+	// Strip the user data header and decode the body
+	decodedMessage, concatenationInfo, err := decodeUserData(submit.UserData(), submit.ESMClass, submit.DataCoding, submit.OptionalParameters)
 	if err != nil {
-		log.Printf("Session %s: Failed to decode short message: %v", session.ID, err)
-		decodedMessage = submit.ShortMessage // Fallback to original message
+		log.Printf("Session %s: Failed to parse user data header: %v", session.ID, err)
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
 	}
 
-	log.Printf("Session %s: Submit SM from %s to %s, data_coding: %d, original: %s, decoded: %s",
-		session.ID, submit.SourceAddr, submit.DestinationAddr, submit.DataCoding, submit.ShortMessage, decodedMessage)
-
-	// Extract concatenation information
-	concatenationInfo := rabbitmq.ExtractConcatenationInfo(submit.OptionalParameters)
+	// Validate the delivery times, relative times count from now
+	scheduleDeliveryTime, validityPeriod, status := normalizeDeliveryTimes(submit.ScheduleDeliveryTime, submit.ValidityPeriod, time.Now())
+	if status != protocol.ESME_ROK {
+		log.Printf("Session %s: Invalid delivery times schedule %q validity %q", session.ID, submit.ScheduleDeliveryTime, submit.ValidityPeriod)
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
 
 	// Convert optional parameters to string map for JSON serialization
 	optionalParamsStr := rabbitmq.ConvertOptionalParamsToString(submit.OptionalParameters)
 
 	// Create RabbitMQ message
 	rabbitMessage := &rabbitmq.SubmitSMMessage{
-		MessageID:            messageID,
 		SystemID:             session.SystemID,
 		SourceAddr:           submit.SourceAddr,
 		DestinationAddr:      submit.DestinationAddr,
@@ -95,20 +120,44 @@ func (h *SMSHandler) HandleSubmitSM(session *session.Session, pdu *protocol.PDU)
 		PriorityFlag:         submit.PriorityFlag,
 		ServiceType:          submit.ServiceType,
 		ProtocolID:           submit.ProtocolID,
-		ScheduleDeliveryTime: submit.ScheduleDeliveryTime,
-		ValidityPeriod:       submit.ValidityPeriod,
+		ScheduleDeliveryTime: scheduleDeliveryTime,
+		ValidityPeriod:       validityPeriod,
 		ReplaceIfPresentFlag: submit.ReplaceIfPresentFlag,
 		SMDefaultMsgID:       submit.SMDefaultMsgID,
 		OptionalParameters:   optionalParamsStr,
 		Concatenation:        concatenationInfo,
 	}
 
-	// Publish to RabbitMQ
-	if h.rabbitMQClient != nil {
-		if err := h.rabbitMQClient.PublishSubmitSM(rabbitMessage); err != nil {
-			log.Printf("Session %s: Failed to publish to RabbitMQ: %v", session.ID, err)
-			// Continue processing even if RabbitMQ publish fails
-		}
+	// Enforce the MT filters of the user
+	if status := h.applyMTFilters(session, rabbitMessage); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Check rate limit
+	if status := h.checkRateLimit(session); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Generate message ID
+	messageID := h.GenerateMessageID(session)
+	rabbitMessage.MessageID = messageID
+
+	// Reserve the price of the message from the prepaid balance
+	if status := h.chargeMessage(session, rabbitMessage); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	log.Printf("Session %s: Submit SM from %s to %s, data_coding: %d, original: %s, decoded: %s",
+		session.ID, rabbitMessage.SourceAddr, submit.DestinationAddr, submit.DataCoding, submit.UserData(), decodedMessage)
+
+	// The message is only acknowledged once RabbitMQ has confirmed it
+	if status := h.acceptMessage(session, rabbitMessage, store.DlrPduDeliverSM); status != protocol.ESME_ROK {
+		return session.SendResponse(protocol.SUBMIT_SM_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	// Increment message counter
+	if err := h.authManager.IncrementMessageCount(session.SystemID, true); err != nil {
+		log.Printf("Session %s: Failed to increment message counter: %v", session.ID, err)
 	}
 
 	// Send submit response
@@ -119,6 +168,334 @@ func (h *SMSHandler) HandleSubmitSM(session *session.Session, pdu *protocol.PDU)
 	return session.SendResponse(protocol.SUBMIT_SM_RESP, protocol.ESME_ROK, responseBody, pdu.SequenceNumber)
 }
 
+// checkRateLimit checks the user's throughput limit and returns the command status to answer with
+func (h *SMSHandler) checkRateLimit(session *session.Session) uint32 {
+	allowed, err := h.authManager.CheckRateLimit(session.SystemID)
+	if err != nil {
+		log.Printf("Session %s: Rate limit check failed: %v", session.ID, err)
+		return protocol.ESME_RSYSERR
+	}
+	if !allowed {
+		log.Printf("Session %s: Rate limit exceeded for user %s", session.ID, session.SystemID)
+		return protocol.ESME_RTHROTTLED
+	}
+	return protocol.ESME_ROK
+}
+
+// chargeMessage reserves the price of every segment of a message from the prepaid balance of the user.
+// Segments of concatenated messages are charged one by one as they are submitted.
+func (h *SMSHandler) chargeMessage(session *session.Session, message *rabbitmq.SubmitSMMessage) uint32 {
+	smppUser, err := h.sessionUser(session)
+	if err != nil {
+		log.Printf("Session %s: Failed to load balance: %v", session.ID, err)
+		return protocol.ESME_RSYSERR
+	}
+
+	segments := 1
+	if !isSegment(message.Concatenation) {
+		segments = max(protocol.ChooseEncoding(message.ShortMessage, h.nationalLanguage).SegmentCount, 1)
+	}
+
+	if err := h.authManager.ChargeMessage(smppUser, message.MessageID, message.DestinationAddr, segments); err != nil {
+		if errors.Is(err, auth.ErrInsufficientBalance) {
+			log.Printf("Session %s: Insufficient balance for %d segment(s) of message %s", session.ID, segments, message.MessageID)
+			if err := h.authManager.IncrementRejectedCount(session.SystemID); err != nil {
+				log.Printf("Session %s: Failed to increment rejected message counter: %v", session.ID, err)
+			}
+			return protocol.ESME_RSUBMITFAIL
+		}
+		log.Printf("Session %s: Failed to charge message %s: %v", session.ID, message.MessageID, err)
+		return protocol.ESME_RSYSERR
+	}
+	return protocol.ESME_ROK
+}
+
+// decodeUserData strips the user data header from a message body and decodes the text.
+// The concatenation IE of the header takes precedence over the SAR TLVs; the error reports a malformed header.
+func decodeUserData(userData []byte, esmClass, dataCoding uint8, optionalParameters map[uint16][]byte) (string, *rabbitmq.ConcatenationInfo, error) {
+	concatenationInfo := rabbitmq.ExtractConcatenationInfo(optionalParameters)
+
+	var udh *protocol.UserDataHeader
+	if esmClass&protocol.ESM_CLASS_UDHI != 0 {
+		var err error
+		udh, userData, err = protocol.ParseUDH(userData)
+		if err != nil {
+			return "", nil, err
+		}
+		if udh.Concatenation != nil {
+			concatenationInfo = &rabbitmq.ConcatenationInfo{
+				ReferenceNumber: udh.Concatenation.Reference,
+				TotalSegments:   udh.Concatenation.Total,
+				SequenceNumber:  udh.Concatenation.Sequence,
+			}
+		}
+	}
+
+	// Decode short message based on data coding
+	decodedMessage, err := protocol.DecodeUserData(userData, dataCoding, udh)
+	if err != nil {
+		log.Printf("Failed to decode short message: %v", err)
+		decodedMessage = string(userData) // Fallback to original message
+	}
+
+	return decodedMessage, concatenationInfo, nil
+}
+
+// acceptMessage stores and publishes a message submitted with submit_sm, submit_multi or data_sm and returns the command
+// status to answer with. Segments of concatenated messages are stored individually and published once the message
+// is complete, they are only taken while RabbitMQ is connected. dlrPdu selects the PDU used to return delivery reports.
+func (h *SMSHandler) acceptMessage(session *session.Session, message *rabbitmq.SubmitSMMessage, dlrPdu string) uint32 {
+	if isSegment(message.Concatenation) {
+		if h.publisher == nil || !h.publisher.IsConnected() {
+			log.Printf("Session %s: Rejecting segment %s, RabbitMQ is not connected", session.ID, message.MessageID)
+			h.refundMessage(session, message, "RabbitMQ not connected")
+			return protocol.ESME_RSYSERR
+		}
+		// The stored segment is what outlives a restart of the server while its message is assembled,
+		// RejectUnassembledSegments refunds it when the assembly was lost
+		if err := h.storeMessage(message, dlrPdu, message.Concatenation.SequenceNumber); err != nil {
+			log.Printf("Session %s: Rejecting segment %s, failed to store it: %v", session.ID, message.MessageID, err)
+			h.refundMessage(session, message, "Message store failed")
+			return protocol.ESME_RSYSERR
+		}
+		h.assembler.AddSegment(message, message.Concatenation, dlrPdu)
+		return protocol.ESME_ROK
+	}
+
+	// Store and publish the message
+	return h.queueMessage(session, message, dlrPdu)
+}
+
+// isSegment reports whether concatenation information describes one segment of a longer message
+func isSegment(concatenation *rabbitmq.ConcatenationInfo) bool {
+	return concatenation != nil && concatenation.TotalSegments > 1 &&
+		concatenation.SequenceNumber >= 1 && concatenation.SequenceNumber <= concatenation.TotalSegments
+}
+
+// queueMessage stores the state of a message and publishes it to RabbitMQ, returning the command status to answer with.
+// A message the broker does not confirm is refunded and stored as rejected. dlrPdu selects the PDU used to return its delivery reports.
+func (h *SMSHandler) queueMessage(session *session.Session, message *rabbitmq.SubmitSMMessage, dlrPdu string) uint32 {
+	// Store message state before publishing so that an early delivery report finds it
+	if err := h.storeMessage(message, dlrPdu, 0); err != nil {
+		log.Printf("Session %s: Failed to store message state: %v", session.ID, err)
+	}
+
+	err := h.publishMessage(message)
+	if err == nil {
+		return protocol.ESME_ROK
+	}
+	log.Printf("Session %s: Failed to publish message %s to RabbitMQ: %v", session.ID, message.MessageID, err)
+
+	if h.messageStore != nil {
+		if err := h.messageStore.UpdateMessageState(message.MessageID, protocol.MESSAGE_STATE_REJECTED, 0, time.Now()); err != nil {
+			log.Printf("Session %s: Failed to store rejected message state: %v", session.ID, err)
+		}
+	}
+	h.refundMessage(session, message, "RabbitMQ publish failed")
+
+	// The broker refusing messages is reported as a full queue, the client may retry later
+	if errors.Is(err, rabbitmq.ErrPublishNacked) {
+		return protocol.ESME_RMSGQFUL
+	}
+	return protocol.ESME_RSYSERR
+}
+
+// refundMessage gives back the charge of a message that could not be accepted
+func (h *SMSHandler) refundMessage(session *session.Session, message *rabbitmq.SubmitSMMessage, reason string) {
+	if err := h.authManager.RefundMessage(message.MessageID, reason); err != nil {
+		log.Printf("Session %s: Failed to refund message %s: %v", session.ID, message.MessageID, err)
+	}
+}
+
+// publishAssembled publishes a reassembled concatenated message after linking its segments,
+// so that its delivery reports reach the message ID of every segment
+func (h *SMSHandler) publishAssembled(message *rabbitmq.SubmitSMMessage, segmentIDs []string, dlrPdu string) {
+	if h.messageStore != nil {
+		if err := h.messageStore.LinkMessageSegments(message.SystemID, message.MessageID, segmentIDs, message.ShortMessage); err != nil {
+			log.Printf("Failed to link segments of message %s: %v", message.MessageID, err)
+		}
+		if h.segmentCancelled(message) {
+			return
+		}
+	}
+
+	if !h.matchAssembledContent(message) {
+		h.rejectAssembled(message, segmentIDs, "Message content rejected by filter")
+		return
+	}
+
+	log.Printf("Publishing concatenated message %s from %s with %d segments", message.MessageID, message.SystemID, len(segmentIDs))
+	if err := h.publishMessage(message); err != nil {
+		// The segments were acknowledged already, the ESME learns of the failure from the delivery report
+		log.Printf("Failed to publish concatenated message %s from %s to RabbitMQ: %v", message.MessageID, message.SystemID, err)
+		h.rejectAssembled(message, segmentIDs, "RabbitMQ publish failed")
+	}
+}
+
+// segmentCancelled reports whether cancel_sm reached a segment of an assembled message before the message was complete.
+// The remaining segments are then cancelled and every segment is refunded, as the message is never sent.
+func (h *SMSHandler) segmentCancelled(message *rabbitmq.SubmitSMMessage) bool {
+	segments, err := h.messageStore.GetMessageSegments(message.SystemID, message.MessageID)
+	if err != nil {
+		log.Printf("Failed to load segments of message %s: %v", message.MessageID, err)
+		return false
+	}
+
+	cancelled := false
+	for _, segment := range segments {
+		if segment.MessageState == protocol.MESSAGE_STATE_DELETED {
+			cancelled = true
+			break
+		}
+	}
+	if !cancelled {
+		return false
+	}
+
+	log.Printf("Concatenated message %s from %s was cancelled while it was assembled, dropping it", message.MessageID, message.SystemID)
+	if err := h.messageStore.CancelMessageSegments(message.SystemID, message.MessageID); err != nil {
+		log.Printf("Failed to cancel segments of message %s: %v", message.MessageID, err)
+	}
+	for _, segment := range segments {
+		if err := h.authManager.RefundMessage(segment.MessageID, "Message cancelled"); err != nil {
+			log.Printf("Failed to refund segment %s of message %s: %v", segment.MessageID, message.MessageID, err)
+		}
+	}
+	return true
+}
+
+// matchAssembledContent applies the MT content filter of the user to the text of a reassembled message.
+// The segments may come from several sessions of the user, the filter is loaded once for the whole message.
+func (h *SMSHandler) matchAssembledContent(message *rabbitmq.SubmitSMMessage) bool {
+	smppUser, err := h.authManager.GetUser(message.SystemID)
+	if err != nil {
+		log.Printf("Failed to load MT filters for concatenated message %s: %v", message.MessageID, err)
+		return false
+	}
+	if !matchMTFilter(smppUser.MtContentFilter, message.ShortMessage) {
+		log.Printf("Concatenated message %s from %s rejected by content filter", message.MessageID, message.SystemID)
+		return false
+	}
+	return true
+}
+
+// rejectAssembled drops a reassembled message whose segments were already acknowledged.
+// Every segment is stored as rejected and refunded, and the ESME gets a REJECTED delivery report if it asked for failure receipts.
+func (h *SMSHandler) rejectAssembled(message *rabbitmq.SubmitSMMessage, segmentIDs []string, reason string) {
+	now := time.Now()
+	for _, segmentID := range segmentIDs {
+		if h.messageStore != nil {
+			if err := h.messageStore.UpdateMessageState(segmentID, protocol.MESSAGE_STATE_REJECTED, 0, now); err != nil {
+				log.Printf("Failed to store rejected state of segment %s: %v", segmentID, err)
+			}
+		}
+		if err := h.authManager.RefundMessage(segmentID, reason); err != nil {
+			log.Printf("Failed to refund segment %s of message %s: %v", segmentID, message.MessageID, err)
+		}
+	}
+	if err := h.authManager.IncrementRejectedCount(message.SystemID); err != nil {
+		log.Printf("Failed to increment rejected message counter of %s: %v", message.SystemID, err)
+	}
+
+	h.reportRejected(message, reason, now)
+}
+
+// reportRejected sends the REJECTED delivery report of a message that was accepted but never published, when it was requested.
+// The report is delivered by this server, the broker the message could not be published to may be down.
+func (h *SMSHandler) reportRejected(message *rabbitmq.SubmitSMMessage, reason string, now time.Time) {
+	if !dlr.Wanted(message.RegisteredDelivery, protocol.MESSAGE_STATE_REJECTED) || h.reporter == nil {
+		return
+	}
+	date := now.Format("20060102150405")
+	h.reporter.DeliverLocalReport(h.sessionManager, &rabbitmq.DeliveryReportMessage{
+		MessageID:       message.MessageID,
+		SystemID:        message.SystemID,
+		SourceAddr:      message.SourceAddr,
+		DestinationAddr: message.DestinationAddr,
+		MessageState:    protocol.MESSAGE_STATE_REJECTED,
+		FinalDate:       date,
+		SubmitDate:      date,
+		DoneDate:        date,
+		Failed:          true,
+		FailureReason:   reason,
+		OriginalText:    message.ShortMessage,
+		DataCoding:      message.DataCoding,
+	})
+}
+
+// RejectUnassembledSegments rejects and refunds the stored segments whose assembly was lost, as when the server
+// restarted while it waited for the missing segments. Only segments older than twice the concatenation timeout
+// are taken, by then every assembler has completed them, also one on another server.
+func (h *SMSHandler) RejectUnassembledSegments() {
+	if h.messageStore == nil {
+		return
+	}
+	segments, err := h.messageStore.RejectUnassembledSegments(time.Now().Add(-2 * h.assembler.timeout))
+	if err != nil {
+		log.Printf("Failed to reject unassembled segments: %v", err)
+	}
+	for _, segment := range segments {
+		log.Printf("Rejecting segment %s of %s, its message was never assembled", segment.MessageID, segment.SystemID)
+		if err := h.authManager.RefundMessage(segment.MessageID, "Message assembly lost"); err != nil {
+			log.Printf("Failed to refund segment %s: %v", segment.MessageID, err)
+		}
+		h.reportRejected(&rabbitmq.SubmitSMMessage{
+			MessageID:          segment.MessageID,
+			SystemID:           segment.SystemID,
+			SourceAddr:         segment.SourceAddr,
+			DestinationAddr:    segment.DestinationAddr,
+			ShortMessage:       segment.ShortMessage,
+			DataCoding:         segment.DataCoding,
+			RegisteredDelivery: segment.RegisteredDelivery,
+		}, "Message assembly lost", *segment.FinalDate)
+	}
+}
+
+// StartSegmentRecovery rejects the segments whose assembly was lost now and then once every concatenation timeout
+func (h *SMSHandler) StartSegmentRecovery() {
+	h.RejectUnassembledSegments()
+	ticker := time.NewTicker(h.assembler.timeout)
+	go func() {
+		for range ticker.C {
+			h.RejectUnassembledSegments()
+		}
+	}()
+}
+
+// storeMessage stores the state of an accepted message or segment, segmentNumber is 0 for whole messages
+func (h *SMSHandler) storeMessage(message *rabbitmq.SubmitSMMessage, dlrPdu string, segmentNumber uint8) error {
+	if h.messageStore == nil {
+		return nil
+	}
+	return h.messageStore.CreateMessage(&store.SmppMessage{
+		MessageID:            message.MessageID,
+		SystemID:             message.SystemID,
+		ServiceType:          message.ServiceType,
+		SourceAddr:           message.SourceAddr,
+		DestinationAddr:      message.DestinationAddr,
+		RegisteredDelivery:   message.RegisteredDelivery,
+		DataCoding:           message.DataCoding,
+		ShortMessage:         message.ShortMessage,
+		ScheduleDeliveryTime: message.ScheduleDeliveryTime,
+		ValidityPeriod:       message.ValidityPeriod,
+		DlrPdu:               dlrPdu,
+		SegmentNumber:        segmentNumber,
+		MessageState:         initialMessageState(message.ScheduleDeliveryTime),
+		SubmitDate:           time.Now(),
+	})
+}
+
+// errRabbitMQUnavailable is returned when messages are published without a RabbitMQ connection
+var errRabbitMQUnavailable = errors.New("RabbitMQ is not available")
+
+// publishMessage publishes a message to RabbitMQ and waits for the broker to confirm it
+func (h *SMSHandler) publishMessage(message *rabbitmq.SubmitSMMessage) error {
+	if h.publisher == nil {
+		return errRabbitMQUnavailable
+	}
+	return h.publisher.PublishSubmitSM(message)
+}
+
 // HandleDeliverSM handles deliver_sm requests
 func (h *SMSHandler) HandleDeliverSM(session *session.Session, pdu *protocol.PDU) error {
 	if !session.CanReceive() {
@@ -145,12 +522,13 @@ func (h *SMSHandler) HandleDeliverSM(session *session.Session, pdu *protocol.PDU
 // SendDeliverSM sends a deliver_sm to a session
 func (h *SMSHandler) SendDeliverSM(session *session.Session, deliver *protocol.DeliverSMPDU) error {
 	// Convert to PDU
+	body := protocol.SerializeDeliverSMPDU(deliver)
 	pdu := &protocol.PDU{
-		CommandLength:  uint32(16 + len(protocol.SerializeSubmitSMPDU((*protocol.SubmitSMPDU)(deliver)))),
+		CommandLength:  uint32(16 + len(body)),
 		CommandID:      protocol.DELIVER_SM,
 		CommandStatus:  0,
 		SequenceNumber: session.GetNextSequenceNumber(),
-		Body:           protocol.SerializeSubmitSMPDU((*protocol.SubmitSMPDU)(deliver)),
+		Body:           body,
 	}
 	return session.SendPDU(pdu)
 }
@@ -164,12 +542,38 @@ func (h *SMSHandler) HandleSubmitSMResp(session *session.Session, pdu *protocol.
 
 // HandleDeliverSMResp handles deliver_sm_resp responses
 func (h *SMSHandler) HandleDeliverSMResp(session *session.Session, pdu *protocol.PDU) error {
-	log.Printf("Session %s: Received deliver_sm_resp", session.ID)
-	// For deliver_sm_resp, we just log it as it's a response to our deliver_sm
+	log.Printf("Session %s: Received deliver_sm_resp for sequence %d with status 0x%08X", session.ID, pdu.SequenceNumber, pdu.CommandStatus)
+	// Completes the deliver_sm waiting in the outbound window
+	session.HandleResponse(pdu)
 	return nil
 }
 
-// GenerateMessageID generates a unique message ID
-func (h *SMSHandler) GenerateMessageID() string {
-	return "MSG" + time.Now().Format("20060102150405")
+// GenerateMessageID generates a unique message ID in the format configured for the SMPP user
+func (h *SMSHandler) GenerateMessageID(session *session.Session) string {
+	id := h.idGenerator.Next()
+
+	user, err := h.sessionUser(session)
+	if err != nil {
+		log.Printf("Session %s: Failed to load message ID format, using decimal: %v", session.ID, err)
+		return idgen.Format(id, idgen.FormatDecimal)
+	}
+
+	// IDs are never shortened; the backend only accepts max lengths the format fits in
+	if !idgen.FitsLength(user.MessageIDFormat, user.MessageIDMaxLength) {
+		log.Printf("Session %s: Message ID max length %d is too short for format %s, ignoring it", session.ID, user.MessageIDMaxLength, user.MessageIDFormat)
+	}
+	return idgen.Format(id, user.MessageIDFormat)
+}
+
+// sessionUser returns the SMPP user of a session, as loaded when the session was bound
+func (h *SMSHandler) sessionUser(session *session.Session) (*auth.SmppUser, error) {
+	return boundUser(h.authManager, session)
+}
+
+// boundUser returns the SMPP user loaded when the session was bound, or loads it when the session carries none
+func boundUser(authManager auth.AuthManager, session *session.Session) (*auth.SmppUser, error) {
+	if user, ok := session.User.(*auth.SmppUser); ok {
+		return user, nil
+	}
+	return authManager.GetUser(session.SystemID)
 }
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"log"
+	"smppserver/auth"
+	"smppserver/protocol"
+	"smppserver/rabbitmq"
+	"smppserver/session"
+	"smppserver/store"
+	"time"
+)
+
+// SubmitMultiHandler handles submit_multi operations
+type SubmitMultiHandler struct {
+	authManager    auth.AuthManager
+	sessionManager *session.SessionManager
+	smsHandler     *SMSHandler
+}
+
+// NewSubmitMultiHandler creates a new submit multi handler
+func NewSubmitMultiHandler(authManager auth.AuthManager, sessionManager *session.SessionManager, smsHandler *SMSHandler) *SubmitMultiHandler {
+	return &SubmitMultiHandler{
+		authManager:    authManager,
+		sessionManager: sessionManager,
+		smsHandler:     smsHandler,
+	}
+}
+
+// HandleSubmitMulti handles submit_multi requests.
+// Every SME destination is published as its own message with its own message ID, so that delivery reports
+// refer to the destination they belong to. The response carries the message ID of the first accepted
+// destination and lists the destinations that were not accepted.
+func (h *SubmitMultiHandler) HandleSubmitMulti(session *session.Session, pdu *protocol.PDU) error {
+	if !session.CanTransmit() {
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVBNDSTS, nil, pdu.SequenceNumber)
+	}
+
+	submit, err := protocol.ParseSubmitMultiPDU(pdu.Body)
+	if err != nil {
+		log.Printf("Session %s: Failed to parse submit_multi: %v", session.ID, err)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVCMDLEN, nil, pdu.SequenceNumber)
+	}
+
+	// Validate source address
+	if submit.SourceAddr == "" {
+		log.Printf("Session %s: Empty source address", session.ID)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVSRCADR, nil, pdu.SequenceNumber)
+	}
+
+	// Validate number of destinations
+	if len(submit.Destinations) == 0 || len(submit.Destinations) > protocol.MaxSubmitMultiDestinations {
+		log.Printf("Session %s: Invalid number of destinations: %d", session.ID, len(submit.Destinations))
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVNUMDESTS, nil, pdu.SequenceNumber)
+	}
+
+	// The message body goes either in short_message or in message_payload, never both
+	if submit.HasShortMessageAndPayload() {
+		log.Printf("Session %s: Both short_message and message_payload present", session.ID)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
+	}
+	if submit.HasEmptyPayload() {
+		log.Printf("Session %s: Empty message_payload", session.ID)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
+	}
+
+	// Strip the user data header and decode the body
+	decodedMessage, concatenationInfo, err := decodeUserData(submit.UserData(), submit.ESMClass, submit.DataCoding, submit.OptionalParameters)
+	if err != nil {
+		log.Printf("Session %s: Failed to parse user data header: %v", session.ID, err)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_RINVMSGLEN, nil, pdu.SequenceNumber)
+	}
+
+	// Validate the delivery times, relative times count from now
+	scheduleDeliveryTime, validityPeriod, status := normalizeDeliveryTimes(submit.ScheduleDeliveryTime, submit.ValidityPeriod, time.Now())
+	if status != protocol.ESME_ROK {
+		log.Printf("Session %s: Invalid delivery times schedule %q validity %q", session.ID, submit.ScheduleDeliveryTime, submit.ValidityPeriod)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	log.Printf("Session %s: Submit multi from %s to %d destinations, data_coding: %d, decoded: %s",
+		session.ID, submit.SourceAddr, len(submit.Destinations), submit.DataCoding, decodedMessage)
+
+	optionalParamsStr := rabbitmq.ConvertOptionalParamsToString(submit.OptionalParameters)
+
+	resp := &protocol.SubmitMultiRespPDU{}
+	for _, destination := range submit.Destinations {
+		if status := h.validateDestination(destination); status != protocol.ESME_ROK {
+			log.Printf("Session %s: Rejected submit_multi destination %q with status 0x%08X",
+				session.ID, destination.DestinationAddr+destination.DLName, status)
+			resp.UnsuccessSMEs = append(resp.UnsuccessSMEs, unsuccessfulSME(destination, status))
+			continue
+		}
+
+		message := &rabbitmq.SubmitSMMessage{
+			SystemID:             session.SystemID,
+			SourceAddr:           submit.SourceAddr,
+			DestinationAddr:      destination.DestinationAddr,
+			ShortMessage:         decodedMessage,
+			DataCoding:           submit.DataCoding,
+			ESMClass:             submit.ESMClass,
+			RegisteredDelivery:   submit.RegisteredDelivery,
+			PriorityFlag:         submit.PriorityFlag,
+			ServiceType:          submit.ServiceType,
+			ProtocolID:           submit.ProtocolID,
+			ScheduleDeliveryTime: scheduleDeliveryTime,
+			ValidityPeriod:       validityPeriod,
+			ReplaceIfPresentFlag: submit.ReplaceIfPresentFlag,
+			SMDefaultMsgID:       submit.SMDefaultMsgID,
+			OptionalParameters:   optionalParamsStr,
+			Concatenation:        concatenationInfo,
+		}
+
+		// The MT filters apply to every destination
+		if status := h.smsHandler.applyMTFilters(session, message); status != protocol.ESME_ROK {
+			resp.UnsuccessSMEs = append(resp.UnsuccessSMEs, unsuccessfulSME(destination, status))
+			continue
+		}
+
+		// Every destination counts against the throughput limit
+		if status := h.smsHandler.checkRateLimit(session); status != protocol.ESME_ROK {
+			resp.UnsuccessSMEs = append(resp.UnsuccessSMEs, unsuccessfulSME(destination, status))
+			continue
+		}
+
+		messageID := h.smsHandler.GenerateMessageID(session)
+		message.MessageID = messageID
+
+		if status := h.smsHandler.chargeMessage(session, message); status != protocol.ESME_ROK {
+			resp.UnsuccessSMEs = append(resp.UnsuccessSMEs, unsuccessfulSME(destination, status))
+			continue
+		}
+
+		if status := h.smsHandler.acceptMessage(session, message, store.DlrPduDeliverSM); status != protocol.ESME_ROK {
+			resp.UnsuccessSMEs = append(resp.UnsuccessSMEs, unsuccessfulSME(destination, status))
+			continue
+		}
+
+		if err := h.authManager.IncrementMessageCount(session.SystemID, true); err != nil {
+			log.Printf("Session %s: Failed to increment message counter: %v", session.ID, err)
+		}
+
+		log.Printf("Session %s: Submit multi destination %s accepted as message %s", session.ID, destination.DestinationAddr, messageID)
+		if resp.MessageID == "" {
+			resp.MessageID = messageID
+		}
+	}
+
+	// Without a single accepted destination there is no message ID to return
+	if status := submitMultiStatus(resp); status != protocol.ESME_ROK {
+		log.Printf("Session %s: Submit multi rejected for all %d destinations with status 0x%08X", session.ID, len(submit.Destinations), status)
+		return session.SendResponse(protocol.SUBMIT_MULTI_RESP, status, nil, pdu.SequenceNumber)
+	}
+
+	return session.SendResponse(protocol.SUBMIT_MULTI_RESP, protocol.ESME_ROK, protocol.SerializeSubmitMultiRespPDU(resp), pdu.SequenceNumber)
+}
+
+// submitMultiStatus returns the command_status of a submit_multi_resp: ESME_ROK once a destination was accepted,
+// otherwise the status all destinations failed with, or ESME_RSUBMITFAIL when they failed for different reasons
+func submitMultiStatus(resp *protocol.SubmitMultiRespPDU) uint32 {
+	if resp.MessageID != "" || len(resp.UnsuccessSMEs) == 0 {
+		return protocol.ESME_ROK
+	}
+
+	status := resp.UnsuccessSMEs[0].ErrorStatusCode
+	for _, sme := range resp.UnsuccessSMEs[1:] {
+		if sme.ErrorStatusCode != status {
+			return protocol.ESME_RSUBMITFAIL
+		}
+	}
+	return status
+}
+
+// validateDestination returns the error status of a destination that cannot be sent to
+func (h *SubmitMultiHandler) validateDestination(destination protocol.SubmitMultiDestination) uint32 {
+	// Distribution lists are not provisioned on this server
+	if destination.DestFlag == protocol.DEST_FLAG_DISTRIBUTION_LIST {
+		return protocol.ESME_RINVDLNAME
+	}
+	if destination.DestinationAddr == "" {
+		return protocol.ESME_RINVDSTADR
+	}
+	return protocol.ESME_ROK
+}
+
+// unsuccessfulSME builds the unsuccess_sme entry of a rejected destination
+func unsuccessfulSME(destination protocol.SubmitMultiDestination, status uint32) protocol.UnsuccessfulSME {
+	address := destination.DestinationAddr
+	if destination.DestFlag == protocol.DEST_FLAG_DISTRIBUTION_LIST {
+		address = destination.DLName
+	}
+	return protocol.UnsuccessfulSME{
+		DestAddrTON:     destination.DestAddrTON,
+		DestAddrNPI:     destination.DestAddrNPI,
+		DestinationAddr: address,
+		ErrorStatusCode: status,
+	}
+}
+
+// HandleSubmitMultiResp handles submit_multi_resp responses
+func (h *SubmitMultiHandler) HandleSubmitMultiResp(session *session.Session, pdu *protocol.PDU) error {
+	log.Printf("Session %s: Received submit_multi_resp", session.ID)
+	return nil
+}
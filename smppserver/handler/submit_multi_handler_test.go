@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"testing"
+
+	"smppserver/protocol"
+)
+
+func TestSubmitMultiStatus(t *testing.T) {
+	failed := func(statuses ...uint32) []protocol.UnsuccessfulSME {
+		smes := make([]protocol.UnsuccessfulSME, len(statuses))
+		for i, status := range statuses {
+			smes[i] = protocol.UnsuccessfulSME{DestinationAddr: "90555111223" + string(rune('0'+i)), ErrorStatusCode: status}
+		}
+		return smes
+	}
+
+	tests := []struct {
+		name string
+		resp *protocol.SubmitMultiRespPDU
+		want uint32
+	}{
+		{"all accepted", &protocol.SubmitMultiRespPDU{MessageID: "1"}, protocol.ESME_ROK},
+		{"partly accepted", &protocol.SubmitMultiRespPDU{MessageID: "1", UnsuccessSMEs: failed(protocol.ESME_RINVDSTADR)}, protocol.ESME_ROK},
+		{"all rejected alike", &protocol.SubmitMultiRespPDU{UnsuccessSMEs: failed(protocol.ESME_RTHROTTLED, protocol.ESME_RTHROTTLED)}, protocol.ESME_RTHROTTLED},
+		{"all rejected differently", &protocol.SubmitMultiRespPDU{UnsuccessSMEs: failed(protocol.ESME_RINVDSTADR, protocol.ESME_RTHROTTLED)}, protocol.ESME_RSUBMITFAIL},
+	}
+
+	for _, tt := range tests {
+		if got := submitMultiStatus(tt.resp); got != tt.want {
+			t.Errorf("%s: submitMultiStatus() = %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
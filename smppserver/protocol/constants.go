@@ -26,6 +26,10 @@ const (
 	SUBMIT_SM      = 0x00000004
 	SUBMIT_SM_RESP = 0x80000004
 
+	// Submit multi commands
+	SUBMIT_MULTI      = 0x00000021
+	SUBMIT_MULTI_RESP = 0x80000021
+
 	// Deliver commands
 	DELIVER_SM      = 0x00000005
 	DELIVER_SM_RESP = 0x80000005
@@ -148,14 +152,42 @@ const (
 	ESM_CLASS_DATAGRAM_MODE          = 0x04 // SMSC delivery receipt (DLR)
 	ESM_CLASS_FORWARD_MODE           = 0x08
 	ESM_CLASS_STORE_AND_FORWARD_MODE = 0x0C
+	ESM_CLASS_INTERMEDIATE           = 0x20 // Intermediate delivery notification
+	ESM_CLASS_UDHI                   = 0x40 // short_message starts with a user data header
+)
+
+// User data header information element identifiers
+const (
+	IEI_CONCAT_8BIT            = 0x00
+	IEI_CONCAT_16BIT           = 0x08
+	IEI_NATIONAL_SINGLE_SHIFT  = 0x24
+	IEI_NATIONAL_LOCKING_SHIFT = 0x25
 )
 
-// SMPP Registered Delivery values
+// submit_multi destination flags
 const (
-	REG_DELIVERY_NONE = 0x00
-	REG_DELIVERY_SMSC = 0x01
-	REG_DELIVERY_SME  = 0x02
-	REG_DELIVERY_BOTH = 0x03
+	DEST_FLAG_SME_ADDRESS       = 0x01
+	DEST_FLAG_DISTRIBUTION_LIST = 0x02
+)
+
+// MaxSubmitMultiDestinations is the maximum number_of_dests of a submit_multi
+const MaxSubmitMultiDestinations = 254
+
+// SMPP Registered Delivery bits (SMPP 3.4 section 5.2.17)
+const (
+	// Bits 1-0 select the SMSC delivery receipt, 0x03 is reserved and requests none
+	REG_DELIVERY_NONE         = 0x00 // No SMSC delivery receipt
+	REG_DELIVERY_SMSC         = 0x01 // SMSC delivery receipt on success or failure
+	REG_DELIVERY_SMSC_FAILURE = 0x02 // SMSC delivery receipt on failure only
+	REG_DELIVERY_SMSC_MASK    = 0x03
+
+	// Bits 3-2 select SME originated acknowledgements
+	REG_DELIVERY_SME_ACK_DELIVERY = 0x04 // SME delivery acknowledgement
+	REG_DELIVERY_SME_ACK_MANUAL   = 0x08 // SME manual/user acknowledgement
+	REG_DELIVERY_SME_ACK_MASK     = 0x0C
+
+	// Bit 4 requests intermediate notifications
+	REG_DELIVERY_INTERMEDIATE = 0x10
 )
 
 // SMPP Priority Flag values
@@ -204,4 +236,12 @@ const (
 	OPT_PARAM_SAR_SEGMENT_SEQNUM_8   = 0x020F // 8-bit sequence number
 	OPT_PARAM_MESSAGE_STATE          = 0x0427 // Message state (SMPP 3.4 standard)
 	OPT_PARAM_RECEIPTED_MESSAGE_ID   = 0x001E // Receipted message ID
+	OPT_PARAM_NETWORK_ERROR_CODE     = 0x0423 // Network type and network specific error code of a failed delivery
+)
+
+// Network types of the network_error_code TLV
+const (
+	NETWORK_TYPE_ANSI_136 = 0x01
+	NETWORK_TYPE_IS_95    = 0x02
+	NETWORK_TYPE_GSM      = 0x03
 )
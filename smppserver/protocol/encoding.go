@@ -0,0 +1,227 @@
+package protocol
+
+import (
+	"unicode/utf16"
+)
+
+// Maximum user data sizes of a single short message
+const (
+	maxGSM7Septets = 160
+	maxUCS2Octets  = 140
+)
+
+// concatIELength is the size of an 8-bit reference concatenation information element
+const concatIELength = 5
+
+// EncodingInfo describes how a text is encoded into short messages
+type EncodingInfo struct {
+	DataCoding uint8
+	// National language shift tables, only meaningful for GSM 7-bit
+	LockingShift GSM7Language
+	SingleShift  GSM7Language
+	// Units is the encoded length in septets for GSM 7-bit and octets for UCS2
+	Units        int
+	SegmentCount int
+}
+
+// EncodedMessage is a text encoded into the short_message of one or more PDUs
+type EncodedMessage struct {
+	EncodingInfo
+	// UDHI is set when segments start with a user data header and the PDUs need ESM_CLASS_UDHI
+	UDHI     bool
+	Segments [][]byte
+}
+
+// gsm7Candidate is a combination of shift tables tried by ChooseEncoding
+type gsm7Candidate struct {
+	lockingShift GSM7Language
+	singleShift  GSM7Language
+	septets      []byte
+	chunks       [][]byte
+}
+
+// ChooseEncoding picks the encoding needing the fewest segments for text.
+// GSM 7-bit with the default tables is preferred, then the national single shift table of language,
+// then its locking shift table, alone and with the single shift table; UCS2 is used when no GSM 7-bit table set can represent the text.
+// Segment counts account for the user data header taken by shift table and concatenation IEs.
+func ChooseEncoding(text string, language GSM7Language) EncodingInfo {
+	if candidate := chooseGSM7(text, language); candidate != nil {
+		return candidate.info()
+	}
+
+	data := encodeUCS2(text)
+	return EncodingInfo{
+		DataCoding:   DCS_UCS2,
+		Units:        len(data),
+		SegmentCount: len(splitUCS2(data)),
+	}
+}
+
+// EncodeShortMessage encodes text with ChooseEncoding and splits it into short_message segments.
+// GSM 7-bit data is unpacked (one septet per octet) as SMPP expects for data_coding 0.
+// Multi-part messages carry a concatenation IE using reference, and national shift tables are
+// announced with their IEs, so every segment then starts with a user data header.
+func EncodeShortMessage(text string, reference uint8, language GSM7Language) *EncodedMessage {
+	var info EncodingInfo
+	var chunks [][]byte
+	if candidate := chooseGSM7(text, language); candidate != nil {
+		info, chunks = candidate.info(), candidate.chunks
+	} else {
+		data := encodeUCS2(text)
+		chunks = splitUCS2(data)
+		info = EncodingInfo{DataCoding: DCS_UCS2, Units: len(data), SegmentCount: len(chunks)}
+	}
+
+	ies := shiftIEs(info.LockingShift, info.SingleShift)
+	message := &EncodedMessage{
+		EncodingInfo: info,
+		UDHI:         len(ies) > 0 || len(chunks) > 1,
+		Segments:     make([][]byte, len(chunks)),
+	}
+
+	for i, chunk := range chunks {
+		if !message.UDHI {
+			message.Segments[i] = chunk
+			continue
+		}
+
+		udh := []byte{0}
+		if len(chunks) > 1 {
+			udh = append(udh, IEI_CONCAT_8BIT, 0x03, reference, byte(len(chunks)), byte(i+1))
+		}
+		udh = append(udh, ies...)
+		udh[0] = byte(len(udh) - 1)
+		message.Segments[i] = append(udh, chunk...)
+	}
+	return message
+}
+
+// chooseGSM7 returns the GSM 7-bit shift table combination needing the fewest segments,
+// or nil when text cannot be encoded in GSM 7-bit
+func chooseGSM7(text string, language GSM7Language) *gsm7Candidate {
+	combinations := [][2]GSM7Language{{GSM7LanguageDefault, GSM7LanguageDefault}}
+	if language != GSM7LanguageDefault {
+		combinations = append(combinations,
+			[2]GSM7Language{GSM7LanguageDefault, language},
+			[2]GSM7Language{language, GSM7LanguageDefault},
+			[2]GSM7Language{language, language})
+	}
+
+	var best *gsm7Candidate
+	for _, combination := range combinations {
+		septets, err := EncodeGSM7(text, combination[0], combination[1])
+		if err != nil {
+			continue
+		}
+
+		candidate := &gsm7Candidate{
+			lockingShift: combination[0],
+			singleShift:  combination[1],
+			septets:      septets,
+		}
+		candidate.chunks = splitGSM7(septets, len(shiftIEs(combination[0], combination[1])))
+		if best == nil || len(candidate.chunks) < len(best.chunks) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+func (c *gsm7Candidate) info() EncodingInfo {
+	return EncodingInfo{
+		DataCoding:   DCS_GSM7,
+		LockingShift: c.lockingShift,
+		SingleShift:  c.singleShift,
+		Units:        len(c.septets),
+		SegmentCount: len(c.chunks),
+	}
+}
+
+// shiftIEs returns the user data header IEs announcing non-default national shift tables
+func shiftIEs(lockingShift, singleShift GSM7Language) []byte {
+	var ies []byte
+	if singleShift != GSM7LanguageDefault {
+		ies = append(ies, IEI_NATIONAL_SINGLE_SHIFT, 0x01, byte(singleShift))
+	}
+	if lockingShift != GSM7LanguageDefault {
+		ies = append(ies, IEI_NATIONAL_LOCKING_SHIFT, 0x01, byte(lockingShift))
+	}
+	return ies
+}
+
+// gsm7Capacity returns the septets left for text next to a user data header of udhLength octets
+// (including its length octet); the header occupies whole septets once packed
+func gsm7Capacity(udhLength int) int {
+	if udhLength == 0 {
+		return maxGSM7Septets
+	}
+	return maxGSM7Septets - (udhLength*8+6)/7
+}
+
+// splitGSM7 splits unpacked septets into the chunks of each segment, given the length of the
+// shift table IEs every segment carries. Chunks never split an escape sequence.
+func splitGSM7(septets []byte, iesLength int) [][]byte {
+	single := 0
+	if iesLength > 0 {
+		single = 1 + iesLength
+	}
+	if len(septets) <= gsm7Capacity(single) {
+		return [][]byte{septets}
+	}
+
+	capacity := gsm7Capacity(1 + concatIELength + iesLength)
+	var chunks [][]byte
+	for len(septets) > 0 {
+		size := capacity
+		if size >= len(septets) {
+			size = len(septets)
+		} else if septets[size-1] == gsm7Escape && !isEscapedSeptet(septets[:size]) {
+			// Keep the escape with the extension character it introduces
+			size--
+		}
+		chunks = append(chunks, septets[:size])
+		septets = septets[size:]
+	}
+	return chunks
+}
+
+// splitUCS2 splits UCS2 data into the chunks of each segment without splitting surrogate pairs
+func splitUCS2(data []byte) [][]byte {
+	if len(data) <= maxUCS2Octets {
+		return [][]byte{data}
+	}
+
+	capacity := maxUCS2Octets - 1 - concatIELength
+	var chunks [][]byte
+	for len(data) > 0 {
+		size := capacity
+		if size >= len(data) {
+			size = len(data)
+		} else if high := uint16(data[size-2])<<8 | uint16(data[size-1]); high >= 0xD800 && high <= 0xDBFF {
+			// Keep high and low surrogates together
+			size -= 2
+		}
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return chunks
+}
+
+// encodeUCS2 encodes text as UCS2 (UTF-16BE)
+func encodeUCS2(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	data := make([]byte, 0, len(units)*2)
+	for _, unit := range units {
+		data = append(data, byte(unit>>8), byte(unit))
+	}
+	return data
+}
+
+// isEscapedSeptet reports whether the last septet of data is itself preceded by an escape
+func isEscapedSeptet(data []byte) bool {
+	escapes := 0
+	for i := len(data) - 2; i >= 0 && data[i] == gsm7Escape; i-- {
+		escapes++
+	}
+	return escapes%2 == 1
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// decodeSegments reassembles the text of encoded segments the way a receiving ESME does
+func decodeSegments(t *testing.T, message *EncodedMessage, reference uint8) string {
+	t.Helper()
+
+	var text strings.Builder
+	for i, segment := range message.Segments {
+		if !message.UDHI {
+			decoded, err := DecodeShortMessage(segment, message.DataCoding)
+			if err != nil {
+				t.Fatalf("segment %d: %v", i+1, err)
+			}
+			text.WriteString(decoded)
+			continue
+		}
+
+		header, data, err := ParseUDH(segment)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i+1, err)
+		}
+		if len(message.Segments) > 1 {
+			c := header.Concatenation
+			if c == nil || c.Reference != uint16(reference) || int(c.Total) != len(message.Segments) || int(c.Sequence) != i+1 {
+				t.Fatalf("segment %d: concatenation IE = %+v", i+1, c)
+			}
+		}
+		if message.DataCoding == DCS_GSM7 && len(data) > gsm7Capacity(len(segment)-len(data)) {
+			t.Errorf("segment %d: %d septets exceed the capacity next to a %d octet header", i+1, len(data), len(segment)-len(data))
+		}
+		if message.DataCoding == DCS_UCS2 && len(segment) > maxUCS2Octets {
+			t.Errorf("segment %d: %d octets exceed %d", i+1, len(segment), maxUCS2Octets)
+		}
+
+		decoded, err := DecodeUserData(data, message.DataCoding, header)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i+1, err)
+		}
+		text.WriteString(decoded)
+	}
+	return text.String()
+}
+
+func TestEncodeShortMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		language   GSM7Language
+		dataCoding uint8
+		segments   int
+	}{
+		{"single GSM 7-bit", "Hello world", GSM7LanguageDefault, DCS_GSM7, 1},
+		{"full GSM 7-bit", strings.Repeat("a", 160), GSM7LanguageDefault, DCS_GSM7, 1},
+		{"concatenated GSM 7-bit", strings.Repeat("a", 161), GSM7LanguageDefault, DCS_GSM7, 2},
+		{"extension counts twice", strings.Repeat("€", 80), GSM7LanguageDefault, DCS_GSM7, 1},
+		{"escape kept with its character", strings.Repeat("a", 152) + strings.Repeat("€", 10), GSM7LanguageDefault, DCS_GSM7, 2},
+		{"turkish single shift", "Işık ağır", GSM7LanguageTurkish, DCS_GSM7, 1},
+		{"turkish concatenated", strings.Repeat("ğüşiöçı ", 40), GSM7LanguageTurkish, DCS_GSM7, 3},
+		{"turkish without the language is UCS2", "Işık", GSM7LanguageDefault, DCS_UCS2, 1},
+		{"single UCS2", strings.Repeat("ж", 70), GSM7LanguageDefault, DCS_UCS2, 1},
+		{"concatenated UCS2", strings.Repeat("ж", 71), GSM7LanguageDefault, DCS_UCS2, 2},
+		{"surrogate pair kept together", strings.Repeat("ж", 66) + strings.Repeat("😀", 4), GSM7LanguageDefault, DCS_UCS2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const reference = 0x5A
+			message := EncodeShortMessage(tt.text, reference, tt.language)
+			if message.DataCoding != tt.dataCoding {
+				t.Errorf("data_coding = %d, want %d", message.DataCoding, tt.dataCoding)
+			}
+			if len(message.Segments) != tt.segments || message.SegmentCount != tt.segments {
+				t.Errorf("%d segments (SegmentCount %d), want %d", len(message.Segments), message.SegmentCount, tt.segments)
+			}
+			if got := ChooseEncoding(tt.text, tt.language); got != message.EncodingInfo {
+				t.Errorf("ChooseEncoding = %+v, EncodeShortMessage used %+v", got, message.EncodingInfo)
+			}
+			if got := decodeSegments(t, message, reference); got != tt.text {
+				t.Errorf("round trip = %q, want %q", got, tt.text)
+			}
+		})
+	}
+}
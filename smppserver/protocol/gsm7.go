@@ -0,0 +1,225 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GSM7Language is a national language identifier of 3GPP TS 23.038 selecting GSM 7-bit shift tables
+type GSM7Language uint8
+
+// National language identifiers with shift tables supported by the codec
+const (
+	GSM7LanguageDefault GSM7Language = 0x00
+	GSM7LanguageTurkish GSM7Language = 0x01
+)
+
+// gsm7Escape switches to the single shift (extension) table for the next septet
+const gsm7Escape = 0x1B
+
+// gsm7DefaultAlphabet is the GSM 03.38 default alphabet; the escape position holds no character
+var gsm7DefaultAlphabet = [128]rune{
+	'@', '£', '$', '¥', 'è', 'é', 'ù', 'ì', 'ò', 'Ç', '\n', 'Ø', 'ø', '\r', 'Å', 'å',
+	'Δ', '_', 'Φ', 'Γ', 'Λ', 'Ω', 'Π', 'Ψ', 'Σ', 'Θ', 'Ξ', 0, 'Æ', 'æ', 'ß', 'É',
+	' ', '!', '"', '#', '¤', '%', '&', '\'', '(', ')', '*', '+', ',', '-', '.', '/',
+	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', ':', ';', '<', '=', '>', '?',
+	'¡', 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O',
+	'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'Ä', 'Ö', 'Ñ', 'Ü', '§',
+	'¿', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o',
+	'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 'ä', 'ö', 'ñ', 'ü', 'à',
+}
+
+// gsm7TurkishLockingShift is the Turkish national language locking shift table
+var gsm7TurkishLockingShift = [128]rune{
+	'@', '£', '$', '¥', '€', 'é', 'ù', 'ı', 'ò', 'Ç', '\n', 'Ğ', 'ğ', '\r', 'Å', 'å',
+	'Δ', '_', 'Φ', 'Γ', 'Λ', 'Ω', 'Π', 'Ψ', 'Σ', 'Θ', 'Ξ', 0, 'Ş', 'ş', 'ß', 'É',
+	' ', '!', '"', '#', '¤', '%', '&', '\'', '(', ')', '*', '+', ',', '-', '.', '/',
+	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', ':', ';', '<', '=', '>', '?',
+	'İ', 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O',
+	'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z', 'Ä', 'Ö', 'Ñ', 'Ü', '§',
+	'ç', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o',
+	'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 'ä', 'ö', 'ñ', 'ü', 'à',
+}
+
+// gsm7DefaultExtension is the GSM 03.38 extension table reached through the escape
+var gsm7DefaultExtension = map[byte]rune{
+	0x0A: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2F: '\\',
+	0x3C: '[', 0x3D: '~', 0x3E: ']', 0x40: '|', 0x65: '€',
+}
+
+// gsm7TurkishSingleShift is the Turkish national language single shift table
+var gsm7TurkishSingleShift = map[byte]rune{
+	0x0A: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2F: '\\',
+	0x3C: '[', 0x3D: '~', 0x3E: ']', 0x40: '|',
+	0x47: 'Ğ', 0x49: 'İ', 0x53: 'Ş', 0x63: 'ç', 0x65: '€', 0x67: 'ğ', 0x69: 'ı', 0x73: 'ş',
+}
+
+var gsm7LockingShiftTables = map[GSM7Language]*[128]rune{
+	GSM7LanguageDefault: &gsm7DefaultAlphabet,
+	GSM7LanguageTurkish: &gsm7TurkishLockingShift,
+}
+
+var gsm7SingleShiftTables = map[GSM7Language]map[byte]rune{
+	GSM7LanguageDefault: gsm7DefaultExtension,
+	GSM7LanguageTurkish: gsm7TurkishSingleShift,
+}
+
+// Reverse lookups from characters to septets, built from the tables above
+var (
+	gsm7LockingShiftSeptets = make(map[GSM7Language]map[rune]byte)
+	gsm7SingleShiftSeptets  = make(map[GSM7Language]map[rune]byte)
+)
+
+func init() {
+	for language, table := range gsm7LockingShiftTables {
+		septets := make(map[rune]byte, len(table))
+		for septet, char := range table {
+			if septet != gsm7Escape {
+				septets[char] = byte(septet)
+			}
+		}
+		gsm7LockingShiftSeptets[language] = septets
+	}
+
+	for language, table := range gsm7SingleShiftTables {
+		septets := make(map[rune]byte, len(table))
+		for septet, char := range table {
+			septets[char] = septet
+		}
+		gsm7SingleShiftSeptets[language] = septets
+	}
+}
+
+// ParseGSM7Language returns the national language identifier for a configured language name.
+// An empty name selects the default alphabet.
+func ParseGSM7Language(name string) (GSM7Language, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "default":
+		return GSM7LanguageDefault, nil
+	case "turkish":
+		return GSM7LanguageTurkish, nil
+	default:
+		return GSM7LanguageDefault, fmt.Errorf("unsupported GSM 7-bit national language: %s", name)
+	}
+}
+
+// EncodeGSM7 encodes text as unpacked septets (one per octet) with the given locking and single shift tables.
+// Characters only present in the single shift table are written as an escape followed by their septet.
+func EncodeGSM7(text string, lockingShift, singleShift GSM7Language) ([]byte, error) {
+	locking, exists := gsm7LockingShiftSeptets[lockingShift]
+	if !exists {
+		return nil, fmt.Errorf("unsupported GSM 7-bit locking shift language: %d", lockingShift)
+	}
+	single, exists := gsm7SingleShiftSeptets[singleShift]
+	if !exists {
+		return nil, fmt.Errorf("unsupported GSM 7-bit single shift language: %d", singleShift)
+	}
+
+	septets := make([]byte, 0, len(text))
+	for _, char := range text {
+		if septet, exists := locking[char]; exists {
+			septets = append(septets, septet)
+		} else if septet, exists := single[char]; exists {
+			septets = append(septets, gsm7Escape, septet)
+		} else {
+			return nil, fmt.Errorf("character %q cannot be encoded in GSM 7-bit", char)
+		}
+	}
+	return septets, nil
+}
+
+// EncodeGSM7Lossy encodes text with the default alphabet and extension table,
+// replacing characters that cannot be represented with '?'
+func EncodeGSM7Lossy(text string) []byte {
+	locking := gsm7LockingShiftSeptets[GSM7LanguageDefault]
+	single := gsm7SingleShiftSeptets[GSM7LanguageDefault]
+
+	septets := make([]byte, 0, len(text))
+	for _, char := range text {
+		if septet, exists := locking[char]; exists {
+			septets = append(septets, septet)
+		} else if septet, exists := single[char]; exists {
+			septets = append(septets, gsm7Escape, septet)
+		} else {
+			septets = append(septets, locking['?'])
+		}
+	}
+	return septets
+}
+
+// DecodeGSM7 decodes unpacked septets with the given locking and single shift tables.
+// As 3GPP TS 23.038 requires, an escape followed by a septet missing from the single shift table
+// decodes as that septet of the locking shift table. Octets above 0x7F decode as '?'.
+func DecodeGSM7(septets []byte, lockingShift, singleShift GSM7Language) string {
+	locking, exists := gsm7LockingShiftTables[lockingShift]
+	if !exists {
+		locking = &gsm7DefaultAlphabet
+	}
+	single, exists := gsm7SingleShiftTables[singleShift]
+	if !exists {
+		single = gsm7DefaultExtension
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(septets); i++ {
+		septet := septets[i]
+		if septet > 0x7F {
+			result.WriteRune('?')
+			continue
+		}
+
+		if septet == gsm7Escape {
+			if i+1 >= len(septets) {
+				// Dangling escape at the end of the data
+				break
+			}
+			i++
+			if char, exists := single[septets[i]]; exists {
+				result.WriteRune(char)
+				continue
+			}
+			septet = septets[i] & 0x7F
+			if septet == gsm7Escape {
+				// Reserved for a further extension table, display a space
+				result.WriteRune(' ')
+				continue
+			}
+		}
+
+		result.WriteRune(locking[septet])
+	}
+	return result.String()
+}
+
+// PackSeptets packs septets into octets as carried in TP-User-Data.
+// fillBits (0-6) leading zero bits align the first septet after a user data header.
+func PackSeptets(septets []byte, fillBits int) []byte {
+	packed := make([]byte, (fillBits+len(septets)*7+7)/8)
+
+	bit := fillBits
+	for _, septet := range septets {
+		value := uint16(septet&0x7F) << (bit % 8)
+		packed[bit/8] |= byte(value)
+		if bit%8 > 1 {
+			packed[bit/8+1] |= byte(value >> 8)
+		}
+		bit += 7
+	}
+	return packed
+}
+
+// UnpackSeptets extracts count septets from packed octets, skipping fillBits leading bits
+func UnpackSeptets(data []byte, count int, fillBits int) []byte {
+	septets := make([]byte, 0, count)
+
+	bit := fillBits
+	for i := 0; i < count && bit/8 < len(data); i++ {
+		value := uint16(data[bit/8])
+		if bit/8+1 < len(data) {
+			value |= uint16(data[bit/8+1]) << 8
+		}
+		septets = append(septets, byte(value>>(bit%8))&0x7F)
+		bit += 7
+	}
+	return septets
+}
@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGSM7RoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		lockingShift GSM7Language
+		singleShift  GSM7Language
+		septets      []byte
+	}{
+		{"empty", "", GSM7LanguageDefault, GSM7LanguageDefault, []byte{}},
+		{"ascii", "Hi @1", GSM7LanguageDefault, GSM7LanguageDefault, []byte{0x48, 0x69, 0x20, 0x00, 0x31}},
+		{"default alphabet", "£¥èÇØÅΔ_ΦßÉ¤¡ÄÖÑÜ§¿äöñüà", GSM7LanguageDefault, GSM7LanguageDefault, nil},
+		{"extension", "{[€]}", GSM7LanguageDefault, GSM7LanguageDefault, []byte{0x1B, 0x28, 0x1B, 0x3C, 0x1B, 0x65, 0x1B, 0x3E, 0x1B, 0x29}},
+		{"line breaks", "a\nb\rc\f", GSM7LanguageDefault, GSM7LanguageDefault, []byte{0x61, 0x0A, 0x62, 0x0D, 0x63, 0x1B, 0x0A}},
+		{"turkish single shift", "Işık", GSM7LanguageDefault, GSM7LanguageTurkish, []byte{0x49, 0x1B, 0x73, 0x1B, 0x69, 0x6B}},
+		{"turkish locking shift", "ığĞçİ", GSM7LanguageTurkish, GSM7LanguageDefault, []byte{0x07, 0x0C, 0x0B, 0x60, 0x40}},
+		{"turkish both tables", "Şş€ı", GSM7LanguageTurkish, GSM7LanguageTurkish, []byte{0x1C, 0x1D, 0x04, 0x07}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			septets, err := EncodeGSM7(tt.text, tt.lockingShift, tt.singleShift)
+			if err != nil {
+				t.Fatalf("EncodeGSM7 error = %v", err)
+			}
+			if tt.septets != nil && !bytes.Equal(septets, tt.septets) {
+				t.Errorf("EncodeGSM7 = % X, want % X", septets, tt.septets)
+			}
+			if got := DecodeGSM7(septets, tt.lockingShift, tt.singleShift); got != tt.text {
+				t.Errorf("DecodeGSM7 = %q, want %q", got, tt.text)
+			}
+		})
+	}
+}
+
+func TestGSM7TablesRoundTrip(t *testing.T) {
+	for language, table := range gsm7LockingShiftTables {
+		for septet, char := range table {
+			if septet == gsm7Escape {
+				continue
+			}
+			text := string(char)
+			encoded, err := EncodeGSM7(text, language, language)
+			if err != nil {
+				t.Errorf("language %d: EncodeGSM7(%q) error = %v", language, text, err)
+				continue
+			}
+			if got := DecodeGSM7(encoded, language, language); got != text {
+				t.Errorf("language %d: septet 0x%02X decodes as %q, want %q", language, septet, got, text)
+			}
+		}
+	}
+
+	for language, table := range gsm7SingleShiftTables {
+		for septet, char := range table {
+			if got := DecodeGSM7([]byte{gsm7Escape, septet}, GSM7LanguageDefault, language); got != string(char) {
+				t.Errorf("language %d: escaped septet 0x%02X decodes as %q, want %q", language, septet, got, string(char))
+			}
+		}
+	}
+}
+
+func TestEncodeGSM7RejectsUnsupportedCharacters(t *testing.T) {
+	tests := []struct {
+		text         string
+		lockingShift GSM7Language
+		singleShift  GSM7Language
+	}{
+		{"ş", GSM7LanguageDefault, GSM7LanguageDefault},
+		{"😀", GSM7LanguageTurkish, GSM7LanguageTurkish},
+		{"ä", GSM7Language(0x7F), GSM7LanguageDefault},
+		{"ä", GSM7LanguageDefault, GSM7Language(0x7F)},
+	}
+
+	for _, tt := range tests {
+		if septets, err := EncodeGSM7(tt.text, tt.lockingShift, tt.singleShift); err == nil {
+			t.Errorf("EncodeGSM7(%q, %d, %d) = % X, want an error", tt.text, tt.lockingShift, tt.singleShift, septets)
+		}
+	}
+}
+
+func TestEncodeGSM7Lossy(t *testing.T) {
+	septets := EncodeGSM7Lossy("aş€")
+	if want := []byte{0x61, 0x3F, 0x1B, 0x65}; !bytes.Equal(septets, want) {
+		t.Errorf("EncodeGSM7Lossy = % X, want % X", septets, want)
+	}
+}
+
+func TestDecodeGSM7EdgeCases(t *testing.T) {
+	tests := []struct {
+		name    string
+		septets []byte
+		want    string
+	}{
+		{"escape without extension character falls back to the locking shift table", []byte{0x1B, 0x41}, "A"},
+		{"double escape", []byte{0x1B, 0x1B}, " "},
+		{"dangling escape", []byte{0x41, 0x1B}, "A"},
+		{"octet above 0x7F", []byte{0x41, 0x80}, "A?"},
+	}
+
+	for _, tt := range tests {
+		if got := DecodeGSM7(tt.septets, GSM7LanguageDefault, GSM7LanguageDefault); got != tt.want {
+			t.Errorf("%s: DecodeGSM7(% X) = %q, want %q", tt.name, tt.septets, got, tt.want)
+		}
+	}
+}
+
+func TestPackSeptets(t *testing.T) {
+	septets, _ := EncodeGSM7("hellohello", GSM7LanguageDefault, GSM7LanguageDefault)
+	// The well-known GSM 03.38 packing example
+	if packed, want := PackSeptets(septets, 0), []byte{0xE8, 0x32, 0x9B, 0xFD, 0x46, 0x97, 0xD9, 0xEC, 0x37}; !bytes.Equal(packed, want) {
+		t.Errorf("PackSeptets = % X, want % X", packed, want)
+	}
+
+	text := "The quick brown fox jumps over the lazy dog {€}"
+	septets, _ = EncodeGSM7(text, GSM7LanguageDefault, GSM7LanguageDefault)
+	for fillBits := 0; fillBits <= 6; fillBits++ {
+		packed := PackSeptets(septets, fillBits)
+		if packed[0]&(1<<fillBits-1) != 0 {
+			t.Errorf("fill bits %d: leading bits are not zero", fillBits)
+		}
+		unpacked := UnpackSeptets(packed, len(septets), fillBits)
+		if got := DecodeGSM7(unpacked, GSM7LanguageDefault, GSM7LanguageDefault); got != text {
+			t.Errorf("fill bits %d: round trip = %q, want %q", fillBits, got, text)
+		}
+	}
+}
+
+func TestParseGSM7Language(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    GSM7Language
+		wantErr bool
+	}{
+		{"", GSM7LanguageDefault, false},
+		{"default", GSM7LanguageDefault, false},
+		{" Turkish ", GSM7LanguageTurkish, false},
+		{"spanish", GSM7LanguageDefault, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseGSM7Language(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseGSM7Language(%q) = %d, %v; want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
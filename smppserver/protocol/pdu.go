@@ -57,6 +57,7 @@ type SubmitSMPDU struct {
 	SMDefaultMsgID       uint8
 	SMLength             uint8
 	ShortMessage         string
+	MessagePayload       []byte // Value of the message_payload TLV when present, parsed from OptionalParameters
 	OptionalParameters   map[uint16][]byte
 }
 
@@ -105,6 +106,7 @@ type DataSMPDU struct {
 	ESMClass           uint8
 	RegisteredDelivery uint8
 	DataCoding         uint8
+	MessagePayload     []byte // Value of the message_payload TLV when present, parsed from OptionalParameters
 	OptionalParameters map[uint16][]byte
 }
 
@@ -573,10 +575,30 @@ func ParseSubmitSMPDU(body []byte) (*SubmitSMPDU, error) {
 		SMDefaultMsgID:       smDefaultMsgID,
 		SMLength:             smLength,
 		ShortMessage:         shortMessage,
+		MessagePayload:       optionalParameters[OPT_PARAM_MESSAGE_PAYLOAD],
 		OptionalParameters:   optionalParameters,
 	}, nil
 }
 
+// UserData returns the message body, taken from message_payload when short_message is empty
+func (s *SubmitSMPDU) UserData() []byte {
+	if len(s.ShortMessage) == 0 && s.MessagePayload != nil {
+		return s.MessagePayload
+	}
+	return []byte(s.ShortMessage)
+}
+
+// HasShortMessageAndPayload reports whether the body was sent both in short_message and message_payload,
+// which SMPP 3.4 forbids
+func (s *SubmitSMPDU) HasShortMessageAndPayload() bool {
+	return len(s.ShortMessage) > 0 && s.MessagePayload != nil
+}
+
+// HasEmptyPayload reports whether a message_payload TLV was sent without a value
+func (s *SubmitSMPDU) HasEmptyPayload() bool {
+	return s.MessagePayload != nil && len(s.MessagePayload) == 0
+}
+
 // SerializeSubmitSMPDU serializes a submit_sm PDU to bytes
 func SerializeSubmitSMPDU(submit *SubmitSMPDU) []byte {
 	var result []byte
@@ -679,7 +701,8 @@ func ParseSubmitSMRespPDU(body []byte) (*SubmitSMRespPDU, error) {
 
 // ParseDataSMPDU parses a data_sm PDU from the body bytes
 func ParseDataSMPDU(body []byte) (*DataSMPDU, error) {
-	if len(body) < 21 {
+	// service_type + source TON/NPI/addr + dest TON/NPI/addr + esm_class + registered_delivery + data_coding
+	if len(body) < 10 {
 		return nil, fmt.Errorf("data_sm PDU body too short")
 	}
 
@@ -778,10 +801,22 @@ func ParseDataSMPDU(body []byte) (*DataSMPDU, error) {
 		ESMClass:           esmClass,
 		RegisteredDelivery: registeredDelivery,
 		DataCoding:         dataCoding,
+		MessagePayload:     optionalParameters[OPT_PARAM_MESSAGE_PAYLOAD],
 		OptionalParameters: optionalParameters,
 	}, nil
 }
 
+// PayloadStatus validates the message_payload of a data_sm, which carries the whole message body
+func (d *DataSMPDU) PayloadStatus() uint32 {
+	if d.MessagePayload == nil {
+		return ESME_RMISSINGOPTPARAM
+	}
+	if len(d.MessagePayload) == 0 {
+		return ESME_RINVMSGLEN
+	}
+	return ESME_ROK
+}
+
 // SerializeDataSMPDU serializes a data_sm PDU to bytes
 func SerializeDataSMPDU(data *DataSMPDU) []byte {
 	var result []byte
@@ -861,7 +896,8 @@ func SerializeDataSMRespPDU(resp *DataSMRespPDU) []byte {
 
 // ParseQuerySMPDU parses a query_sm PDU from the body bytes
 func ParseQuerySMPDU(body []byte) (*QuerySMPDU, error) {
-	if len(body) < 17 {
+	// message_id (min 1 byte) + source_addr_ton + source_addr_npi + source_addr (min 1 byte)
+	if len(body) < 4 {
 		return nil, fmt.Errorf("query_sm PDU body too short")
 	}
 
@@ -940,7 +976,8 @@ func SerializeQuerySMRespPDU(resp *QuerySMRespPDU) []byte {
 
 // ParseCancelSMPDU parses a cancel_sm PDU from the body bytes
 func ParseCancelSMPDU(body []byte) (*CancelSMPDU, error) {
-	if len(body) < 25 {
+	// service_type + message_id + source TON/NPI/addr + dest TON/NPI/addr, all C-strings at least 1 byte
+	if len(body) < 8 {
 		return nil, fmt.Errorf("cancel_sm PDU body too short")
 	}
 
@@ -1044,7 +1081,8 @@ func SerializeCancelSMRespPDU() []byte {
 
 // ParseReplaceSMPDU parses a replace_sm PDU from the body bytes
 func ParseReplaceSMPDU(body []byte) (*ReplaceSMPDU, error) {
-	if len(body) < 17 {
+	// message_id + source TON/NPI/addr + schedule + validity + registered_delivery + sm_default_msg_id + sm_length
+	if len(body) < 9 {
 		return nil, fmt.Errorf("replace_sm PDU body too short")
 	}
 
@@ -1422,38 +1460,9 @@ func decodeUCS2(data []byte) (string, error) {
 	return string(utf16.Decode(runes)), nil
 }
 
-// decodeGSM7Bit decodes GSM 7-bit default alphabet
+// decodeGSM7Bit decodes unpacked GSM 7-bit default alphabet data, including extension table escapes
 func decodeGSM7Bit(data []byte) (string, error) {
-	// GSM 7-bit default alphabet mapping
-	gsm7BitMap := map[byte]rune{
-		0x00: '@', 0x01: '£', 0x02: '$', 0x03: '¥', 0x04: 'è', 0x05: 'é', 0x06: 'ù', 0x07: 'ì',
-		0x08: 'ò', 0x09: 'Ç', 0x0A: '\n', 0x0B: 'Ø', 0x0C: 'ø', 0x0D: '\r', 0x0E: 'Å', 0x0F: 'å',
-		0x10: 'Δ', 0x11: '_', 0x12: 'Φ', 0x13: 'Γ', 0x14: 'Λ', 0x15: 'Ω', 0x16: 'Π', 0x17: 'Ψ',
-		0x18: 'Σ', 0x19: 'Θ', 0x1A: 'Ξ', 0x1B: '\x1B', 0x1C: 'Æ', 0x1D: 'æ', 0x1E: 'ß', 0x1F: 'É',
-		0x20: ' ', 0x21: '!', 0x22: '"', 0x23: '#', 0x24: '¤', 0x25: '%', 0x26: '&', 0x27: '\'',
-		0x28: '(', 0x29: ')', 0x2A: '*', 0x2B: '+', 0x2C: ',', 0x2D: '-', 0x2E: '.', 0x2F: '/',
-		0x30: '0', 0x31: '1', 0x32: '2', 0x33: '3', 0x34: '4', 0x35: '5', 0x36: '6', 0x37: '7',
-		0x38: '8', 0x39: '9', 0x3A: ':', 0x3B: ';', 0x3C: '<', 0x3D: '=', 0x3E: '>', 0x3F: '?',
-		0x40: '¡', 0x41: 'A', 0x42: 'B', 0x43: 'C', 0x44: 'D', 0x45: 'E', 0x46: 'F', 0x47: 'G',
-		0x48: 'H', 0x49: 'I', 0x4A: 'J', 0x4B: 'K', 0x4C: 'L', 0x4D: 'M', 0x4E: 'N', 0x4F: 'O',
-		0x50: 'P', 0x51: 'Q', 0x52: 'R', 0x53: 'S', 0x54: 'T', 0x55: 'U', 0x56: 'V', 0x57: 'W',
-		0x58: 'X', 0x59: 'Y', 0x5A: 'Z', 0x5B: 'Ä', 0x5C: 'Ö', 0x5D: 'Ñ', 0x5E: 'Ü', 0x5F: '§',
-		0x60: '¿', 0x61: 'a', 0x62: 'b', 0x63: 'c', 0x64: 'd', 0x65: 'e', 0x66: 'f', 0x67: 'g',
-		0x68: 'h', 0x69: 'i', 0x6A: 'j', 0x6B: 'k', 0x6C: 'l', 0x6D: 'm', 0x6E: 'n', 0x6F: 'o',
-		0x70: 'p', 0x71: 'q', 0x72: 'r', 0x73: 's', 0x74: 't', 0x75: 'u', 0x76: 'v', 0x77: 'w',
-		0x78: 'x', 0x79: 'y', 0x7A: 'z', 0x7B: 'ä', 0x7C: 'ö', 0x7D: 'ñ', 0x7E: 'ü', 0x7F: 'à',
-	}
-
-	result := make([]rune, 0, len(data))
-	for _, b := range data {
-		if char, exists := gsm7BitMap[b]; exists {
-			result = append(result, char)
-		} else {
-			result = append(result, '?')
-		}
-	}
-
-	return string(result), nil
+	return DecodeGSM7(data, GSM7LanguageDefault, GSM7LanguageDefault), nil
 }
 
 // readCString reads a null-terminated string from the given offset
@@ -0,0 +1,80 @@
+package protocol
+
+import "testing"
+
+func TestDataSMPayloadStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[uint16][]byte
+		want       uint32
+	}{
+		{"missing payload", nil, ESME_RMISSINGOPTPARAM},
+		{"empty payload", map[uint16][]byte{OPT_PARAM_MESSAGE_PAYLOAD: {}}, ESME_RINVMSGLEN},
+		{"payload", map[uint16][]byte{OPT_PARAM_MESSAGE_PAYLOAD: []byte("hello")}, ESME_ROK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := SerializeDataSMPDU(&DataSMPDU{
+				SourceAddr:         "SENDER",
+				DestinationAddr:    "905551112233",
+				OptionalParameters: tt.parameters,
+			})
+
+			data, err := ParseDataSMPDU(body)
+			if err != nil {
+				t.Fatalf("ParseDataSMPDU() error = %v", err)
+			}
+			if got := data.PayloadStatus(); got != tt.want {
+				t.Errorf("PayloadStatus() = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubmitSMPayload(t *testing.T) {
+	tests := []struct {
+		name         string
+		shortMessage string
+		parameters   map[uint16][]byte
+		userData     string
+		both         bool
+		emptyPayload bool
+	}{
+		{"short message", "hello", nil, "hello", false, false},
+		{"payload", "", map[uint16][]byte{OPT_PARAM_MESSAGE_PAYLOAD: []byte("hello")}, "hello", false, false},
+		{"empty payload", "", map[uint16][]byte{OPT_PARAM_MESSAGE_PAYLOAD: {}}, "", false, true},
+		{"short message and payload", "hello", map[uint16][]byte{OPT_PARAM_MESSAGE_PAYLOAD: []byte("hello")}, "hello", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := SerializeSubmitSMPDU(&SubmitSMPDU{
+				SourceAddr:         "SENDER",
+				DestinationAddr:    "905551112233",
+				SMLength:           uint8(len(tt.shortMessage)),
+				ShortMessage:       tt.shortMessage,
+				OptionalParameters: tt.parameters,
+			})
+
+			submit, err := ParseSubmitSMPDU(body)
+			if err != nil {
+				t.Fatalf("ParseSubmitSMPDU() error = %v", err)
+			}
+			if got := string(submit.UserData()); got != tt.userData {
+				t.Errorf("UserData() = %q, want %q", got, tt.userData)
+			}
+			if got := submit.HasShortMessageAndPayload(); got != tt.both {
+				t.Errorf("HasShortMessageAndPayload() = %v, want %v", got, tt.both)
+			}
+			if got := submit.HasEmptyPayload(); got != tt.emptyPayload {
+				t.Errorf("HasEmptyPayload() = %v, want %v", got, tt.emptyPayload)
+			}
+
+			multi := &SubmitMultiPDU{ShortMessage: submit.ShortMessage, MessagePayload: submit.MessagePayload}
+			if got := multi.HasEmptyPayload(); got != tt.emptyPayload {
+				t.Errorf("submit_multi HasEmptyPayload() = %v, want %v", got, tt.emptyPayload)
+			}
+		})
+	}
+}
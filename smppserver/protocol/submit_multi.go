@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SubmitMultiDestination is a destination of submit_multi, either an SME address or a distribution list name
+type SubmitMultiDestination struct {
+	DestFlag        uint8
+	DestAddrTON     uint8
+	DestAddrNPI     uint8
+	DestinationAddr string // Set for DEST_FLAG_SME_ADDRESS
+	DLName          string // Set for DEST_FLAG_DISTRIBUTION_LIST
+}
+
+// SubmitMultiPDU represents submit_multi request PDU
+type SubmitMultiPDU struct {
+	ServiceType          string
+	SourceAddrTON        uint8
+	SourceAddrNPI        uint8
+	SourceAddr           string
+	Destinations         []SubmitMultiDestination
+	ESMClass             uint8
+	ProtocolID           uint8
+	PriorityFlag         uint8
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	RegisteredDelivery   uint8
+	ReplaceIfPresentFlag uint8
+	DataCoding           uint8
+	SMDefaultMsgID       uint8
+	SMLength             uint8
+	ShortMessage         string
+	MessagePayload       []byte // Value of the message_payload TLV when present, parsed from OptionalParameters
+	OptionalParameters   map[uint16][]byte
+}
+
+// UnsuccessfulSME is a destination of submit_multi that was not accepted
+type UnsuccessfulSME struct {
+	DestAddrTON     uint8
+	DestAddrNPI     uint8
+	DestinationAddr string
+	ErrorStatusCode uint32
+}
+
+// SubmitMultiRespPDU represents submit_multi response PDU
+type SubmitMultiRespPDU struct {
+	MessageID     string
+	UnsuccessSMEs []UnsuccessfulSME
+}
+
+// ParseSubmitMultiPDU parses a submit_multi PDU from the body bytes
+func ParseSubmitMultiPDU(body []byte) (*SubmitMultiPDU, error) {
+	submit := &SubmitMultiPDU{}
+	offset := 0
+
+	readByte := func(field string) (uint8, error) {
+		if offset >= len(body) {
+			return 0, fmt.Errorf("submit_multi PDU body too short for %s", field)
+		}
+		value := body[offset]
+		offset++
+		return value, nil
+	}
+	readString := func(field string) (string, error) {
+		if offset >= len(body) {
+			return "", fmt.Errorf("submit_multi PDU body too short for %s", field)
+		}
+		value, newOffset := readCString(body, offset)
+		offset = newOffset
+		return value, nil
+	}
+
+	var err error
+	if submit.ServiceType, err = readString("service type"); err != nil {
+		return nil, err
+	}
+	if submit.SourceAddrTON, err = readByte("source addr TON"); err != nil {
+		return nil, err
+	}
+	if submit.SourceAddrNPI, err = readByte("source addr NPI"); err != nil {
+		return nil, err
+	}
+	if submit.SourceAddr, err = readString("source addr"); err != nil {
+		return nil, err
+	}
+
+	numberOfDests, err := readByte("number of dests")
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(numberOfDests); i++ {
+		var destination SubmitMultiDestination
+		if destination.DestFlag, err = readByte("dest flag"); err != nil {
+			return nil, err
+		}
+
+		switch destination.DestFlag {
+		case DEST_FLAG_SME_ADDRESS:
+			if destination.DestAddrTON, err = readByte("dest addr TON"); err != nil {
+				return nil, err
+			}
+			if destination.DestAddrNPI, err = readByte("dest addr NPI"); err != nil {
+				return nil, err
+			}
+			if destination.DestinationAddr, err = readString("destination addr"); err != nil {
+				return nil, err
+			}
+		case DEST_FLAG_DISTRIBUTION_LIST:
+			if destination.DLName, err = readString("dl name"); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("submit_multi PDU has invalid dest flag %d", destination.DestFlag)
+		}
+
+		submit.Destinations = append(submit.Destinations, destination)
+	}
+
+	if submit.ESMClass, err = readByte("ESM class"); err != nil {
+		return nil, err
+	}
+	if submit.ProtocolID, err = readByte("protocol ID"); err != nil {
+		return nil, err
+	}
+	if submit.PriorityFlag, err = readByte("priority flag"); err != nil {
+		return nil, err
+	}
+	if submit.ScheduleDeliveryTime, err = readString("schedule delivery time"); err != nil {
+		return nil, err
+	}
+	if submit.ValidityPeriod, err = readString("validity period"); err != nil {
+		return nil, err
+	}
+	if submit.RegisteredDelivery, err = readByte("registered delivery"); err != nil {
+		return nil, err
+	}
+	if submit.ReplaceIfPresentFlag, err = readByte("replace if present flag"); err != nil {
+		return nil, err
+	}
+	if submit.DataCoding, err = readByte("data coding"); err != nil {
+		return nil, err
+	}
+	if submit.SMDefaultMsgID, err = readByte("SM default msg ID"); err != nil {
+		return nil, err
+	}
+	if submit.SMLength, err = readByte("SM length"); err != nil {
+		return nil, err
+	}
+
+	// Short Message
+	if submit.SMLength > 0 {
+		if offset+int(submit.SMLength) > len(body) {
+			return nil, fmt.Errorf("submit_multi PDU body too short for short message")
+		}
+		submit.ShortMessage = string(body[offset : offset+int(submit.SMLength)])
+		offset += int(submit.SMLength)
+	}
+
+	// Optional Parameters (if any)
+	submit.OptionalParameters = make(map[uint16][]byte)
+	for offset+4 <= len(body) {
+		tag := binary.BigEndian.Uint16(body[offset : offset+2])
+		length := binary.BigEndian.Uint16(body[offset+2 : offset+4])
+		offset += 4
+
+		if offset+int(length) > len(body) {
+			break
+		}
+		submit.OptionalParameters[tag] = body[offset : offset+int(length)]
+		offset += int(length)
+	}
+	submit.MessagePayload = submit.OptionalParameters[OPT_PARAM_MESSAGE_PAYLOAD]
+
+	return submit, nil
+}
+
+// UserData returns the message body, taken from message_payload when short_message is empty
+func (s *SubmitMultiPDU) UserData() []byte {
+	if len(s.ShortMessage) == 0 && s.MessagePayload != nil {
+		return s.MessagePayload
+	}
+	return []byte(s.ShortMessage)
+}
+
+// HasShortMessageAndPayload reports whether the body was sent both in short_message and message_payload,
+// which SMPP 3.4 forbids
+func (s *SubmitMultiPDU) HasShortMessageAndPayload() bool {
+	return len(s.ShortMessage) > 0 && s.MessagePayload != nil
+}
+
+// HasEmptyPayload reports whether a message_payload TLV was sent without a value
+func (s *SubmitMultiPDU) HasEmptyPayload() bool {
+	return s.MessagePayload != nil && len(s.MessagePayload) == 0
+}
+
+// SerializeSubmitMultiRespPDU serializes a submit_multi_resp PDU to bytes
+func SerializeSubmitMultiRespPDU(resp *SubmitMultiRespPDU) []byte {
+	var result []byte
+
+	// Message ID
+	result = append(result, []byte(resp.MessageID)...)
+	result = append(result, 0)
+
+	// Unsuccessful SMEs
+	result = append(result, uint8(len(resp.UnsuccessSMEs)))
+	for _, sme := range resp.UnsuccessSMEs {
+		result = append(result, sme.DestAddrTON, sme.DestAddrNPI)
+		result = append(result, []byte(sme.DestinationAddr)...)
+		result = append(result, 0)
+		result = binary.BigEndian.AppendUint32(result, sme.ErrorStatusCode)
+	}
+
+	return result
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"errors"
+)
+
+// ErrInvalidUDH is returned when a user data header is truncated or its IEs overrun it
+var ErrInvalidUDH = errors.New("invalid user data header")
+
+// InformationElement is a single IE of a user data header
+type InformationElement struct {
+	ID   uint8
+	Data []byte
+}
+
+// ConcatenationIE holds the concatenation IE of a segment of a long message
+type ConcatenationIE struct {
+	Reference uint16
+	Total     uint8
+	Sequence  uint8
+}
+
+// UserDataHeader is a parsed user data header
+type UserDataHeader struct {
+	Elements      []InformationElement
+	Concatenation *ConcatenationIE // nil when the header has no valid concatenation IE
+	LockingShift  GSM7Language
+	SingleShift   GSM7Language
+}
+
+// ParseUDH parses the user data header at the start of short message data, as announced by ESM_CLASS_UDHI.
+// It returns the header and the user data following it.
+func ParseUDH(data []byte) (*UserDataHeader, []byte, error) {
+	if len(data) == 0 || int(data[0])+1 > len(data) {
+		return nil, nil, ErrInvalidUDH
+	}
+
+	header := &UserDataHeader{}
+	ies := data[1 : int(data[0])+1]
+	for len(ies) > 0 {
+		if len(ies) < 2 || int(ies[1])+2 > len(ies) {
+			return nil, nil, ErrInvalidUDH
+		}
+
+		element := InformationElement{ID: ies[0], Data: ies[2 : int(ies[1])+2]}
+		header.Elements = append(header.Elements, element)
+		ies = ies[int(ies[1])+2:]
+
+		switch element.ID {
+		case IEI_CONCAT_8BIT:
+			if len(element.Data) == 3 {
+				header.Concatenation = &ConcatenationIE{
+					Reference: uint16(element.Data[0]),
+					Total:     element.Data[1],
+					Sequence:  element.Data[2],
+				}
+			}
+		case IEI_CONCAT_16BIT:
+			if len(element.Data) == 4 {
+				header.Concatenation = &ConcatenationIE{
+					Reference: uint16(element.Data[0])<<8 | uint16(element.Data[1]),
+					Total:     element.Data[2],
+					Sequence:  element.Data[3],
+				}
+			}
+		case IEI_NATIONAL_SINGLE_SHIFT:
+			if len(element.Data) == 1 {
+				header.SingleShift = GSM7Language(element.Data[0])
+			}
+		case IEI_NATIONAL_LOCKING_SHIFT:
+			if len(element.Data) == 1 {
+				header.LockingShift = GSM7Language(element.Data[0])
+			}
+		}
+	}
+
+	// Segments numbered outside 1..total are treated as standalone messages
+	if c := header.Concatenation; c != nil && (c.Total == 0 || c.Sequence == 0 || c.Sequence > c.Total) {
+		header.Concatenation = nil
+	}
+
+	return header, data[int(data[0])+1:], nil
+}
+
+// DecodeUserData decodes short message data that followed a user data header.
+// GSM 7-bit data is decoded with the national shift tables announced by the header.
+func DecodeUserData(data []byte, dataCoding uint8, header *UserDataHeader) (string, error) {
+	if header != nil && dataCoding == DCS_GSM7 {
+		return DecodeGSM7(data, header.LockingShift, header.SingleShift), nil
+	}
+	return DecodeShortMessage(data, dataCoding)
+}
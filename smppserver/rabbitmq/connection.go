@@ -0,0 +1,55 @@
+package rabbitmq
+
+import (
+	"fmt"
+
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// openChannel opens the channel used for publishing and consuming
+func (r *RabbitMQClient) openChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %v", err)
+	}
+
+	// Publisher confirms tell when the broker has taken responsibility for a submitted message
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	if err := declareTopology(ch, r.config); err != nil {
+		if topology.IsArgumentsMismatch(err) {
+			return nil, fmt.Errorf("%v; a queue exists with other arguments, stop the SMPP server and the backend and run migrate-queues of the backend", err)
+		}
+		return nil, err
+	}
+	return ch, nil
+}
+
+// addConsumer registers a consumer and starts it when RabbitMQ is connected.
+// Registered consumers are started again after every reconnection.
+func (r *RabbitMQClient) addConsumer(name string, start func(ch *amqp.Channel) error) error {
+	return r.connection.AddConsumer(name, start)
+}
+
+// currentChannel returns the channel of the current connection, nil before the first connection
+func (r *RabbitMQClient) currentChannel() *amqp.Channel {
+	if r.connection == nil {
+		return nil
+	}
+	return r.connection.Channel()
+}
+
+// IsConnected reports whether messages can be published
+func (r *RabbitMQClient) IsConnected() bool {
+	return r.connection.IsConnected()
+}
+
+// State returns the state of the RabbitMQ connection
+func (r *RabbitMQClient) State() amqpconn.State {
+	return r.connection.State()
+}
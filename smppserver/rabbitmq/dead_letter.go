@@ -0,0 +1,68 @@
+package rabbitmq
+
+import (
+	"log"
+
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// maxRetries is how many times a failed message is queued again before it is dead-lettered
+const maxRetries = topology.MaxRetries
+
+// declareDeadLetterSource declares a queue whose failed messages are dead-lettered, together with its dead-letter
+// queue and its retry queues. args must include the dead-letter arguments of the queue.
+func declareDeadLetterSource(ch *amqp.Channel, config *Config, queueName string, args amqp.Table) error {
+	if err := topology.DeclareDeadLetterQueue(ch, config.Exchange, queueName); err != nil {
+		return err
+	}
+	if err := topology.DeclareRetryQueues(ch, queueName); err != nil {
+		return err
+	}
+
+	_, err := ch.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		args,      // arguments
+	)
+	return err
+}
+
+// failedCopy returns where the copy of a message that failed in a queue goes: to the retry queue of its next attempt,
+// which hands it back to the queue after a delay, until it was retried maxRetries times, then, or right away when it
+// cannot be processed, to the dead-letter queue of the queue.
+func failedCopy(config *Config, msg amqp.Delivery, queueName, reason string, cause error) (exchange, key string, copied amqp.Publishing) {
+	if retries := topology.CountHeader(msg.Headers, topology.HeaderRetryCount); retries < maxRetries && reason != topology.ReasonUnprocessable {
+		retryQueue, copied := topology.RetryMessage(msg, queueName)
+		return "", retryQueue, copied
+	}
+	return topology.DeadLetterExchange(config.Exchange), queueName, topology.DeadLetterMessage(msg, queueName, reason, cause)
+}
+
+// settleFailed retries or dead-letters a message that failed in a queue, see failedCopy. The message is acknowledged
+// once the broker confirms its copy and requeued as it is when the copy cannot be published.
+func (r *RabbitMQClient) settleFailed(msg amqp.Delivery, queueName, reason string, cause error) {
+	exchange, key, copied := failedCopy(r.config, msg, queueName, reason, cause)
+
+	var err error = amqp.ErrClosed
+	if ch := r.currentChannel(); ch != nil {
+		err = amqpconn.PublishConfirmed(ch, exchange, key, copied, r.confirmTimeout())
+	}
+	if err != nil {
+		log.Printf("Failed to move failed message from %s on, requeueing it: %v", queueName, err)
+		msg.Nack(false, true)
+		return
+	}
+
+	if exchange == "" {
+		log.Printf("Queued failed message from %s for a retry in %s: %v", queueName, key, cause)
+	} else {
+		log.Printf("Dead-lettered message from %s (%s): %v", queueName, reason, cause)
+	}
+	msg.Ack(false)
+}
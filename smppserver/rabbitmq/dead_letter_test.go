@@ -0,0 +1,155 @@
+package rabbitmq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"smppserver/session"
+	"smppserver/store"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// settlement records how a delivery was acknowledged
+type settlement struct {
+	mutex    sync.Mutex
+	acked    bool
+	requeued bool
+	rejected bool
+	settled  chan struct{}
+}
+
+func newSettlement() *settlement {
+	return &settlement{settled: make(chan struct{}, 1)}
+}
+
+func (s *settlement) Ack(tag uint64, multiple bool) error {
+	s.mutex.Lock()
+	s.acked = true
+	s.mutex.Unlock()
+	s.settled <- struct{}{}
+	return nil
+}
+
+func (s *settlement) Nack(tag uint64, multiple, requeue bool) error {
+	s.mutex.Lock()
+	s.requeued = requeue
+	s.rejected = !requeue
+	s.mutex.Unlock()
+	s.settled <- struct{}{}
+	return nil
+}
+
+func (s *settlement) Reject(tag uint64, requeue bool) error {
+	return s.Nack(tag, false, requeue)
+}
+
+// wait waits until the delivery was settled
+func (s *settlement) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.settled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was never acknowledged")
+	}
+}
+
+func TestFailedCopyRetriesBeforeDeadLettering(t *testing.T) {
+	config := &Config{Exchange: "tsimcloudrouter"}
+	failure := errors.New("database down")
+
+	exchange, key, copied := failedCopy(config, amqp.Delivery{Body: []byte(`{}`)}, "tsimcloud_delivery_report", topology.ReasonFailed, failure)
+	if exchange != "" || key != topology.RetryQueue("tsimcloud_delivery_report", 1) {
+		t.Errorf("first failure goes to %q/%q, want the first retry queue of the queue", exchange, key)
+	}
+	if count := topology.CountHeader(copied.Headers, topology.HeaderRetryCount); count != 1 {
+		t.Errorf("retry count = %d, want 1", count)
+	}
+
+	lastRetry := amqp.Delivery{Headers: amqp.Table{topology.HeaderRetryCount: int32(maxRetries)}, Body: []byte(`{}`)}
+	exchange, key, copied = failedCopy(config, lastRetry, "tsimcloud_delivery_report", topology.ReasonFailed, failure)
+	if exchange != "tsimcloudrouter.dlx" || key != "tsimcloud_delivery_report" {
+		t.Errorf("failure of the last retry goes to %q/%q, want the dead-letter exchange", exchange, key)
+	}
+	if copied.Headers[topology.HeaderDeadLetterReason] != topology.ReasonFailed || copied.MessageId == "" {
+		t.Errorf("dead-lettered copy = %+v, want the reason and a message ID", copied)
+	}
+
+	exchange, _, _ = failedCopy(config, amqp.Delivery{Body: []byte(`{`)}, "tsimcloud_deliver_sm", topology.ReasonUnprocessable, failure)
+	if exchange != "tsimcloudrouter.dlx" {
+		t.Errorf("unprocessable message goes to %q, want the dead-letter exchange right away", exchange)
+	}
+}
+
+func TestHandleInboundMessageKeepsUnparsableMessageWhileDisconnected(t *testing.T) {
+	client := &RabbitMQClient{config: &Config{Exchange: "tsimcloudrouter", InboundQueue: "tsimcloud_deliver_sm"}}
+	s := newSettlement()
+
+	client.handleInboundMessage(amqp.Delivery{Acknowledger: s, Body: []byte(`not json`)}, nil)
+
+	s.wait(t)
+	if !s.requeued {
+		t.Errorf("settlement = %+v, want the message requeued while it cannot be dead-lettered", s)
+	}
+}
+
+// storeError is an error type of its own, unlike the errors.New errors of other stores
+type storeError struct{}
+
+func (storeError) Error() string { return "disk full" }
+
+// failingReportStore fails to store the delivery reports of the segments of a message
+type failingReportStore struct {
+	store.MessageStore
+	mutex  sync.Mutex
+	failed int
+}
+
+func (s *failingReportStore) GetMessageSegments(systemID, parentMessageID string) ([]store.SmppMessage, error) {
+	return []store.SmppMessage{{MessageID: "seg-1"}, {MessageID: "seg-2"}}, nil
+}
+
+func (s *failingReportStore) GetMessage(systemID, messageID string) (*store.SmppMessage, error) {
+	return nil, store.ErrMessageNotFound
+}
+
+func (s *failingReportStore) UpdateMessageState(messageID string, state uint8, errorCode uint8, doneAt time.Time) error {
+	return nil
+}
+
+func (s *failingReportStore) GetQueuedDeliveryReports(systemID string, limit int) ([]store.SmppPendingDeliveryReport, error) {
+	return nil, nil
+}
+
+func (s *failingReportStore) QueueDeliveryReport(report *store.SmppPendingDeliveryReport, maxQueued int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed++
+	if s.failed%2 == 0 {
+		return storeError{}
+	}
+	return errors.New("connection refused")
+}
+
+func TestHandleDeliveryReportRequeuesReportsThatCannotBeStored(t *testing.T) {
+	client := &RabbitMQClient{
+		config:       &Config{Exchange: "tsimcloudrouter", DeliveryReportQueue: "tsimcloud_delivery_report"},
+		messageStore: &failingReportStore{},
+	}
+	sessionManager := session.NewSessionManager(&session.SessionConfig{}, nil)
+	s := newSettlement()
+
+	// Both segments fail with errors of different types
+	client.handleDeliveryReport(amqp.Delivery{
+		Acknowledger: s,
+		Body:         []byte(`{"message_id":"seg-1","system_id":"esme","delivered":true}`),
+	}, sessionManager)
+
+	s.wait(t)
+	if !s.requeued {
+		t.Errorf("settlement = %+v, want the report requeued while it cannot be retried", s)
+	}
+}
@@ -0,0 +1,300 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"smppserver/protocol"
+	"smppserver/session"
+	"smppserver/store"
+)
+
+// defaultDLRRetention is used when no DLR retention is configured
+const defaultDLRRetention = 72 * time.Hour
+
+// maxDLRAttempts is the number of receiver sessions a delivery report is offered to before it is stored
+const maxDLRAttempts = 3
+
+// reportOutcome is the final result of offering a delivery report to the receiver sessions of a system ID
+type reportOutcome int
+
+const (
+	reportDelivered   reportOutcome = iota // An ESME acknowledged the report
+	reportRejected                         // An ESME permanently rejected the report
+	reportUndelivered                      // No session accepted the report
+)
+
+// dispatchDeliveryReport hands a delivery report to the worker of its system ID, which sends it to a receiver
+// session and stores it for redelivery when none accepts it. The consumer never waits for an ESME, so an
+// unresponsive one only holds up its own reports.
+// done is called once the report was delivered, rejected or stored; a non-nil error means it could not be stored.
+func (r *RabbitMQClient) dispatchDeliveryReport(sessionManager *session.SessionManager, report *DeliveryReportMessage, dlrPdu string, done func(error)) {
+	r.reportWorkers.add(report.SystemID, func() {
+		r.sendOrQueueReport(sessionManager, report, dlrPdu, done)
+	})
+}
+
+// DeliverLocalReport sends a delivery report raised by this server, such as the rejection of a message that never
+// reached the broker, to the receiver sessions of its system ID or stores it for redelivery. It does not go through
+// RabbitMQ, which may be the reason the message was rejected. The report of an assembled message goes to each segment.
+func (r *RabbitMQClient) DeliverLocalReport(sessionManager *session.SessionManager, report *DeliveryReportMessage) {
+	for _, report := range r.segmentReports(report) {
+		report := report
+		r.dispatchDeliveryReport(sessionManager, report, r.dlrPduFor(report), func(err error) {
+			if err != nil {
+				log.Printf("Failed to store delivery report %s for redelivery: %v", report.MessageID, err)
+			}
+		})
+	}
+}
+
+// sendOrQueueReport sends a delivery report to a receiver session of its system ID and stores it for redelivery
+// when none accepts it. Reports stored earlier are sent first so that the order is preserved.
+func (r *RabbitMQClient) sendOrQueueReport(sessionManager *session.SessionManager, report *DeliveryReportMessage, dlrPdu string, done func(error)) {
+	if r.messageStore == nil {
+		r.deliverReport(sessionManager, report, dlrPdu, func(reportOutcome) {
+			done(nil)
+		})
+		return
+	}
+
+	lock := systemLock(&r.reportLocks, report.SystemID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !r.deliverQueuedReports(sessionManager, report.SystemID) {
+		done(r.queueDeliveryReport(report, dlrPdu))
+		return
+	}
+
+	r.deliverReport(sessionManager, report, dlrPdu, func(outcome reportOutcome) {
+		if outcome == reportUndelivered {
+			done(r.queueDeliveryReport(report, dlrPdu))
+			return
+		}
+		done(nil)
+	})
+}
+
+// DeliverQueuedReports sends the delivery reports stored for a system ID while it had no receiver session bound
+func (r *RabbitMQClient) DeliverQueuedReports(sessionManager *session.SessionManager, systemID string) {
+	if r.messageStore == nil {
+		return
+	}
+
+	lock := systemLock(&r.reportLocks, systemID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r.deliverQueuedReports(sessionManager, systemID)
+}
+
+// deliverQueuedReports sends stored delivery reports oldest first, one at a time, and reports whether none is left.
+// The caller must hold the report lock of the system ID.
+func (r *RabbitMQClient) deliverQueuedReports(sessionManager *session.SessionManager, systemID string) bool {
+	for {
+		pending, err := r.messageStore.GetQueuedDeliveryReports(systemID, queueBatchSize)
+		if err != nil {
+			log.Printf("Failed to load queued delivery reports for %s: %v", systemID, err)
+			return false
+		}
+
+		for i := range pending {
+			var report DeliveryReportMessage
+			if err := json.Unmarshal([]byte(pending[i].Report), &report); err != nil {
+				log.Printf("Dropping unreadable queued delivery report %s: %v", pending[i].MessageID, err)
+			} else if r.deliverReportAndWait(sessionManager, &report, pending[i].DlrPdu) == reportUndelivered {
+				return false
+			}
+
+			if err := r.messageStore.DeleteDeliveryReport(pending[i].ID); err != nil {
+				log.Printf("Failed to remove delivered report %s from queue: %v", pending[i].MessageID, err)
+				return false
+			}
+		}
+
+		if len(pending) < queueBatchSize {
+			if len(pending) > 0 {
+				log.Printf("Delivered queued delivery reports of %s", systemID)
+			}
+			return true
+		}
+	}
+}
+
+// deliverReportAndWait offers a delivery report to the receiver sessions of its system ID and waits for the outcome
+func (r *RabbitMQClient) deliverReportAndWait(sessionManager *session.SessionManager, report *DeliveryReportMessage, dlrPdu string) reportOutcome {
+	result := make(chan reportOutcome, 1)
+	r.deliverReport(sessionManager, report, dlrPdu, func(outcome reportOutcome) {
+		result <- outcome
+	})
+	return <-result
+}
+
+// reportDelivery tracks the attempts to deliver one delivery report
+type reportDelivery struct {
+	client         *RabbitMQClient
+	sessionManager *session.SessionManager
+	report         *DeliveryReportMessage
+	dlrPdu         string
+	tried          map[string]bool
+	done           func(reportOutcome)
+}
+
+// deliverReport sends a delivery report to exactly one receiver session of its system ID, picking the least
+// loaded one. When the response times out or reports a temporary error the report is offered to another
+// receiver session. done is called once with the outcome.
+func (r *RabbitMQClient) deliverReport(sessionManager *session.SessionManager, report *DeliveryReportMessage, dlrPdu string, done func(reportOutcome)) {
+	delivery := &reportDelivery{
+		client:         r,
+		sessionManager: sessionManager,
+		report:         report,
+		dlrPdu:         dlrPdu,
+		tried:          make(map[string]bool),
+		done:           done,
+	}
+	delivery.attempt()
+}
+
+// attempt sends the report to the next untried receiver session
+func (d *reportDelivery) attempt() {
+	for len(d.tried) < maxDLRAttempts {
+		s := d.client.pickReceiver(d.sessionManager, d.report.SystemID, d.tried)
+		if s == nil {
+			break
+		}
+		d.tried[s.ID] = true
+
+		err := d.client.sendDeliveryReportToSession(s, d.report, d.dlrPdu, func(status uint32, err error) {
+			d.handleResponse(s, status, err)
+		})
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to send delivery report %s to session %s: %v", d.report.MessageID, s.ID, err)
+	}
+
+	log.Printf("No receiver session accepted delivery report %s for system ID: %s", d.report.MessageID, d.report.SystemID)
+	d.done(reportUndelivered)
+}
+
+// handleResponse decides what to do with the response of a session to the report
+func (d *reportDelivery) handleResponse(s *session.Session, status uint32, err error) {
+	switch {
+	case err != nil:
+		log.Printf("Delivery report %s to session %s failed: %v", d.report.MessageID, s.ID, err)
+		d.attempt()
+	case status == protocol.ESME_ROK:
+		log.Printf("Delivery report %s acknowledged by session %s", d.report.MessageID, s.ID)
+		d.done(reportDelivered)
+	case isTemporaryStatus(status):
+		log.Printf("Session %s temporarily refused delivery report %s with status 0x%08X", s.ID, d.report.MessageID, status)
+		d.attempt()
+	default:
+		log.Printf("Session %s rejected delivery report %s with status 0x%08X, dropping it", s.ID, d.report.MessageID, status)
+		d.done(reportRejected)
+	}
+}
+
+// isTemporaryStatus reports whether a response status means the request may succeed if sent again
+func isTemporaryStatus(status uint32) bool {
+	switch status {
+	case protocol.ESME_RTHROTTLED, protocol.ESME_RMSGQFUL, protocol.ESME_RSYSERR:
+		return true
+	default:
+		return false
+	}
+}
+
+// pickReceiver returns the receiver session of a system ID with the fewest unacknowledged requests,
+// skipping sessions that were already tried. Ties are spread over the sessions in turn.
+func (r *RabbitMQClient) pickReceiver(sessionManager *session.SessionManager, systemID string, tried map[string]bool) *session.Session {
+	var candidates []*session.Session
+	for _, s := range sessionManager.GetSessionsBySystemID(systemID) {
+		if s.CanReceive() && !tried[s.ID] {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	start := int(atomic.AddUint32(&r.receiverTurn, 1) % uint32(len(candidates)))
+
+	var best *session.Session
+	for i := range candidates {
+		candidate := candidates[(start+i)%len(candidates)]
+		if best == nil || candidate.InFlight() < best.InFlight() {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// queueDeliveryReport stores a delivery report until a receiver session of its system ID binds
+func (r *RabbitMQClient) queueDeliveryReport(report *DeliveryReportMessage, dlrPdu string) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode delivery report: %v", err)
+	}
+
+	retention := r.config.DLRRetention
+	if retention <= 0 {
+		retention = defaultDLRRetention
+	}
+
+	if err := r.messageStore.QueueDeliveryReport(&store.SmppPendingDeliveryReport{
+		MessageID: report.MessageID,
+		SystemID:  report.SystemID,
+		Report:    string(body),
+		DlrPdu:    dlrPdu,
+		ExpiresAt: time.Now().Add(retention),
+	}, r.config.DLRQueueLimit); err != nil {
+		return err
+	}
+
+	log.Printf("Queued delivery report %s for system ID %s until a receiver binds", report.MessageID, report.SystemID)
+	return nil
+}
+
+// systemWorkers runs tasks one after another on one goroutine per system ID, in the order they were added.
+// The goroutine of a system ID ends once its tasks are done.
+type systemWorkers struct {
+	mutex sync.Mutex
+	tasks map[string][]func() // system ID -> tasks waiting, present while its goroutine runs
+}
+
+// add queues a task for the worker of a system ID, starting the worker when it is not running
+func (w *systemWorkers) add(systemID string, task func()) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if tasks, running := w.tasks[systemID]; running {
+		w.tasks[systemID] = append(tasks, task)
+		return
+	}
+	if w.tasks == nil {
+		w.tasks = make(map[string][]func())
+	}
+	w.tasks[systemID] = []func(){task}
+
+	go func() {
+		for {
+			w.mutex.Lock()
+			tasks := w.tasks[systemID]
+			if len(tasks) == 0 {
+				delete(w.tasks, systemID)
+				w.mutex.Unlock()
+				return
+			}
+			w.tasks[systemID] = tasks[1:]
+			w.mutex.Unlock()
+
+			tasks[0]()
+		}
+	}()
+}
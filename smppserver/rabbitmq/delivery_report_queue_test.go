@@ -0,0 +1,261 @@
+package rabbitmq
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"smppserver/protocol"
+	"smppserver/session"
+	"smppserver/store"
+)
+
+// noAnswer leaves a request of a reportReceiver unanswered
+const noAnswer uint32 = 0xFFFFFFFF
+
+// reportReceiver adds a receiver session of systemID whose ESME answers the first requests with statuses
+// and leaves every later request unanswered. Each received request is reported on the returned channel.
+func reportReceiver(t *testing.T, sessionManager *session.SessionManager, systemID string, responseTimeout time.Duration, statuses ...uint32) (*session.Session, <-chan uint32) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s := session.NewSession(server, &session.SessionConfig{
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		ResponseTimeout: responseTimeout,
+	})
+	s.SystemID = systemID
+	s.SetState(session.StateBoundRX)
+	if err := sessionManager.AddSession(s); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	received := make(chan uint32, 10)
+	go func() {
+		for i := 0; ; i++ {
+			pdu, err := protocol.ReadPDU(client)
+			if err != nil {
+				return
+			}
+			received <- pdu.SequenceNumber
+			if i < len(statuses) && statuses[i] != noAnswer {
+				s.HandleResponse(&protocol.PDU{CommandID: protocol.DELIVER_SM_RESP, CommandStatus: statuses[i], SequenceNumber: pdu.SequenceNumber})
+			}
+		}
+	}()
+	return s, received
+}
+
+// occupy leaves one request of the session unanswered, so that its load is higher than that of idle sessions
+func occupy(t *testing.T, s *session.Session, received <-chan uint32) {
+	t.Helper()
+	if err := s.SendRequest(&protocol.PDU{CommandID: protocol.DELIVER_SM, SequenceNumber: s.GetNextSequenceNumber()}, func(uint32, error) {}); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+}
+
+// sessionID returns the ID of a picked session, or none
+func sessionID(s *session.Session) string {
+	if s == nil {
+		return "none"
+	}
+	return s.ID
+}
+
+func newReportSessionManager() *session.SessionManager {
+	return session.NewSessionManager(&session.SessionConfig{MaxSessions: 10}, nil)
+}
+
+// awaitOutcome returns the outcome of a report delivery, failing when it does not arrive in time
+func awaitOutcome(t *testing.T, outcomes <-chan reportOutcome) reportOutcome {
+	t.Helper()
+	select {
+	case outcome := <-outcomes:
+		return outcome
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery report outcome never arrived")
+		return reportUndelivered
+	}
+}
+
+func TestPickReceiverPrefersTheLeastLoadedUntriedReceiver(t *testing.T) {
+	client := &RabbitMQClient{config: &Config{}}
+	sessionManager := newReportSessionManager()
+
+	busy, busyReceived := reportReceiver(t, sessionManager, "esme", time.Minute)
+	occupy(t, busy, busyReceived)
+	idle, _ := reportReceiver(t, sessionManager, "esme", time.Minute)
+	transmitter, _ := reportReceiver(t, sessionManager, "esme", time.Minute)
+	transmitter.SetState(session.StateBoundTX)
+	reportReceiver(t, sessionManager, "other-esme", time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if s := client.pickReceiver(sessionManager, "esme", map[string]bool{}); s != idle {
+			t.Fatalf("picked %s, want the idle receiver", sessionID(s))
+		}
+	}
+	if s := client.pickReceiver(sessionManager, "esme", map[string]bool{idle.ID: true}); s != busy {
+		t.Errorf("picked %s with the idle receiver tried, want the busy one", sessionID(s))
+	}
+	if s := client.pickReceiver(sessionManager, "esme", map[string]bool{idle.ID: true, busy.ID: true}); s != nil {
+		t.Errorf("picked %s with every receiver tried, want none", s.ID)
+	}
+	if s := client.pickReceiver(sessionManager, "unbound-esme", map[string]bool{}); s != nil {
+		t.Errorf("picked %s for a system ID without sessions, want none", s.ID)
+	}
+}
+
+func TestDeliverReportRetriesOnAnotherSession(t *testing.T) {
+	tests := []struct {
+		name          string
+		firstStatuses []uint32 // Answers of the session tried first, none makes the request time out
+	}{
+		{"temporary error", []uint32{protocol.ESME_RTHROTTLED}},
+		{"response timeout", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &RabbitMQClient{config: &Config{}}
+			sessionManager := newReportSessionManager()
+
+			_, firstReceived := reportReceiver(t, sessionManager, "esme", 100*time.Millisecond, tt.firstStatuses...)
+			// The second session is busier, so that the report goes to the first one first
+			second, secondReceived := reportReceiver(t, sessionManager, "esme", time.Minute, noAnswer, protocol.ESME_ROK)
+			occupy(t, second, secondReceived)
+
+			outcomes := make(chan reportOutcome, 1)
+			report := &DeliveryReportMessage{MessageID: "m1", SystemID: "esme", Delivered: true}
+			client.deliverReport(sessionManager, report, store.DlrPduDeliverSM, func(outcome reportOutcome) {
+				outcomes <- outcome
+			})
+
+			if outcome := awaitOutcome(t, outcomes); outcome != reportDelivered {
+				t.Errorf("outcome = %d, want delivered", outcome)
+			}
+			if len(firstReceived) != 1 || len(secondReceived) != 1 {
+				t.Errorf("sessions received %d and %d reports, want one each", len(firstReceived), len(secondReceived))
+			}
+		})
+	}
+}
+
+func TestDeliverReportStopsAtPermanentRejection(t *testing.T) {
+	client := &RabbitMQClient{config: &Config{}}
+	sessionManager := newReportSessionManager()
+	_, firstReceived := reportReceiver(t, sessionManager, "esme", time.Minute, protocol.ESME_RINVDSTADR)
+	_, secondReceived := reportReceiver(t, sessionManager, "esme", time.Minute, protocol.ESME_RINVDSTADR)
+
+	outcomes := make(chan reportOutcome, 1)
+	client.deliverReport(sessionManager, &DeliveryReportMessage{MessageID: "m1", SystemID: "esme"}, store.DlrPduDeliverSM, func(outcome reportOutcome) {
+		outcomes <- outcome
+	})
+
+	if outcome := awaitOutcome(t, outcomes); outcome != reportRejected {
+		t.Errorf("outcome = %d, want rejected", outcome)
+	}
+	if sent := len(firstReceived) + len(secondReceived); sent != 1 {
+		t.Errorf("report sent %d times, want once", sent)
+	}
+}
+
+func TestDispatchDeliveryReportDoesNotWaitForAnUnresponsiveESME(t *testing.T) {
+	client := &RabbitMQClient{config: &Config{}}
+	sessionManager := newReportSessionManager()
+	reportReceiver(t, sessionManager, "slow-esme", time.Minute)
+	_, fastReceived := reportReceiver(t, sessionManager, "fast-esme", time.Minute, protocol.ESME_ROK, protocol.ESME_ROK)
+
+	slowDone := make(chan error, 3)
+	returned := make(chan struct{})
+	go func() {
+		// The slow ESME never answers, its later reports wait for its worker
+		for i := 0; i < 3; i++ {
+			client.dispatchDeliveryReport(sessionManager, &DeliveryReportMessage{MessageID: "slow", SystemID: "slow-esme"}, store.DlrPduDeliverSM, func(err error) {
+				slowDone <- err
+			})
+		}
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("dispatchDeliveryReport waited for the ESME")
+	}
+
+	fastDone := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		client.dispatchDeliveryReport(sessionManager, &DeliveryReportMessage{MessageID: "fast", SystemID: "fast-esme"}, store.DlrPduDeliverSM, func(err error) {
+			fastDone <- err
+		})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-fastDone:
+			if err != nil {
+				t.Errorf("fast report failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("report of another system waited for the unresponsive ESME")
+		}
+	}
+	if len(fastReceived) != 2 {
+		t.Errorf("fast ESME received %d reports, want 2", len(fastReceived))
+	}
+	if len(slowDone) != 0 {
+		t.Errorf("%d reports of the unresponsive ESME completed without an answer", len(slowDone))
+	}
+}
+
+func TestSystemWorkersRunTasksInOrder(t *testing.T) {
+	var workers systemWorkers
+	order := make(chan int, 10)
+	release := make(chan struct{})
+
+	workers.add("esme", func() {
+		<-release
+		order <- 1
+	})
+	workers.add("esme", func() { order <- 2 })
+	workers.add("other-esme", func() { order <- 3 })
+
+	// The other system ID does not wait for the first task
+	select {
+	case got := <-order:
+		if got != 3 {
+			t.Fatalf("task %d ran first, want the task of the other system ID", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("task of another system ID waited")
+	}
+
+	close(release)
+	for _, want := range []int{1, 2} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("task %d ran, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task %d never ran", want)
+		}
+	}
+}
+
+func TestDeliverLocalReportDoesNotNeedTheBroker(t *testing.T) {
+	// The client never connected to RabbitMQ
+	client := &RabbitMQClient{config: &Config{}}
+	sessionManager := newReportSessionManager()
+	_, received := reportReceiver(t, sessionManager, "esme", time.Minute, protocol.ESME_ROK)
+
+	client.DeliverLocalReport(sessionManager, &DeliveryReportMessage{MessageID: "m1", SystemID: "esme", Failed: true})
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local delivery report never reached the receiver session")
+	}
+}
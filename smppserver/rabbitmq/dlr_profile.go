@@ -0,0 +1,153 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"smppserver/auth"
+	"smppserver/protocol"
+)
+
+// DlrProfileSource looks up the DLR profile of an SMPP user
+type DlrProfileSource interface {
+	GetDlrProfile(systemID string) (*auth.SmppDlrProfile, error)
+}
+
+// dlrFields are the values a delivery report text is made of
+type dlrFields struct {
+	messageID  string
+	sub        string
+	dlvrd      string
+	submitDate string
+	doneDate   string
+	stat       string
+	err        string
+	text       string
+}
+
+// SetDlrProfileSource sets where the DLR profiles of SMPP users are looked up
+func (r *RabbitMQClient) SetDlrProfileSource(dlrProfiles DlrProfileSource) {
+	r.dlrProfiles = dlrProfiles
+}
+
+// dlrProfileFor returns the DLR profile of a user, nil for the built-in layout
+func (r *RabbitMQClient) dlrProfileFor(systemID string) *auth.SmppDlrProfile {
+	if r.dlrProfiles == nil {
+		return nil
+	}
+
+	profile, err := r.dlrProfiles.GetDlrProfile(systemID)
+	if err != nil {
+		log.Printf("Failed to load DLR profile of %s, using the built-in layout: %v", systemID, err)
+		return nil
+	}
+	return profile
+}
+
+// renderDlrText fills the text template of a profile
+func renderDlrText(template string, fields dlrFields) string {
+	return strings.NewReplacer(
+		"{id}", fields.messageID,
+		"{sub}", fields.sub,
+		"{dlvrd}", fields.dlvrd,
+		"{submit_date}", fields.submitDate,
+		"{done_date}", fields.doneDate,
+		"{stat}", fields.stat,
+		"{err}", fields.err,
+		"{text}", fields.text,
+	).Replace(template)
+}
+
+// formatDlrMessageID converts the message ID shown in the receipt text.
+// IDs that do not fit the conversion are shown as issued.
+func formatDlrMessageID(messageID, idFormat string) string {
+	switch idFormat {
+	case auth.DlrIDFormatHex, auth.DlrIDFormatHexUpper:
+		value, err := strconv.ParseUint(messageID, 10, 64)
+		if err != nil {
+			return messageID
+		}
+		hex := strconv.FormatUint(value, 16)
+		if idFormat == auth.DlrIDFormatHexUpper {
+			hex = strings.ToUpper(hex)
+		}
+		return hex
+	case auth.DlrIDFormatDecimal:
+		value, err := strconv.ParseUint(messageID, 16, 64)
+		if err != nil {
+			return messageID
+		}
+		return strconv.FormatUint(value, 10)
+	default:
+		return messageID
+	}
+}
+
+// formatDlrDate formats a report timestamp (YYYYMMDDhhmmss) with the date layout of a profile
+func (r *RabbitMQClient) formatDlrDate(timestamp, layout string) string {
+	date, err := time.ParseInLocation("20060102150405", r.cleanTimestamp(timestamp), time.Local)
+	if err != nil {
+		// Missing dates are zeros, as in the built-in layout
+		return strings.Repeat("0", len(time.Time{}.Format(layout)))
+	}
+	return date.Format(layout)
+}
+
+// mapDlrErrorCode returns the err value of a profile for an error code, looking up the code first and the stat value second
+func mapDlrErrorCode(errorCodeMap *string, errorCode uint8, stat string) string {
+	defaultValue := fmt.Sprintf("%03d", errorCode)
+	if errorCodeMap == nil {
+		return defaultValue
+	}
+
+	var statValue string
+	statFound := false
+	for _, pair := range strings.Split(*errorCodeMap, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if code, err := strconv.Atoi(key); err == nil {
+			if code == int(errorCode) {
+				return value
+			}
+			continue
+		}
+		if !statFound && strings.EqualFold(key, stat) {
+			statValue = value
+			statFound = true
+		}
+	}
+
+	if statFound {
+		return statValue
+	}
+	return defaultValue
+}
+
+// applyDlrProfile sets the addressing and TLVs of a receipt as a profile asks for
+func applyDlrProfile(deliverPDU *protocol.DeliverSMPDU, profile *auth.SmppDlrProfile, report *DeliveryReportMessage) {
+	deliverPDU.SourceAddrTON = profile.SourceAddrTON
+	deliverPDU.SourceAddrNPI = profile.SourceAddrNPI
+	deliverPDU.DestAddrTON = profile.DestAddrTON
+	deliverPDU.DestAddrNPI = profile.DestAddrNPI
+
+	if !profile.IncludeReceiptedMessageID {
+		delete(deliverPDU.OptionalParameters, protocol.OPT_PARAM_RECEIPTED_MESSAGE_ID)
+	}
+	if !profile.IncludeMessageState {
+		delete(deliverPDU.OptionalParameters, protocol.OPT_PARAM_MESSAGE_STATE)
+	}
+
+	if !profile.IncludeNetworkErrorCode {
+		delete(deliverPDU.OptionalParameters, protocol.OPT_PARAM_NETWORK_ERROR_CODE)
+	} else if report.ErrorCode != 0 {
+		deliverPDU.OptionalParameters[protocol.OPT_PARAM_NETWORK_ERROR_CODE] = networkErrorCode(profile.NetworkType, report.ErrorCode)
+	}
+}
@@ -0,0 +1,314 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"smppserver/protocol"
+	"smppserver/session"
+	"smppserver/store"
+	"tsimcloud/shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// queueBatchSize is the number of queued messages or delivery reports loaded at once
+const queueBatchSize = 100
+
+// InboundSMSMessage represents an inbound (MO) SMS received by a device and routed to an SMPP user
+type InboundSMSMessage struct {
+	MessageID       string `json:"message_id"`
+	SystemID        string `json:"system_id"`
+	SourceAddr      string `json:"source_addr"`      // Sender's phone number
+	DestinationAddr string `json:"destination_addr"` // Receiving SIM number
+	Message         string `json:"message"`
+	DeviceIMEI      string `json:"device_imei"`
+	SimSlot         int    `json:"sim_slot"`
+	RoutingID       uint   `json:"routing_id"`
+	ReceivedAt      string `json:"received_at"` // 20060102150405
+}
+
+// StartInboundConsumer starts consuming inbound SMS messages, again after every reconnection
+func (r *RabbitMQClient) StartInboundConsumer(sessionManager *session.SessionManager) error {
+	if r.config.InboundQueue == "" {
+		return fmt.Errorf("inbound queue is not configured")
+	}
+
+	return r.addConsumer("inbound SMS consumer", func(ch *amqp.Channel) error {
+		return r.consumeInbound(ch, sessionManager)
+	})
+}
+
+// consumeInbound consumes inbound SMS messages on a channel
+func (r *RabbitMQClient) consumeInbound(ch *amqp.Channel, sessionManager *session.SessionManager) error {
+	msgs, err := ch.Consume(
+		r.config.InboundQueue, // queue
+		"",                    // consumer
+		false,                 // auto-ack
+		false,                 // exclusive
+		false,                 // no-local
+		false,                 // no-wait
+		nil,                   // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to start inbound consumer: %v", err)
+	}
+
+	go func() {
+		for msg := range msgs {
+			r.handleInboundMessage(msg, sessionManager)
+		}
+	}()
+
+	log.Printf("Started inbound SMS consumer for queue: %s", r.config.InboundQueue)
+	return nil
+}
+
+// handleInboundMessage queues an inbound SMS and delivers it if the SMPP user has a receiver bound
+func (r *RabbitMQClient) handleInboundMessage(msg amqp.Delivery, sessionManager *session.SessionManager) {
+	var inbound InboundSMSMessage
+	if err := json.Unmarshal(msg.Body, &inbound); err != nil {
+		log.Printf("Failed to unmarshal inbound SMS: %v", err)
+		r.settleFailed(msg, r.config.InboundQueue, topology.ReasonUnprocessable, err)
+		return
+	}
+
+	log.Printf("Received inbound SMS %s for system: %s", inbound.MessageID, inbound.SystemID)
+
+	if r.messageStore == nil {
+		log.Printf("Message store not available, dropping inbound SMS %s", inbound.MessageID)
+		msg.Ack(false)
+		return
+	}
+
+	receivedAt, err := time.ParseInLocation("20060102150405", inbound.ReceivedAt, time.Local)
+	if err != nil {
+		receivedAt = time.Now()
+	}
+
+	// Keep the message until a receiver session accepts it
+	if err := r.messageStore.QueueInboundMessage(&store.SmppInboundMessage{
+		MessageID:       inbound.MessageID,
+		SystemID:        inbound.SystemID,
+		SourceAddr:      inbound.SourceAddr,
+		DestinationAddr: inbound.DestinationAddr,
+		Message:         inbound.Message,
+		ReceivedAt:      receivedAt,
+	}); err != nil {
+		log.Printf("Failed to queue inbound SMS %s: %v", inbound.MessageID, err)
+		r.settleFailed(msg, r.config.InboundQueue, topology.ReasonFailed, err)
+		return
+	}
+	msg.Ack(false)
+
+	// The consumer goes on with the next message while a slow ESME answers
+	r.inboundRuns.trigger(inbound.SystemID, func() {
+		r.DeliverQueuedInbound(sessionManager, inbound.SystemID)
+	})
+}
+
+// DeliverQueuedInbound sends the queued inbound messages of a system ID to its receiver sessions in arrival order.
+// Messages stay queued while the SMPP user has no RX or TRX session bound.
+func (r *RabbitMQClient) DeliverQueuedInbound(sessionManager *session.SessionManager, systemID string) {
+	if r.messageStore == nil {
+		return
+	}
+
+	// Only one delivery run per system ID, so that messages are neither duplicated nor reordered
+	lock := systemLock(&r.inboundLocks, systemID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for {
+		messages, err := r.messageStore.GetQueuedInboundMessages(systemID, queueBatchSize)
+		if err != nil {
+			log.Printf("Failed to load queued inbound messages for %s: %v", systemID, err)
+			return
+		}
+
+		for i := range messages {
+			if !r.deliverInbound(sessionManager, &messages[i]) {
+				return
+			}
+
+			if err := r.messageStore.DeleteInboundMessage(messages[i].ID); err != nil {
+				log.Printf("Failed to remove delivered inbound SMS %s: %v", messages[i].MessageID, err)
+				return
+			}
+		}
+
+		if len(messages) < queueBatchSize {
+			return
+		}
+	}
+}
+
+// deliverInbound sends an inbound message to the first receiver session of its system ID that accepts it
+func (r *RabbitMQClient) deliverInbound(sessionManager *session.SessionManager, message *store.SmppInboundMessage) bool {
+	for _, s := range sessionManager.GetSessionsBySystemID(message.SystemID) {
+		if !s.CanReceive() {
+			continue
+		}
+
+		if err := r.sendInboundToSession(s, message); err != nil {
+			log.Printf("Failed to send inbound SMS %s to session %s: %v", message.MessageID, s.ID, err)
+			continue
+		}
+
+		log.Printf("Delivered inbound SMS %s to session %s", message.MessageID, s.ID)
+		return true
+	}
+
+	log.Printf("No receiver session for system %s, inbound SMS %s stays queued", message.SystemID, message.MessageID)
+	return false
+}
+
+// sendInboundToSession sends an inbound message as one or more deliver_sm PDUs, each acknowledged before the next.
+// Segments acknowledged by an earlier attempt are skipped, so a retry never repeats them.
+func (r *RabbitMQClient) sendInboundToSession(session *session.Session, message *store.SmppInboundMessage) error {
+	encoded := protocol.EncodeShortMessage(message.Message, uint8(message.ID), r.config.NationalLanguage)
+
+	esmClass := uint8(protocol.ESM_CLASS_DEFAULT)
+	if encoded.UDHI {
+		esmClass |= protocol.ESM_CLASS_UDHI
+	}
+
+	sourceTON, sourceNPI, sourceAddr := addressType(message.SourceAddr)
+	destTON, destNPI, destinationAddr := addressType(message.DestinationAddr)
+
+	// The concatenation reference is derived from the row ID, so resumed segments still belong to the same message
+	for i := message.SegmentsDelivered; i < len(encoded.Segments); i++ {
+		segment := encoded.Segments[i]
+		deliverPDU := &protocol.DeliverSMPDU{
+			SourceAddrTON:      sourceTON,
+			SourceAddrNPI:      sourceNPI,
+			SourceAddr:         sourceAddr,
+			DestAddrTON:        destTON,
+			DestAddrNPI:        destNPI,
+			DestinationAddr:    destinationAddr,
+			ESMClass:           esmClass,
+			DataCoding:         encoded.DataCoding,
+			SMLength:           uint8(len(segment)),
+			ShortMessage:       string(segment),
+			OptionalParameters: make(map[uint16][]byte),
+		}
+
+		body := protocol.SerializeDeliverSMPDU(deliverPDU)
+		pdu := &protocol.PDU{
+			CommandLength:  uint32(16 + len(body)),
+			CommandID:      protocol.DELIVER_SM,
+			CommandStatus:  0,
+			SequenceNumber: session.GetNextSequenceNumber(),
+			Body:           body,
+		}
+
+		status, err := session.SendRequestAndWait(pdu)
+		if err != nil {
+			return err
+		}
+		if status != protocol.ESME_ROK {
+			return fmt.Errorf("deliver_sm rejected with status 0x%08X", status)
+		}
+
+		message.SegmentsDelivered = i + 1
+		if i+1 < len(encoded.Segments) {
+			if err := r.messageStore.UpdateInboundProgress(message.ID, message.SegmentsDelivered); err != nil {
+				log.Printf("Failed to record progress of inbound SMS %s: %v", message.MessageID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StartQueueRedelivery periodically retries queued delivery reports and inbound messages of users
+// that have a receiver session bound, for example after a response timeout
+func (r *RabbitMQClient) StartQueueRedelivery(sessionManager *session.SessionManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			systemIDs := make(map[string]bool)
+			for _, s := range sessionManager.GetAllSessions() {
+				if s.CanReceive() {
+					systemIDs[s.SystemID] = true
+				}
+			}
+
+			for systemID := range systemIDs {
+				systemID := systemID
+				r.reportRuns.trigger(systemID, func() {
+					r.DeliverQueuedReports(sessionManager, systemID)
+				})
+				r.inboundRuns.trigger(systemID, func() {
+					r.DeliverQueuedInbound(sessionManager, systemID)
+				})
+			}
+		}
+	}()
+}
+
+// systemRuns runs background deliveries on one goroutine per system ID, so that an unresponsive ESME
+// only delays its own messages. A trigger during a run makes the run start over once it finishes.
+type systemRuns struct {
+	mutex   sync.Mutex
+	pending map[string]bool // system ID -> triggered again during the run, present while a run is active
+}
+
+// trigger starts deliver on a goroutine of its own unless a run of the system ID is active already
+func (s *systemRuns) trigger(systemID string, deliver func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, running := s.pending[systemID]; running {
+		s.pending[systemID] = true
+		return
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]bool)
+	}
+	s.pending[systemID] = false
+
+	go func() {
+		for {
+			deliver()
+
+			s.mutex.Lock()
+			if !s.pending[systemID] {
+				delete(s.pending, systemID)
+				s.mutex.Unlock()
+				return
+			}
+			s.pending[systemID] = false
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+// systemLock returns the mutex of a system ID from locks, creating it on first use
+func systemLock(locks *sync.Map, systemID string) *sync.Mutex {
+	lock, _ := locks.LoadOrStore(systemID, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// addressType returns the TON and NPI for an address along with the address in SMPP form
+func addressType(addr string) (uint8, uint8, string) {
+	number := strings.TrimPrefix(addr, "+")
+	if number == "" {
+		return protocol.TON_UNKNOWN, protocol.NPI_UNKNOWN, number
+	}
+
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return protocol.TON_ALPHANUMERIC, protocol.NPI_UNKNOWN, addr
+		}
+	}
+
+	if strings.HasPrefix(addr, "+") {
+		return protocol.TON_INTERNATIONAL, protocol.NPI_ISDN, number
+	}
+	return protocol.TON_UNKNOWN, protocol.NPI_ISDN, number
+}
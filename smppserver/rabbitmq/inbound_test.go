@@ -0,0 +1,283 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"smppserver/protocol"
+	"smppserver/session"
+	"smppserver/store"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// progressStore records the inbound progress written by the client
+type progressStore struct {
+	store.MessageStore
+	progress []int
+}
+
+func (s *progressStore) UpdateInboundProgress(id uint, segmentsDelivered int) error {
+	s.progress = append(s.progress, segmentsDelivered)
+	return nil
+}
+
+// receiverSession returns a bound receiver session whose ESME answers each deliver_sm with the next status of
+// statuses and reports the received bodies on the returned channel
+func receiverSession(t *testing.T, statuses ...uint32) (*session.Session, <-chan []byte) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s := session.NewSession(server, &session.SessionConfig{
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		ResponseTimeout: 5 * time.Second,
+	})
+	s.SetState(session.StateBoundRX)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	bodies := make(chan []byte, 10)
+	go func() {
+		for _, status := range statuses {
+			pdu, err := protocol.ReadPDU(client)
+			if err != nil {
+				return
+			}
+			bodies <- pdu.Body
+			s.HandleResponse(&protocol.PDU{
+				CommandID:      protocol.DELIVER_SM_RESP,
+				CommandStatus:  status,
+				SequenceNumber: pdu.SequenceNumber,
+			})
+		}
+	}()
+	return s, bodies
+}
+
+func TestSendInboundResumesAfterFailedSegment(t *testing.T) {
+	messageStore := &progressStore{}
+	client := &RabbitMQClient{config: &Config{}, messageStore: messageStore}
+	message := &store.SmppInboundMessage{
+		ID:              42,
+		MessageID:       "mo-1",
+		SourceAddr:      "+905551112233",
+		DestinationAddr: "905554445566",
+		Message:         strings.Repeat("0123456789", 40),
+	}
+
+	segments := protocol.EncodeShortMessage(message.Message, uint8(message.ID), client.config.NationalLanguage).Segments
+	if len(segments) != 3 {
+		t.Fatalf("test message has %d segments, want 3", len(segments))
+	}
+
+	// The first session accepts segment 1 and rejects segment 2
+	first, firstBodies := receiverSession(t, protocol.ESME_ROK, protocol.ESME_RSYSERR)
+	if err := client.sendInboundToSession(first, message); err == nil {
+		t.Fatal("sendInboundToSession succeeded although segment 2 was rejected")
+	}
+	if message.SegmentsDelivered != 1 {
+		t.Fatalf("SegmentsDelivered = %d after the failure, want 1", message.SegmentsDelivered)
+	}
+
+	// The second session must only receive segments 2 and 3
+	second, secondBodies := receiverSession(t, protocol.ESME_ROK, protocol.ESME_ROK)
+	if err := client.sendInboundToSession(second, message); err != nil {
+		t.Fatalf("sendInboundToSession error = %v", err)
+	}
+	if message.SegmentsDelivered != 3 {
+		t.Errorf("SegmentsDelivered = %d, want 3", message.SegmentsDelivered)
+	}
+
+	for i, want := range [][]byte{segments[0], segments[1]} {
+		if body := <-firstBodies; !bytes.Contains(body, want) {
+			t.Errorf("first session PDU %d does not carry segment %d", i+1, i+1)
+		}
+	}
+	for i, want := range [][]byte{segments[1], segments[2]} {
+		if body := <-secondBodies; !bytes.Contains(body, want) {
+			t.Errorf("second session PDU %d does not carry segment %d", i+1, i+2)
+		}
+	}
+
+	// Progress is persisted after every acknowledged segment except the last, which deletes the message instead
+	if got := messageStore.progress; len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("persisted progress = %v, want [1 2]", got)
+	}
+}
+
+// inboundQueue keeps the queued inbound messages in memory
+type inboundQueue struct {
+	store.MessageStore
+	mutex    sync.Mutex
+	nextID   uint
+	messages []store.SmppInboundMessage
+}
+
+func (s *inboundQueue) QueueInboundMessage(message *store.SmppInboundMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	message.ID = s.nextID
+	s.messages = append(s.messages, *message)
+	return nil
+}
+
+func (s *inboundQueue) GetQueuedInboundMessages(systemID string, limit int) ([]store.SmppInboundMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var queued []store.SmppInboundMessage
+	for _, message := range s.messages {
+		if message.SystemID == systemID && len(queued) < limit {
+			queued = append(queued, message)
+		}
+	}
+	return queued, nil
+}
+
+func (s *inboundQueue) DeleteInboundMessage(id uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, message := range s.messages {
+		if message.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *inboundQueue) queued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.messages)
+}
+
+// heldReceiver adds a receiver session of systemID whose ESME only answers a deliver_sm once it is released
+func heldReceiver(t *testing.T, sessionManager *session.SessionManager, systemID string) (received <-chan []byte, release chan<- struct{}) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s := session.NewSession(server, &session.SessionConfig{
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		ResponseTimeout: 5 * time.Second,
+	})
+	s.SystemID = systemID
+	s.SetState(session.StateBoundRX)
+	if err := sessionManager.AddSession(s); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	bodies := make(chan []byte, 10)
+	releases := make(chan struct{}, 10)
+	go func() {
+		for {
+			pdu, err := protocol.ReadPDU(client)
+			if err != nil {
+				return
+			}
+			bodies <- pdu.Body
+			<-releases
+			s.HandleResponse(&protocol.PDU{CommandID: protocol.DELIVER_SM_RESP, SequenceNumber: pdu.SequenceNumber})
+		}
+	}()
+	return bodies, releases
+}
+
+func inboundDelivery(acknowledger amqp.Acknowledger, messageID, text string) amqp.Delivery {
+	body, _ := json.Marshal(InboundSMSMessage{MessageID: messageID, SystemID: "esme", SourceAddr: "+905551112233", Message: text})
+	return amqp.Delivery{Acknowledger: acknowledger, Body: body}
+}
+
+func TestHandleInboundMessageDoesNotWaitForTheESME(t *testing.T) {
+	messageStore := &inboundQueue{}
+	client := &RabbitMQClient{config: &Config{InboundQueue: "tsimcloud_deliver_sm"}, messageStore: messageStore}
+	sessionManager := session.NewSessionManager(&session.SessionConfig{MaxSessions: 10}, nil)
+	received, release := heldReceiver(t, sessionManager, "esme")
+
+	// Both messages are stored and acked although the ESME has not answered the first deliver_sm yet
+	for _, id := range []string{"mo-1", "mo-2"} {
+		s := newSettlement()
+		done := make(chan struct{})
+		go func() {
+			client.handleInboundMessage(inboundDelivery(s, id, "Hello "+id), sessionManager)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handling %s waited for the ESME", id)
+		}
+		if !s.acked {
+			t.Errorf("%s was not acked once it was stored", id)
+		}
+	}
+
+	// The messages are delivered in arrival order by the run of the system ID
+	for _, id := range []string{"mo-1", "mo-2"} {
+		select {
+		case body := <-received:
+			if !bytes.Contains(body, []byte("Hello "+id)) {
+				t.Errorf("deliver_sm body %q, want %s", body, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was never delivered", id)
+		}
+		release <- struct{}{}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for messageStore.queued() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages still queued after delivery", messageStore.queued())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSystemRunsRunAgainWhenTriggeredDuringARun(t *testing.T) {
+	var runs systemRuns
+	started := make(chan int, 10)
+	proceed := make(chan struct{})
+	count := 0
+	deliver := func() {
+		count++
+		started <- count
+		<-proceed
+	}
+
+	runs.trigger("esme", deliver)
+	<-started
+	// Triggers during the run coalesce into one more run
+	runs.trigger("esme", deliver)
+	runs.trigger("esme", deliver)
+	proceed <- struct{}{}
+
+	select {
+	case run := <-started:
+		if run != 2 {
+			t.Fatalf("run %d started, want 2", run)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("trigger during the run was lost")
+	}
+	proceed <- struct{}{}
+
+	select {
+	case run := <-started:
+		t.Fatalf("run %d started, want the triggers coalesced", run)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
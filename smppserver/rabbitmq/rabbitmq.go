@@ -1,27 +1,59 @@
 package rabbitmq
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
+	"smppserver/auth"
 	"smppserver/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"smppserver/session"
+	"smppserver/store"
+	"tsimcloud/shared/amqpconn"
+	"tsimcloud/shared/dlr"
+	"tsimcloud/shared/topology"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type RabbitMQClient struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	config  *Config
+	connection    *amqpconn.Connection
+	config        *Config
+	messageStore  store.MessageStore
+	dlrProfiles   DlrProfileSource
+	inboundLocks  sync.Map      // system ID -> *sync.Mutex
+	reportLocks   sync.Map      // system ID -> *sync.Mutex
+	inboundRuns   systemRuns    // Deliveries of queued inbound messages
+	reportRuns    systemRuns    // Redeliveries of queued delivery reports
+	reportWorkers systemWorkers // Delivery reports received from the broker
+	receiverTurn  uint32        // Rotates the receiver session preferred when loads are equal
 }
 
+// deliveryReportPrefetch is the maximum number of unacked delivery reports held by the consumer
+const deliveryReportPrefetch = 500
+
+// defaultPublishConfirmTimeout is how long a publish waits for the broker confirm by default
+const defaultPublishConfirmTimeout = 5 * time.Second
+
+// ErrPublishNacked is returned when the broker refuses or does not confirm a published message in time
+var ErrPublishNacked = amqpconn.ErrNacked
+
 type Config struct {
 	URL                 string
 	Exchange            string
 	Queue               string
 	DeliveryReportQueue string
+	InboundQueue        string
+	DLRRetention        time.Duration         // How long undelivered DLRs are kept, defaults to 72h
+	DLRQueueLimit       int                   // Maximum undelivered DLRs kept per system ID, 0 means unlimited
+	NationalLanguage    protocol.GSM7Language // Shift tables allowed when encoding inbound SMS as GSM 7-bit
+	ConfirmTimeout      time.Duration         // How long a publish waits for the broker confirm, defaults to 5s
 }
 
 // SubmitSMMessage represents the message structure for RabbitMQ
@@ -43,6 +75,7 @@ type SubmitSMMessage struct {
 	SMDefaultMsgID       uint8                  `json:"sm_default_msg_id"`
 	OptionalParameters   map[string]interface{} `json:"optional_parameters"`
 	Concatenation        *ConcatenationInfo     `json:"concatenation,omitempty"`
+	SegmentMessageIDs    []string               `json:"segment_message_ids,omitempty"` // Message IDs returned for each segment of a reassembled message
 }
 
 // ConcatenationInfo represents concatenation information
@@ -70,19 +103,21 @@ type DeliveryReportMessage struct {
 	DataCoding      uint8  `json:"data_coding,omitempty"`   // Orijinal mesajın data coding'i
 }
 
+// NewRabbitMQClient connects to RabbitMQ and keeps the connection up in the background.
+// When the broker is not reachable the client is returned with the error of the first attempt and connects later.
 func NewRabbitMQClient(config *Config) (*RabbitMQClient, error) {
-	conn, err := amqp.Dial(config.URL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
-	}
-
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open channel: %v", err)
+	r := &RabbitMQClient{
+		config: config,
 	}
+	r.connection = amqpconn.New(r.openChannel)
+	err := r.connection.Connect(config.URL)
+	return r, err
+}
 
+// declareTopology declares the exchange and queues used by the SMPP server
+func declareTopology(ch *amqp.Channel, config *Config) error {
 	// Declare exchange
-	err = ch.ExchangeDeclare(
+	err := ch.ExchangeDeclare(
 		config.Exchange, // name
 		"direct",        // type
 		true,            // durable
@@ -92,20 +127,13 @@ func NewRabbitMQClient(config *Config) (*RabbitMQClient, error) {
 		nil,             // arguments
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare exchange: %v", err)
+		return fmt.Errorf("failed to declare exchange: %v", err)
 	}
 
-	// Declare queue
-	_, err = ch.QueueDeclare(
-		config.Queue, // name
-		true,         // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
+	// Declare queue, higher priorities are delivered first
+	err = declareDeadLetterSource(ch, config, config.Queue, topology.PriorityQueueArguments(config.Exchange, config.Queue))
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare queue: %v", err)
+		return fmt.Errorf("failed to declare queue: %w", err)
 	}
 
 	// Bind queue to exchange
@@ -117,20 +145,12 @@ func NewRabbitMQClient(config *Config) (*RabbitMQClient, error) {
 		nil,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to bind queue: %v", err)
+		return fmt.Errorf("failed to bind queue: %v", err)
 	}
 
 	// Declare delivery report queue
-	_, err = ch.QueueDeclare(
-		config.DeliveryReportQueue, // name
-		true,                       // durable
-		false,                      // delete when unused
-		false,                      // exclusive
-		false,                      // no-wait
-		nil,                        // arguments
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to declare delivery report queue: %v", err)
+	if err := declareDeadLetterSource(ch, config, config.DeliveryReportQueue, topology.QueueArguments(config.Exchange, config.DeliveryReportQueue)); err != nil {
+		return fmt.Errorf("failed to declare delivery report queue: %w", err)
 	}
 
 	// Bind delivery report queue to exchange
@@ -142,31 +162,46 @@ func NewRabbitMQClient(config *Config) (*RabbitMQClient, error) {
 		nil,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to bind delivery report queue: %v", err)
+		return fmt.Errorf("failed to bind delivery report queue: %v", err)
 	}
 
-	return &RabbitMQClient{
-		conn:    conn,
-		channel: ch,
-		config:  config,
-	}, nil
-}
-
-func (r *RabbitMQClient) Close() error {
-	if r.channel != nil {
-		if err := r.channel.Close(); err != nil {
-			return fmt.Errorf("failed to close channel: %v", err)
+	if config.InboundQueue != "" {
+		// Declare inbound SMS queue
+		if err := declareDeadLetterSource(ch, config, config.InboundQueue, topology.QueueArguments(config.Exchange, config.InboundQueue)); err != nil {
+			return fmt.Errorf("failed to declare inbound queue: %w", err)
 		}
-	}
-	if r.conn != nil {
-		if err := r.conn.Close(); err != nil {
-			return fmt.Errorf("failed to close connection: %v", err)
+
+		// Bind inbound SMS queue to exchange
+		err = ch.QueueBind(
+			config.InboundQueue, // queue name
+			"deliver_sm",        // routing key
+			config.Exchange,     // exchange
+			false,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind inbound queue: %v", err)
 		}
 	}
+
 	return nil
 }
 
-// PublishSubmitSM publishes a submit_sm message to RabbitMQ
+// Close stops reconnecting and closes the connection
+func (r *RabbitMQClient) Close() error {
+	return r.connection.Close()
+}
+
+// confirmTimeout is how long a publish waits for the broker confirm
+func (r *RabbitMQClient) confirmTimeout() time.Duration {
+	if r.config.ConfirmTimeout <= 0 {
+		return defaultPublishConfirmTimeout
+	}
+	return r.config.ConfirmTimeout
+}
+
+// PublishSubmitSM publishes a submit_sm message to RabbitMQ and waits until the broker confirms it.
+// ErrPublishNacked is returned when the broker refuses the message or does not confirm it in time.
 func (r *RabbitMQClient) PublishSubmitSM(message *SubmitSMMessage) error {
 	// Convert message to JSON
 	body, err := json.Marshal(message)
@@ -174,8 +209,17 @@ func (r *RabbitMQClient) PublishSubmitSM(message *SubmitSMMessage) error {
 		return fmt.Errorf("failed to marshal message: %v", err)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), r.confirmTimeout())
+	defer cancel()
+
+	ch := r.currentChannel()
+	if ch == nil {
+		return fmt.Errorf("failed to publish message: %v", amqp.ErrClosed)
+	}
+
 	// Publish message
-	err = r.channel.Publish(
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
 		r.config.Exchange, // exchange
 		"submit_sm",       // routing key
 		false,             // mandatory
@@ -184,16 +228,62 @@ func (r *RabbitMQClient) PublishSubmitSM(message *SubmitSMMessage) error {
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			Priority:     min(message.PriorityFlag, topology.MaxPriority),
 		},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to publish message: %v", err)
 	}
 
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPublishNacked, err)
+	}
+	if !acked {
+		// Pending confirms are released unacknowledged when the channel closes
+		if ch.IsClosed() {
+			return fmt.Errorf("failed to publish message: %v", amqp.ErrClosed)
+		}
+		return ErrPublishNacked
+	}
+
 	log.Printf("Published submit_sm message to RabbitMQ: %s", message.MessageID)
 	return nil
 }
 
+// PublishDeliveryReport publishes a delivery report generated by the SMPP server itself
+func (r *RabbitMQClient) PublishDeliveryReport(report *DeliveryReportMessage) error {
+	// Convert report to JSON
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery report: %v", err)
+	}
+
+	ch := r.currentChannel()
+	if ch == nil {
+		return fmt.Errorf("failed to publish delivery report: %v", amqp.ErrClosed)
+	}
+
+	// Publish report
+	err = ch.Publish(
+		r.config.Exchange, // exchange
+		"delivery_report", // routing key
+		false,             // mandatory
+		false,             // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish delivery report: %v", err)
+	}
+
+	log.Printf("Published delivery report to RabbitMQ: %s", report.MessageID)
+	return nil
+}
+
 // ConvertOptionalParamsToString converts optional parameters to string format for JSON
 func ConvertOptionalParamsToString(optionalParams map[uint16][]byte) map[string]interface{} {
 	result := make(map[string]interface{})
@@ -265,9 +355,26 @@ func ExtractConcatenationInfo(optionalParams map[uint16][]byte) *ConcatenationIn
 	return concatInfo
 }
 
-// StartDeliveryReportConsumer starts consuming delivery report messages
+// SetMessageStore sets the store that delivery reports update
+func (r *RabbitMQClient) SetMessageStore(messageStore store.MessageStore) {
+	r.messageStore = messageStore
+}
+
+// StartDeliveryReportConsumer starts consuming delivery report messages, again after every reconnection
 func (r *RabbitMQClient) StartDeliveryReportConsumer(sessionManager *session.SessionManager) error {
-	msgs, err := r.channel.Consume(
+	return r.addConsumer("delivery report consumer", func(ch *amqp.Channel) error {
+		return r.consumeDeliveryReports(ch, sessionManager)
+	})
+}
+
+// consumeDeliveryReports consumes delivery report messages on a channel
+func (r *RabbitMQClient) consumeDeliveryReports(ch *amqp.Channel, sessionManager *session.SessionManager) error {
+	// Reports stay unacked until an ESME answers, so bound how many the broker hands out at once
+	if err := ch.Qos(deliveryReportPrefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set delivery report prefetch: %v", err)
+	}
+
+	msgs, err := ch.Consume(
 		r.config.DeliveryReportQueue, // queue
 		"",                           // consumer
 		false,                        // auto-ack
@@ -292,11 +399,10 @@ func (r *RabbitMQClient) StartDeliveryReportConsumer(sessionManager *session.Ses
 
 // handleDeliveryReport processes delivery report messages
 func (r *RabbitMQClient) handleDeliveryReport(msg amqp.Delivery, sessionManager *session.SessionManager) {
-	defer msg.Ack(false)
-
 	var deliveryReport DeliveryReportMessage
 	if err := json.Unmarshal(msg.Body, &deliveryReport); err != nil {
 		log.Printf("Failed to unmarshal delivery report: %v", err)
+		r.settleFailed(msg, r.config.DeliveryReportQueue, topology.ReasonUnprocessable, err)
 		return
 	}
 
@@ -312,63 +418,106 @@ func (r *RabbitMQClient) handleDeliveryReport(msg amqp.Delivery, sessionManager
 
 	log.Printf("Received delivery report for message: %s, system: %s", deliveryReport.MessageID, deliveryReport.SystemID)
 
-	// Find sessions for the system ID
-	sessions := sessionManager.GetSessionsBySystemID(deliveryReport.SystemID)
-	if len(sessions) == 0 {
-		log.Printf("No sessions found for system ID: %s", deliveryReport.SystemID)
-		return
+	// A reassembled concatenated message reports for each of its segments
+	reports := r.segmentReports(&deliveryReport)
+
+	// The broker message is only acked once every report was acknowledged, rejected or stored for redelivery
+	remaining := int32(len(reports))
+	var failedMutex sync.Mutex
+	var failed error
+	for _, report := range reports {
+		// Record the new state so that query_sm reflects it
+		r.updateMessageState(report)
+
+		// Messages submitted with data_sm may ask for their reports as data_sm
+		dlrPdu := r.dlrPduFor(report)
+
+		report := report
+		r.dispatchDeliveryReport(sessionManager, report, dlrPdu, func(err error) {
+			if err != nil {
+				log.Printf("Failed to store delivery report %s for redelivery: %v", report.MessageID, err)
+				failedMutex.Lock()
+				failed = err
+				failedMutex.Unlock()
+			}
+			if atomic.AddInt32(&remaining, -1) > 0 {
+				return
+			}
+
+			failedMutex.Lock()
+			err = failed
+			failedMutex.Unlock()
+			if err != nil {
+				// Waiting for the broker confirm must not hold up the session that answered the report
+				go r.settleFailed(msg, r.config.DeliveryReportQueue, topology.ReasonFailed, err)
+				return
+			}
+			msg.Ack(false)
+		})
+	}
+}
+
+// segmentReports returns one delivery report per segment of a reassembled concatenated message,
+// or the report itself for messages that were published as submitted
+func (r *RabbitMQClient) segmentReports(report *DeliveryReportMessage) []*DeliveryReportMessage {
+	if r.messageStore == nil {
+		return []*DeliveryReportMessage{report}
 	}
 
-	// Send delivery report to all sessions for this system ID
-	for _, session := range sessions {
-		if err := r.sendDeliveryReportToSession(session, &deliveryReport); err != nil {
-			log.Printf("Failed to send delivery report to session %s: %v", session.ID, err)
-		}
+	segments, err := r.messageStore.GetMessageSegments(report.SystemID, report.MessageID)
+	if err != nil {
+		log.Printf("Failed to load segments of message %s: %v", report.MessageID, err)
+		return []*DeliveryReportMessage{report}
+	}
+	if len(segments) == 0 {
+		return []*DeliveryReportMessage{report}
+	}
+
+	reports := make([]*DeliveryReportMessage, len(segments))
+	for i, segment := range segments {
+		segmentReport := *report
+		segmentReport.MessageID = segment.MessageID
+		reports[i] = &segmentReport
+	}
+	log.Printf("Delivery report for message %s applies to %d segments", report.MessageID, len(segments))
+	return reports
+}
+
+// dlrPduFor returns the PDU the delivery report of a message should be sent with
+func (r *RabbitMQClient) dlrPduFor(report *DeliveryReportMessage) string {
+	if r.messageStore == nil {
+		return store.DlrPduDeliverSM
+	}
+
+	message, err := r.messageStore.GetMessage(report.SystemID, report.MessageID)
+	if err != nil || message.DlrPdu == "" {
+		return store.DlrPduDeliverSM
 	}
+	return message.DlrPdu
 }
 
-// sendDeliveryReportToSession sends a delivery report to a specific session
-func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, report *DeliveryReportMessage) error {
+// sendDeliveryReportToSession sends a delivery report to a specific session as deliver_sm or data_sm.
+// The callback receives the outcome of the matching response.
+func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, report *DeliveryReportMessage, dlrPdu string, callback session.ResponseCallback) error {
 	// Debug: Log the delivery report details
 	log.Printf("DEBUG: Delivery Report - MessageID: %s, Delivered: %v, Failed: %v, MessageState: %d",
 		report.MessageID, report.Delivered, report.Failed, report.MessageState)
 
 	// Determine the actual message state based on delivery status
-	// System Message State Values: 0=SCHEDULED, 1=ENROUTE, 2=DELIVERED, 3=EXPIRED, 4=DELETED, 5=UNDELIVERABLE, 6=ACCEPTED, 7=UNKNOWN, 8=REJECTED
-	var messageState uint8
-
-	// Debug: Log the decision process
-	log.Printf("DEBUG: Message State Decision Process:")
-	log.Printf("DEBUG: - report.Delivered: %v", report.Delivered)
-	log.Printf("DEBUG: - report.Failed: %v", report.Failed)
-	log.Printf("DEBUG: - report.MessageState: %d", report.MessageState)
-
-	if report.Delivered {
-		messageState = protocol.MESSAGE_STATE_DELIVERED // DELIVERED (System standard: 2)
-		log.Printf("DEBUG: - Setting messageState to DELIVERED (%d) because report.Delivered = true", messageState)
-	} else if report.Failed {
-		messageState = protocol.MESSAGE_STATE_UNDELIVERABLE // UNDELIVERABLE (System standard: 5)
-		log.Printf("DEBUG: - Setting messageState to UNDELIVERABLE (%d) because report.Failed = true", messageState)
-	} else if report.MessageState > 0 {
-		messageState = report.MessageState // Use original if available and valid
-		log.Printf("DEBUG: - Setting messageState to original value (%d) from report.MessageState", messageState)
-	} else {
-		messageState = protocol.MESSAGE_STATE_ENROUTE // Default to ENROUTE if no state provided (System standard: 1)
-		log.Printf("DEBUG: - Setting messageState to ENROUTE (%d) as default", messageState)
-	}
+	messageState := resolveMessageState(report)
 
 	// Debug: Log the message state determination
 	log.Printf("DEBUG: Message State Determination - Delivered: %v, Failed: %v, Original MessageState: %d, Final MessageState: %d",
 		report.Delivered, report.Failed, report.MessageState, messageState)
 
+	// Users with a DLR profile receive receipts laid out by it
+	profile := r.dlrProfileFor(report.SystemID)
+
 	// Create delivery report text in SMPP format
-	deliveryReportText := r.createDeliveryReportText(report, messageState)
+	deliveryReportText := r.createDeliveryReportText(report, messageState, profile)
 
-	// Determine data coding - use original message's data coding if available, otherwise default to GSM 7-bit
-	dataCoding := uint8(protocol.DCS_GSM7) // Default to GSM 7-bit
-	if report.DataCoding != 0 {
-		dataCoding = report.DataCoding
-	}
+	// The receipt text is always sent in the GSM 7-bit default alphabet, whatever the original data coding was
+	encodedText := protocol.EncodeGSM7Lossy(deliveryReportText)
 
 	// Create deliver_sm PDU for delivery report
 	// In delivery report: SourceAddr = original destination (recipient), DestinationAddr = original source (sender)
@@ -387,13 +536,18 @@ func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, r
 		ValidityPeriod:       "",
 		RegisteredDelivery:   0, // deliver_sm'de registered_delivery anlamsızdır, 0x00 olmalı
 		ReplaceIfPresentFlag: 0,
-		DataCoding:           dataCoding, // Use original message's data coding
+		DataCoding:           protocol.DCS_GSM7,
 		SMDefaultMsgID:       0,
-		SMLength:             uint8(len(deliveryReportText)),
-		ShortMessage:         deliveryReportText, // Delivery report text
+		SMLength:             uint8(len(encodedText)),
+		ShortMessage:         string(encodedText), // Delivery report text
 		OptionalParameters:   make(map[uint16][]byte),
 	}
 
+	// ENROUTE and ACCEPTED are intermediate notifications rather than delivery receipts
+	if dlr.IsIntermediate(messageState) {
+		deliverPDU.ESMClass = protocol.ESM_CLASS_INTERMEDIATE
+	}
+
 	// Debug: Log the final message state being sent
 	log.Printf("DEBUG: Final Message State for Optional Parameters: %d", messageState)
 
@@ -402,6 +556,14 @@ func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, r
 	deliverPDU.OptionalParameters[protocol.OPT_PARAM_RECEIPTED_MESSAGE_ID] = []byte(report.MessageID)
 	deliverPDU.OptionalParameters[protocol.OPT_PARAM_MESSAGE_STATE] = []byte{messageState}
 
+	// Failures carry the error code mapped from the device or router failure
+	if report.ErrorCode != 0 {
+		deliverPDU.OptionalParameters[protocol.OPT_PARAM_NETWORK_ERROR_CODE] = networkErrorCode(protocol.NETWORK_TYPE_GSM, report.ErrorCode)
+	}
+	if profile != nil {
+		applyDlrProfile(deliverPDU, profile, report)
+	}
+
 	// Debug: Log the DLR PDU configuration
 	log.Printf("DEBUG: DLR PDU Configuration - ESMClass: 0x%02X, RegisteredDelivery: 0x%02X, MessageState: %d",
 		deliverPDU.ESMClass, deliverPDU.RegisteredDelivery, messageState)
@@ -416,11 +578,31 @@ func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, r
 
 	// Convert to PDU and send
 	// Use SerializeDeliverSMPDU for deliver_sm PDU, not SerializeSubmitSMPDU
+	commandID := uint32(protocol.DELIVER_SM)
 	deliverBody := protocol.SerializeDeliverSMPDU(deliverPDU)
 
+	if dlrPdu == store.DlrPduDataSM {
+		// data_sm has no short_message, the receipt text travels in message_payload
+		commandID = protocol.DATA_SM
+		deliverPDU.OptionalParameters[protocol.OPT_PARAM_MESSAGE_PAYLOAD] = encodedText
+		deliverBody = protocol.SerializeDataSMPDU(&protocol.DataSMPDU{
+			ServiceType:        deliverPDU.ServiceType,
+			SourceAddrTON:      deliverPDU.SourceAddrTON,
+			SourceAddrNPI:      deliverPDU.SourceAddrNPI,
+			SourceAddr:         deliverPDU.SourceAddr,
+			DestAddrTON:        deliverPDU.DestAddrTON,
+			DestAddrNPI:        deliverPDU.DestAddrNPI,
+			DestinationAddr:    deliverPDU.DestinationAddr,
+			ESMClass:           deliverPDU.ESMClass,
+			RegisteredDelivery: deliverPDU.RegisteredDelivery,
+			DataCoding:         deliverPDU.DataCoding,
+			OptionalParameters: deliverPDU.OptionalParameters,
+		})
+	}
+
 	pdu := &protocol.PDU{
 		CommandLength:  uint32(16 + len(deliverBody)), // 16 bytes header + body length
-		CommandID:      protocol.DELIVER_SM,
+		CommandID:      commandID,
 		CommandStatus:  0,
 		SequenceNumber: session.GetNextSequenceNumber(),
 		Body:           deliverBody,
@@ -430,7 +612,7 @@ func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, r
 	log.Printf("DEBUG: Sending DLR PDU - CommandID: 0x%08X, SequenceNumber: %d, BodyLength: %d",
 		pdu.CommandID, pdu.SequenceNumber, len(pdu.Body))
 
-	err := session.SendPDU(pdu)
+	err := session.SendRequest(pdu, callback)
 	if err != nil {
 		log.Printf("ERROR: Failed to send DLR PDU: %v", err)
 		return err
@@ -440,8 +622,68 @@ func (r *RabbitMQClient) sendDeliveryReportToSession(session *session.Session, r
 	return nil
 }
 
+// networkErrorCode encodes a network_error_code TLV: the network type followed by a 2 byte error code
+func networkErrorCode(networkType, errorCode uint8) []byte {
+	value := make([]byte, 3)
+	value[0] = networkType
+	binary.BigEndian.PutUint16(value[1:], uint16(errorCode))
+	return value
+}
+
+// resolveMessageState determines the SMPP message state carried by a delivery report
+func resolveMessageState(report *DeliveryReportMessage) uint8 {
+	// System Message State Values: 0=SCHEDULED, 1=ENROUTE, 2=DELIVERED, 3=EXPIRED, 4=DELETED, 5=UNDELIVERABLE, 6=ACCEPTED, 7=UNKNOWN, 8=REJECTED
+	var messageState uint8
+
+	// Debug: Log the decision process
+	log.Printf("DEBUG: Message State Decision Process:")
+	log.Printf("DEBUG: - report.Delivered: %v", report.Delivered)
+	log.Printf("DEBUG: - report.Failed: %v", report.Failed)
+	log.Printf("DEBUG: - report.MessageState: %d", report.MessageState)
+
+	if report.Delivered {
+		messageState = protocol.MESSAGE_STATE_DELIVERED // DELIVERED (System standard: 2)
+		log.Printf("DEBUG: - Setting messageState to DELIVERED (%d) because report.Delivered = true", messageState)
+	} else if report.Failed && store.IsFinalState(report.MessageState) {
+		messageState = report.MessageState // Keep the kind of failure, e.g. EXPIRED or REJECTED
+		log.Printf("DEBUG: - Setting messageState to failure state (%d) from report.MessageState", messageState)
+	} else if report.Failed {
+		messageState = protocol.MESSAGE_STATE_UNDELIVERABLE // UNDELIVERABLE (System standard: 5)
+		log.Printf("DEBUG: - Setting messageState to UNDELIVERABLE (%d) because report.Failed = true", messageState)
+	} else if report.MessageState > 0 {
+		messageState = report.MessageState // Use original if available and valid
+		log.Printf("DEBUG: - Setting messageState to original value (%d) from report.MessageState", messageState)
+	} else {
+		messageState = protocol.MESSAGE_STATE_ENROUTE // Default to ENROUTE if no state provided (System standard: 1)
+		log.Printf("DEBUG: - Setting messageState to ENROUTE (%d) as default", messageState)
+	}
+
+	return messageState
+}
+
+// updateMessageState records the state of a delivery report in the message store
+func (r *RabbitMQClient) updateMessageState(report *DeliveryReportMessage) {
+	if r.messageStore == nil {
+		return
+	}
+
+	doneAt := time.Now()
+	for _, date := range []string{report.DoneDate, report.FinalDate} {
+		if parsed, err := time.ParseInLocation("20060102150405", date, time.Local); err == nil {
+			doneAt = parsed
+			break
+		}
+	}
+
+	err := r.messageStore.UpdateMessageState(report.MessageID, resolveMessageState(report), report.ErrorCode, doneAt)
+	if err != nil {
+		log.Printf("Failed to update state of message %s: %v", report.MessageID, err)
+	}
+}
+
 // createDeliveryReportText creates the delivery report text in SMPP format
-func (r *RabbitMQClient) createDeliveryReportText(report *DeliveryReportMessage, messageState uint8) string {
+// A DLR profile replaces the layout, ID format, dates and error codes of the text.
+func (r *RabbitMQClient) createDeliveryReportText(report *DeliveryReportMessage, messageState uint8, profile *auth.SmppDlrProfile) string {
 	// SMPP Standard DLR Format: "id:message_id sub:001 dlvrd:001 submit date:submit_date done date:done_date stat:status err:error_code text:original_text"
 
 	// Debug: Log input parameters
@@ -499,20 +741,20 @@ func (r *RabbitMQClient) createDeliveryReportText(report *DeliveryReportMessage,
 	// Use original message text, not generic "Delivery Report"
 	var originalText string
 	if report.OriginalText != "" && len(report.OriginalText) > 0 {
-		// Clean text to ensure only ASCII characters (SMPP 3.4 standard)
-		cleanedText := ""
+		// Drop control characters, the receipt is a single line. Characters outside the GSM 7-bit
+		// default alphabet and extension table become '?' when the text is encoded.
+		var cleanedText []rune
 		for _, char := range report.OriginalText {
-			if char >= 32 && char <= 126 { // ASCII printable characters only
-				cleanedText += string(char)
+			if !unicode.IsControl(char) {
+				cleanedText = append(cleanedText, char)
 			}
 		}
 
 		// Limit text to first 20 characters as per SMPP 3.4 standard
 		if len(cleanedText) > 20 {
-			originalText = cleanedText[:20]
-		} else if len(cleanedText) > 0 {
-			originalText = cleanedText
+			cleanedText = cleanedText[:20]
 		}
+		originalText = string(cleanedText)
 	}
 
 	// If no original text available, use a meaningful fallback
@@ -526,6 +768,21 @@ func (r *RabbitMQClient) createDeliveryReportText(report *DeliveryReportMessage,
 		messageID = "UNKNOWN"
 	}
 
+	if profile != nil {
+		deliveryText := renderDlrText(profile.TextTemplate, dlrFields{
+			messageID:  formatDlrMessageID(messageID, profile.IDFormat),
+			sub:        subCount,
+			dlvrd:      dlvrdCount,
+			submitDate: r.formatDlrDate(report.SubmitDate, profile.DateFormat),
+			doneDate:   r.formatDlrDate(report.DoneDate, profile.DateFormat),
+			stat:       status,
+			err:        mapDlrErrorCode(profile.ErrorCodeMap, report.ErrorCode, status),
+			text:       originalText,
+		})
+		log.Printf("DEBUG: Final delivery text (DLR profile %s): '%s'", profile.Name, deliveryText)
+		return deliveryText
+	}
+
 	// SMPP 3.4 standard DLR format: id:<message_id> sub:001 dlvrd:001 submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:<status> err:000 text:<first 20 chars>
 	deliveryText := fmt.Sprintf("id:%s sub:%s dlvrd:%s submit date:%s done date:%s stat:%s err:%03d text:%s",
 		messageID, subCount, dlvrdCount, submitDate, doneDate, status, report.ErrorCode, originalText)
@@ -0,0 +1,36 @@
+package rabbitmq
+
+import (
+	"strings"
+	"testing"
+
+	"smppserver/protocol"
+	"smppserver/store"
+)
+
+func TestDeliveryReportTextIsGSM7Encoded(t *testing.T) {
+	client := &RabbitMQClient{config: &Config{}}
+	s, bodies := receiverSession(t, protocol.ESME_ROK)
+
+	// The original text was sent as UCS2 and uses characters of the extension table and none of GSM 7-bit
+	report := &DeliveryReportMessage{MessageID: "m1", SystemID: "esme", Delivered: true, OriginalText: "Price {10€}\nж", DataCoding: protocol.DCS_UCS2}
+	outcome := make(chan uint32, 1)
+	if err := client.sendDeliveryReportToSession(s, report, store.DlrPduDeliverSM, func(status uint32, err error) {
+		outcome <- status
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-outcome
+
+	receipt, err := protocol.ParseSubmitSMPDU(<-bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.DataCoding != protocol.DCS_GSM7 {
+		t.Errorf("data_coding = %d, want GSM 7-bit", receipt.DataCoding)
+	}
+	text := protocol.DecodeGSM7([]byte(receipt.ShortMessage), protocol.GSM7LanguageDefault, protocol.GSM7LanguageDefault)
+	if !strings.HasPrefix(text, "id:m1 ") || !strings.HasSuffix(text, "text:Price {10€}?") {
+		t.Errorf("receipt text = %q", text)
+	}
+}
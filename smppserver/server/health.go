@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startHealth starts the HTTP listener serving GET /health
+func (s *SMPServer) startHealth() error {
+	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.HealthPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start health server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	s.healthServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Printf("Health server started on %s", addr)
+
+	go func() {
+		if err := s.healthServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Health server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// handleHealth reports the bound sessions and the RabbitMQ connection state.
+// The server is degraded while RabbitMQ is not connected, as submitted messages are rejected meanwhile.
+func (s *SMPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rabbitMQState := s.rabbitMQClient.State()
+	status, code := "ok", http.StatusOK
+	if !rabbitMQState.Connected {
+		status, code = "degraded", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   status,
+		"sessions": len(s.sessionManager.GetAllSessions()),
+		"rabbitmq": rabbitMQState,
+	})
+}
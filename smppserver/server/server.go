@@ -1,14 +1,21 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"smppserver/auth"
 	"smppserver/config"
 	"smppserver/handler"
+	"smppserver/protocol"
 	"smppserver/rabbitmq"
 	"smppserver/session"
+	"smppserver/store"
+	"time"
+	"tsimcloud/shared/idgen"
 )
 
 type SMPServer struct {
@@ -17,7 +24,10 @@ type SMPServer struct {
 	handler        *handler.SMPPHandler
 	sessionManager *session.SessionManager
 	rabbitMQClient *rabbitmq.RabbitMQClient
+	messageStore   *store.MySQLMessageStore
 	listener       net.Listener
+	tlsListener    net.Listener
+	healthServer   *http.Server
 }
 
 func NewSMPServer(config *config.Config) (*SMPServer, error) {
@@ -28,6 +38,8 @@ func NewSMPServer(config *config.Config) (*SMPServer, error) {
 		EnquireLinkInterval: config.Server.EnquireLinkInterval,
 		ReadTimeout:         config.Server.ReadTimeout,
 		WriteTimeout:        config.Server.WriteTimeout,
+		WindowSize:          config.Server.WindowSize,
+		ResponseTimeout:     config.Server.ResponseTimeout,
 	}
 
 	// Initialize MySQL-based auth manager first (without session manager)
@@ -42,29 +54,54 @@ func NewSMPServer(config *config.Config) (*SMPServer, error) {
 	// Update auth manager with session manager reference
 	authManager.SetSessionManager(sessionManager)
 
+	// Initialize message state store used by query_sm and delivery reports
+	messageStore, err := store.NewMySQLMessageStore(config.GetDatabaseDSN(), config.SMPP.MessageRetention)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MySQL message store: %v", err)
+	}
+
+	// Initialize message ID generator, the node ID must be unique across all instances of both services
+	idGenerator, err := idgen.NewGenerator(config.Server.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message ID generator: %v", err)
+	}
+
+	nationalLanguage, err := protocol.ParseGSM7Language(config.SMPP.NationalLanguage)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize RabbitMQ client
 	rabbitMQConfig := &rabbitmq.Config{
 		URL:                 config.RabbitMQ.URL,
 		Exchange:            config.RabbitMQ.Exchange,
 		Queue:               config.RabbitMQ.Queue,
 		DeliveryReportQueue: config.RabbitMQ.DeliveryReportQueue,
+		InboundQueue:        config.RabbitMQ.InboundQueue,
+		DLRRetention:        config.SMPP.DLRRetention,
+		DLRQueueLimit:       config.SMPP.DLRQueueLimit,
+		NationalLanguage:    nationalLanguage,
+		ConfirmTimeout:      config.RabbitMQ.ConfirmTimeout,
 	}
 	rabbitMQClient, err := rabbitmq.NewRabbitMQClient(rabbitMQConfig)
 	if err != nil {
-		log.Printf("Warning: Failed to initialize RabbitMQ client: %v", err)
-		// Continue without RabbitMQ if it fails to initialize
-		rabbitMQClient = nil
+		// The client keeps reconnecting, submitted messages are rejected with ESME_RSYSERR until it is connected
+		log.Printf("Warning: RabbitMQ not available, reconnecting in the background: %v", err)
 	}
 
-	// Start delivery report consumer if RabbitMQ is available
-	if rabbitMQClient != nil {
-		if err := rabbitMQClient.StartDeliveryReportConsumer(sessionManager); err != nil {
-			log.Printf("Warning: Failed to start delivery report consumer: %v", err)
-		}
+	// Start the consumers, they resume on their own after every reconnection
+	rabbitMQClient.SetMessageStore(messageStore)
+	rabbitMQClient.SetDlrProfileSource(authManager)
+	if err := rabbitMQClient.StartDeliveryReportConsumer(sessionManager); err != nil {
+		log.Printf("Warning: Failed to start delivery report consumer: %v", err)
+	}
+	if err := rabbitMQClient.StartInboundConsumer(sessionManager); err != nil {
+		log.Printf("Warning: Failed to start inbound SMS consumer: %v", err)
 	}
+	rabbitMQClient.StartQueueRedelivery(sessionManager, time.Minute)
 
 	// Initialize handler
-	smppHandler := handler.NewSMPPHandler(authManager, sessionManager, rabbitMQClient)
+	smppHandler := handler.NewSMPPHandler(authManager, sessionManager, rabbitMQClient, messageStore, idGenerator, config.SMPP.ConcatenationTimeout, nationalLanguage)
 
 	server := &SMPServer{
 		config:         config,
@@ -72,6 +109,7 @@ func NewSMPServer(config *config.Config) (*SMPServer, error) {
 		handler:        smppHandler,
 		sessionManager: sessionManager,
 		rabbitMQClient: rabbitMQClient,
+		messageStore:   messageStore,
 	}
 
 	return server, nil
@@ -87,14 +125,66 @@ func (s *SMPServer) Start() error {
 	s.listener = listener
 	log.Printf("SMPP Server started on %s", addr)
 
+	// Start the TLS listener next to the plain one, both share the session manager
+	if s.config.Server.TLS.Enabled {
+		if err := s.startTLS(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	// Serve the health state to load balancers and orchestrators
+	if s.config.Server.HealthPort != 0 {
+		if err := s.startHealth(); err != nil {
+			listener.Close()
+			if s.tlsListener != nil {
+				s.tlsListener.Close()
+			}
+			return err
+		}
+	}
+
 	// Start cleanup routines
 	go s.authManager.StartCleanupRoutine()
 	go s.sessionManager.StartCleanupRoutine()
+	go s.messageStore.StartCleanupRoutine()
+
+	// Segments of messages whose assembly was lost in a restart are rejected and refunded
+	go s.handler.StartSegmentRecovery()
+
+	s.serve(listener)
+	return nil
+}
 
-	// Accept connections
+// startTLS starts the SMPP over TLS listener
+func (s *SMPServer) startTLS() error {
+	reloader, err := newCertificateReloader(s.config.Server.TLS)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificates: %v", err)
+	}
+	reloader.watch()
+
+	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.TLS.Port)
+	listener, err := tls.Listen("tcp", addr, reloader.tlsConfig())
+	if err != nil {
+		return fmt.Errorf("failed to start TLS server: %v", err)
+	}
+
+	s.tlsListener = listener
+	log.Printf("SMPP TLS Server started on %s", addr)
+
+	go s.serve(listener)
+	return nil
+}
+
+// serve accepts connections until the listener is closed
+func (s *SMPServer) serve(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
@@ -104,8 +194,15 @@ func (s *SMPServer) Start() error {
 }
 
 func (s *SMPServer) handleConnection(conn net.Conn) {
+	// TCP options apply to the connection underneath TLS
+	rawConn := conn
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS {
+		rawConn = tlsConn.NetConn()
+	}
+
 	// Enable TCP Keepalive and other TCP options from config
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok {
 		if s.config.Server.TCPKeepalive {
 			if err := tcpConn.SetKeepAlive(true); err != nil {
 				log.Printf("Failed to set TCP keepalive: %v", err)
@@ -132,7 +229,30 @@ func (s *SMPServer) handleConnection(conn net.Conn) {
 		}
 	}
 
+	// Complete the TLS handshake up front so that the client certificate is known before bind
+	var clientCertFingerprint string
+	if isTLS {
+		// A client that never finishes the handshake must not hold the connection open
+		timeout := s.sessionManager.Config.ReadTimeout
+		if timeout <= 0 {
+			timeout = defaultTLSHandshakeTimeout
+		}
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+			clientCertFingerprint = certificateFingerprint(certificates[0])
+			log.Printf("TLS client %s presented certificate %s (%s)", conn.RemoteAddr(), clientCertFingerprint, certificates[0].Subject.CommonName)
+		}
+	}
+
 	sess := session.NewSession(conn, s.sessionManager.Config)
+	sess.ClientCertFingerprint = clientCertFingerprint
 
 	// Add session to manager
 	s.sessionManager.AddSession(sess)
@@ -149,11 +269,20 @@ func (s *SMPServer) Stop() error {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	if s.tlsListener != nil {
+		s.tlsListener.Close()
+	}
+	if s.healthServer != nil {
+		s.healthServer.Close()
+	}
 	if s.authManager != nil {
 		s.authManager.Close()
 	}
 	if s.rabbitMQClient != nil {
 		s.rabbitMQClient.Close()
 	}
+	if s.messageStore != nil {
+		s.messageStore.Close()
+	}
 	return nil
 }
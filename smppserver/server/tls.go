@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"smppserver/config"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultTLSReloadInterval is used when no certificate reload interval is configured
+const defaultTLSReloadInterval = time.Minute
+
+// defaultTLSHandshakeTimeout bounds the TLS handshake when no read timeout is configured
+const defaultTLSHandshakeTimeout = 30 * time.Second
+
+// certificateReloader serves the TLS certificate and client CA pool of the SMPPS listener and reloads them
+// when their files change, so that renewed certificates are picked up without a restart
+type certificateReloader struct {
+	config      config.TLSConfig
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+// newCertificateReloader loads the configured certificate files
+func newCertificateReloader(tlsConfig config.TLSConfig) (*certificateReloader, error) {
+	reloader := &certificateReloader{config: tlsConfig}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// files returns the certificate files to watch
+func (r *certificateReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+// reload reads the certificate, key and client CA files; the previous ones stay in use on error
+func (r *certificateReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.config.ClientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// changed reports whether any certificate file was modified since the last reload
+func (r *certificateReloader) changed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates when their files change and on SIGHUP
+func (r *certificateReloader) watch() {
+	interval := r.config.ReloadInterval
+	if interval <= 0 {
+		interval = defaultTLSReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+			case <-hangup:
+			}
+
+			if err := r.reload(); err != nil {
+				log.Printf("Failed to reload TLS certificates, keeping the current ones: %v", err)
+				continue
+			}
+			log.Printf("Reloaded TLS certificates from %s", r.config.CertFile)
+		}
+	}()
+}
+
+// tlsConfig returns a TLS configuration always serving the latest loaded certificates
+func (r *certificateReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	if r.config.ClientCAFile != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+		if r.config.RequireClientCert {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// certificateFingerprint returns the hex SHA-256 fingerprint of a certificate
+func certificateFingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"smppserver/config"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its key to the files of tlsConfig
+func writeCertificate(t *testing.T, tlsConfig config.TLSConfig, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(tlsConfig.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tlsConfig.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch moves the modification time of files forward, so that a rewrite within the same clock tick is noticed
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, file := range files {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedCommonName returns the common name of the certificate the reloader serves to a new client
+func servedCommonName(t *testing.T, reloader *certificateReloader) string {
+	t.Helper()
+
+	served, err := reloader.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(served.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate.Subject.CommonName
+}
+
+func TestCertificateReloaderServesRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig := config.TLSConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}
+	writeCertificate(t, tlsConfig, "first")
+
+	reloader, err := newCertificateReloader(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloader.changed() {
+		t.Error("changed right after loading")
+	}
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Fatalf("serving %s, want first", name)
+	}
+
+	writeCertificate(t, tlsConfig, "renewed")
+	touch(t, tlsConfig.CertFile, tlsConfig.KeyFile)
+	if !reloader.changed() {
+		t.Fatal("renewed certificate not noticed")
+	}
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if reloader.changed() {
+		t.Error("changed after reloading the renewed certificate")
+	}
+	if name := servedCommonName(t, reloader); name != "renewed" {
+		t.Errorf("serving %s after the reload, want renewed", name)
+	}
+}
+
+func TestCertificateReloaderKeepsCertificateOnError(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig := config.TLSConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}
+	writeCertificate(t, tlsConfig, "current")
+
+	reloader, err := newCertificateReloader(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate caught half written cannot be loaded
+	if err := os.WriteFile(tlsConfig.CertFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, tlsConfig.CertFile)
+	if !reloader.changed() {
+		t.Fatal("rewritten certificate not noticed")
+	}
+	if err := reloader.reload(); err == nil {
+		t.Fatal("reload of an invalid certificate succeeded")
+	}
+	if name := servedCommonName(t, reloader); name != "current" {
+		t.Errorf("serving %s after the failed reload, want current", name)
+	}
+	// The change stays pending, so the next check tries again
+	if !reloader.changed() {
+		t.Error("failed reload cleared the change")
+	}
+
+	// A missing client CA file fails the reload as well
+	reloader.config.ClientCAFile = filepath.Join(dir, "missing-ca.pem")
+	writeCertificate(t, tlsConfig, "renewed")
+	if err := reloader.reload(); err == nil {
+		t.Error("reload with a missing client CA file succeeded")
+	}
+	if name := servedCommonName(t, reloader); name != "current" {
+		t.Errorf("serving %s after the failed reload, want current", name)
+	}
+}
+
+func TestNewCertificateReloaderFailsWithoutCertificate(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertificateReloader(config.TLSConfig{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "missing.key")}); err == nil {
+		t.Error("newCertificateReloader succeeded without certificate files")
+	}
+}
@@ -28,7 +28,6 @@ type Session struct {
 	Conn              net.Conn
 	State             SessionState
 	SystemID          string
-	Password          string
 	SystemType        string
 	InterfaceVersion  uint8
 	AddressRange      string
@@ -41,6 +40,20 @@ type Session struct {
 	Mutex             sync.RWMutex
 	MessageQueue      chan *protocol.PDU
 	IsAuthenticated   bool
+	User              interface{} // SMPP user loaded at bind (*auth.SmppUser, which imports this package)
+
+	// ClientCertFingerprint is the SHA-256 fingerprint of the verified TLS client certificate, if any
+	ClientCertFingerprint string
+
+	// Outbound window of requests sent to the ESME that wait for a response
+	window          chan struct{}
+	pending         map[uint32]*pendingRequest
+	pendingMutex    sync.Mutex
+	responseTimeout time.Duration
+
+	// Inbound window of requests from the ESME handled in the background
+	inbound         chan struct{}
+	inboundRequests sync.WaitGroup
 }
 
 // SessionManager manages all active SMPP sessions
@@ -60,6 +73,8 @@ type SessionConfig struct {
 	EnquireLinkInterval time.Duration
 	ReadTimeout         time.Duration
 	WriteTimeout        time.Duration
+	WindowSize          int           // Maximum unacknowledged requests per session
+	ResponseTimeout     time.Duration // How long to wait for the response to a request
 }
 
 // NewSessionManager creates a new session manager
@@ -79,6 +94,15 @@ func NewSession(conn net.Conn, config *SessionConfig) *Session {
 
 	now := time.Now()
 
+	windowSize := config.WindowSize
+	if windowSize <= 0 {
+		windowSize = DefaultWindowSize
+	}
+	responseTimeout := config.ResponseTimeout
+	if responseTimeout <= 0 {
+		responseTimeout = DefaultResponseTimeout
+	}
+
 	session := &Session{
 		ID:              generateSessionID(),
 		Conn:            conn,
@@ -90,6 +114,10 @@ func NewSession(conn net.Conn, config *SessionConfig) *Session {
 		Cancel:          cancel,
 		MessageQueue:    make(chan *protocol.PDU, 100),
 		IsAuthenticated: false,
+		window:          make(chan struct{}, windowSize),
+		inbound:         make(chan struct{}, windowSize),
+		pending:         make(map[uint32]*pendingRequest),
+		responseTimeout: responseTimeout,
 	}
 
 	// Set connection timeouts
@@ -428,6 +456,8 @@ func (s *Session) Close() {
 
 	close(s.MessageQueue)
 
+	s.failPendingRequests(ErrSessionClosed)
+
 	log.Printf("Session %s closed", s.ID)
 }
 
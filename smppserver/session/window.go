@@ -0,0 +1,192 @@
+package session
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"smppserver/protocol"
+)
+
+// Outbound window defaults used when the configuration does not set them
+const (
+	DefaultWindowSize      = 10
+	DefaultResponseTimeout = 30 * time.Second
+)
+
+// ErrWindowFull is returned when no outbound window slot frees up within the response timeout
+var ErrWindowFull = errors.New("outbound window is full")
+
+// ErrResponseTimeout is passed to response callbacks when the ESME does not answer in time
+var ErrResponseTimeout = errors.New("response timeout")
+
+// ErrSessionClosed is passed to response callbacks of requests still pending when the session closes
+var ErrSessionClosed = errors.New("session closed")
+
+// ResponseCallback receives the command_status of the response to a request, or an error if none arrived
+type ResponseCallback func(status uint32, err error)
+
+// pendingRequest is a request sent to the ESME that is waiting for its response
+type pendingRequest struct {
+	commandID uint32
+	callback  ResponseCallback
+	timer     *time.Timer
+}
+
+// SendRequest sends a PDU that expects a response from the ESME, such as deliver_sm or data_sm.
+// At most WindowSize requests are unacknowledged at once; SendRequest waits up to the response timeout
+// for a free slot. The callback is called exactly once, from another goroutine, when the response
+// arrives, the response timeout expires or the session closes.
+func (s *Session) SendRequest(pdu *protocol.PDU, callback ResponseCallback) error {
+	select {
+	case s.window <- struct{}{}:
+	case <-s.Context.Done():
+		return ErrSessionClosed
+	case <-time.After(s.responseTimeout):
+		return ErrWindowFull
+	}
+
+	sequenceNumber := pdu.SequenceNumber
+	request := &pendingRequest{
+		commandID: pdu.CommandID,
+		callback:  callback,
+	}
+
+	s.pendingMutex.Lock()
+	s.pending[sequenceNumber] = request
+	request.timer = time.AfterFunc(s.responseTimeout, func() {
+		s.completeRequest(sequenceNumber, 0, ErrResponseTimeout)
+	})
+	s.pendingMutex.Unlock()
+
+	if err := s.SendPDU(pdu); err != nil {
+		// Nothing was sent, so the caller handles the error instead of the callback
+		if s.takeRequest(sequenceNumber) != nil {
+			request.timer.Stop()
+			<-s.window
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SendRequestAndWait sends a request through the outbound window and waits for its response
+func (s *Session) SendRequestAndWait(pdu *protocol.PDU) (uint32, error) {
+	type response struct {
+		status uint32
+		err    error
+	}
+
+	result := make(chan response, 1)
+	if err := s.SendRequest(pdu, func(status uint32, err error) {
+		result <- response{status, err}
+	}); err != nil {
+		return 0, err
+	}
+
+	r := <-result
+	return r.status, r.err
+}
+
+// HandleResponse matches a response PDU (or generic_nack) to a pending request by sequence number.
+// It reports whether a pending request was found.
+func (s *Session) HandleResponse(pdu *protocol.PDU) bool {
+	request := s.peekRequest(pdu.SequenceNumber)
+	if request == nil {
+		log.Printf("Session %s: No pending request for response 0x%08X with sequence %d", s.ID, pdu.CommandID, pdu.SequenceNumber)
+		return false
+	}
+
+	if pdu.CommandID != protocol.GENERIC_NACK && pdu.CommandID != request.commandID|protocol.GENERIC_NACK {
+		log.Printf("Session %s: Response 0x%08X does not match request 0x%08X with sequence %d",
+			s.ID, pdu.CommandID, request.commandID, pdu.SequenceNumber)
+		return false
+	}
+
+	status := pdu.CommandStatus
+	if pdu.CommandID == protocol.GENERIC_NACK && status == protocol.ESME_ROK {
+		// A generic_nack always rejects the request, even without a status
+		status = protocol.ESME_RSYSERR
+	}
+
+	s.completeRequest(pdu.SequenceNumber, status, nil)
+	return true
+}
+
+// InFlight returns the number of requests waiting for a response
+func (s *Session) InFlight() int {
+	return len(s.window)
+}
+
+// completeRequest releases the window slot of a request and calls its callback
+func (s *Session) completeRequest(sequenceNumber uint32, status uint32, err error) {
+	request := s.takeRequest(sequenceNumber)
+	if request == nil {
+		return
+	}
+
+	request.timer.Stop()
+	<-s.window
+
+	go request.callback(status, err)
+}
+
+// Dispatch handles a request of the ESME in the background, so that the read loop keeps reading while the
+// request waits, typically for the broker to confirm a submitted message. At most WindowSize requests are
+// handled at once; beyond that Dispatch waits for one to finish. Responses may therefore be sent out of order,
+// as SMPP allows. A handler error is answered with a generic_nack like on the read loop.
+func (s *Session) Dispatch(pdu *protocol.PDU, handle func() error) {
+	s.inbound <- struct{}{}
+	s.inboundRequests.Add(1)
+
+	go func() {
+		defer func() {
+			<-s.inbound
+			s.inboundRequests.Done()
+		}()
+
+		if err := handle(); err != nil {
+			log.Printf("Session %s: failed to handle PDU: %v", s.ID, err)
+			if s.CanSendPDU() {
+				s.SendGenericNACK(pdu.SequenceNumber)
+			}
+		}
+	}()
+}
+
+// WaitDispatched waits until the requests handled in the background are answered
+func (s *Session) WaitDispatched() {
+	s.inboundRequests.Wait()
+}
+
+// failPendingRequests completes every pending request with err, used when the session closes
+func (s *Session) failPendingRequests(err error) {
+	s.pendingMutex.Lock()
+	sequenceNumbers := make([]uint32, 0, len(s.pending))
+	for sequenceNumber := range s.pending {
+		sequenceNumbers = append(sequenceNumbers, sequenceNumber)
+	}
+	s.pendingMutex.Unlock()
+
+	for _, sequenceNumber := range sequenceNumbers {
+		s.completeRequest(sequenceNumber, 0, err)
+	}
+}
+
+func (s *Session) peekRequest(sequenceNumber uint32) *pendingRequest {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	return s.pending[sequenceNumber]
+}
+
+func (s *Session) takeRequest(sequenceNumber uint32) *pendingRequest {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	request, exists := s.pending[sequenceNumber]
+	if exists {
+		delete(s.pending, sequenceNumber)
+	}
+	return request
+}
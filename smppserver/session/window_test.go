@@ -0,0 +1,215 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"smppserver/protocol"
+)
+
+// newPipeSession returns a session with the given window size whose ESME side of the connection is returned
+func newPipeSession(t *testing.T, windowSize int) (*Session, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s := NewSession(server, &SessionConfig{
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+		WindowSize:   windowSize,
+	})
+	s.SetState(StateBoundTRX)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return s, client
+}
+
+func TestDispatchLimitsInboundWindow(t *testing.T) {
+	s, _ := newPipeSession(t, 2)
+
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		s.Dispatch(&protocol.PDU{SequenceNumber: uint32(i + 1)}, func() error {
+			<-release
+			return nil
+		})
+	}
+
+	// The window is full, the third request waits for a slot
+	dispatched := make(chan struct{})
+	go func() {
+		s.Dispatch(&protocol.PDU{SequenceNumber: 3}, func() error { return nil })
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("Dispatch returned with a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch did not return once the window had room")
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		s.WaitDispatched()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("WaitDispatched did not return after every request was handled")
+	}
+}
+
+func TestDispatchAnswersErrorsWithGenericNACK(t *testing.T) {
+	s, client := newPipeSession(t, 1)
+
+	s.Dispatch(&protocol.PDU{SequenceNumber: 7}, func() error { return errors.New("malformed") })
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	pdu, err := protocol.ReadPDU(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pdu.CommandID != protocol.GENERIC_NACK || pdu.SequenceNumber != 7 {
+		t.Errorf("response = 0x%08X seq %d, want generic_nack seq 7", pdu.CommandID, pdu.SequenceNumber)
+	}
+	s.WaitDispatched()
+}
+
+// response is the outcome a request callback received
+type response struct {
+	status uint32
+	err    error
+}
+
+// sendDeliverSM sends a deliver_sm with sequenceNumber and returns the channel its outcome arrives on.
+// The ESME side reads the request so that the send does not block on the pipe.
+func sendDeliverSM(t *testing.T, s *Session, client net.Conn, sequenceNumber uint32) <-chan response {
+	t.Helper()
+
+	read := make(chan error, 1)
+	go func() {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := protocol.ReadPDU(client)
+		read <- err
+	}()
+
+	outcome := make(chan response, 1)
+	err := s.SendRequest(&protocol.PDU{CommandID: protocol.DELIVER_SM, SequenceNumber: sequenceNumber}, func(status uint32, err error) {
+		outcome <- response{status, err}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	return outcome
+}
+
+// awaitResponse returns the outcome of a request, failing when the callback is not called in time
+func awaitResponse(t *testing.T, outcome <-chan response) response {
+	t.Helper()
+	select {
+	case r := <-outcome:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("request callback was never called")
+		return response{}
+	}
+}
+
+func TestSendRequestCompletesOnMatchingResponse(t *testing.T) {
+	s, client := newPipeSession(t, 2)
+
+	outcome := sendDeliverSM(t, s, client, 11)
+	if s.InFlight() != 1 {
+		t.Fatalf("InFlight = %d while waiting for the response, want 1", s.InFlight())
+	}
+
+	if !s.HandleResponse(&protocol.PDU{CommandID: protocol.DELIVER_SM_RESP, CommandStatus: protocol.ESME_RX_T_APPN, SequenceNumber: 11}) {
+		t.Fatal("matching response was not accepted")
+	}
+	if r := awaitResponse(t, outcome); r.err != nil || r.status != protocol.ESME_RX_T_APPN {
+		t.Errorf("callback got status 0x%08X error %v, want ESME_RX_T_APPN", r.status, r.err)
+	}
+	if s.InFlight() != 0 {
+		t.Errorf("InFlight = %d after the response, want 0", s.InFlight())
+	}
+
+	// A second response to the same sequence number has no request left
+	if s.HandleResponse(&protocol.PDU{CommandID: protocol.DELIVER_SM_RESP, SequenceNumber: 11}) {
+		t.Error("duplicate response was accepted")
+	}
+}
+
+func TestHandleResponseTreatsGenericNACKAsRejection(t *testing.T) {
+	s, client := newPipeSession(t, 2)
+
+	tests := []struct {
+		status uint32
+		want   uint32
+	}{
+		{protocol.ESME_ROK, protocol.ESME_RSYSERR},
+		{protocol.ESME_RINVCMDID, protocol.ESME_RINVCMDID},
+	}
+	for i, tt := range tests {
+		sequenceNumber := uint32(20 + i)
+		outcome := sendDeliverSM(t, s, client, sequenceNumber)
+		if !s.HandleResponse(&protocol.PDU{CommandID: protocol.GENERIC_NACK, CommandStatus: tt.status, SequenceNumber: sequenceNumber}) {
+			t.Fatalf("generic_nack with status 0x%08X was not accepted", tt.status)
+		}
+		if r := awaitResponse(t, outcome); r.status != tt.want {
+			t.Errorf("generic_nack with status 0x%08X completed with 0x%08X, want 0x%08X", tt.status, r.status, tt.want)
+		}
+	}
+}
+
+func TestHandleResponseIgnoresMismatchedCommandID(t *testing.T) {
+	s, client := newPipeSession(t, 2)
+
+	outcome := sendDeliverSM(t, s, client, 30)
+	if s.HandleResponse(&protocol.PDU{CommandID: protocol.SUBMIT_SM_RESP, SequenceNumber: 30}) {
+		t.Fatal("submit_sm_resp was accepted for a deliver_sm")
+	}
+	select {
+	case r := <-outcome:
+		t.Fatalf("request completed with %+v by a mismatched response", r)
+	default:
+	}
+
+	// The request still waits for its own response
+	if !s.HandleResponse(&protocol.PDU{CommandID: protocol.DELIVER_SM_RESP, SequenceNumber: 30}) {
+		t.Fatal("matching response was not accepted after the mismatched one")
+	}
+	if r := awaitResponse(t, outcome); r.err != nil || r.status != protocol.ESME_ROK {
+		t.Errorf("callback got status 0x%08X error %v, want ESME_ROK", r.status, r.err)
+	}
+}
+
+func TestSendRequestTimesOutWithoutResponse(t *testing.T) {
+	s, client := newPipeSession(t, 1)
+	s.responseTimeout = 50 * time.Millisecond
+
+	outcome := sendDeliverSM(t, s, client, 40)
+
+	if r := awaitResponse(t, outcome); !errors.Is(r.err, ErrResponseTimeout) {
+		t.Errorf("callback error = %v, want ErrResponseTimeout", r.err)
+	}
+	if s.InFlight() != 0 {
+		t.Errorf("InFlight = %d after the timeout, want 0", s.InFlight())
+	}
+	// A late response finds no request
+	if s.HandleResponse(&protocol.PDU{CommandID: protocol.DELIVER_SM_RESP, SequenceNumber: 40}) {
+		t.Error("response after the timeout was accepted")
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// SmppPendingDeliveryReport is a delivery report waiting for a receiver session of an SMPP user
+type SmppPendingDeliveryReport struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID string    `json:"message_id" gorm:"index;not null;size:64"`
+	SystemID  string    `json:"system_id" gorm:"index;not null;size:50"`
+	Report    string    `json:"report" gorm:"type:text;not null"` // JSON encoded delivery report
+	DlrPdu    string    `json:"dlr_pdu" gorm:"size:20;not null;default:'deliver_sm'"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name for SmppPendingDeliveryReport
+func (SmppPendingDeliveryReport) TableName() string {
+	return "smpp_pending_delivery_reports"
+}
+
+// QueueDeliveryReport stores a delivery report until a receiver session binds.
+// When the system ID already has maxQueued reports queued, its oldest reports are dropped to make room.
+func (s *MySQLMessageStore) QueueDeliveryReport(report *SmppPendingDeliveryReport, maxQueued int) error {
+	if report.DlrPdu == "" {
+		report.DlrPdu = DlrPduDeliverSM
+	}
+
+	if err := s.db.Create(report).Error; err != nil {
+		return fmt.Errorf("failed to queue delivery report: %v", err)
+	}
+
+	if maxQueued <= 0 {
+		return nil
+	}
+
+	var count int64
+	if err := s.db.Model(&SmppPendingDeliveryReport{}).Where("system_id = ?", report.SystemID).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to count queued delivery reports: %v", err)
+	}
+
+	if excess := int(count) - maxQueued; excess > 0 {
+		var oldest []uint
+		if err := s.db.Model(&SmppPendingDeliveryReport{}).Where("system_id = ?", report.SystemID).
+			Order("id ASC").Limit(excess).Pluck("id", &oldest).Error; err != nil {
+			return fmt.Errorf("failed to find oldest delivery reports: %v", err)
+		}
+		if err := s.db.Delete(&SmppPendingDeliveryReport{}, oldest).Error; err != nil {
+			return fmt.Errorf("failed to drop oldest delivery reports: %v", err)
+		}
+		log.Printf("Delivery report queue of %s is full, dropped %d oldest reports", report.SystemID, len(oldest))
+	}
+
+	return nil
+}
+
+// GetQueuedDeliveryReports returns the unexpired queued delivery reports of a system ID, oldest first
+func (s *MySQLMessageStore) GetQueuedDeliveryReports(systemID string, limit int) ([]SmppPendingDeliveryReport, error) {
+	var reports []SmppPendingDeliveryReport
+	if err := s.db.Where("system_id = ? AND expires_at > ?", systemID, time.Now()).
+		Order("id ASC").Limit(limit).Find(&reports).Error; err != nil {
+		return nil, fmt.Errorf("failed to get queued delivery reports: %v", err)
+	}
+	return reports, nil
+}
+
+// DeleteDeliveryReport removes a delivered report from the queue
+func (s *MySQLMessageStore) DeleteDeliveryReport(id uint) error {
+	if err := s.db.Delete(&SmppPendingDeliveryReport{}, id).Error; err != nil {
+		return fmt.Errorf("failed to delete delivery report: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// SmppInboundMessage is an inbound (MO) SMS waiting to be delivered to a receiver session of an SMPP user
+type SmppInboundMessage struct {
+	ID              uint   `json:"id" gorm:"primaryKey"`
+	MessageID       string `json:"message_id" gorm:"uniqueIndex;not null;size:64"`
+	SystemID        string `json:"system_id" gorm:"index;not null;size:50"`
+	SourceAddr      string `json:"source_addr" gorm:"size:21"`
+	DestinationAddr string `json:"destination_addr" gorm:"size:21"`
+	Message         string `json:"message" gorm:"type:text"`
+	// SegmentsDelivered counts the leading segments already acknowledged by a receiver session,
+	// so that a retry resumes with the next segment instead of repeating them
+	SegmentsDelivered int       `json:"segments_delivered" gorm:"not null;default:0"`
+	ReceivedAt        time.Time `json:"received_at" gorm:"not null"`
+	CreatedAt         time.Time `json:"created_at" gorm:"index"`
+}
+
+// TableName specifies the table name for SmppInboundMessage
+func (SmppInboundMessage) TableName() string {
+	return "smpp_inbound_messages"
+}
+
+// QueueInboundMessage stores an inbound message until it is delivered.
+// Queuing a message that is already queued is a no-op, so redelivered broker messages are not duplicated.
+func (s *MySQLMessageStore) QueueInboundMessage(message *SmppInboundMessage) error {
+	var count int64
+	if err := s.db.Model(&SmppInboundMessage{}).Where("message_id = ?", message.MessageID).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check inbound message: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if err := s.db.Create(message).Error; err != nil {
+		return fmt.Errorf("failed to queue inbound message: %v", err)
+	}
+	return nil
+}
+
+// GetQueuedInboundMessages returns the queued inbound messages of a system ID, oldest first
+func (s *MySQLMessageStore) GetQueuedInboundMessages(systemID string, limit int) ([]SmppInboundMessage, error) {
+	var messages []SmppInboundMessage
+	if err := s.db.Where("system_id = ?", systemID).Order("id ASC").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("failed to get queued inbound messages: %v", err)
+	}
+	return messages, nil
+}
+
+// UpdateInboundProgress records how many segments of a queued inbound message were acknowledged
+func (s *MySQLMessageStore) UpdateInboundProgress(id uint, segmentsDelivered int) error {
+	if err := s.db.Model(&SmppInboundMessage{}).Where("id = ?", id).Update("segments_delivered", segmentsDelivered).Error; err != nil {
+		return fmt.Errorf("failed to update inbound message progress: %v", err)
+	}
+	return nil
+}
+
+// DeleteInboundMessage removes a delivered inbound message from the queue
+func (s *MySQLMessageStore) DeleteInboundMessage(id uint) error {
+	if err := s.db.Delete(&SmppInboundMessage{}, id).Error; err != nil {
+		return fmt.Errorf("failed to delete inbound message: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMessageNotFound is returned when no stored message matches a lookup
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrMessageNotPending is returned when a message has already been handed to a device or reached a final state
+var ErrMessageNotPending = errors.New("message is no longer pending")
+
+// MessageStore interface defines the methods that any message state store must implement
+type MessageStore interface {
+	CreateMessage(message *SmppMessage) error
+	GetMessage(systemID, messageID string) (*SmppMessage, error)
+	LinkMessageSegments(systemID, parentMessageID string, messageIDs []string, shortMessage string) error
+	GetMessageSegments(systemID, parentMessageID string) ([]SmppMessage, error)
+	UpdateMessageState(messageID string, state uint8, errorCode uint8, doneAt time.Time) error
+	CancelMessage(message *SmppMessage) error
+	CancelMessageSegments(systemID, parentMessageID string) error
+	CancelMessages(systemID, serviceType, sourceAddr, destinationAddr string) ([]SmppMessage, error)
+	ReplaceMessage(message *SmppMessage, replacement *MessageReplacement) error
+	RejectUnassembledSegments(olderThan time.Time) ([]SmppMessage, error)
+	QueueInboundMessage(message *SmppInboundMessage) error
+	GetQueuedInboundMessages(systemID string, limit int) ([]SmppInboundMessage, error)
+	UpdateInboundProgress(id uint, segmentsDelivered int) error
+	DeleteInboundMessage(id uint) error
+	QueueDeliveryReport(report *SmppPendingDeliveryReport, maxQueued int) error
+	GetQueuedDeliveryReports(systemID string, limit int) ([]SmppPendingDeliveryReport, error)
+	DeleteDeliveryReport(id uint) error
+	StartCleanupRoutine()
+	Close() error
+}
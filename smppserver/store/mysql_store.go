@@ -0,0 +1,451 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"smppserver/protocol"
+	"tsimcloud/shared/billing"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// SmppMessage represents the database model for the state of a submitted message
+type SmppMessage struct {
+	ID                   uint       `json:"id" gorm:"primaryKey"`
+	MessageID            string     `json:"message_id" gorm:"uniqueIndex;not null;size:64"`
+	SystemID             string     `json:"system_id" gorm:"index;not null;size:50"`
+	ServiceType          string     `json:"service_type" gorm:"size:6"`
+	SourceAddr           string     `json:"source_addr" gorm:"size:21"`
+	DestinationAddr      string     `json:"destination_addr" gorm:"size:21"`
+	RegisteredDelivery   uint8      `json:"registered_delivery" gorm:"not null;default:0"`
+	DataCoding           uint8      `json:"data_coding" gorm:"not null;default:0"`
+	ShortMessage         string     `json:"short_message" gorm:"type:text"`
+	ScheduleDeliveryTime string     `json:"schedule_delivery_time" gorm:"size:17"`
+	ValidityPeriod       string     `json:"validity_period" gorm:"size:17"`
+	DlrPdu               string     `json:"dlr_pdu" gorm:"size:20;not null;default:'deliver_sm'"`
+	ParentMessageID      string     `json:"parent_message_id" gorm:"index;size:64"` // Message the segment was published as, set for segments of concatenated messages
+	SegmentNumber        uint8      `json:"segment_number" gorm:"not null;default:0"`
+	MessageState         uint8      `json:"message_state" gorm:"not null;default:1"`
+	ErrorCode            uint8      `json:"error_code" gorm:"not null;default:0"`
+	SubmitDate           time.Time  `json:"submit_date" gorm:"not null"`
+	FinalDate            *time.Time `json:"final_date"`
+	DispatchedAt         *time.Time `json:"dispatched_at"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at" gorm:"index"`
+}
+
+// TableName specifies the table name for SmppMessage
+func (SmppMessage) TableName() string {
+	return "smpp_messages"
+}
+
+// IsFinal reports whether the message has reached a final state
+func (m *SmppMessage) IsFinal() bool {
+	return IsFinalState(m.MessageState)
+}
+
+// IsFinalState reports whether a message state is final, i.e. the message will not change state again
+func IsFinalState(state uint8) bool {
+	switch state {
+	case protocol.MESSAGE_STATE_DELIVERED,
+		protocol.MESSAGE_STATE_EXPIRED,
+		protocol.MESSAGE_STATE_DELETED,
+		protocol.MESSAGE_STATE_UNDELIVERABLE,
+		protocol.MESSAGE_STATE_REJECTED:
+		return true
+	}
+	return false
+}
+
+// PDUs that can carry delivery reports back to an SMPP client
+const (
+	DlrPduDeliverSM = "deliver_sm"
+	DlrPduDataSM    = "data_sm"
+)
+
+// MessageReplacement holds the fields of a pending message that replace_sm may change
+type MessageReplacement struct {
+	ShortMessage         string
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	RegisteredDelivery   uint8
+	Segments             int // Segments the message is charged for after the replacement, 0 keeps the charge
+}
+
+// pendingStates are the states of a message that has not yet been handed to a device.
+// They are ints because GORM binds a []uint8 as a single binary value instead of expanding it for IN.
+var pendingStates = []int{
+	protocol.MESSAGE_STATE_SCHEDULED,
+	protocol.MESSAGE_STATE_ENROUTE,
+}
+
+// finalStates are the states of a message that will not change state again
+var finalStates = []int{
+	protocol.MESSAGE_STATE_DELIVERED,
+	protocol.MESSAGE_STATE_EXPIRED,
+	protocol.MESSAGE_STATE_DELETED,
+	protocol.MESSAGE_STATE_UNDELIVERABLE,
+	protocol.MESSAGE_STATE_REJECTED,
+}
+
+// MySQLMessageStore keeps message states in MySQL
+type MySQLMessageStore struct {
+	db        *gorm.DB
+	retention time.Duration
+}
+
+// NewMySQLMessageStore creates a new MySQL-based message store
+func NewMySQLMessageStore(dsn string, retention time.Duration) (*MySQLMessageStore, error) {
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MySQL: %v", err)
+	}
+
+	// Auto migrate tables
+	if err := db.AutoMigrate(&SmppMessage{}, &SmppInboundMessage{}, &SmppPendingDeliveryReport{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate tables: %v", err)
+	}
+
+	if retention <= 0 {
+		retention = 72 * time.Hour
+	}
+
+	return &MySQLMessageStore{
+		db:        db,
+		retention: retention,
+	}, nil
+}
+
+// CreateMessage stores a newly accepted message
+func (s *MySQLMessageStore) CreateMessage(message *SmppMessage) error {
+	if message.SubmitDate.IsZero() {
+		message.SubmitDate = time.Now()
+	}
+	if message.DlrPdu == "" {
+		message.DlrPdu = DlrPduDeliverSM
+	}
+
+	if err := s.db.Create(message).Error; err != nil {
+		return fmt.Errorf("failed to store message: %v", err)
+	}
+
+	return nil
+}
+
+// GetMessage returns the stored message submitted by systemID with the given message ID
+func (s *MySQLMessageStore) GetMessage(systemID, messageID string) (*SmppMessage, error) {
+	var message SmppMessage
+	err := s.db.Where("message_id = ? AND system_id = ?", messageID, systemID).First(&message).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrMessageNotFound
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	return &message, nil
+}
+
+// LinkMessageSegments records that the segments with the given message IDs were published together as parentMessageID.
+// The parent keeps the assembled text, so that the router and replace_sm work on the whole message rather than its first segment.
+func (s *MySQLMessageStore) LinkMessageSegments(systemID, parentMessageID string, messageIDs []string, shortMessage string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&SmppMessage{}).
+			Where("system_id = ? AND message_id IN ?", systemID, messageIDs).
+			Update("parent_message_id", parentMessageID).Error; err != nil {
+			return fmt.Errorf("failed to link message segments: %v", err)
+		}
+
+		if err := tx.Model(&SmppMessage{}).
+			Where("system_id = ? AND message_id = ? AND dispatched_at IS NULL", systemID, parentMessageID).
+			Update("short_message", shortMessage).Error; err != nil {
+			return fmt.Errorf("failed to store assembled message: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetMessageSegments returns the segments published together as parentMessageID, in segment order.
+// The result is empty for messages that were not concatenated.
+func (s *MySQLMessageStore) GetMessageSegments(systemID, parentMessageID string) ([]SmppMessage, error) {
+	var segments []SmppMessage
+	if err := s.db.Where("system_id = ? AND parent_message_id = ?", systemID, parentMessageID).
+		Order("segment_number ASC").
+		Find(&segments).Error; err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return segments, nil
+}
+
+// UpdateMessageState records the state carried by a delivery report
+func (s *MySQLMessageStore) UpdateMessageState(messageID string, state uint8, errorCode uint8, doneAt time.Time) error {
+	updates := map[string]interface{}{
+		"message_state": state,
+		"error_code":    errorCode,
+		"updated_at":    time.Now(),
+	}
+
+	if IsFinalState(state) {
+		updates["final_date"] = &doneAt
+	}
+
+	result := s.db.Model(&SmppMessage{}).Where("message_id = ?", messageID).Updates(updates)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update message state: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+// CancelMessage marks a pending message as deleted so that the router drops it.
+// Cancelling a concatenated message cancels its segments as well.
+func (s *MySQLMessageStore) CancelMessage(message *SmppMessage) error {
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&SmppMessage{}).
+			Where("id = ? AND dispatched_at IS NULL AND message_state IN ?", message.ID, pendingStates).
+			Updates(deletedState(now))
+		if result.Error != nil {
+			return fmt.Errorf("failed to cancel message: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrMessageNotPending
+		}
+
+		if message.ParentMessageID == message.MessageID {
+			return cancelSegments(tx, message.SystemID, message.MessageID, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	message.MessageState = protocol.MESSAGE_STATE_DELETED
+	message.FinalDate = &now
+	return nil
+}
+
+// CancelMessageSegments marks the pending segments published together as parentMessageID as deleted
+func (s *MySQLMessageStore) CancelMessageSegments(systemID, parentMessageID string) error {
+	return cancelSegments(s.db, systemID, parentMessageID, time.Now())
+}
+
+// cancelSegments marks the pending segments of a concatenated message as deleted
+func cancelSegments(db *gorm.DB, systemID, parentMessageID string, now time.Time) error {
+	if err := db.Model(&SmppMessage{}).
+		Where("system_id = ? AND parent_message_id = ? AND message_state IN ?", systemID, parentMessageID, pendingStates).
+		Updates(deletedState(now)).Error; err != nil {
+		return fmt.Errorf("failed to cancel message segments: %v", err)
+	}
+	return nil
+}
+
+// deletedState returns the column updates of a cancelled message
+func deletedState(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"message_state": protocol.MESSAGE_STATE_DELETED,
+		"final_date":    &now,
+		"updated_at":    now,
+	}
+}
+
+// CancelMessages cancels every pending message of systemID sent from sourceAddr to destinationAddr.
+// An empty serviceType matches any service type. Linked segments are cancelled through their parent message.
+func (s *MySQLMessageStore) CancelMessages(systemID, serviceType, sourceAddr, destinationAddr string) ([]SmppMessage, error) {
+	query := s.db.Where("system_id = ? AND source_addr = ? AND destination_addr = ? AND dispatched_at IS NULL AND message_state IN ?",
+		systemID, sourceAddr, destinationAddr, pendingStates).
+		Where("parent_message_id IS NULL OR parent_message_id = '' OR parent_message_id = message_id")
+	if serviceType != "" {
+		query = query.Where("service_type = ?", serviceType)
+	}
+
+	var messages []SmppMessage
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	var cancelled []SmppMessage
+	for i := range messages {
+		if err := s.CancelMessage(&messages[i]); err != nil {
+			if err == ErrMessageNotPending {
+				// Dispatched between the lookup and the update
+				continue
+			}
+			return cancelled, err
+		}
+		cancelled = append(cancelled, messages[i])
+	}
+
+	if len(cancelled) == 0 {
+		return nil, ErrMessageNotPending
+	}
+
+	return cancelled, nil
+}
+
+// RejectUnassembledSegments marks the pending segments submitted before olderThan that were never published as part
+// of an assembled message as rejected, and returns them. Their assembly was lost, as when the server restarted
+// while it waited for the missing segments.
+func (s *MySQLMessageStore) RejectUnassembledSegments(olderThan time.Time) ([]SmppMessage, error) {
+	var segments []SmppMessage
+	if err := s.db.Where("segment_number > 0 AND (parent_message_id IS NULL OR parent_message_id = '') AND dispatched_at IS NULL AND message_state IN ? AND submit_date < ?",
+		pendingStates, olderThan).
+		Find(&segments).Error; err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	now := time.Now()
+	var rejected []SmppMessage
+	for i := range segments {
+		result := s.db.Model(&SmppMessage{}).
+			Where("id = ? AND (parent_message_id IS NULL OR parent_message_id = '') AND dispatched_at IS NULL AND message_state IN ?", segments[i].ID, pendingStates).
+			Updates(map[string]interface{}{
+				"message_state": protocol.MESSAGE_STATE_REJECTED,
+				"final_date":    &now,
+				"updated_at":    now,
+			})
+		if result.Error != nil {
+			return rejected, fmt.Errorf("failed to reject segment: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			// Assembled or cancelled between the lookup and the update
+			continue
+		}
+		segments[i].MessageState = protocol.MESSAGE_STATE_REJECTED
+		segments[i].FinalDate = &now
+		rejected = append(rejected, segments[i])
+	}
+	return rejected, nil
+}
+
+// ReplaceMessage changes the text and schedule of a pending message.
+// Empty text, schedule and validity fields keep their current values. When the replacement sets the segments,
+// the charge of the message moves to the new count in the same transaction, and the replacement fails with
+// billing.ErrInsufficientBalance when the balance cannot pay for the extra segments.
+func (s *MySQLMessageStore) ReplaceMessage(message *SmppMessage, replacement *MessageReplacement) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"registered_delivery": replacement.RegisteredDelivery,
+		"updated_at":          now,
+	}
+	if replacement.ShortMessage != "" {
+		updates["short_message"] = replacement.ShortMessage
+	}
+	if replacement.ScheduleDeliveryTime != "" {
+		updates["schedule_delivery_time"] = replacement.ScheduleDeliveryTime
+		updates["message_state"] = protocol.MESSAGE_STATE_SCHEDULED
+	}
+	if replacement.ValidityPeriod != "" {
+		updates["validity_period"] = replacement.ValidityPeriod
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&SmppMessage{}).
+			Where("id = ? AND dispatched_at IS NULL AND message_state IN ?", message.ID, pendingStates).
+			Updates(updates)
+		if result.Error != nil {
+			return fmt.Errorf("failed to replace message: %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrMessageNotPending
+		}
+
+		if replacement.Segments > 0 {
+			return repriceMessage(tx, message, replacement.Segments)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	message.RegisteredDelivery = replacement.RegisteredDelivery
+	if replacement.ShortMessage != "" {
+		message.ShortMessage = replacement.ShortMessage
+	}
+	if replacement.ScheduleDeliveryTime != "" {
+		message.ScheduleDeliveryTime = replacement.ScheduleDeliveryTime
+		message.MessageState = protocol.MESSAGE_STATE_SCHEDULED
+	}
+	if replacement.ValidityPeriod != "" {
+		message.ValidityPeriod = replacement.ValidityPeriod
+	}
+	return nil
+}
+
+// repriceMessage charges a message for its new number of segments.
+// The segments of a concatenated message were charged one each, the whole charge moves to the message they were published as.
+func repriceMessage(tx *gorm.DB, message *SmppMessage, segments int) error {
+	if message.ParentMessageID == message.MessageID {
+		var segmentIDs []string
+		if err := tx.Model(&SmppMessage{}).
+			Where("system_id = ? AND parent_message_id = ? AND message_id <> ?", message.SystemID, message.MessageID, message.MessageID).
+			Pluck("message_id", &segmentIDs).Error; err != nil {
+			return fmt.Errorf("failed to load message segments: %v", err)
+		}
+		for _, id := range segmentIDs {
+			if err := billing.RepriceMessage(tx, id, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return billing.RepriceMessage(tx, message.MessageID, segments)
+}
+
+// StartCleanupRoutine starts a routine to remove final messages older than the retention period
+func (s *MySQLMessageStore) StartCleanupRoutine() {
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for range ticker.C {
+			s.cleanupExpiredMessages()
+		}
+	}()
+}
+
+// cleanupExpiredMessages removes messages that reached a final state longer than the retention period ago.
+// Pending messages are kept however long they wait, query_sm, cancel_sm, replace_sm and the router still need them.
+// Each table is cleaned independently, so a failure on one does not keep the others growing.
+func (s *MySQLMessageStore) cleanupExpiredMessages() {
+	expiredTime := time.Now().Add(-s.retention)
+
+	result := s.db.Where("message_state IN ? AND COALESCE(final_date, updated_at) < ?", finalStates, expiredTime).Delete(&SmppMessage{})
+	if result.Error != nil {
+		log.Printf("Failed to cleanup expired messages: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d expired messages", result.RowsAffected)
+	}
+
+	// Inbound messages nobody bound to receive within the retention period are dropped
+	result = s.db.Where("created_at < ?", expiredTime).Delete(&SmppInboundMessage{})
+	if result.Error != nil {
+		log.Printf("Failed to cleanup expired inbound messages: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d undelivered inbound messages", result.RowsAffected)
+	}
+
+	result = s.db.Where("expires_at < ?", time.Now()).Delete(&SmppPendingDeliveryReport{})
+	if result.Error != nil {
+		log.Printf("Failed to cleanup expired delivery reports: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d expired delivery reports", result.RowsAffected)
+	}
+}
+
+// Close closes the database connection
+func (s *MySQLMessageStore) Close() error {
+	if s.db != nil {
+		sqlDB, err := s.db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.Close()
+	}
+	return nil
+}
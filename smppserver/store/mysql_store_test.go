@@ -0,0 +1,365 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"smppserver/protocol"
+	"tsimcloud/shared/billing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestStore returns a store backed by an in-memory SQLite database with the store tables migrated
+func newTestStore(t *testing.T) *MySQLMessageStore {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens its own database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&SmppMessage{}, &SmppInboundMessage{}, &SmppPendingDeliveryReport{}); err != nil {
+		t.Fatal(err)
+	}
+	return &MySQLMessageStore{db: db, retention: time.Hour}
+}
+
+func TestCleanupContinuesAfterFailedTable(t *testing.T) {
+	s := newTestStore(t)
+
+	old := time.Now().Add(-2 * time.Hour)
+	message := &SmppMessage{MessageID: "1", SystemID: "esme", SubmitDate: old, MessageState: protocol.MESSAGE_STATE_DELIVERED}
+	if err := s.db.Create(message).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Model(message).UpdateColumn("updated_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Create(&SmppPendingDeliveryReport{MessageID: "1", SystemID: "esme", Report: "{}", ExpiresAt: old}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleaning the inbound queue fails, the other tables must still be cleaned
+	if err := s.db.Migrator().DropTable(&SmppInboundMessage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.cleanupExpiredMessages()
+
+	var messages, reports int64
+	s.db.Model(&SmppMessage{}).Count(&messages)
+	s.db.Model(&SmppPendingDeliveryReport{}).Count(&reports)
+	if messages != 0 {
+		t.Errorf("%d expired messages left", messages)
+	}
+	if reports != 0 {
+		t.Errorf("%d expired delivery reports left after the inbound cleanup failed", reports)
+	}
+}
+
+func TestCleanupKeepsRecentRows(t *testing.T) {
+	s := newTestStore(t)
+
+	if err := s.db.Create(&SmppMessage{MessageID: "1", SystemID: "esme", SubmitDate: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Create(&SmppInboundMessage{MessageID: "mo-1", SystemID: "esme", ReceivedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Create(&SmppPendingDeliveryReport{MessageID: "1", SystemID: "esme", Report: "{}", ExpiresAt: time.Now().Add(time.Hour)}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	s.cleanupExpiredMessages()
+
+	for _, model := range []interface{}{&SmppMessage{}, &SmppInboundMessage{}, &SmppPendingDeliveryReport{}} {
+		var count int64
+		s.db.Model(model).Count(&count)
+		if count != 1 {
+			t.Errorf("%T: %d rows left, want 1", model, count)
+		}
+	}
+}
+
+func TestCleanupKeepsPendingMessages(t *testing.T) {
+	s := newTestStore(t)
+
+	old := time.Now().Add(-2 * time.Hour)
+	recentlyFinal := time.Now().Add(-time.Minute)
+	messages := []*SmppMessage{
+		// Scheduled or valid for longer than the retention period
+		{MessageID: "scheduled", SystemID: "esme", SubmitDate: old, MessageState: protocol.MESSAGE_STATE_SCHEDULED},
+		{MessageID: "enroute", SystemID: "esme", SubmitDate: old, MessageState: protocol.MESSAGE_STATE_ENROUTE},
+		// Final only recently, after a long wait
+		{MessageID: "expired", SystemID: "esme", SubmitDate: old, MessageState: protocol.MESSAGE_STATE_EXPIRED, FinalDate: &recentlyFinal},
+		{MessageID: "delivered", SystemID: "esme", SubmitDate: old, MessageState: protocol.MESSAGE_STATE_DELIVERED, FinalDate: &old},
+	}
+	for _, message := range messages {
+		if err := s.db.Create(message).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := s.db.Model(message).UpdateColumn("updated_at", old).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.cleanupExpiredMessages()
+
+	for _, id := range []string{"scheduled", "enroute", "expired"} {
+		if _, err := s.GetMessage("esme", id); err != nil {
+			t.Errorf("message %s: %v, want it kept", id, err)
+		}
+	}
+	if _, err := s.GetMessage("esme", "delivered"); err != ErrMessageNotFound {
+		t.Errorf("message delivered before the retention period: %v, want it removed", err)
+	}
+}
+
+func TestCancelAndReplacePendingMessages(t *testing.T) {
+	s := newTestStore(t)
+
+	for _, id := range []string{"cancel", "replace", "dispatched"} {
+		if err := s.CreateMessage(&SmppMessage{MessageID: id, SystemID: "esme", ShortMessage: "old"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.db.Model(&SmppMessage{}).Where("message_id = ?", "dispatched").Update("dispatched_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	message, _ := s.GetMessage("esme", "cancel")
+	if err := s.CancelMessage(message); err != nil {
+		t.Fatalf("CancelMessage error = %v", err)
+	}
+	if message, _ = s.GetMessage("esme", "cancel"); message.MessageState != protocol.MESSAGE_STATE_DELETED {
+		t.Errorf("cancelled state = %d, want DELETED", message.MessageState)
+	}
+	if err := s.CancelMessage(message); err != ErrMessageNotPending {
+		t.Errorf("second CancelMessage error = %v, want ErrMessageNotPending", err)
+	}
+
+	message, _ = s.GetMessage("esme", "replace")
+	if err := s.ReplaceMessage(message, &MessageReplacement{ShortMessage: "new"}); err != nil {
+		t.Fatalf("ReplaceMessage error = %v", err)
+	}
+	if message, _ = s.GetMessage("esme", "replace"); message.ShortMessage != "new" {
+		t.Errorf("replaced text = %q, want %q", message.ShortMessage, "new")
+	}
+
+	message, _ = s.GetMessage("esme", "dispatched")
+	if err := s.CancelMessage(message); err != ErrMessageNotPending {
+		t.Errorf("CancelMessage of a dispatched message error = %v, want ErrMessageNotPending", err)
+	}
+	if err := s.ReplaceMessage(message, &MessageReplacement{ShortMessage: "new"}); err != ErrMessageNotPending {
+		t.Errorf("ReplaceMessage of a dispatched message error = %v, want ErrMessageNotPending", err)
+	}
+}
+
+// createSegments stores the segments of a concatenated message and links them as assembled
+func createSegments(t *testing.T, s *MySQLMessageStore, texts ...string) []string {
+	t.Helper()
+
+	ids := make([]string, len(texts))
+	for i, text := range texts {
+		ids[i] = fmt.Sprintf("seg-%d", i+1)
+		if err := s.CreateMessage(&SmppMessage{
+			MessageID:       ids[i],
+			SystemID:        "esme",
+			SourceAddr:      "sender",
+			DestinationAddr: "905551112233",
+			ShortMessage:    text,
+			SegmentNumber:   uint8(i + 1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func TestLinkMessageSegmentsStoresAssembledText(t *testing.T) {
+	s := newTestStore(t)
+	ids := createSegments(t, s, "Hello ", "world")
+
+	if err := s.LinkMessageSegments("esme", ids[0], ids, "Hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := s.GetMessage("esme", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.ShortMessage != "Hello world" {
+		t.Errorf("parent text = %q, want the assembled text", parent.ShortMessage)
+	}
+
+	segments, err := s.GetMessageSegments("esme", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1].ShortMessage != "world" {
+		t.Errorf("segments = %+v, want both segments linked with their own text", segments)
+	}
+}
+
+func TestCancelMessageCancelsSegments(t *testing.T) {
+	s := newTestStore(t)
+	ids := createSegments(t, s, "Hello ", "world")
+	if err := s.LinkMessageSegments("esme", ids[0], ids, "Hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, _ := s.GetMessage("esme", ids[0])
+	if err := s.CancelMessage(parent); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		message, _ := s.GetMessage("esme", id)
+		if message.MessageState != protocol.MESSAGE_STATE_DELETED {
+			t.Errorf("message %s state = %d, want DELETED", id, message.MessageState)
+		}
+	}
+}
+
+func TestCancelMessagesSkipsLinkedSegments(t *testing.T) {
+	s := newTestStore(t)
+	ids := createSegments(t, s, "Hello ", "world")
+	if err := s.LinkMessageSegments("esme", ids[0], ids, "Hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, err := s.CancelMessages("esme", "", "sender", "905551112233")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled) != 1 || cancelled[0].MessageID != ids[0] {
+		t.Fatalf("cancelled %d messages, want only the parent %s", len(cancelled), ids[0])
+	}
+
+	segment, _ := s.GetMessage("esme", ids[1])
+	if segment.MessageState != protocol.MESSAGE_STATE_DELETED {
+		t.Errorf("segment state = %d, want DELETED through its parent", segment.MessageState)
+	}
+}
+
+// balanceUser holds the balance columns of smpp_users that charges update
+type balanceUser struct {
+	ID        uint
+	MtBalance *string
+}
+
+func (balanceUser) TableName() string {
+	return "smpp_users"
+}
+
+func TestReplaceMessageRepricesInTheSameTransaction(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.db.AutoMigrate(&balanceUser{}, &billing.Transaction{}); err != nil {
+		t.Fatal(err)
+	}
+	balance := "0.3000"
+	user := &balanceUser{MtBalance: &balance}
+	if err := s.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Each segment was charged on its own when it was submitted
+	ids := createSegments(t, s, "Hello ", "world")
+	for _, id := range ids {
+		id := id
+		if err := s.db.Create(&billing.Transaction{SmppUserID: user.ID, SystemID: "esme", Type: billing.LedgerCharge, MessageID: &id,
+			Amount: "-0.1000", Segments: 1, Rate: "0.1000"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.LinkMessageSegments("esme", ids[0], ids, "Hello world"); err != nil {
+		t.Fatal(err)
+	}
+	parent, _ := s.GetMessage("esme", ids[0])
+
+	// Four more segments cost more than the balance, the text stays as it was
+	err := s.ReplaceMessage(parent, &MessageReplacement{ShortMessage: "too long", Segments: 6})
+	if !errors.Is(err, billing.ErrInsufficientBalance) {
+		t.Fatalf("ReplaceMessage beyond the balance error = %v, want ErrInsufficientBalance", err)
+	}
+	if stored, _ := s.GetMessage("esme", ids[0]); stored.ShortMessage != "Hello world" {
+		t.Errorf("text = %q after the failed replacement, want the original", stored.ShortMessage)
+	}
+	var segmentCharge billing.Transaction
+	s.db.Where("message_id = ? AND type = ?", ids[1], billing.LedgerCharge).First(&segmentCharge)
+	if segmentCharge.Segments != 1 {
+		t.Errorf("segment charged for %d segments after the failed replacement, want 1", segmentCharge.Segments)
+	}
+
+	// The whole charge moves to the parent, the balance pays the one extra segment
+	if err := s.ReplaceMessage(parent, &MessageReplacement{ShortMessage: "longer", Segments: 3}); err != nil {
+		t.Fatal(err)
+	}
+	var stored balanceUser
+	s.db.First(&stored, user.ID)
+	if amount, _ := billing.ParseAmount(*stored.MtBalance); amount != 2000 {
+		t.Errorf("balance = %s, want 0.2000", *stored.MtBalance)
+	}
+	for id, segments := range map[string]int{ids[0]: 3, ids[1]: 0} {
+		var charge billing.Transaction
+		s.db.Where("message_id = ? AND type = ?", id, billing.LedgerCharge).First(&charge)
+		if charge.Segments != segments {
+			t.Errorf("message %s charged for %d segments, want %d", id, charge.Segments, segments)
+		}
+	}
+}
+
+func TestRejectUnassembledSegments(t *testing.T) {
+	s := newTestStore(t)
+	ids := createSegments(t, s, "lost", "assembled", "cancelled", "recent")
+	if err := s.CreateMessage(&SmppMessage{MessageID: "whole", SystemID: "esme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LinkMessageSegments("esme", ids[1], ids[1:2], "assembled"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateMessageState(ids[2], protocol.MESSAGE_STATE_DELETED, 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := s.db.Model(&SmppMessage{}).Where("message_id <> ?", ids[3]).Update("submit_date", old).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := s.RejectUnassembledSegments(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 || rejected[0].MessageID != ids[0] || rejected[0].FinalDate == nil {
+		t.Fatalf("rejected %+v, want the old unassembled segment only", rejected)
+	}
+
+	want := map[string]uint8{
+		ids[0]:  protocol.MESSAGE_STATE_REJECTED,
+		ids[1]:  protocol.MESSAGE_STATE_ENROUTE,
+		ids[2]:  protocol.MESSAGE_STATE_DELETED,
+		ids[3]:  protocol.MESSAGE_STATE_ENROUTE,
+		"whole": protocol.MESSAGE_STATE_ENROUTE,
+	}
+	for id, state := range want {
+		if message, _ := s.GetMessage("esme", id); message.MessageState != state {
+			t.Errorf("message %s state = %d, want %d", id, message.MessageState, state)
+		}
+	}
+
+	// Later runs find the segments that became old enough
+	if rejected, _ := s.RejectUnassembledSegments(time.Now()); len(rejected) != 1 || rejected[0].MessageID != ids[3] {
+		t.Errorf("second run rejected %+v, want only the segment that became old enough", rejected)
+	}
+}